@@ -4,5 +4,7 @@ go 1.14
 
 require (
 	github.com/lib/pq v1.7.0
+	github.com/mattn/go-sqlite3 v1.14.14
 	github.com/nyaruka/phonenumbers v1.0.56
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
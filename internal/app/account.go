@@ -0,0 +1,119 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/user"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+const apiTokensPath = "/account/tokens"
+
+// apiTokenExpiryDays are the choices given for how long a new API token lasts.
+var apiTokenExpiryDays = []int{7, 30, 90, 365}
+
+// handleAPITokens lets users create API tokens for their scripts and revoke them.
+//
+// It's wrapped by requireUser, so it can only be used from a signed in browser and an API
+// token can't be used to create more tokens.
+func handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	record, _ := currentUser(r)
+	switch r.Method {
+	case http.MethodGet:
+		writeAPITokensPage(w, r, record, http.StatusOK, apiTokensPageData{})
+	case http.MethodPost:
+		r.ParseForm()
+		switch r.FormValue("Action") {
+		case "create":
+			days, err := strconv.Atoi(r.FormValue("ExpiresInDays"))
+			if err != nil {
+				setErrorCode(w, user.ErrInvalidAPITokenLifetime.Code())
+				writeAPITokensPage(w, r, record, http.StatusBadRequest, apiTokensPageData{Error: user.ErrInvalidAPITokenLifetime.Error()})
+				return
+			}
+			token, created, err := user.CreateAPIToken(record.ID, r.FormValue("Name"), user.TokenScope(r.FormValue("Scope")), time.Duration(days)*24*time.Hour)
+			if err != nil {
+				if validationErr, ok := err.(*validate.ValidationError); ok {
+					setErrorCode(w, validationErr.Code())
+					writeAPITokensPage(w, r, record, http.StatusBadRequest, apiTokensPageData{Error: validationErr.Error()})
+					return
+				}
+				log.Print(err)
+				writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred creating the API token")
+				return
+			}
+			// The token is only ever shown here, so don't let it be cached or redirect away from it
+			w.Header().Set("Cache-Control", "no-store")
+			writeAPITokensPage(w, r, record, http.StatusOK, apiTokensPageData{
+				NewToken:     token,
+				NewTokenName: created.Name,
+			})
+		case "revoke":
+			id, err := strconv.ParseInt(r.FormValue("TokenID"), 10, 64)
+			if err != nil {
+				setErrorCode(w, codeInvalidRequest)
+				writeAPITokensPage(w, r, record, http.StatusBadRequest, apiTokensPageData{Error: "Invalid TokenID provided."})
+				return
+			}
+			if err := user.RevokeAPIToken(record.ID, id); err != nil {
+				if err == user.ErrAPITokenNotFound {
+					setErrorCode(w, codeAPITokenNotFound)
+					writeAPITokensPage(w, r, record, http.StatusNotFound, apiTokensPageData{Error: "API token not found."})
+					return
+				}
+				log.Print(err)
+				writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred revoking the API token")
+				return
+			}
+			http.Redirect(w, r, apiTokensPath, http.StatusSeeOther)
+		default:
+			setErrorCode(w, codeInvalidRequest)
+			writeAPITokensPage(w, r, record, http.StatusBadRequest, apiTokensPageData{Error: "Invalid Action provided."})
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// apiTokensPageData is what changes on the API tokens page depending on what was just done.
+type apiTokensPageData struct {
+	// NewToken is the token that was just created
+	NewToken     string
+	NewTokenName string
+	Error        string
+}
+
+// writeAPITokensPage renders the users API tokens along with the form to create another.
+func writeAPITokensPage(w http.ResponseWriter, r *http.Request, record user.User, statusCode int, pageData apiTokensPageData) {
+	type TemplateData struct {
+		apiTokensPageData
+		Tokens     []user.APIToken
+		Scopes     []user.TokenScope
+		ExpiryDays []int
+		// Username of the signed in user
+		Username  string
+		CSRFToken string
+	}
+	tokens, err := user.ListAPITokens(record.ID)
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred listing API tokens")
+		return
+	}
+	token := csrfToken(w, r)
+	w.WriteHeader(statusCode)
+	if err := templates.ExecuteTemplate(w, "apiTokens.html", TemplateData{
+		apiTokensPageData: pageData,
+		Tokens:            tokens,
+		Scopes:            user.TokenScopes,
+		ExpiryDays:        apiTokenExpiryDays,
+		Username:          record.Username,
+		CSRFToken:         token,
+	}); err != nil {
+		log.Print(err)
+	}
+}
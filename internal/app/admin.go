@@ -0,0 +1,97 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/silbinarywolf/contact-site/internal/user"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+const (
+	adminUsersPath   = "/admin/users"
+	adminMetricsPath = "/admin/metrics"
+)
+
+// handleAdminUsers lists every user and lets admins change their roles.
+//
+// Users are still created with the --create-user flag, as that needs their password.
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminUsersPage(w, r, http.StatusOK, "")
+	case http.MethodPost:
+		r.ParseForm()
+		id, err := strconv.ParseInt(r.FormValue("UserID"), 10, 64)
+		if err != nil {
+			setErrorCode(w, codeInvalidRequest)
+			writeAdminUsersPage(w, r, http.StatusBadRequest, "Invalid UserID provided.")
+			return
+		}
+		if err := user.SetRole(id, user.Role(r.FormValue("Role"))); err != nil {
+			switch err := err.(type) {
+			case *validate.ValidationError:
+				setErrorCode(w, err.Code())
+				writeAdminUsersPage(w, r, http.StatusBadRequest, err.Error())
+			default:
+				if err == user.ErrNotFound {
+					setErrorCode(w, codeUserNotFound)
+					writeAdminUsersPage(w, r, http.StatusNotFound, "User not found.")
+					return
+				}
+				log.Print(err)
+				writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred changing the role")
+			}
+			return
+		}
+		http.Redirect(w, r, adminUsersPath, http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// writeAdminUsersPage renders the list of users, with an error if changing a role failed.
+func writeAdminUsersPage(w http.ResponseWriter, r *http.Request, statusCode int, errorMessage string) {
+	type TemplateData struct {
+		Users []user.User
+		Roles []user.Role
+		// Username of the signed in user
+		Username  string
+		Error     string
+		CSRFToken string
+	}
+	records, err := user.List()
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred listing users")
+		return
+	}
+	templateData := TemplateData{
+		Users:     records,
+		Roles:     user.Roles,
+		Error:     errorMessage,
+		CSRFToken: csrfToken(w, r),
+	}
+	if record, ok := currentUser(r); ok {
+		templateData.Username = record.Username
+	}
+	w.WriteHeader(statusCode)
+	if err := templates.ExecuteTemplate(w, "adminUsers.html", templateData); err != nil {
+		log.Print(err)
+	}
+}
+
+// handleAdminMetrics serves counts of what the application has done as JSON, for monitoring.
+func handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		PostContactRejections spamRejectionCounts `json:"postContactRejections"`
+	}{
+		PostContactRejections: spamRejections.snapshot(),
+	})
+}
@@ -0,0 +1,610 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/user"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+const (
+	apiContactsPath = "/api/v1/contacts"
+
+	// maxAPIRequestBodySize is the maximum amount of bytes we'll read from a JSON request body.
+	// Arbitrarily chosen, but it's far more than a single contact should ever need.
+	maxAPIRequestBodySize = 1 << 20
+
+	// maxAPIImportSize is the maximum amount of bytes we'll read from an uploaded CSV file.
+	// Roughly 100,000 contacts, which is more than we'd want to import in a single request anyway.
+	maxAPIImportSize = 10 << 20
+)
+
+// apiError is the JSON body we respond with when something goes wrong.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Message string `json:"message"`
+	// Code is a name for the problem that doesn't change, ie. "contact.not_found", so that
+	// clients can tell errors apart without matching the message. It's also sent as the
+	// errorCodeHeader.
+	Code string `json:"code"`
+	// Fields is every problem with what was sent, with the field each is about
+	Fields []validate.FieldError `json:"fields,omitempty"`
+	// Duplicates is set when creating a contact fails because it may be a duplicate
+	Duplicates []contact.Duplicate `json:"duplicates,omitempty"`
+}
+
+// apiContactList is the JSON body for listing contacts.
+//
+// We wrap the list in an object rather than returning a top-level array so that we can add
+// fields later (ie. pagination information) without breaking clients.
+type apiContactList struct {
+	Contacts []contact.Contact `json:"contacts"`
+	// Next and Previous are links to the next and previous pages, if there are any.
+	Next     string `json:"next,omitempty"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// apiDuplicateList is the JSON body for listing the possible duplicates of a contact.
+type apiDuplicateList struct {
+	Duplicates []contact.Duplicate `json:"duplicates"`
+}
+
+// apiMergeInput is the JSON body we accept when merging another contact into a contact.
+type apiMergeInput struct {
+	// SourceID is the contact to merge, it's deleted once merged.
+	SourceID int64 `json:"sourceId"`
+	// SourceVersion is the version of the source contact the client saw, so that it isn't
+	// deleted with changes the client hasn't seen. The target is checked with If-Match.
+	SourceVersion int64 `json:"sourceVersion"`
+}
+
+// apiMergeResult is the JSON body for a successful merge.
+type apiMergeResult struct {
+	Contact contact.Contact    `json:"contact"`
+	Merge   contact.MergeAudit `json:"merge"`
+}
+
+// apiMergeList is the JSON body for listing what has been merged into a contact.
+type apiMergeList struct {
+	Merges []contact.MergeAudit `json:"merges"`
+}
+
+// apiContactInput is the JSON body we accept when creating or updating a contact.
+//
+// Fields are pointers so that PATCH requests can tell the difference between a field
+// being omitted and a field being explicitly set to an empty value.
+type apiContactInput struct {
+	FullName     *string                `json:"fullName"`
+	Emails       *[]apiEmailInput       `json:"emails"`
+	PhoneNumbers *[]apiPhoneNumberInput `json:"phoneNumbers"`
+	// CountryCode is used for any phone numbers that don't set their own, the same as
+	// the "Country" field on the HTML form.
+	CountryCode string `json:"countryCode"`
+}
+
+// apiEmailInput is an email within apiContactInput.
+//
+// When updating a contact, emails with an ID are updated in-place, rather than replaced.
+type apiEmailInput struct {
+	ID        int64  `json:"id,omitempty"`
+	Address   string `json:"address"`
+	Label     string `json:"label,omitempty"`
+	IsPrimary bool   `json:"isPrimary,omitempty"`
+}
+
+// apiPhoneNumberInput is a phone number within apiContactInput or the JSON body
+// we accept for the phone number endpoints.
+//
+// When updating a contact, phone numbers with an ID are updated in-place, rather
+// than replaced.
+type apiPhoneNumberInput struct {
+	ID          int64  `json:"id,omitempty"`
+	Number      string `json:"number"`
+	CountryCode string `json:"countryCode,omitempty"`
+	Extension   string `json:"extension,omitempty"`
+	Label       string `json:"label,omitempty"`
+	IsPrimary   bool   `json:"isPrimary,omitempty"`
+}
+
+// toPhoneNumber converts the input into a PhoneNumber, using defaultCountryCode if
+// the input doesn't have a country code. The ID is left for the caller to set.
+func (input *apiPhoneNumberInput) toPhoneNumber(defaultCountryCode string) contact.PhoneNumber {
+	countryCode := input.CountryCode
+	if countryCode == "" {
+		countryCode = defaultCountryCode
+	}
+	return contact.PhoneNumber{
+		Number:      input.Number,
+		CountryCode: countryCode,
+		Extension:   input.Extension,
+		Label:       input.Label,
+		IsPrimary:   input.IsPrimary,
+	}
+}
+
+// applyTo will copy any provided fields onto the record.
+func (input *apiContactInput) applyTo(record *contact.Contact) {
+	if input.FullName != nil {
+		record.FullName = *input.FullName
+	}
+	if input.Emails != nil {
+		record.Emails = make([]contact.EmailAddress, len(*input.Emails))
+		for i, email := range *input.Emails {
+			record.Emails[i] = contact.EmailAddress{
+				ID:        email.ID,
+				Address:   email.Address,
+				Label:     email.Label,
+				IsPrimary: email.IsPrimary,
+			}
+		}
+	}
+	if input.PhoneNumbers != nil {
+		record.PhoneNumbers = make([]contact.PhoneNumber, len(*input.PhoneNumbers))
+		for i, phoneNumber := range *input.PhoneNumbers {
+			record.PhoneNumbers[i] = phoneNumber.toPhoneNumber(input.CountryCode)
+			record.PhoneNumbers[i].ID = phoneNumber.ID
+		}
+	}
+}
+
+// handleAPIContacts handles the "/api/v1/contacts" collection.
+func handleAPIContacts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		options, err := parseListOptions(r.URL.Query())
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		result, err := contact.List(options)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		body := apiContactList{
+			Contacts: result.Contacts,
+		}
+		if body.Contacts == nil {
+			// Encode as an empty JSON array rather than null
+			body.Contacts = []contact.Contact{}
+		}
+		if result.HasNext {
+			body.Next = listOptionsURL(apiContactsPath, result.NextOptions())
+		}
+		if result.HasPrevious() {
+			body.Previous = listOptionsURL(apiContactsPath, result.PreviousOptions())
+		}
+		writeJSON(w, http.StatusOK, body)
+	case http.MethodPost:
+		if !requirePermission(w, r, user.PermissionCreateContacts) {
+			return
+		}
+		var input apiContactInput
+		if !readJSON(w, r, &input) {
+			return
+		}
+		record := &contact.Contact{}
+		input.applyTo(record)
+		insertNew := contact.InsertNew
+		if r.URL.Query().Get("allowDuplicates") == "true" {
+			insertNew = contact.InsertNewAllowingDuplicates
+		}
+		if err := insertNew(requestActor(r), record); err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		w.Header().Set("Location", apiContactsPath+"/"+strconv.FormatInt(record.ID, 10))
+		w.Header().Set("ETag", contactETag(*record))
+		writeJSON(w, http.StatusCreated, record)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleAPIImport handles "/api/v1/contacts/import". The CSV or vCard file can either be
+// uploaded as the "file" field of a multipart form or sent as the request body.
+//
+// The report is always returned so the client can see which rows failed, but the status code
+// is 422 if nothing was imported because a row failed when importing all or nothing.
+func handleAPIImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !requirePermission(w, r, user.PermissionCreateContacts) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIImportSize)
+	var body io.Reader = r.Body
+	format := r.URL.Query().Get("format")
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "multipart/form-data") {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidImportFile, "Invalid file provided: "+err.Error())
+			return
+		}
+		defer file.Close()
+		body = file
+		contentType = header.Header.Get("Content-Type")
+		if format == "" {
+			format = importFormatForFileName(header.Filename)
+		}
+	}
+	if format == "" {
+		format = importFormatForContentType(contentType)
+	}
+	records, err := readImportFile(body, format)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidImportFile, err.Error())
+		return
+	}
+	query := r.URL.Query()
+	options := contact.ImportOptions{
+		DryRun:          query.Get("dryRun") == "true",
+		AllOrNothing:    query.Get("allOrNothing") == "true",
+		AllowDuplicates: query.Get("allowDuplicates") == "true",
+	}
+	report, err := contact.Import(requestActor(r), records, options)
+	if err != nil {
+		writeAPIContactError(w, err)
+		return
+	}
+	if report.Results == nil {
+		// Encode as an empty JSON array rather than null
+		report.Results = []contact.ImportResult{}
+	}
+	statusCode := http.StatusOK
+	if options.AllOrNothing && !options.DryRun && report.Failed > 0 {
+		statusCode = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, statusCode, report)
+}
+
+// handleAPIContact handles a single contact and its phone numbers, ie.
+// - "/api/v1/contacts/{id}"
+// - "/api/v1/contacts/{id}/phoneNumbers"
+// - "/api/v1/contacts/{id}/phoneNumbers/{phoneNumberId}"
+// - "/api/v1/contacts/{id}/duplicates"
+// - "/api/v1/contacts/{id}/merges"
+func handleAPIContact(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiContactsPath+"/"), "/")
+	id, ok := parseAPIID(parts[0])
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+		return
+	}
+	if len(parts) > 1 {
+		switch {
+		case parts[1] == "phoneNumbers" && len(parts) == 2:
+			handleAPIPhoneNumbers(w, r, id)
+		case parts[1] == "phoneNumbers" && len(parts) == 3:
+			phoneNumberID, ok := parseAPIID(parts[2])
+			if !ok {
+				writeJSONError(w, http.StatusNotFound, codePhoneNumberNotFound, "Phone Number not found")
+				return
+			}
+			handleAPIPhoneNumber(w, r, id, phoneNumberID)
+		case parts[1] == "duplicates" && len(parts) == 2:
+			handleAPIDuplicates(w, r, id)
+		case parts[1] == "merges" && len(parts) == 2:
+			handleAPIMerges(w, r, id)
+		default:
+			writeJSONError(w, http.StatusNotFound, codeNotFound, "Not found")
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		record, err := contact.Get(id)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		w.Header().Set("ETag", contactETag(record))
+		writeJSON(w, http.StatusOK, record)
+	case http.MethodPut, http.MethodPatch:
+		if !requirePermission(w, r, user.PermissionEditContacts) {
+			return
+		}
+		version, ok := apiIfMatchVersion(w, r, id)
+		if !ok {
+			return
+		}
+		var input apiContactInput
+		if !readJSON(w, r, &input) {
+			return
+		}
+		record := contact.Contact{}
+		var err error
+		if r.Method == http.MethodPatch {
+			// PATCH only changes the fields that were provided, so start from
+			// what is currently stored.
+			record, err = contact.Get(id)
+			if err != nil {
+				writeAPIContactError(w, err)
+				return
+			}
+		}
+		record.ID = id
+		record.Version = version
+		input.applyTo(&record)
+		if err := contact.Update(requestActor(r), &record); err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		w.Header().Set("ETag", contactETag(record))
+		writeJSON(w, http.StatusOK, record)
+	case http.MethodDelete:
+		if !requirePermission(w, r, user.PermissionDeleteContacts) {
+			return
+		}
+		version, ok := apiIfMatchVersion(w, r, id)
+		if !ok {
+			return
+		}
+		if err := contact.DeleteIfVersion(requestActor(r), id, version); err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// handleAPIPhoneNumbers handles "/api/v1/contacts/{id}/phoneNumbers"
+func handleAPIPhoneNumbers(w http.ResponseWriter, r *http.Request, contactID int64) {
+	switch r.Method {
+	case http.MethodPost:
+		// Adding, changing or removing a phone number is editing the contact
+		if !requirePermission(w, r, user.PermissionEditContacts) {
+			return
+		}
+		version, ok := apiIfMatchVersion(w, r, contactID)
+		if !ok {
+			return
+		}
+		var input apiPhoneNumberInput
+		if !readJSON(w, r, &input) {
+			return
+		}
+		record := input.toPhoneNumber("")
+		newVersion, err := contact.AddPhoneNumber(requestActor(r), contactID, version, &record)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		w.Header().Set("Location", apiContactsPath+"/"+strconv.FormatInt(contactID, 10)+"/phoneNumbers/"+strconv.FormatInt(record.ID, 10))
+		setPhoneNumberETag(w, contactID, newVersion)
+		writeJSON(w, http.StatusCreated, record)
+	default:
+		writeMethodNotAllowed(w, http.MethodPost)
+	}
+}
+
+// handleAPIPhoneNumber handles "/api/v1/contacts/{id}/phoneNumbers/{phoneNumberId}"
+func handleAPIPhoneNumber(w http.ResponseWriter, r *http.Request, contactID int64, phoneNumberID int64) {
+	if (r.Method == http.MethodPut || r.Method == http.MethodDelete) &&
+		!requirePermission(w, r, user.PermissionEditContacts) {
+		return
+	}
+	var version int64
+	if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		var ok bool
+		if version, ok = apiIfMatchVersion(w, r, contactID); !ok {
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var input apiPhoneNumberInput
+		if !readJSON(w, r, &input) {
+			return
+		}
+		record := input.toPhoneNumber("")
+		record.ID = phoneNumberID
+		record.ContactID = contactID
+		newVersion, err := contact.UpdatePhoneNumber(requestActor(r), version, &record)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		setPhoneNumberETag(w, contactID, newVersion)
+		writeJSON(w, http.StatusOK, record)
+	case http.MethodDelete:
+		newVersion, err := contact.DeletePhoneNumber(requestActor(r), contactID, phoneNumberID, version)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		setPhoneNumberETag(w, contactID, newVersion)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// handleAPIDuplicates handles "/api/v1/contacts/{id}/duplicates", which lists the other
+// contacts that look like the same person.
+func handleAPIDuplicates(w http.ResponseWriter, r *http.Request, contactID int64) {
+	switch r.Method {
+	case http.MethodGet:
+		record, err := contact.Get(contactID)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		duplicates, err := contact.FindDuplicates(&record)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiDuplicateList{
+			Duplicates: duplicates,
+		})
+	default:
+		writeMethodNotAllowed(w, http.MethodGet)
+	}
+}
+
+// handleAPIMerges handles "/api/v1/contacts/{id}/merges". Posting merges another contact
+// into this one, getting lists what has been merged into this one.
+func handleAPIMerges(w http.ResponseWriter, r *http.Request, contactID int64) {
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := contact.Get(contactID); err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		merges, err := contact.GetMerges(contactID)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiMergeList{
+			Merges: merges,
+		})
+	case http.MethodPost:
+		// Merging deletes the source contact
+		if !requirePermission(w, r, user.PermissionEditContacts, user.PermissionDeleteContacts) {
+			return
+		}
+		version, ok := apiIfMatchVersion(w, r, contactID)
+		if !ok {
+			return
+		}
+		var input apiMergeInput
+		if !readJSON(w, r, &input) {
+			return
+		}
+		if input.SourceID <= 0 {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid sourceId provided")
+			return
+		}
+		if input.SourceVersion <= 0 {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid sourceVersion provided")
+			return
+		}
+		record, audit, err := contact.Merge(requestActor(r), contactID, version, input.SourceID, input.SourceVersion)
+		if err != nil {
+			writeAPIContactError(w, err)
+			return
+		}
+		w.Header().Set("ETag", contactETag(record))
+		writeJSON(w, http.StatusOK, apiMergeResult{
+			Contact: record,
+			Merge:   audit,
+		})
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// parseAPIID parses an ID from a URL path segment. Returns false if it's not a valid ID.
+func parseAPIID(s string) (int64, bool) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// writeAPIContactError will map errors from the contact package to the appropriate
+// HTTP status code and JSON error body.
+func writeAPIContactError(w http.ResponseWriter, err error) {
+	if err == contact.ErrVersionConflict {
+		// It's only returned when the client gave an If-Match header that's out of date
+		writeJSONError(w, http.StatusPreconditionFailed, errorCode(err), err.Error())
+		return
+	}
+	if validationErr, ok := err.(*validate.ValidationError); ok {
+		writeAPIValidationError(w, validationErr)
+		return
+	}
+	if duplicateErr, ok := err.(*contact.DuplicateError); ok {
+		setErrorCode(w, codeDuplicate)
+		writeJSON(w, http.StatusConflict, apiError{
+			Error: apiErrorDetail{
+				Message:    duplicateErr.Error(),
+				Code:       codeDuplicate,
+				Duplicates: duplicateErr.Duplicates,
+			},
+		})
+		return
+	}
+	switch err {
+	case contact.ErrNotFound:
+		writeJSONError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+		return
+	case contact.ErrPhoneNumberNotFound:
+		writeJSONError(w, http.StatusNotFound, codePhoneNumberNotFound, "Phone Number not found")
+		return
+	case contact.ErrEmailNotFound:
+		writeJSONError(w, http.StatusNotFound, codeEmailNotFound, "Email not found")
+		return
+	}
+	log.Print(err)
+	writeJSONError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred")
+}
+
+// readJSON will decode the request body into v. If this fails, an error response is
+// written and false is returned.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestBodySize))
+	// Same reasoning as our config file, if a client is sending a field that doesn't exist,
+	// they probably made a typo and we'd rather tell them about it than silently ignore it.
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidJSON, "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowedMethods ...string) {
+	w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+// writeAPIValidationError responds with every problem in the validation error, along with the
+// field each is about, so that clients can show them next to their own fields.
+func writeAPIValidationError(w http.ResponseWriter, err *validate.ValidationError) {
+	setErrorCode(w, err.Code())
+	writeJSON(w, http.StatusBadRequest, apiError{
+		Error: apiErrorDetail{
+			Message: err.Error(),
+			Code:    err.Code(),
+			Fields:  err.Fields(),
+		},
+	})
+}
+
+// writeJSONError responds with the message and code of an error, see errorCodeHeader.
+func writeJSONError(w http.ResponseWriter, statusCode int, code string, message string) {
+	setErrorCode(w, code)
+	writeJSON(w, statusCode, apiError{
+		Error: apiErrorDetail{
+			Message: message,
+			Code:    code,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// Headers have already been sent at this point, so all we can do is log it.
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
@@ -1,24 +1,43 @@
 package app
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"text/template"
+	"text/tabwriter"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/silbinarywolf/contact-site/internal/config"
 	"github.com/silbinarywolf/contact-site/internal/contact"
 	"github.com/silbinarywolf/contact-site/internal/db"
+	"github.com/silbinarywolf/contact-site/internal/user"
 	"github.com/silbinarywolf/contact-site/internal/validate"
 )
 
 var (
 	flagInit    bool
 	flagDestroy bool
+	flagMigrate string
+
+	flagImport                string
+	flagImportDryRun          bool
+	flagImportAllOrNothing    bool
+	flagImportAllowDuplicates bool
+
+	flagExport             string
+	flagExportVCardVersion string
+	flagExportFilter       string
+
+	flagCreateUser     string
+	flagCreateUserRole string
 
 	// templates holds all our /.templates files
 	templates *template.Template
@@ -30,63 +49,159 @@ var (
 func init() {
 	flag.BoolVar(&flagInit, "init", false, "if init flag is used, the database, tables and initial data will be setup")
 	flag.BoolVar(&flagDestroy, "destroy", false, "if destroy flag is used, the database will be destroyed.")
+	flag.StringVar(&flagMigrate, "migrate", "", "run database migrations and exit. \"up\" applies all pending migrations, \"down N\" reverts the last N migrations (default 1) and \"status\" lists them.")
+	flag.StringVar(&flagImport, "import", "", "import contacts from the given CSV or vCard (.vcf) file and exit.")
+	flag.BoolVar(&flagImportDryRun, "import-dry-run", false, "used with --import, report what would be imported without importing anything.")
+	flag.BoolVar(&flagImportAllOrNothing, "import-all-or-nothing", false, "used with --import, only import the contacts if every row is valid.")
+	flag.BoolVar(&flagImportAllowDuplicates, "import-allow-duplicates", false, "used with --import, import contacts even if they look like an existing contact.")
+	flag.StringVar(&flagExport, "export", "", "write every contact to stdout and exit. The format can be \"csv\", \"jsonl\" or \"vcf\".")
+	flag.StringVar(&flagExportVCardVersion, "export-vcard-version", "4.0", "used with --export vcf, the vCard version to export as. Either \"3.0\" or \"4.0\".")
+	flag.StringVar(&flagExportFilter, "export-filter", "", "used with --export, only export the contacts matching the filters, given the same as the query string of the export endpoint. ie. \"q=alex&sort=name\"")
+	flag.StringVar(&flagCreateUser, "create-user", "", "create a user that can sign in with the given username and exit. The password is read from stdin.")
+	flag.StringVar(&flagCreateUserRole, "create-user-role", string(user.RoleViewer), "used with --create-user, the role of the user. Either \"viewer\", \"editor\" or \"admin\".")
 }
 
 func handleHomePage(w http.ResponseWriter, r *http.Request) {
+	type SortURLs struct {
+		FullName string
+		Email    string
+	}
+	type ExportURLs struct {
+		CSV       string
+		JSONLines string
+		VCard     string
+	}
 	type TemplateData struct {
-		Contacts []contact.Contact
+		Contacts    []contact.Contact
+		Options     contact.ListOptions
+		SortURLs    SortURLs
+		ExportURLs  ExportURLs
+		NextURL     string
+		PreviousURL string
+		// Region is where the viewer is, phone numbers are formatted for it
+		Region string
+		// Username of the signed in user
+		Username string
+		// What the signed in user can do, so that the page only shows what they can use
+		CanCreate       bool
+		CanExport       bool
+		CanEdit         bool
+		CanDelete       bool
+		CanManageUsers  bool
+		CanViewAuditLog bool
+		// CSRFToken must be in every form, see protectForm
+		CSRFToken string
+		// Form is the add contact form, shown below the contacts
+		Form contactForm
+	}
+	options, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorCode(err), err.Error())
+		return
+	}
+	result, err := contact.List(options)
+	if err != nil {
+		if validationErr, ok := err.(*validate.ValidationError); ok {
+			writeError(w, http.StatusBadRequest, validationErr.Code(), validationErr.Error())
+			return
+		}
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred listing contacts")
+		return
 	}
 	var templateData TemplateData
-	templateData.Contacts = contact.GetAll()
+	templateData.Contacts = result.Contacts
+	templateData.Options = result.Options
+	templateData.Region = contact.DefaultRegion()
+	templateData.CSRFToken = csrfToken(w, r)
+	if record, ok := currentUser(r); ok {
+		templateData.Username = record.Username
+		templateData.CanCreate = record.Can(user.PermissionCreateContacts)
+		templateData.CanExport = record.Can(user.PermissionImportExportContacts)
+		templateData.CanEdit = record.Can(user.PermissionEditContacts)
+		templateData.CanDelete = record.Can(user.PermissionDeleteContacts)
+		templateData.CanManageUsers = record.Can(user.PermissionManageUsers)
+		templateData.CanViewAuditLog = record.Can(user.PermissionViewAuditLog)
+	}
+	if templateData.CanCreate {
+		templateData.Form = newContactForm().withPageFields(w, r)
+	}
+	templateData.SortURLs = SortURLs{
+		FullName: sortURL("/", result.Options, contact.SortByFullName),
+		Email:    sortURL("/", result.Options, contact.SortByEmail),
+	}
+	templateData.ExportURLs = ExportURLs{
+		CSV:       exportURL(result.Options, exportFormatCSV),
+		JSONLines: exportURL(result.Options, exportFormatJSONLines),
+		VCard:     exportURL(result.Options, exportFormatVCard),
+	}
+	if result.HasNext {
+		templateData.NextURL = listOptionsURL("/", result.NextOptions())
+	}
+	if result.HasPrevious() {
+		templateData.PreviousURL = listOptionsURL("/", result.PreviousOptions())
+	}
 	if err := templates.ExecuteTemplate(w, "index.html", templateData); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
 		return
 	}
 }
 
+// handlePostContact saves the add contact form, see handleNewContact. If anything is wrong
+// with what was entered, the form is shown again with the error next to each field.
 func handlePostContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
 	r.ParseForm()
-
-	fullName := r.FormValue("FullName")
-	email := r.FormValue("Email")
-	phoneNumbersDat := strings.TrimSpace(r.FormValue("PhoneNumbers"))
-	var phoneNumbers []string
-	if len(phoneNumbersDat) > 0 {
-		if len(phoneNumbersDat) >= 4096 {
-			// Arbitrarily limited the max amount of data to 4096.
-			http.Error(w, "Invalid Phone Numbers given, too many phone numbers given.", http.StatusBadRequest)
-			return
-		}
-		phoneNumbers = strings.Split(phoneNumbersDat, "\n")
-	}
-
-	// Create record from request
-	record := &contact.Contact{}
-	record.FullName = fullName
-	record.Email = email
-	// We know the size of phone numbers provided.
-	// So lets allocate precisely that amount.
-	record.PhoneNumbers = make([]contact.PhoneNumber, len(phoneNumbers))
-	for i, phoneNumber := range phoneNumbers {
-		record.PhoneNumbers[i] = contact.PhoneNumber{
-			Number: phoneNumber,
-		}
+	form := parseContactForm(r)
+	if form.Error != "" {
+		setErrorCode(w, codeTooManyRows)
+		writeContactFormPage(w, r, http.StatusBadRequest, form)
+		return
+	}
+	// Allow spare rows to be left empty
+	form.removeBlankRows()
+	record := form.toContact()
+	insertNew := contact.InsertNew
+	if r.FormValue("AllowDuplicates") == "true" {
+		insertNew = contact.InsertNewAllowingDuplicates
 	}
-	if err := contact.InsertNew(record); err != nil {
+	if err := insertNew(requestActor(r), &record); err != nil {
 		switch err := err.(type) {
 		case *validate.ValidationError:
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			form.setErrors(err)
+			setErrorCode(w, err.Code())
+			writeContactFormPage(w, r, http.StatusBadRequest, form)
+		case *contact.DuplicateError:
+			// Show who they might be a duplicate of and let them submit the same
+			// values again if it's actually a different person.
+			type TemplateData struct {
+				Duplicates []contact.Duplicate
+				Form       contactForm
+				Region     string
+			}
+			templateData := TemplateData{
+				Duplicates: err.Duplicates,
+				Form:       form.withPageFields(w, r),
+				Region:     contact.DefaultRegion(),
+			}
+			// Start the wait before it can be submitted again
+			templateData.Form.FormStartedAt = formStartedAt(time.Now())
+			setErrorCode(w, codeDuplicate)
+			w.WriteHeader(http.StatusConflict)
+			if err := templates.ExecuteTemplate(w, "duplicateContact.html", templateData); err != nil {
+				log.Print(err)
+			}
 		default:
 			log.Print(err)
-			http.Error(w, "An unexpected error occurred inserting the record", http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred inserting the record")
 		}
 		return
 	}
-	if err := templates.ExecuteTemplate(w, "postContact.html", nil); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	return
+	http.Redirect(w, r, contactPagePath(record.ID), http.StatusSeeOther)
 }
 
 // MustInitialize will init various modules such as templates, configs and database connections.
@@ -109,20 +224,30 @@ func MustInitialize() {
 	// folders simple. (ie. all dot-prefixed folders are denied/blocked from public)
 	templates = template.Must(template.ParseFiles(
 		".templates/index.html",
-		".templates/postContact.html",
+		".templates/duplicateContact.html",
+		".templates/login.html",
+		".templates/adminUsers.html",
+		".templates/apiTokens.html",
+		".templates/auditLog.html",
+		".templates/trash.html",
+		".templates/contact.html",
+		".templates/contactForm.html",
 	))
 
-	// Load config
-	config.MustLoad()
+	// Load config, unless it has already been set. (ie. by our tests)
+	if !config.IsSet() {
+		config.MustLoad()
+	}
 
-	// Connect to the database
-	config := config.Get()
-	db.MustConnect(db.Settings{
-		Host:     config.Database.Host,
-		Port:     config.Database.Port,
-		User:     config.Database.User,
-		Password: config.Database.Password,
-	})
+	// Setup where contacts are stored
+	mustSetupStore()
+	mustSetupSpamProtection()
+
+	if region := config.Get().Phone.DefaultRegion; region != "" {
+		if err := contact.SetDefaultRegion(region); err != nil {
+			log.Fatalf("\"phone.defaultRegion\" JSON key is invalid: %s", err)
+		}
+	}
 
 	// Flags and initialization
 	if flagDestroy {
@@ -135,11 +260,52 @@ func MustInitialize() {
 		mustSetup()
 		os.Exit(0)
 	}
+	if flagMigrate != "" {
+		mustMigrate(flagMigrate, flag.Args())
+		os.Exit(0)
+	}
 	mustSetup()
+	if flagImport != "" {
+		// --import flag will import the CSV file, after migrations have been applied
+		if !mustImport(flagImport) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if flagExport != "" {
+		mustExport(flagExport, flagExportVCardVersion, flagExportFilter)
+		os.Exit(0)
+	}
+	if flagCreateUser != "" {
+		mustCreateUser(flagCreateUser, flagCreateUserRole, os.Stdin)
+		os.Exit(0)
+	}
 
 	// Setup routes
-	http.HandleFunc("/", handleHomePage)
-	http.HandleFunc("/postContact", handlePostContact)
+	//
+	// Everything to do with contacts requires a signed in user. Wrap new routes with
+	// requireUser if they're pages or requireAPIUser if they're used by scripts or other clients,
+	// giving the permission needed to use them at all. Routes that do more than one thing,
+	// ie. reading and changing contacts, check for the rest with requirePermission.
+	http.HandleFunc("/", requireUser(user.PermissionReadContacts, handleHomePage))
+	//
+	// Pages that accept a POST must also be wrapped with protectForm.
+	http.HandleFunc(postContactPath, protectForm(requireUser(user.PermissionCreateContacts, preventSpam(handlePostContact))))
+	http.HandleFunc(loginPath, protectForm(handleLogin))
+	http.HandleFunc(logoutPath, protectForm(handleLogout))
+	http.HandleFunc(adminUsersPath, protectForm(requireUser(user.PermissionManageUsers, handleAdminUsers)))
+	http.HandleFunc(contactsPath+"/", protectForm(requireUser(user.PermissionReadContacts, handleContactPages)))
+	http.HandleFunc(trashPath, protectForm(requireUser(user.PermissionDeleteContacts, handleTrash)))
+	http.HandleFunc(adminAuditPath, requireUser(user.PermissionViewAuditLog, handleAdminAudit))
+	http.HandleFunc(adminAuditExportPath, requireAPIUser(user.PermissionViewAuditLog, handleAdminAuditExport))
+	http.HandleFunc(adminMetricsPath, requireAPIUser(user.PermissionManageUsers, handleAdminMetrics))
+	http.HandleFunc(apiTokensPath, protectForm(requireUser(user.PermissionReadContacts, handleAPITokens)))
+	http.HandleFunc(apiContactsPath, requireAPIUser(user.PermissionReadContacts, handleAPIContacts))
+	http.HandleFunc(apiContactsPath+"/", requireAPIUser(user.PermissionReadContacts, handleAPIContact))
+	http.HandleFunc(apiContactsPath+"/import", requireAPIUser(user.PermissionImportExportContacts, handleAPIImport))
+	http.HandleFunc(exportPath, requireAPIUser(user.PermissionImportExportContacts, handleExport))
+	http.HandleFunc(carddavPath, requireAPIUser(user.PermissionReadContacts, handleCardDAV))
+	http.HandleFunc(carddavWellKnownPath, handleCardDAVWellKnown)
 	http.HandleFunc("/static/main.css", func(w http.ResponseWriter, r *http.Request) {
 		// Manually serving CSS rather than using http.FileServer because Golang's in-built
 		// detection methods can't really determine if the file is CSS or not.
@@ -156,9 +322,10 @@ func MustStart() {
 	if !isInitialized {
 		panic("Must call Initialize before calling Start")
 	}
+	startPurgingTrash()
 	port := ":" + strconv.Itoa(config.Get().Web.Port)
 	log.Printf("Starting server on " + port + "...")
-	err := http.ListenAndServe(port, nil)
+	err := http.ListenAndServe(port, withSecurityHeaders(http.DefaultServeMux))
 	if err != nil {
 		panic(err)
 	}
@@ -173,15 +340,141 @@ func MustClose() {
 	isClosed = true
 }
 
+// mustSetupStore will connect to the configured database, if any, and tell the
+// contact and user packages to store their records in it.
+func mustSetupStore() {
+	settings := config.Get().Database
+	switch settings.Driver {
+	case config.DatabaseDriverMemory:
+		contact.SetStore(contact.NewMemoryStore())
+		user.SetStore(user.NewMemoryStore())
+	case config.DatabaseDriverSQLite:
+		db.MustConnect(db.Settings{
+			Dialect: db.DialectSQLite,
+			Path:    settings.Path,
+		})
+		contact.SetStore(contact.NewSQLStore())
+		user.SetStore(user.NewSQLStore())
+	default:
+		db.MustConnect(db.Settings{
+			Dialect:  db.DialectPostgres,
+			Host:     settings.Host,
+			Port:     settings.Port,
+			User:     settings.User,
+			Password: settings.Password,
+		})
+		contact.SetStore(contact.NewSQLStore())
+		user.SetStore(user.NewSQLStore())
+	}
+}
+
+// hasDatabase returns false if contacts are only being stored in memory.
+func hasDatabase() bool {
+	return config.Get().Database.Driver != config.DatabaseDriverMemory
+}
+
 // mustDestroy will drop all the tables in the current database.
 //
 // In a real production situation, I'd probably make this hidden behind tag like "dev" or "debug"
 // as it only exists for developer convenience.
 func mustDestroy() {
-	contact.MustDestroy()
+	if !hasDatabase() {
+		log.Fatalf("Cannot destroy the database when using the \"%s\" database driver.", config.DatabaseDriverMemory)
+	}
+	db.MustDestroy()
 }
 
-// mustSetup will create tables and mock data for records.
+// mustSetup will apply any pending migrations and add mock data for records if
+// the database was brand new.
 func mustSetup() {
-	contact.MustInitialize()
+	if !hasDatabase() {
+		// Memory is always brand new
+		contact.MustInsertMockData()
+		user.MustInsertMockData()
+		return
+	}
+	version, err := db.CurrentVersion()
+	if err != nil {
+		panic(err)
+	}
+	if err := db.MigrateUp(); err != nil {
+		panic(err)
+	}
+	if version == 0 {
+		contact.MustInsertMockData()
+	}
+}
+
+// mustMigrate handles the --migrate flag.
+//
+// The number of migrations to revert for "down" can either be given as part of the flag
+// value, ie. --migrate="down 2", or as the argument after it, ie. --migrate down 2
+func mustMigrate(command string, args []string) {
+	if !hasDatabase() {
+		log.Fatalf("Cannot run migrations when using the \"%s\" database driver.", config.DatabaseDriverMemory)
+	}
+	fields := append(strings.Fields(command), args...)
+	if len(fields) == 0 {
+		log.Fatalf("No migrate command given. Expected \"up\", \"down N\" or \"status\".")
+	}
+	switch fields[0] {
+	case "up":
+		if err := db.MigrateUp(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Migrations applied.")
+	case "down":
+		steps := 1
+		if len(fields) > 1 {
+			var err error
+			steps, err = strconv.Atoi(fields[1])
+			if err != nil || steps <= 0 {
+				log.Fatalf("Invalid number of migrations to revert: %q", fields[1])
+			}
+		}
+		if err := db.MigrateDown(steps); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Reverted %d migration(s).", steps)
+	case "status":
+		statuses, err := db.MigrationStatuses()
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS")
+		for _, status := range statuses {
+			state := "pending"
+			if status.IsApplied {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, state)
+		}
+		w.Flush()
+	default:
+		log.Fatalf("Unknown migrate command %q. Expected \"up\", \"down N\" or \"status\".", fields[0])
+	}
+}
+
+// mustCreateUser handles the --create-user flag. The password is the first line read from
+// stdin so that it doesn't end up in the shell history, ie.
+// echo "my password" | contact-site --create-user jae
+func mustCreateUser(username string, roleName string, stdin io.Reader) {
+	if !hasDatabase() {
+		log.Fatalf("Cannot create users when using the \"%s\" database driver, they'd be lost when the application stops.", config.DatabaseDriverMemory)
+	}
+	role, err := user.ParseRole(roleName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	record, err := user.Create(username, password, role)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Created %s %q.", record.Role, record.Username)
 }
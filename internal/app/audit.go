@@ -0,0 +1,194 @@
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+const (
+	adminAuditPath       = "/admin/audit"
+	adminAuditExportPath = "/admin/audit/export"
+)
+
+var (
+	errInvalidContactIDFilter = validate.NewError("audit.contact_id.invalid", "Invalid contactId provided. Must be a positive number.")
+	errInvalidUserIDFilter    = validate.NewError("audit.user_id.invalid", "Invalid userId provided. Must be a positive number.")
+)
+
+// parseAuditOptions will read the query parameters used for browsing the audit log.
+// This is shared between the audit log page and its export so they behave the same.
+//
+// - limit: maximum entries per page
+// - offset: amount of entries to skip
+// - contactId: only show changes to this contact
+// - userId: only show changes made by this user
+func parseAuditOptions(query url.Values) (contact.AuditOptions, error) {
+	var options contact.AuditOptions
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return contact.AuditOptions{}, errInvalidLimit
+		}
+		options.Limit = limit
+	}
+	if s := query.Get("offset"); s != "" {
+		offset, err := strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return contact.AuditOptions{}, errInvalidOffset
+		}
+		options.Offset = offset
+	}
+	if s := query.Get("contactId"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 0 {
+			return contact.AuditOptions{}, errInvalidContactIDFilter
+		}
+		options.ContactID = id
+	}
+	if s := query.Get("userId"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 0 {
+			return contact.AuditOptions{}, errInvalidUserIDFilter
+		}
+		options.UserID = id
+	}
+	return options, nil
+}
+
+// auditOptionsURL is the inverse of parseAuditOptions, it builds a URL for the given path
+// and options so we can link to next/previous pages and filters.
+func auditOptionsURL(path string, options contact.AuditOptions) string {
+	query := url.Values{}
+	if options.Limit != 0 && options.Limit != contact.DefaultListLimit {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.Offset != 0 {
+		query.Set("offset", strconv.Itoa(options.Offset))
+	}
+	if options.ContactID != 0 {
+		query.Set("contactId", strconv.FormatInt(options.ContactID, 10))
+	}
+	if options.UserID != 0 {
+		query.Set("userId", strconv.FormatInt(options.UserID, 10))
+	}
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
+
+// handleAdminAudit shows the audit log, newest first, optionally filtered by contact or user.
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	type Entry struct {
+		contact.AuditEntry
+		// BeforeJSON and AfterJSON are the snapshots as indented JSON, blank if there's none
+		BeforeJSON string
+		AfterJSON  string
+	}
+	type TemplateData struct {
+		Entries []Entry
+		Options contact.AuditOptions
+		// NextURL and PreviousURL are blank if there's no page in that direction
+		NextURL     string
+		PreviousURL string
+		// ExportURL downloads every entry matching the filters, not just this page
+		ExportURL string
+		// Username of the signed in user
+		Username  string
+		CSRFToken string
+	}
+	options, err := parseAuditOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorCode(err), err.Error())
+		return
+	}
+	result, err := contact.ListAudit(options)
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred listing the audit log")
+		return
+	}
+	exportOptions := result.Options
+	exportOptions.Limit = 0
+	exportOptions.Offset = 0
+	entries := make([]Entry, len(result.Entries))
+	for i, entry := range result.Entries {
+		entries[i] = Entry{
+			AuditEntry: entry,
+			BeforeJSON: indentedJSON(entry.Before),
+			AfterJSON:  indentedJSON(entry.After),
+		}
+	}
+	templateData := TemplateData{
+		Entries:   entries,
+		Options:   result.Options,
+		ExportURL: auditOptionsURL(adminAuditExportPath, exportOptions),
+		CSRFToken: csrfToken(w, r),
+	}
+	if result.HasNext {
+		templateData.NextURL = auditOptionsURL(adminAuditPath, result.NextOptions())
+	}
+	if result.HasPrevious() {
+		templateData.PreviousURL = auditOptionsURL(adminAuditPath, result.PreviousOptions())
+	}
+	if record, ok := currentUser(r); ok {
+		templateData.Username = record.Username
+	}
+	if err := templates.ExecuteTemplate(w, "auditLog.html", templateData); err != nil {
+		log.Print(err)
+	}
+}
+
+// handleAdminAuditExport handles "/admin/audit/export", which downloads every entry in the
+// audit log as JSON lines, newest first. It takes the same filters as the audit log page.
+func handleAdminAuditExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	options, err := parseAuditOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorCode(err), err.Error())
+		return
+	}
+	writer := newJSONLinesWriter(w)
+	w.Header().Set("Content-Type", exportFormatJSONLines.ContentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\"audit.jsonl\"")
+	err = contact.ForEachAuditEntry(options, func(entry contact.AuditEntry) error {
+		// Encode adds the trailing newline
+		return writer.encoder.Encode(entry)
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		// Headers and some entries may have already been sent at this point, so all we can
+		// do is log it. The client will see a truncated file.
+		log.Printf("Failed to export the audit log: %v", err)
+	}
+}
+
+// indentedJSON returns the contact as indented JSON, or blank if it's nil.
+func indentedJSON(record *contact.Contact) string {
+	if record == nil {
+		return ""
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		// Contacts only have fields that can always be encoded
+		panic(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,316 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/config"
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/csrf"
+	"github.com/silbinarywolf/contact-site/internal/user"
+)
+
+const (
+	loginPath  = "/login"
+	logoutPath = "/logout"
+
+	// sessionCookieName is the cookie holding the session token of the signed in user
+	sessionCookieName = "session"
+
+	// authRealm is shown by clients when asking for a username and password
+	authRealm = "Contact Site"
+)
+
+// signedInContextKey is how the signedIn details are stored in a requests context.
+type signedInContextKey struct{}
+
+// signedIn is who signed in to make a request and how.
+type signedIn struct {
+	User user.User
+	// Token is set when signed in with an API token, which limits what the user can do
+	Token *user.APIToken
+	// IsAPI is true for the API, export and CardDAV endpoints, where errors are sent as JSON
+	IsAPI bool
+}
+
+// requireUser only calls the handler for signed in users with the given permission. Anyone
+// not signed in is sent to the login page.
+//
+// The permission is what's needed to use the page at all. Handlers that do more than one
+// thing check for the rest with requirePermission.
+//
+// Only the session cookie is checked, not the Authorization header. Browsers remember Basic
+// authentication and send it with requests from other sites, whereas the session cookie is
+// SameSite, so pages that change things (ie. "/postContact") can't be submitted from elsewhere.
+func requireUser(permission user.Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record, ok, err := sessionUser(r)
+		if err != nil {
+			log.Print(err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred signing in")
+			return
+		}
+		if !ok {
+			http.Redirect(w, r, loginPath+"?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusSeeOther)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), signedInContextKey{}, signedIn{User: record}))
+		if !requirePermission(w, r, permission) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// requireAPIUser is the same as requireUser, but for the API, export and CardDAV endpoints.
+// Along with the session cookie, these take an API token as "Authorization: Bearer {token}"
+// or a username and password with HTTP Basic authentication, as that's what scripts and
+// CardDAV clients use.
+//
+// Anyone else gets a "401 Unauthorized" rather than being sent to the login page.
+func requireAPIUser(permission user.Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := bearerToken(r); ok {
+			record, apiToken, err := user.AuthenticateAPIToken(token)
+			if err == user.ErrAPITokenNotFound {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+authRealm+`", error="invalid_token"`)
+				writeJSONError(w, http.StatusUnauthorized, codeInvalidAPIToken, "Invalid API token. It may have expired or been revoked.")
+				return
+			}
+			if err != nil {
+				log.Print(err)
+				writeJSONError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred signing in")
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), signedInContextKey{}, signedIn{User: record, Token: &apiToken, IsAPI: true}))
+			if !requirePermission(w, r, permission) {
+				return
+			}
+			handler(w, r)
+			return
+		}
+		record, ok, err := sessionUser(r)
+		if err == nil && !ok {
+			record, ok, err = basicAuthUser(r)
+		}
+		if err != nil {
+			log.Print(err)
+			writeJSONError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred signing in")
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`", charset="UTF-8"`)
+			writeJSONError(w, http.StatusUnauthorized, codeNotSignedIn, "Not signed in. Sign in with an API token, a session cookie or a username and password.")
+			return
+		}
+		// Browsers send the session cookie and remembered Basic authentication by themselves,
+		// so make sure another site isn't using them. API tokens are only sent by scripts.
+		if err := csrf.VerifyOrigin(r); err != nil {
+			writeJSONError(w, http.StatusForbidden, errorCode(err), err.Error())
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), signedInContextKey{}, signedIn{User: record, IsAPI: true}))
+		if !requirePermission(w, r, permission) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// requirePermission returns true if the signed in user has every given permission. Otherwise
+// it writes a "403 Forbidden" response and returns false.
+//
+// This is where every permission is checked, for both pages and the API, so that what each
+// role can do is only decided by the user package.
+func requirePermission(w http.ResponseWriter, r *http.Request, permissions ...user.Permission) bool {
+	current, ok := r.Context().Value(signedInContextKey{}).(signedIn)
+	if !ok {
+		// Handlers checking permissions must be wrapped by requireUser or requireAPIUser
+		panic("requirePermission called for a request that isn't signed in")
+	}
+	for _, permission := range permissions {
+		if current.User.Can(permission) && (current.Token == nil || current.Token.Scope.Allows(permission)) {
+			continue
+		}
+		message := fmt.Sprintf("Forbidden. Your role %q doesn't have the %q permission.", current.User.Role, permission)
+		if current.User.Can(permission) {
+			message = fmt.Sprintf("Forbidden. Your API token's scope %q doesn't allow the %q permission.", current.Token.Scope, permission)
+		}
+		if current.IsAPI {
+			writeJSONError(w, http.StatusForbidden, codeForbidden, message)
+		} else {
+			writeError(w, http.StatusForbidden, codeForbidden, message)
+		}
+		return false
+	}
+	return true
+}
+
+// currentUser returns the signed in user. It's only set for handlers wrapped by requireUser
+// or requireAPIUser.
+func currentUser(r *http.Request) (user.User, bool) {
+	current, ok := r.Context().Value(signedInContextKey{}).(signedIn)
+	return current.User, ok
+}
+
+// requestActor returns who is making the request, so that changes to contacts are recorded
+// against them in the audit log.
+func requestActor(r *http.Request) contact.Actor {
+	record, _ := currentUser(r)
+	return contact.Actor{
+		UserID:   record.ID,
+		Username: record.Username,
+		IP:       clientIP(r),
+	}
+}
+
+// sessionUser returns the user signed in with the session cookie, if there is one.
+func sessionUser(r *http.Request) (user.User, bool, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return user.User{}, false, nil
+	}
+	record, err := user.GetSession(cookie.Value)
+	if err == user.ErrSessionNotFound {
+		return user.User{}, false, nil
+	}
+	if err != nil {
+		return user.User{}, false, err
+	}
+	return record, true, nil
+}
+
+// bearerToken returns the API token sent as "Authorization: Bearer {token}", if there is one.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	// The scheme is case-insensitive, see RFC 7235 section 2.1
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// basicAuthUser returns the user signed in with HTTP Basic authentication, if there is one.
+func basicAuthUser(r *http.Request) (user.User, bool, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return user.User{}, false, nil
+	}
+	record, err := user.Authenticate(username, password)
+	if err == user.ErrInvalidCredentials {
+		return user.User{}, false, nil
+	}
+	if err != nil {
+		return user.User{}, false, err
+	}
+	return record, true, nil
+}
+
+// handleLogin shows the login page and signs in users that submit it.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	type TemplateData struct {
+		Username  string
+		Next      string
+		Error     string
+		CSRFToken string
+	}
+	switch r.Method {
+	case http.MethodGet:
+		templateData := TemplateData{
+			Next:      safeRedirectPath(r.URL.Query().Get("next")),
+			CSRFToken: csrfToken(w, r),
+		}
+		if err := templates.ExecuteTemplate(w, "login.html", templateData); err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+	case http.MethodPost:
+		r.ParseForm()
+		templateData := TemplateData{
+			Username:  r.FormValue("Username"),
+			Next:      safeRedirectPath(r.FormValue("Next")),
+			CSRFToken: csrfToken(w, r),
+		}
+		record, err := user.Authenticate(templateData.Username, r.FormValue("Password"))
+		if err != nil {
+			statusCode, code := http.StatusUnauthorized, codeInvalidCredentials
+			templateData.Error = "Incorrect username or password."
+			if err != user.ErrInvalidCredentials {
+				log.Print(err)
+				statusCode, code = http.StatusInternalServerError, codeInternal
+				templateData.Error = "An unexpected error occurred signing in."
+			}
+			setErrorCode(w, code)
+			w.WriteHeader(statusCode)
+			if err := templates.ExecuteTemplate(w, "login.html", templateData); err != nil {
+				log.Print(err)
+			}
+			return
+		}
+		token, session, err := user.CreateSession(record.ID)
+		if err != nil {
+			log.Print(err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred signing in")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    token,
+			Path:     "/",
+			Expires:  session.ExpiresAt,
+			Secure:   isSecureRequest(r),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, templateData.Next, http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleLogout signs out the current session. It only accepts POST so that other sites can't
+// sign users out with a link or image.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := user.DeleteSession(cookie.Value); err != nil {
+			log.Print(err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred signing out")
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   isSecureRequest(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, loginPath, http.StatusSeeOther)
+}
+
+// safeRedirectPath returns the path to send the user to after signing in. Only paths on this
+// site are allowed, so the login page can't be used to send users to another site.
+func safeRedirectPath(next string) string {
+	// "//example.com" and "/\example.com" are treated by browsers as another site
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// isSecureRequest returns true if the session cookie should only be sent over HTTPS.
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || config.Get().Web.SecureCookies
+}
@@ -0,0 +1,703 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/contactvcard"
+	"github.com/silbinarywolf/contact-site/internal/user"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+// CardDAV (RFC 6352) lets phones and address books sync every contact as a single address book.
+//
+// The layout is deliberately as small as clients allow:
+// - "/carddav/" is both the principal and the address book home, as every user shares the one address book
+// - "/carddav/contacts/" is the address book
+// - "/carddav/contacts/{uid}.vcf" is a contact, named by its (path escaped) UID
+const (
+	carddavPath            = "/carddav/"
+	carddavAddressBookPath = carddavPath + "contacts/"
+	// carddavWellKnownPath is where clients look for the CardDAV server, see RFC 6764
+	carddavWellKnownPath = "/.well-known/carddav"
+
+	// carddavVCardExtension is added to a contacts UID to get the name of its resource
+	carddavVCardExtension = ".vcf"
+
+	// carddavVCardVersion is the vCard version we send when the client doesn't ask for one.
+	// RFC 6352 requires vCard 3.0 support, so it's what every client understands.
+	carddavVCardVersion = contactvcard.Version3
+)
+
+const (
+	davNamespace            = "DAV:"
+	carddavNamespace        = "urn:ietf:params:xml:ns:carddav"
+	calendarServerNamespace = "http://calendarserver.org/ns/"
+)
+
+// davPrefixes are the prefixes our responses use for each namespace. Elements from any other
+// namespace, ie. unknown properties a client asked for, declare their namespace inline.
+var davPrefixes = map[string]string{
+	davNamespace:            "D",
+	carddavNamespace:        "C",
+	calendarServerNamespace: "CS",
+}
+
+// davResource is a collection or contact and its live properties.
+type davResource struct {
+	Href string
+	// Properties are what PROPFIND with allprop returns, in order
+	Properties []davProperty
+}
+
+// davProperty is a single property of a resource.
+type davProperty struct {
+	Name xml.Name
+	// Value is the XML inside the property element, which must already be escaped
+	Value string
+}
+
+// davResponse is a single response within a multistatus.
+type davResponse struct {
+	Href string
+	// Status is set instead of the properties when the resource itself can't be returned,
+	// ie. a multiget for a contact that doesn't exist.
+	Status   int
+	Found    []davProperty
+	NotFound []xml.Name
+}
+
+// davPropfind is the body of a PROPFIND request. An empty body is the same as allprop.
+type davPropfind struct {
+	XMLName  xml.Name     `xml:"DAV: propfind"`
+	AllProp  *struct{}    `xml:"DAV: allprop"`
+	PropName *struct{}    `xml:"DAV: propname"`
+	Prop     *davPropList `xml:"DAV: prop"`
+}
+
+// davPropList is the properties a client asked for.
+type davPropList struct {
+	Names []davPropName `xml:",any"`
+}
+
+// davPropName is a requested property. Its attributes are only used by CARDDAV:address-data,
+// which can ask for a particular vCard version.
+type davPropName struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+// handleCardDAVWellKnown sends clients that only know the host name to the CardDAV server.
+func handleCardDAVWellKnown(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, carddavPath, http.StatusMovedPermanently)
+}
+
+// handleCardDAV handles everything under "/carddav/".
+func handleCardDAV(w http.ResponseWriter, r *http.Request) {
+	// Clients check for "addressbook" to know this is a CardDAV server, see RFC 6352 section 6.1
+	w.Header().Set("DAV", "1, 3, addressbook")
+
+	// The escaped path is used so that a UID containing a "/" is still a single path segment
+	path := r.URL.EscapedPath()
+	switch {
+	case path == carddavPath:
+		handleCardDAVRoot(w, r)
+	case path == carddavAddressBookPath, path+"/" == carddavAddressBookPath:
+		handleCardDAVAddressBook(w, r)
+	case strings.HasPrefix(path, carddavAddressBookPath):
+		uid, ok := carddavUIDFromName(strings.TrimPrefix(path, carddavAddressBookPath))
+		if !ok {
+			writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+			return
+		}
+		handleCardDAVContact(w, r, uid)
+	default:
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+	}
+}
+
+// handleCardDAVRoot handles "/carddav/", which only exists so clients can find the address book.
+func handleCardDAVRoot(w http.ResponseWriter, r *http.Request) {
+	allowedMethods := []string{http.MethodOptions, "PROPFIND"}
+	switch r.Method {
+	case http.MethodOptions:
+		writeDAVOptions(w, allowedMethods...)
+	case "PROPFIND":
+		request, ok := readDAVPropfind(w, r)
+		if !ok {
+			return
+		}
+		resources := []davResource{carddavRootResource()}
+		if davDepth(r) > 0 {
+			viewer, _ := currentUser(r)
+			addressBook, _, err := carddavAddressBookResource(viewer)
+			if err != nil {
+				writeDAVContactError(w, err)
+				return
+			}
+			resources = append(resources, addressBook)
+		}
+		writeDAVMultistatus(w, davPropfindResponses(resources, request))
+	default:
+		writeDAVMethodNotAllowed(w, allowedMethods...)
+	}
+}
+
+// handleCardDAVAddressBook handles "/carddav/contacts/", the address book of every contact.
+func handleCardDAVAddressBook(w http.ResponseWriter, r *http.Request) {
+	allowedMethods := []string{http.MethodOptions, "PROPFIND", "REPORT"}
+	switch r.Method {
+	case http.MethodOptions:
+		writeDAVOptions(w, allowedMethods...)
+	case "PROPFIND":
+		request, ok := readDAVPropfind(w, r)
+		if !ok {
+			return
+		}
+		viewer, _ := currentUser(r)
+		addressBook, contacts, err := carddavAddressBookResource(viewer)
+		if err != nil {
+			writeDAVContactError(w, err)
+			return
+		}
+		resources := []davResource{addressBook}
+		if davDepth(r) > 0 {
+			for _, record := range contacts {
+				resources = append(resources, carddavContactResource(record, ""))
+			}
+		}
+		writeDAVMultistatus(w, davPropfindResponses(resources, request))
+	case "REPORT":
+		handleCardDAVReport(w, r)
+	default:
+		writeDAVMethodNotAllowed(w, allowedMethods...)
+	}
+}
+
+// handleCardDAVContact handles "/carddav/contacts/{uid}.vcf", a single contact as a vCard.
+func handleCardDAVContact(w http.ResponseWriter, r *http.Request, uid string) {
+	allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, "PROPFIND"}
+	switch r.Method {
+	case http.MethodOptions:
+		writeDAVOptions(w, allowedMethods...)
+	case http.MethodGet, http.MethodHead:
+		record, err := contact.GetByUID(uid)
+		if err != nil {
+			writeDAVContactError(w, err)
+			return
+		}
+		card := carddavVCard(record, carddavVCardVersion)
+		w.Header().Set("Content-Type", exportFormatVCard.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(card)))
+		w.Header().Set("ETag", contactETag(record))
+		// The body isn't sent for HEAD requests
+		io.WriteString(w, card)
+	case http.MethodPut:
+		handleCardDAVPut(w, r, uid)
+	case http.MethodDelete:
+		if !requirePermission(w, r, user.PermissionDeleteContacts) {
+			return
+		}
+		record, err := contact.GetByUID(uid)
+		if err != nil {
+			writeDAVContactError(w, err)
+			return
+		}
+		if !davPreconditionsPass(r, &record) {
+			setErrorCode(w, contact.ErrVersionConflict.Code())
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if err := contact.DeleteIfVersion(requestActor(r), record.ID, davExpectedVersion(r, &record)); err != nil {
+			writeDAVContactError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		request, ok := readDAVPropfind(w, r)
+		if !ok {
+			return
+		}
+		record, err := contact.GetByUID(uid)
+		if err != nil {
+			writeDAVContactError(w, err)
+			return
+		}
+		writeDAVMultistatus(w, davPropfindResponses([]davResource{carddavContactResource(record, "")}, request))
+	default:
+		writeDAVMethodNotAllowed(w, allowedMethods...)
+	}
+}
+
+// handleCardDAVPut creates or replaces the contact with the given UID from a single vCard.
+//
+// The vCard goes through the same validation as any other contact, so a contact without a
+// phone number is refused. Duplicates are allowed, as the client is syncing what it already
+// has and there's nobody to ask.
+func handleCardDAVPut(w http.ResponseWriter, r *http.Request, uid string) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "text/vcard" && mediaType != "text/x-vcard") {
+			writeDAVError(w, http.StatusForbidden, carddavNamespace, "supported-address-data", "Expected a text/vcard body")
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAPIRequestBodySize+1))
+	if err != nil {
+		writeDAVError(w, http.StatusBadRequest, carddavNamespace, "valid-address-data", "Unable to read body: "+err.Error())
+		return
+	}
+	if len(body) > maxAPIRequestBodySize {
+		writeDAVError(w, http.StatusForbidden, carddavNamespace, "max-resource-size", "The vCard is too large")
+		return
+	}
+	records, err := contactvcard.Read(strings.NewReader(string(body)))
+	if err != nil {
+		writeDAVError(w, http.StatusForbidden, carddavNamespace, "valid-address-data", err.Error())
+		return
+	}
+	if len(records) != 1 {
+		writeDAVError(w, http.StatusForbidden, carddavNamespace, "valid-address-data", "Expected a single vCard")
+		return
+	}
+	record := records[0].Contact
+	if record.UID == "" {
+		record.UID = uid
+	}
+	if record.UID != uid {
+		// The resource name is how we find a contact, so it has to be its UID
+		writeDAVError(w, http.StatusForbidden, carddavNamespace, "valid-address-data", "The vCards UID must match its name, ie. \"{UID}"+carddavVCardExtension+"\"")
+		return
+	}
+
+	// Another client could change the contact between checking the ETag and updating it, so
+	// the version that matched is checked again when it's updated, see davExpectedVersion.
+	existing, err := contact.GetByUID(uid)
+	if err != nil && err != contact.ErrNotFound {
+		writeDAVContactError(w, err)
+		return
+	}
+	var existingRecord *contact.Contact
+	if err == nil {
+		existingRecord = &existing
+	}
+	// PUT either adds or changes a contact, which need different permissions
+	permission := user.PermissionEditContacts
+	if existingRecord == nil {
+		permission = user.PermissionCreateContacts
+	}
+	if !requirePermission(w, r, permission) {
+		return
+	}
+	if !davPreconditionsPass(r, existingRecord) {
+		setErrorCode(w, contact.ErrVersionConflict.Code())
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	statusCode := http.StatusNoContent
+	if existingRecord == nil {
+		err = contact.InsertNewAllowingDuplicates(requestActor(r), &record)
+		statusCode = http.StatusCreated
+	} else {
+		record.ID = existingRecord.ID
+		record.Version = davExpectedVersion(r, existingRecord)
+		err = contact.Update(requestActor(r), &record)
+	}
+	if err == contact.ErrVersionConflict {
+		setErrorCode(w, contact.ErrVersionConflict.Code())
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		if validationErr, ok := err.(*validate.ValidationError); ok {
+			setErrorCode(w, validationErr.Code())
+			writeDAVError(w, http.StatusForbidden, carddavNamespace, "valid-address-data", validationErr.Error())
+			return
+		}
+		writeDAVContactError(w, err)
+		return
+	}
+	// No ETag is sent back as phone numbers are normalized, so what we'd return from GET
+	// isn't what was sent. This tells the client to fetch it again, see RFC 6352 section 6.3.2.3
+	w.WriteHeader(statusCode)
+}
+
+// carddavRootResource is "/carddav/", the principal that owns the address book.
+func carddavRootResource() davResource {
+	homeHref := davHref(carddavPath)
+	return davResource{
+		Href: carddavPath,
+		Properties: []davProperty{
+			{Name: xml.Name{Space: davNamespace, Local: "resourcetype"}, Value: "<D:collection/><D:principal/>"},
+			{Name: xml.Name{Space: davNamespace, Local: "displayname"}, Value: "Contact Site"},
+			{Name: xml.Name{Space: davNamespace, Local: "current-user-principal"}, Value: homeHref},
+			{Name: xml.Name{Space: davNamespace, Local: "principal-URL"}, Value: homeHref},
+			{Name: xml.Name{Space: davNamespace, Local: "current-user-privilege-set"}, Value: "<D:privilege><D:read/></D:privilege>"},
+			{Name: xml.Name{Space: carddavNamespace, Local: "addressbook-home-set"}, Value: homeHref},
+		},
+	}
+}
+
+// carddavAddressBookResource is "/carddav/contacts/" as seen by the given user. Its CTag is
+// derived from every contact, so they're returned too.
+func carddavAddressBookResource(viewer user.User) (davResource, []contact.Contact, error) {
+	var contacts []contact.Contact
+	err := contact.ForEach(contact.ListOptions{SortBy: contact.SortByID}, func(record contact.Contact) error {
+		contacts = append(contacts, record)
+		return nil
+	})
+	if err != nil {
+		return davResource{}, nil, err
+	}
+	resource := davResource{
+		Href: carddavAddressBookPath,
+		Properties: []davProperty{
+			{Name: xml.Name{Space: davNamespace, Local: "resourcetype"}, Value: "<D:collection/><C:addressbook/>"},
+			{Name: xml.Name{Space: davNamespace, Local: "displayname"}, Value: "Contacts"},
+			{Name: xml.Name{Space: davNamespace, Local: "current-user-principal"}, Value: davHref(carddavPath)},
+			{Name: xml.Name{Space: davNamespace, Local: "current-user-privilege-set"}, Value: carddavPrivilegeSet(viewer)},
+			{Name: xml.Name{Space: davNamespace, Local: "supported-report-set"}, Value: "<D:supported-report><D:report><C:addressbook-query/></D:report></D:supported-report>" +
+				"<D:supported-report><D:report><C:addressbook-multiget/></D:report></D:supported-report>"},
+			{Name: xml.Name{Space: carddavNamespace, Local: "addressbook-description"}, Value: "Every contact on the Contact Site"},
+			{Name: xml.Name{Space: carddavNamespace, Local: "supported-address-data"}, Value: `<C:address-data-type content-type="text/vcard" version="3.0"/>` +
+				`<C:address-data-type content-type="text/vcard" version="4.0"/>`},
+			{Name: xml.Name{Space: carddavNamespace, Local: "max-resource-size"}, Value: strconv.Itoa(maxAPIRequestBodySize)},
+			{Name: xml.Name{Space: calendarServerNamespace, Local: "getctag"}, Value: escapeXML(carddavCTag(contacts))},
+		},
+	}
+	return resource, contacts, nil
+}
+
+// carddavPrivilegeSet is the WebDAV privileges (RFC 3744) the user has on the address book,
+// so that clients can show it as read-only to users that can't change contacts.
+func carddavPrivilegeSet(viewer user.User) string {
+	privileges := "<D:privilege><D:read/></D:privilege>"
+	if viewer.Can(user.PermissionEditContacts) {
+		privileges += "<D:privilege><D:write-content/></D:privilege>"
+	}
+	if viewer.Can(user.PermissionCreateContacts) {
+		privileges += "<D:privilege><D:bind/></D:privilege>"
+	}
+	if viewer.Can(user.PermissionDeleteContacts) {
+		privileges += "<D:privilege><D:unbind/></D:privilege>"
+	}
+	return privileges
+}
+
+// carddavContactResource is "/carddav/contacts/{uid}.vcf". The vCard itself is only included
+// as CARDDAV:address-data if a version is given, as it can only be asked for by a REPORT.
+func carddavContactResource(record contact.Contact, addressDataVersion contactvcard.Version) davResource {
+	card := carddavVCard(record, carddavVCardVersion)
+	resource := davResource{
+		Href: carddavContactHref(record),
+		Properties: []davProperty{
+			{Name: xml.Name{Space: davNamespace, Local: "resourcetype"}},
+			{Name: xml.Name{Space: davNamespace, Local: "getetag"}, Value: escapeXML(contactETag(record))},
+			{Name: xml.Name{Space: davNamespace, Local: "getcontenttype"}, Value: escapeXML(exportFormatVCard.ContentType)},
+			{Name: xml.Name{Space: davNamespace, Local: "getcontentlength"}, Value: strconv.Itoa(len(card))},
+			{Name: xml.Name{Space: davNamespace, Local: "current-user-principal"}, Value: davHref(carddavPath)},
+		},
+	}
+	if addressDataVersion != "" {
+		if addressDataVersion != carddavVCardVersion {
+			card = carddavVCard(record, addressDataVersion)
+		}
+		resource.Properties = append(resource.Properties, davProperty{
+			Name:  xml.Name{Space: carddavNamespace, Local: "address-data"},
+			Value: escapeXML(card),
+		})
+	}
+	return resource
+}
+
+// carddavVCard returns the contact as a single vCard.
+func carddavVCard(record contact.Contact, version contactvcard.Version) string {
+	var card strings.Builder
+	writer := contactvcard.NewWriter(&card, version)
+	// Writing to a strings.Builder can't fail
+	writer.Write(record)
+	writer.Flush()
+	return card.String()
+}
+
+// carddavCTag changes whenever any contact is inserted, changed or deleted, so clients can
+// skip syncing when nothing has changed.
+func carddavCTag(contacts []contact.Contact) string {
+	etags := make([]string, len(contacts))
+	for i, record := range contacts {
+		etags[i] = contactETag(record)
+	}
+	sort.Strings(etags)
+	hash := sha256.Sum256([]byte(strings.Join(etags, ",")))
+	return hex.EncodeToString(hash[:])
+}
+
+// carddavContactHref is the path of a contacts vCard.
+func carddavContactHref(record contact.Contact) string {
+	return carddavAddressBookPath + url.PathEscape(record.UID) + carddavVCardExtension
+}
+
+// carddavUIDFromName returns the UID of a contact from the escaped name of its vCard, ie.
+// "contact-1.vcf". Returns false if it's not a valid name.
+func carddavUIDFromName(name string) (string, bool) {
+	if strings.Contains(name, "/") || !strings.HasSuffix(name, carddavVCardExtension) {
+		return "", false
+	}
+	uid, err := url.PathUnescape(strings.TrimSuffix(name, carddavVCardExtension))
+	if err != nil || uid == "" {
+		return "", false
+	}
+	return uid, true
+}
+
+// davDepth returns the Depth header of a PROPFIND or REPORT. There's nothing more than
+// one level below any of our collections, so "infinity" is the same as 1.
+func davDepth(r *http.Request) int {
+	if r.Header.Get("Depth") == "0" {
+		return 0
+	}
+	return 1
+}
+
+// davPreconditionsPass checks the If-Match and If-None-Match headers against the contact,
+// which is nil if it doesn't exist yet. Clients use these so they don't overwrite changes
+// they haven't seen.
+func davPreconditionsPass(r *http.Request, record *contact.Contact) bool {
+	etag := ""
+	if record != nil {
+		etag = contactETag(*record)
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if record == nil || !davETagMatches(ifMatch, etag) {
+			return false
+		}
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if record != nil && davETagMatches(ifNoneMatch, etag) {
+			return false
+		}
+	}
+	return true
+}
+
+// davExpectedVersion returns the version of the contact that passed davPreconditionsPass
+// if the client gave an If-Match header, so that it's only changed if it's still at that
+// version. Otherwise 0 is returned, as the client doesn't mind overwriting other changes.
+func davExpectedVersion(r *http.Request, record *contact.Contact) int64 {
+	if r.Header.Get("If-Match") == "" {
+		return 0
+	}
+	return record.Version
+}
+
+// davETagMatches returns true if the header, a list of ETags or "*", matches the ETag.
+func davETagMatches(header string, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" || strings.TrimPrefix(value, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// readDAVPropfind decodes the body of a PROPFIND request. If this fails, an error response
+// is written and false is returned.
+func readDAVPropfind(w http.ResponseWriter, r *http.Request) (davPropfind, bool) {
+	var request davPropfind
+	body, ok := readDAVBody(w, r)
+	if !ok {
+		return davPropfind{}, false
+	}
+	if len(body) == 0 {
+		return davPropfind{AllProp: &struct{}{}}, true
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidXML, "Invalid XML body: "+err.Error())
+		return davPropfind{}, false
+	}
+	return request, true
+}
+
+// readDAVBody reads the XML body of a request, returning an empty body if there isn't one.
+// If this fails, an error response is written and false is returned.
+func readDAVBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAPIRequestBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Unable to read body: "+err.Error())
+		return nil, false
+	}
+	if strings.TrimSpace(string(body)) == "" {
+		return nil, true
+	}
+	return body, true
+}
+
+// davPropfindResponses returns the properties asked for from each resource.
+func davPropfindResponses(resources []davResource, request davPropfind) []davResponse {
+	responses := make([]davResponse, len(resources))
+	for i, resource := range resources {
+		response := davResponse{Href: resource.Href}
+		switch {
+		case request.PropName != nil:
+			for _, property := range resource.Properties {
+				response.Found = append(response.Found, davProperty{Name: property.Name})
+			}
+		case request.Prop != nil:
+			response = davPropResponse(resource, request.Prop.Names)
+		default:
+			response.Found = resource.Properties
+		}
+		responses[i] = response
+	}
+	return responses
+}
+
+// davPropResponse returns the properties of the resource that were asked for by name.
+func davPropResponse(resource davResource, names []davPropName) davResponse {
+	response := davResponse{Href: resource.Href}
+	for _, name := range names {
+		found := false
+		for _, property := range resource.Properties {
+			if property.Name == name.XMLName {
+				response.Found = append(response.Found, property)
+				found = true
+				break
+			}
+		}
+		if !found {
+			response.NotFound = append(response.NotFound, name.XMLName)
+		}
+	}
+	return response
+}
+
+// writeDAVMultistatus writes the responses as a "207 Multi-Status".
+func writeDAVMultistatus(w http.ResponseWriter, responses []davResponse) {
+	var body strings.Builder
+	body.WriteString(xml.Header)
+	body.WriteString(`<D:multistatus xmlns:D="DAV:" xmlns:C="` + carddavNamespace + `" xmlns:CS="` + calendarServerNamespace + `">`)
+	for _, response := range responses {
+		body.WriteString("<D:response>")
+		body.WriteString("<D:href>" + escapeXML(response.Href) + "</D:href>")
+		if response.Status != 0 {
+			body.WriteString("<D:status>" + davStatus(response.Status) + "</D:status>")
+			body.WriteString("</D:response>")
+			continue
+		}
+		if len(response.Found) > 0 || len(response.NotFound) == 0 {
+			body.WriteString("<D:propstat><D:prop>")
+			for _, property := range response.Found {
+				writeDAVElement(&body, property.Name, property.Value)
+			}
+			body.WriteString("</D:prop><D:status>" + davStatus(http.StatusOK) + "</D:status></D:propstat>")
+		}
+		if len(response.NotFound) > 0 {
+			body.WriteString("<D:propstat><D:prop>")
+			for _, name := range response.NotFound {
+				writeDAVElement(&body, name, "")
+			}
+			body.WriteString("</D:prop><D:status>" + davStatus(http.StatusNotFound) + "</D:status></D:propstat>")
+		}
+		body.WriteString("</D:response>")
+	}
+	body.WriteString("</D:multistatus>")
+	writeDAVXML(w, http.StatusMultiStatus, body.String())
+}
+
+// writeDAVError writes a DAV:error body for a failed precondition, ie. CARDDAV:valid-address-data,
+// with a message to explain it.
+//
+// Unless a more specific code has already been set with setErrorCode, the code of the error is
+// the precondition, ie. "carddav.valid-address-data".
+func writeDAVError(w http.ResponseWriter, statusCode int, space string, precondition string, message string) {
+	if w.Header().Get(errorCodeHeader) == "" {
+		setErrorCode(w, "carddav."+precondition)
+	}
+	var body strings.Builder
+	body.WriteString(xml.Header)
+	body.WriteString(`<D:error xmlns:D="DAV:" xmlns:C="` + carddavNamespace + `">`)
+	writeDAVElement(&body, xml.Name{Space: space, Local: precondition}, "")
+	body.WriteString("<D:responsedescription>" + escapeXML(message) + "</D:responsedescription>")
+	body.WriteString("</D:error>")
+	writeDAVXML(w, statusCode, body.String())
+}
+
+// writeDAVContactError will map errors from the contact package to the appropriate
+// HTTP status code.
+func writeDAVContactError(w http.ResponseWriter, err error) {
+	switch err {
+	case contact.ErrNotFound:
+		writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+		return
+	case contact.ErrVersionConflict:
+		writeError(w, http.StatusPreconditionFailed, errorCode(err), err.Error())
+		return
+	}
+	if validationErr, ok := err.(*validate.ValidationError); ok {
+		writeError(w, http.StatusBadRequest, validationErr.Code(), validationErr.Error())
+		return
+	}
+	log.Print(err)
+	writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred")
+}
+
+// writeDAVElement writes an empty element if the value is blank.
+func writeDAVElement(body *strings.Builder, name xml.Name, value string) {
+	tag := name.Local
+	attrs := ""
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		tag = prefix + ":" + name.Local
+	} else {
+		attrs = ` xmlns="` + escapeXML(name.Space) + `"`
+	}
+	if value == "" {
+		body.WriteString("<" + tag + attrs + "/>")
+		return
+	}
+	body.WriteString("<" + tag + attrs + ">" + value + "</" + tag + ">")
+}
+
+func writeDAVXML(w http.ResponseWriter, statusCode int, body string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(statusCode)
+	io.WriteString(w, body)
+}
+
+func writeDAVOptions(w http.ResponseWriter, allowedMethods ...string) {
+	w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeDAVMethodNotAllowed(w http.ResponseWriter, allowedMethods ...string) {
+	w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+// davHref returns a DAV:href element for the path.
+func davHref(path string) string {
+	return "<D:href>" + escapeXML(path) + "</D:href>"
+}
+
+// davStatus returns the status line for a status code, ie. "HTTP/1.1 200 OK"
+func davStatus(statusCode int) string {
+	return "HTTP/1.1 " + strconv.Itoa(statusCode) + " " + http.StatusText(statusCode)
+}
+
+func escapeXML(s string) string {
+	var escaped strings.Builder
+	// Writing to a strings.Builder can't fail
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
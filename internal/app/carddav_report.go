@@ -0,0 +1,339 @@
+package app
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/contactvcard"
+)
+
+// carddavMultiget is the body of an addressbook-multiget REPORT, which fetches contacts by href.
+type carddavMultiget struct {
+	XMLName xml.Name    `xml:"urn:ietf:params:xml:ns:carddav addressbook-multiget"`
+	Prop    davPropList `xml:"DAV: prop"`
+	Hrefs   []string    `xml:"DAV: href"`
+}
+
+// carddavQuery is the body of an addressbook-query REPORT, which searches the address book.
+type carddavQuery struct {
+	XMLName xml.Name      `xml:"urn:ietf:params:xml:ns:carddav addressbook-query"`
+	Prop    davPropList   `xml:"DAV: prop"`
+	Filter  carddavFilter `xml:"urn:ietf:params:xml:ns:carddav filter"`
+	Limit   struct {
+		NResults int `xml:"urn:ietf:params:xml:ns:carddav nresults"`
+	} `xml:"urn:ietf:params:xml:ns:carddav limit"`
+}
+
+// carddavFilter matches vCards by their properties, see RFC 6352 section 10.5.
+type carddavFilter struct {
+	// Test is "anyof" (the default) or "allof"
+	Test        string              `xml:"test,attr"`
+	PropFilters []carddavPropFilter `xml:"urn:ietf:params:xml:ns:carddav prop-filter"`
+}
+
+// carddavPropFilter matches a vCard property, ie. "FN".
+type carddavPropFilter struct {
+	Name         string             `xml:"name,attr"`
+	Test         string             `xml:"test,attr"`
+	IsNotDefined *struct{}          `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+	TextMatches  []carddavTextMatch `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+	// ParamFilters aren't supported, as we don't keep any parameters to match against
+	ParamFilters []struct{} `xml:"urn:ietf:params:xml:ns:carddav param-filter"`
+}
+
+// carddavTextMatch matches the value of a vCard property.
+type carddavTextMatch struct {
+	Collation       string `xml:"collation,attr"`
+	NegateCondition string `xml:"negate-condition,attr"`
+	MatchType       string `xml:"match-type,attr"`
+	Value           string `xml:",chardata"`
+}
+
+// carddavFilterError is a filter we can't apply, it's the CARDDAV precondition that failed.
+type carddavFilterError struct {
+	Precondition string
+	Message      string
+}
+
+func (err *carddavFilterError) Error() string {
+	return err.Message
+}
+
+// handleCardDAVReport handles the addressbook-multiget and addressbook-query REPORTs on the
+// address book.
+func handleCardDAVReport(w http.ResponseWriter, r *http.Request) {
+	body, ok := readDAVBody(w, r)
+	if !ok {
+		return
+	}
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(body, &root); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidXML, "Invalid XML body: "+err.Error())
+		return
+	}
+	switch root.XMLName {
+	case xml.Name{Space: carddavNamespace, Local: "addressbook-multiget"}:
+		var request carddavMultiget
+		if err := xml.Unmarshal(body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidXML, "Invalid XML body: "+err.Error())
+			return
+		}
+		handleCardDAVMultiget(w, request)
+	case xml.Name{Space: carddavNamespace, Local: "addressbook-query"}:
+		var request carddavQuery
+		if err := xml.Unmarshal(body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidXML, "Invalid XML body: "+err.Error())
+			return
+		}
+		handleCardDAVQuery(w, request)
+	default:
+		writeDAVError(w, http.StatusForbidden, davNamespace, "supported-report", "Unsupported report, expected addressbook-multiget or addressbook-query")
+	}
+}
+
+// handleCardDAVMultiget returns each contact asked for, or a 404 for ones that don't exist.
+func handleCardDAVMultiget(w http.ResponseWriter, request carddavMultiget) {
+	version, ok := carddavAddressDataVersion(request.Prop.Names)
+	if !ok {
+		writeDAVError(w, http.StatusForbidden, carddavNamespace, "supported-address-data", "Unsupported address data, expected text/vcard version 3.0 or 4.0")
+		return
+	}
+	responses := make([]davResponse, 0, len(request.Hrefs))
+	for _, href := range request.Hrefs {
+		href = strings.TrimSpace(href)
+		record, err := carddavContactForHref(href)
+		if err == contact.ErrNotFound {
+			responses = append(responses, davResponse{Href: href, Status: http.StatusNotFound})
+			continue
+		}
+		if err != nil {
+			writeDAVContactError(w, err)
+			return
+		}
+		responses = append(responses, davPropResponse(carddavContactResource(record, version), request.Prop.Names))
+	}
+	writeDAVMultistatus(w, responses)
+}
+
+// handleCardDAVQuery returns every contact that matches the filter, up to the limit.
+func handleCardDAVQuery(w http.ResponseWriter, request carddavQuery) {
+	version, ok := carddavAddressDataVersion(request.Prop.Names)
+	if !ok {
+		writeDAVError(w, http.StatusForbidden, carddavNamespace, "supported-address-data", "Unsupported address data, expected text/vcard version 3.0 or 4.0")
+		return
+	}
+	// Check the filter up front, so an unsupported filter fails even if there are no contacts
+	if _, err := request.Filter.matches(&contact.Contact{}); err != nil {
+		filterErr := err.(*carddavFilterError)
+		writeDAVError(w, http.StatusForbidden, carddavNamespace, filterErr.Precondition, filterErr.Message)
+		return
+	}
+	var responses []davResponse
+	isTruncated := false
+	err := contact.ForEach(contact.ListOptions{SortBy: contact.SortByID}, func(record contact.Contact) error {
+		if isTruncated {
+			return nil
+		}
+		if isMatch, _ := request.Filter.matches(&record); !isMatch {
+			return nil
+		}
+		if request.Limit.NResults > 0 && len(responses) == request.Limit.NResults {
+			isTruncated = true
+			return nil
+		}
+		responses = append(responses, davPropResponse(carddavContactResource(record, version), request.Prop.Names))
+		return nil
+	})
+	if err != nil {
+		writeDAVContactError(w, err)
+		return
+	}
+	if isTruncated {
+		// Tells the client there were more results than it asked for, see RFC 6352 section 8.6.1
+		responses = append(responses, davResponse{Href: carddavAddressBookPath, Status: http.StatusInsufficientStorage})
+	}
+	writeDAVMultistatus(w, responses)
+}
+
+// carddavContactForHref returns the contact with the given href, which can be a path or a
+// full URL. Returns contact.ErrNotFound if it's not the href of a contact.
+func carddavContactForHref(href string) (contact.Contact, error) {
+	parsedHref, err := url.Parse(href)
+	if err != nil {
+		return contact.Contact{}, contact.ErrNotFound
+	}
+	path := parsedHref.EscapedPath()
+	if !strings.HasPrefix(path, carddavAddressBookPath) {
+		return contact.Contact{}, contact.ErrNotFound
+	}
+	uid, ok := carddavUIDFromName(strings.TrimPrefix(path, carddavAddressBookPath))
+	if !ok {
+		return contact.Contact{}, contact.ErrNotFound
+	}
+	return contact.GetByUID(uid)
+}
+
+// carddavAddressDataVersion returns the vCard version asked for by a CARDDAV:address-data
+// property, or a blank version if it wasn't asked for. Returns false if the version or content
+// type isn't one we can return.
+//
+// The properties asked for within address-data are ignored, the whole vCard is always returned.
+func carddavAddressDataVersion(names []davPropName) (contactvcard.Version, bool) {
+	for _, name := range names {
+		if name.XMLName != (xml.Name{Space: carddavNamespace, Local: "address-data"}) {
+			continue
+		}
+		version := carddavVCardVersion
+		for _, attr := range name.Attrs {
+			switch attr.Name.Local {
+			case "content-type":
+				if attr.Value != "text/vcard" {
+					return "", false
+				}
+			case "version":
+				var err error
+				version, err = contactvcard.ParseVersion(attr.Value)
+				if err != nil {
+					return "", false
+				}
+			}
+		}
+		return version, true
+	}
+	return "", true
+}
+
+// matches returns true if the contact matches the filter. An empty filter matches every contact.
+func (filter carddavFilter) matches(record *contact.Contact) (bool, error) {
+	if len(filter.PropFilters) == 0 {
+		return true, nil
+	}
+	results := make([]bool, len(filter.PropFilters))
+	for i, propFilter := range filter.PropFilters {
+		isMatch, err := propFilter.matches(record)
+		if err != nil {
+			return false, err
+		}
+		results[i] = isMatch
+	}
+	return carddavTest(filter.Test, results), nil
+}
+
+// matches returns true if the contacts values for the property match the filter.
+func (filter carddavPropFilter) matches(record *contact.Contact) (bool, error) {
+	if len(filter.ParamFilters) > 0 {
+		return false, &carddavFilterError{Precondition: "supported-filter", Message: "Parameter filters are not supported"}
+	}
+	values := carddavPropertyValues(record, filter.Name)
+	if filter.IsNotDefined != nil {
+		return len(values) == 0, nil
+	}
+	if len(filter.TextMatches) == 0 {
+		return len(values) > 0, nil
+	}
+	results := make([]bool, len(filter.TextMatches))
+	for i, textMatch := range filter.TextMatches {
+		isMatch, err := textMatch.matches(values)
+		if err != nil {
+			return false, err
+		}
+		results[i] = isMatch
+	}
+	return carddavTest(filter.Test, results), nil
+}
+
+// matches returns true if any of the values match. An undefined property never matches,
+// even when the condition is negated.
+func (textMatch carddavTextMatch) matches(values []string) (bool, error) {
+	var fold func(s string) string
+	switch textMatch.Collation {
+	case "", "i;unicode-casemap":
+		fold = strings.ToLower
+	case "i;ascii-casemap":
+		fold = asciiToLower
+	case "i;octet":
+		fold = func(s string) string { return s }
+	default:
+		return false, &carddavFilterError{Precondition: "supported-collation", Message: "Unsupported collation, expected i;unicode-casemap, i;ascii-casemap or i;octet"}
+	}
+	var match func(value, s string) bool
+	switch textMatch.MatchType {
+	case "", "contains":
+		match = strings.Contains
+	case "equals":
+		match = func(value, s string) bool { return value == s }
+	case "starts-with":
+		match = strings.HasPrefix
+	case "ends-with":
+		match = strings.HasSuffix
+	default:
+		return false, &carddavFilterError{Precondition: "supported-filter", Message: "Unsupported match type, expected equals, contains, starts-with or ends-with"}
+	}
+	s := fold(textMatch.Value)
+	isNegated := textMatch.NegateCondition == "yes"
+	for _, value := range values {
+		if match(fold(value), s) != isNegated {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// carddavPropertyValues returns the values a contact has for a vCard property. These are the
+// same values we write to its vCard, so filters match what the client sees.
+func carddavPropertyValues(record *contact.Contact, name string) []string {
+	var values []string
+	switch strings.ToUpper(name) {
+	case "FN":
+		if record.FullName != "" {
+			values = append(values, record.FullName)
+		}
+	case "UID":
+		if record.UID != "" {
+			values = append(values, record.UID)
+		}
+	case "EMAIL":
+		for _, email := range record.Emails {
+			values = append(values, email.Address)
+		}
+	case "TEL":
+		for _, phoneNumber := range record.PhoneNumbers {
+			values = append(values, phoneNumber.Number)
+		}
+	}
+	return values
+}
+
+// carddavTest combines results with the "test" attribute of a filter, which is either
+// "anyof" (the default) or "allof".
+func carddavTest(test string, results []bool) bool {
+	if test == "allof" {
+		for _, result := range results {
+			if !result {
+				return false
+			}
+		}
+		return true
+	}
+	for _, result := range results {
+		if result {
+			return true
+		}
+	}
+	return false
+}
+
+// asciiToLower lower-cases only the ASCII letters, for the "i;ascii-casemap" collation.
+func asciiToLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,400 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+// maxContactFormRows is the most emails, or phone numbers, the contact form takes. It's
+// arbitrary, it's only there so that a single request can't make us do an unbounded amount
+// of work.
+const maxContactFormRows = 50
+
+// Actions of the buttons that add and remove rows of the contact form. The remove actions
+// are followed by the index of the row, ie. "RemovePhoneNumber-2".
+const (
+	contactFormActionAddEmail          = "AddEmail"
+	contactFormActionRemoveEmail       = "RemoveEmail-"
+	contactFormActionAddPhoneNumber    = "AddPhoneNumber"
+	contactFormActionRemovePhoneNumber = "RemovePhoneNumber-"
+)
+
+// contactFormEmail is a row of the contact form for one email address.
+type contactFormEmail struct {
+	// ID is 0 for emails that haven't been saved yet
+	ID      int64
+	Address string
+	Label   string
+	// Errors are the problems with this row, see setErrors
+	Errors []string
+}
+
+// contactFormPhoneNumber is a row of the contact form for one phone number.
+type contactFormPhoneNumber struct {
+	// ID is 0 for phone numbers that haven't been saved yet
+	ID        int64
+	Number    string
+	Extension string
+	Label     string
+	// Errors are the problems with this row, see setErrors
+	Errors []string
+}
+
+// contactForm holds the values of the form for adding or editing a contact, so that they
+// can be shown again with an error next to each field that has a problem.
+//
+// Emails and phone numbers are sent as one value per row for each of "EmailID",
+// "EmailAddress" and "EmailLabel", and "PhoneNumberID", "PhoneNumber", "PhoneNumberExtension"
+// and "PhoneNumberLabel". "PrimaryEmail" and "PrimaryPhoneNumber" are the index of the
+// primary row.
+type contactForm struct {
+	// ID and Version are 0 when adding a contact
+	ID      int64
+	Version int64
+
+	FullName string
+	// CountryCode is used for phone numbers that don't start with a "+"
+	CountryCode  string
+	Emails       []contactFormEmail
+	PhoneNumbers []contactFormPhoneNumber
+	// PrimaryEmail and PrimaryPhoneNumber are the index of the primary row, or -1 for none
+	PrimaryEmail       int
+	PrimaryPhoneNumber int
+
+	// FullNameError, EmailsError, PhoneNumbersError and CountryCodeError are shown next to
+	// those fields. Errors with a single email or phone number are shown with its row instead.
+	FullNameError     string
+	EmailsError       string
+	PhoneNumbersError string
+	CountryCodeError  string
+	// Error is shown at the top of the form, for problems that aren't with a single field
+	Error string
+
+	// Region is where the viewer is, it's what CountryCode defaults to
+	Region string
+	// CSRFToken must be in every form, see protectForm
+	CSRFToken string
+	// FormStartedAt must be in the add contact form, see preventSpam
+	FormStartedAt string
+}
+
+// newContactForm returns the empty form for adding a contact. It has a row for one email
+// and one phone number, and the email is the primary one, unless another is chosen.
+func newContactForm() contactForm {
+	return contactForm{
+		Emails:             []contactFormEmail{{}},
+		PhoneNumbers:       []contactFormPhoneNumber{{}},
+		PrimaryEmail:       0,
+		PrimaryPhoneNumber: -1,
+	}
+}
+
+// contactFormFromContact returns the form for editing the given contact. Phone numbers are
+// written the way they're shown to someone in the given region.
+func contactFormFromContact(record contact.Contact, region string) contactForm {
+	form := contactForm{
+		ID:                 record.ID,
+		Version:            record.Version,
+		FullName:           record.FullName,
+		PrimaryEmail:       -1,
+		PrimaryPhoneNumber: -1,
+	}
+	for i, email := range record.Emails {
+		form.Emails = append(form.Emails, contactFormEmail{
+			ID:      email.ID,
+			Address: email.Address,
+			Label:   email.Label,
+		})
+		if email.IsPrimary {
+			form.PrimaryEmail = i
+		}
+	}
+	for i, phoneNumber := range record.PhoneNumbers {
+		extension := phoneNumber.Extension
+		// The extension has its own field
+		phoneNumber.Extension = ""
+		form.PhoneNumbers = append(form.PhoneNumbers, contactFormPhoneNumber{
+			ID:        phoneNumber.ID,
+			Number:    phoneNumber.Format(region),
+			Extension: extension,
+			Label:     phoneNumber.Label,
+		})
+		if phoneNumber.IsPrimary {
+			form.PrimaryPhoneNumber = i
+		}
+	}
+	return form
+}
+
+// parseContactForm reads the contact form from a request that's already had ParseForm called.
+// ID and Version aren't read, as they aren't always sent by the form.
+//
+// If there are more than maxContactFormRows emails or phone numbers, the rest are dropped
+// and the Error is set.
+func parseContactForm(r *http.Request) contactForm {
+	form := contactForm{
+		FullName:    r.PostFormValue("FullName"),
+		CountryCode: strings.TrimSpace(r.PostFormValue("CountryCode")),
+	}
+	emailIDs := r.PostForm["EmailID"]
+	emailAddresses := r.PostForm["EmailAddress"]
+	emailLabels := r.PostForm["EmailLabel"]
+	for i := 0; i < maxInt(len(emailIDs), len(emailAddresses), len(emailLabels)); i++ {
+		if i == maxContactFormRows {
+			form.Error = "Too many emails given, a contact can have at most " + strconv.Itoa(maxContactFormRows) + "."
+			break
+		}
+		id, _ := parseAPIID(valueAt(emailIDs, i))
+		form.Emails = append(form.Emails, contactFormEmail{
+			ID:      id,
+			Address: valueAt(emailAddresses, i),
+			Label:   valueAt(emailLabels, i),
+		})
+	}
+	phoneNumberIDs := r.PostForm["PhoneNumberID"]
+	phoneNumbers := r.PostForm["PhoneNumber"]
+	phoneNumberExtensions := r.PostForm["PhoneNumberExtension"]
+	phoneNumberLabels := r.PostForm["PhoneNumberLabel"]
+	for i := 0; i < maxInt(len(phoneNumberIDs), len(phoneNumbers), len(phoneNumberExtensions), len(phoneNumberLabels)); i++ {
+		if i == maxContactFormRows {
+			form.Error = "Too many phone numbers given, a contact can have at most " + strconv.Itoa(maxContactFormRows) + "."
+			break
+		}
+		id, _ := parseAPIID(valueAt(phoneNumberIDs, i))
+		form.PhoneNumbers = append(form.PhoneNumbers, contactFormPhoneNumber{
+			ID:        id,
+			Number:    valueAt(phoneNumbers, i),
+			Extension: valueAt(phoneNumberExtensions, i),
+			Label:     valueAt(phoneNumberLabels, i),
+		})
+	}
+	form.PrimaryEmail = parseRowIndex(r.PostFormValue("PrimaryEmail"), len(form.Emails))
+	form.PrimaryPhoneNumber = parseRowIndex(r.PostFormValue("PrimaryPhoneNumber"), len(form.PhoneNumbers))
+	return form
+}
+
+// applyAction adds or removes a row of the form, as asked for by the "Action" the form was
+// submitted with. It returns false if the action isn't one of ours, which is how the form is
+// submitted to be saved.
+func (form *contactForm) applyAction(action string) bool {
+	switch {
+	case action == contactFormActionAddEmail:
+		if len(form.Emails) < maxContactFormRows {
+			form.Emails = append(form.Emails, contactFormEmail{})
+		}
+	case action == contactFormActionAddPhoneNumber:
+		if len(form.PhoneNumbers) < maxContactFormRows {
+			form.PhoneNumbers = append(form.PhoneNumbers, contactFormPhoneNumber{})
+		}
+	case strings.HasPrefix(action, contactFormActionRemoveEmail):
+		i, err := strconv.Atoi(strings.TrimPrefix(action, contactFormActionRemoveEmail))
+		if err == nil && i >= 0 && i < len(form.Emails) {
+			form.Emails = append(form.Emails[:i], form.Emails[i+1:]...)
+			form.PrimaryEmail = primaryAfterRemoving(form.PrimaryEmail, i)
+		}
+	case strings.HasPrefix(action, contactFormActionRemovePhoneNumber):
+		i, err := strconv.Atoi(strings.TrimPrefix(action, contactFormActionRemovePhoneNumber))
+		if err == nil && i >= 0 && i < len(form.PhoneNumbers) {
+			form.PhoneNumbers = append(form.PhoneNumbers[:i], form.PhoneNumbers[i+1:]...)
+			form.PrimaryPhoneNumber = primaryAfterRemoving(form.PrimaryPhoneNumber, i)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// removeBlankRows drops the emails and phone numbers that weren't filled in, so that a
+// spare row left empty isn't an error.
+func (form *contactForm) removeBlankRows() {
+	for i := len(form.Emails) - 1; i >= 0; i-- {
+		if strings.TrimSpace(form.Emails[i].Address) == "" {
+			form.Emails = append(form.Emails[:i], form.Emails[i+1:]...)
+			form.PrimaryEmail = primaryAfterRemoving(form.PrimaryEmail, i)
+		}
+	}
+	for i := len(form.PhoneNumbers) - 1; i >= 0; i-- {
+		if strings.TrimSpace(form.PhoneNumbers[i].Number) == "" {
+			form.PhoneNumbers = append(form.PhoneNumbers[:i], form.PhoneNumbers[i+1:]...)
+			form.PrimaryPhoneNumber = primaryAfterRemoving(form.PrimaryPhoneNumber, i)
+		}
+	}
+}
+
+// toContact returns the contact the form describes. Each email and phone number is in the
+// same position as its row.
+func (form contactForm) toContact() contact.Contact {
+	record := contact.Contact{
+		ID:       form.ID,
+		Version:  form.Version,
+		FullName: form.FullName,
+	}
+	for i, row := range form.Emails {
+		record.Emails = append(record.Emails, contact.EmailAddress{
+			ID:        row.ID,
+			Address:   row.Address,
+			Label:     row.Label,
+			IsPrimary: i == form.PrimaryEmail,
+		})
+	}
+	for i, row := range form.PhoneNumbers {
+		record.PhoneNumbers = append(record.PhoneNumbers, contact.PhoneNumber{
+			ID:          row.ID,
+			Number:      row.Number,
+			Extension:   row.Extension,
+			Label:       row.Label,
+			CountryCode: form.CountryCode,
+			IsPrimary:   i == form.PrimaryPhoneNumber,
+		})
+	}
+	return record
+}
+
+// setErrors puts each problem from saving the contact next to the field it's about, see
+// validate.FieldError. The emails and phone numbers must be in the same order as they were
+// given to be saved, see toContact.
+func (form *contactForm) setErrors(err *validate.ValidationError) {
+	var otherErrors []string
+	for _, fieldErr := range err.Fields() {
+		switch {
+		case fieldErr.Field == "fullName":
+			form.FullNameError = fieldErr.Message
+		case fieldErr.Field == "emails":
+			form.EmailsError = fieldErr.Message
+		case fieldErr.Field == "phoneNumbers":
+			form.PhoneNumbersError = fieldErr.Message
+		default:
+			if i, ok := parseFieldIndex(fieldErr.Field, "emails"); ok && i < len(form.Emails) {
+				form.Emails[i].Errors = append(form.Emails[i].Errors, fieldErr.Message)
+				continue
+			}
+			if i, ok := parseFieldIndex(fieldErr.Field, "phoneNumbers"); ok && i < len(form.PhoneNumbers) {
+				if strings.HasSuffix(fieldErr.Field, ".countryCode") {
+					// Every phone number uses the same country
+					form.CountryCodeError = fieldErr.Message
+					continue
+				}
+				form.PhoneNumbers[i].Errors = append(form.PhoneNumbers[i].Errors, fieldErr.Message)
+				continue
+			}
+			otherErrors = append(otherErrors, fieldErr.Message)
+		}
+	}
+	if len(otherErrors) > 0 {
+		form.Error = strings.Join(otherErrors, " ")
+	}
+}
+
+// parseFieldIndex returns the index from a field like "phoneNumbers[2].number", given the
+// name of the list, ie. "phoneNumbers". Returns false if the field isn't in that list.
+func parseFieldIndex(field string, list string) (int, bool) {
+	if !strings.HasPrefix(field, list+"[") {
+		return 0, false
+	}
+	field = strings.TrimPrefix(field, list+"[")
+	end := strings.IndexByte(field, ']')
+	if end == -1 {
+		return 0, false
+	}
+	i, err := strconv.Atoi(field[:end])
+	if err != nil || i < 0 {
+		return 0, false
+	}
+	return i, true
+}
+
+// IsNew is true if the form is for adding a contact, rather than editing one.
+func (form contactForm) IsNew() bool {
+	return form.ID == 0
+}
+
+// SaveURL is where the form is posted to save it.
+func (form contactForm) SaveURL() string {
+	if form.IsNew() {
+		return postContactPath
+	}
+	return contactPagePath(form.ID) + "/edit"
+}
+
+// RowsURL is where the buttons that add and remove rows post the form. It's shown again with
+// the row changed, without saving anything.
+func (form contactForm) RowsURL() string {
+	if form.IsNew() {
+		return newContactPath
+	}
+	return contactPagePath(form.ID) + "/edit"
+}
+
+// withPageFields sets the fields the template needs that don't come from what was submitted.
+func (form contactForm) withPageFields(w http.ResponseWriter, r *http.Request) contactForm {
+	// Always have a row to fill in
+	if len(form.Emails) == 0 {
+		form.Emails = append(form.Emails, contactFormEmail{})
+	}
+	if len(form.PhoneNumbers) == 0 {
+		form.PhoneNumbers = append(form.PhoneNumbers, contactFormPhoneNumber{})
+	}
+	form.Region = contact.DefaultRegion()
+	form.CSRFToken = csrfToken(w, r)
+	if form.IsNew() {
+		// Keep when the form was first loaded, so that adding a row or fixing a mistake doesn't
+		// restart the wait before it can be submitted
+		if _, ok := parseFormStartedAt(r.PostFormValue(formStartedAtField)); ok {
+			form.FormStartedAt = r.PostFormValue(formStartedAtField)
+		} else {
+			form.FormStartedAt = formStartedAt(time.Now())
+		}
+	}
+	return form
+}
+
+// parseRowIndex returns the row index given, or -1 if it isn't one of the rows.
+func parseRowIndex(s string, rows int) int {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i >= rows {
+		return -1
+	}
+	return i
+}
+
+// primaryAfterRemoving returns the index of the primary row after the row at removed is
+// removed.
+func primaryAfterRemoving(primary int, removed int) int {
+	switch {
+	case primary == removed:
+		return -1
+	case primary > removed:
+		return primary - 1
+	}
+	return primary
+}
+
+// valueAt returns values[i], or "" if there isn't one.
+func valueAt(values []string, i int) string {
+	if i < len(values) {
+		return values[i]
+	}
+	return ""
+}
+
+func maxInt(values ...int) int {
+	max := 0
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+	return max
+}
+
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
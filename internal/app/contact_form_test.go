@@ -0,0 +1,53 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestContactFormRows(t *testing.T) {
+	form := contactForm{
+		Emails:             []contactFormEmail{{Address: "a@test.com"}, {Address: " "}, {Address: "c@test.com"}},
+		PhoneNumbers:       []contactFormPhoneNumber{{Number: "1"}, {Number: "2"}, {Number: "3"}},
+		PrimaryEmail:       2,
+		PrimaryPhoneNumber: 1,
+	}
+	type TestData struct {
+		Action string
+		// Handled is false for actions that save the form
+		Handled            bool
+		Emails             int
+		PhoneNumbers       int
+		PrimaryEmail       int
+		PrimaryPhoneNumber int
+	}
+	testDataList := []TestData{
+		{Action: "", Handled: false, Emails: 3, PhoneNumbers: 3, PrimaryEmail: 2, PrimaryPhoneNumber: 1},
+		{Action: "AddEmail", Handled: true, Emails: 4, PhoneNumbers: 3, PrimaryEmail: 2, PrimaryPhoneNumber: 1},
+		{Action: "RemovePhoneNumber-0", Handled: true, Emails: 4, PhoneNumbers: 2, PrimaryEmail: 2, PrimaryPhoneNumber: 0},
+		{Action: "RemovePhoneNumber-0", Handled: true, Emails: 4, PhoneNumbers: 1, PrimaryEmail: 2, PrimaryPhoneNumber: -1},
+		{Action: "RemovePhoneNumber-5", Handled: true, Emails: 4, PhoneNumbers: 1, PrimaryEmail: 2, PrimaryPhoneNumber: -1},
+		{Action: "RemoveEmail-x", Handled: true, Emails: 4, PhoneNumbers: 1, PrimaryEmail: 2, PrimaryPhoneNumber: -1},
+		{Action: "AddPhoneNumber", Handled: true, Emails: 4, PhoneNumbers: 2, PrimaryEmail: 2, PrimaryPhoneNumber: -1},
+	}
+	for _, testData := range testDataList {
+		if handled := form.applyAction(testData.Action); handled != testData.Handled {
+			t.Fatalf("%q: expected handled to be %v", testData.Action, testData.Handled)
+		}
+		if len(form.Emails) != testData.Emails ||
+			len(form.PhoneNumbers) != testData.PhoneNumbers ||
+			form.PrimaryEmail != testData.PrimaryEmail ||
+			form.PrimaryPhoneNumber != testData.PrimaryPhoneNumber {
+			t.Fatalf("%q: expected %+v but got %+v", testData.Action, testData, form)
+		}
+	}
+
+	// The blank email and the added rows are dropped, and the primary email moves with its row
+	form.removeBlankRows()
+	if len(form.Emails) != 2 || len(form.PhoneNumbers) != 1 || form.PrimaryEmail != 1 {
+		t.Fatalf("expected blank rows to be removed but got %+v", form)
+	}
+	record := form.toContact()
+	if record.Emails[0].IsPrimary || !record.Emails[1].IsPrimary || record.Emails[1].Address != "c@test.com" {
+		t.Fatalf("expected the last email to be primary but got %+v", record.Emails)
+	}
+}
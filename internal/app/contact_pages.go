@@ -0,0 +1,264 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/user"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+const (
+	contactsPath   = "/contacts"
+	newContactPath = contactsPath + "/new"
+	// postContactPath saves the add contact form, see handlePostContact
+	postContactPath = "/postContact"
+)
+
+// contactPagePath is the path of the page showing the contact with the given ID.
+func contactPagePath(id int64) string {
+	return contactsPath + "/" + strconv.FormatInt(id, 10)
+}
+
+// handleContactPages routes the pages under "/contacts/":
+//
+// - /contacts/new: the form for adding a contact
+// - /contacts/{id}: every field of a contact
+// - /contacts/{id}/edit: the form for editing a contact
+// - /contacts/{id}/delete: moves a contact to the trash
+func handleContactPages(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, contactsPath+"/"), "/")
+	if len(parts) == 1 && parts[0] == "new" {
+		if !requirePermission(w, r, user.PermissionCreateContacts) {
+			return
+		}
+		handleNewContact(w, r)
+		return
+	}
+	id, ok := parseAPIID(parts[0])
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		handleContact(w, r, id)
+	case len(parts) == 2 && parts[1] == "edit":
+		if !requirePermission(w, r, user.PermissionEditContacts) {
+			return
+		}
+		handleEditContact(w, r, id)
+	case len(parts) == 2 && parts[1] == "delete":
+		if !requirePermission(w, r, user.PermissionDeleteContacts) {
+			return
+		}
+		handleDeleteContact(w, r, id)
+	default:
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+	}
+}
+
+// handleContact shows every field of a contact, including the details of each phone number
+// that don't fit on the home page.
+func handleContact(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	record, err := contact.Get(id)
+	if err != nil {
+		writeContactPageError(w, r, err)
+		return
+	}
+	writeContactPage(w, r, http.StatusOK, record, "")
+}
+
+// handleNewContact shows the form for adding a contact. The form is saved by posting it to
+// handlePostContact, but the buttons that add and remove rows post it here, so that it's
+// shown again with the row changed.
+func handleNewContact(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeContactFormPage(w, r, http.StatusOK, newContactForm())
+	case http.MethodPost:
+		r.ParseForm()
+		form := parseContactForm(r)
+		form.applyAction(r.PostFormValue("Action"))
+		writeContactFormPage(w, r, http.StatusOK, form)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleEditContact shows the form for editing a contact and saves it. The buttons that add
+// and remove rows post the form here too, it's shown again with the row changed rather than
+// being saved.
+//
+// The form has the Version of the contact it was loaded with, so that saving it fails rather
+// than overwriting what someone else has changed since.
+func handleEditContact(w http.ResponseWriter, r *http.Request, id int64) {
+	switch r.Method {
+	case http.MethodGet:
+		record, err := contact.Get(id)
+		if err != nil {
+			writeContactPageError(w, r, err)
+			return
+		}
+		writeContactFormPage(w, r, http.StatusOK, contactFormFromContact(record, contact.DefaultRegion()))
+	case http.MethodPost:
+		r.ParseForm()
+		version, ok := parseVersionField(w, r)
+		if !ok {
+			return
+		}
+		form := parseContactForm(r)
+		form.ID = id
+		form.Version = version
+		if form.applyAction(r.PostFormValue("Action")) {
+			writeContactFormPage(w, r, http.StatusOK, form)
+			return
+		}
+		if form.Error != "" {
+			setErrorCode(w, codeTooManyRows)
+			writeContactFormPage(w, r, http.StatusBadRequest, form)
+			return
+		}
+		form.removeBlankRows()
+		record := form.toContact()
+		switch err := contact.Update(requestActor(r), &record); err {
+		case nil:
+			http.Redirect(w, r, contactPagePath(id), http.StatusSeeOther)
+		case contact.ErrVersionConflict, contact.ErrEmailNotFound, contact.ErrPhoneNumberNotFound:
+			// Someone else has changed it since the form was loaded, so show what it is now
+			latest, getErr := contact.Get(id)
+			if getErr != nil {
+				writeContactPageError(w, r, getErr)
+				return
+			}
+			form = contactFormFromContact(latest, contact.DefaultRegion())
+			form.Error = contact.ErrVersionConflict.Error()
+			setErrorCode(w, contact.ErrVersionConflict.Code())
+			writeContactFormPage(w, r, http.StatusConflict, form)
+		default:
+			if validationErr, ok := err.(*validate.ValidationError); ok {
+				form.setErrors(validationErr)
+				setErrorCode(w, validationErr.Code())
+				writeContactFormPage(w, r, http.StatusBadRequest, form)
+				return
+			}
+			writeContactPageError(w, r, err)
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleDeleteContact moves the contact to the trash, as long as it hasn't changed since the
+// page the form was posted from was loaded.
+func handleDeleteContact(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	r.ParseForm()
+	version, ok := parseVersionField(w, r)
+	if !ok {
+		return
+	}
+	switch err := contact.DeleteIfVersion(requestActor(r), id, version); err {
+	case nil:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	case contact.ErrVersionConflict:
+		// Show what's changed, so they can decide if they still want to delete it
+		latest, getErr := contact.Get(id)
+		if getErr != nil {
+			writeContactPageError(w, r, getErr)
+			return
+		}
+		setErrorCode(w, errorCode(err))
+		writeContactPage(w, r, http.StatusConflict, latest, err.Error())
+	default:
+		writeContactPageError(w, r, err)
+	}
+}
+
+// parseVersionField reads the "Version" field of a form that changes a contact. If it's
+// missing or invalid, an error response is written and false is returned.
+func parseVersionField(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	version, ok := parseAPIID(r.PostFormValue("Version"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid Version provided. Reload the page and try again.")
+		return 0, false
+	}
+	return version, true
+}
+
+// writeContactPageError responds to a failure getting or changing a contact that isn't about
+// what was entered in the form.
+func writeContactPageError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == contact.ErrNotFound {
+		writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+		return
+	}
+	log.Print(err)
+	writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred with the contact")
+}
+
+// writeContactPage renders every field of the contact, with an error if deleting it failed.
+func writeContactPage(w http.ResponseWriter, r *http.Request, statusCode int, record contact.Contact, errorMessage string) {
+	type TemplateData struct {
+		Contact contact.Contact
+		// Region is where the viewer is, phone numbers are formatted for it
+		Region string
+		// Username of the signed in user
+		Username string
+		// What the signed in user can do, so that the page only shows what they can use
+		CanEdit         bool
+		CanDelete       bool
+		CanViewAuditLog bool
+		Error           string
+		CSRFToken       string
+	}
+	templateData := TemplateData{
+		Contact:   record,
+		Region:    contact.DefaultRegion(),
+		Error:     errorMessage,
+		CSRFToken: csrfToken(w, r),
+	}
+	if signedInUser, ok := currentUser(r); ok {
+		templateData.Username = signedInUser.Username
+		templateData.CanEdit = signedInUser.Can(user.PermissionEditContacts)
+		templateData.CanDelete = signedInUser.Can(user.PermissionDeleteContacts)
+		templateData.CanViewAuditLog = signedInUser.Can(user.PermissionViewAuditLog)
+	}
+	w.WriteHeader(statusCode)
+	if err := templates.ExecuteTemplate(w, "contact.html", templateData); err != nil {
+		log.Print(err)
+	}
+}
+
+// writeContactFormPage renders the form for adding or editing a contact.
+func writeContactFormPage(w http.ResponseWriter, r *http.Request, statusCode int, form contactForm) {
+	type TemplateData struct {
+		Form contactForm
+		// Username of the signed in user
+		Username string
+	}
+	templateData := TemplateData{
+		Form: form.withPageFields(w, r),
+	}
+	if signedInUser, ok := currentUser(r); ok {
+		templateData.Username = signedInUser.Username
+	}
+	w.WriteHeader(statusCode)
+	if err := templates.ExecuteTemplate(w, "contactForm.html", templateData); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/user"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+// errorCodeHeader is the response header with the code of what went wrong, so that clients
+// can tell errors apart without matching the message, which may change. JSON error bodies have
+// the same code as "error.code".
+const errorCodeHeader = "X-Error-Code"
+
+// Codes of errors that aren't a *validate.ValidationError, which has its own. The same as those,
+// they must never change and must be listed in "docs/en/API.md#error-codes".
+const (
+	codeInternal            = "internal"
+	codeNotFound            = "not_found"
+	codeMethodNotAllowed    = "method_not_allowed"
+	codeInvalidRequest      = "request.invalid"
+	codeInvalidJSON         = "request.invalid_json"
+	codeInvalidXML          = "request.invalid_xml"
+	codeIfMatchRequired     = "request.if_match_required"
+	codeNotSignedIn         = "auth.not_signed_in"
+	codeInvalidCredentials  = "auth.invalid_credentials"
+	codeInvalidAPIToken     = "auth.invalid_token"
+	codeForbidden           = "auth.forbidden"
+	codeContactNotFound     = "contact.not_found"
+	codePhoneNumberNotFound = "contact.phone.not_found"
+	codeEmailNotFound       = "contact.email.not_found"
+	codeDuplicate           = "contact.duplicate"
+	codeTooManyRows         = "contact.form.too_many_rows"
+	codeUserNotFound        = "user.not_found"
+	codeAPITokenNotFound    = "api_token.not_found"
+	codeInvalidImportFile   = "import.invalid_file"
+	codeInvalidSubmission   = "spam.invalid_submission"
+	codeFormExpired         = "spam.form_expired"
+	codeRateLimited         = "spam.rate_limited"
+)
+
+// errorCode returns the code to send to the client for err. Errors we don't know about are
+// codeInternal, as they shouldn't be shown to the client either.
+func errorCode(err error) string {
+	switch err {
+	case contact.ErrNotFound:
+		return codeContactNotFound
+	case contact.ErrPhoneNumberNotFound:
+		return codePhoneNumberNotFound
+	case contact.ErrEmailNotFound:
+		return codeEmailNotFound
+	case user.ErrNotFound:
+		return codeUserNotFound
+	case user.ErrAPITokenNotFound:
+		return codeAPITokenNotFound
+	}
+	switch err := err.(type) {
+	case *validate.ValidationError:
+		return err.Code()
+	case *contact.DuplicateError:
+		return codeDuplicate
+	}
+	return codeInternal
+}
+
+// setErrorCode sets the code of the error for pages that show the error themselves, rather
+// than with writeError or writeJSONError. It must be called before the status code is written.
+func setErrorCode(w http.ResponseWriter, code string) {
+	w.Header().Set(errorCodeHeader, code)
+}
+
+// writeError is the same as http.Error, but with the code of the error, see errorCodeHeader.
+func writeError(w http.ResponseWriter, statusCode int, code string, message string) {
+	setErrorCode(w, code)
+	http.Error(w, message, statusCode)
+}
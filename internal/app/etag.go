@@ -0,0 +1,68 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+// contactETag is the ETag of a contact, for both the API and CardDAV. The ID is included as
+// well as the version so that a contact deleted and then created again with the same UID
+// doesn't reuse an old ETag.
+func contactETag(record contact.Contact) string {
+	return `"` + strconv.FormatInt(record.ID, 10) + "-" + strconv.FormatInt(record.Version, 10) + `"`
+}
+
+// parseContactETag is the inverse of contactETag. It returns the version from the ETag, which
+// must be for the contact with the given ID. Weak ETags are treated the same as strong ones.
+func parseContactETag(etag string, id int64) (int64, bool) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	parts := strings.Split(etag[1:len(etag)-1], "-")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	etagID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || etagID != id {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// apiIfMatchVersion reads the version of the contact that an API client last saw from the
+// If-Match header, so that changing it fails rather than overwriting changes the client hasn't
+// seen. "*" is returned as 0, which overwrites any version.
+//
+// The header is required. If it's missing or isn't an ETag of the contact, an error response
+// is written and false is returned.
+func apiIfMatchVersion(w http.ResponseWriter, r *http.Request, id int64) (int64, bool) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" {
+		writeJSONError(w, http.StatusPreconditionRequired, codeIfMatchRequired, "If-Match header is required. Set it to the ETag from getting the contact, or \"*\" to overwrite any changes.")
+		return 0, false
+	}
+	if ifMatch == "*" {
+		return 0, true
+	}
+	version, ok := parseContactETag(ifMatch, id)
+	if !ok {
+		writeJSONError(w, http.StatusPreconditionFailed, contact.ErrVersionConflict.Code(), contact.ErrVersionConflict.Error())
+		return 0, false
+	}
+	return version, true
+}
+
+// setPhoneNumberETag sets the ETag of the contact after one of its phone numbers was changed,
+// so that a client can change another without getting the contact again. version is the one
+// the store returned for the contact after the change.
+func setPhoneNumberETag(w http.ResponseWriter, contactID int64, version int64) {
+	w.Header().Set("ETag", contactETag(contact.Contact{ID: contactID, Version: version}))
+}
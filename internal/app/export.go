@@ -0,0 +1,185 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/contactcsv"
+	"github.com/silbinarywolf/contact-site/internal/contactvcard"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+const exportPath = "/export/"
+
+// exportFormat is a file format that contacts can be exported as.
+type exportFormat struct {
+	// Name is what the format is called by the --export flag and is the file extension
+	// used by the export endpoint, ie. "/export/contacts.csv"
+	Name        string
+	ContentType string
+}
+
+var (
+	exportFormatCSV       = exportFormat{Name: "csv", ContentType: "text/csv; charset=utf-8"}
+	exportFormatJSONLines = exportFormat{Name: "jsonl", ContentType: "application/x-ndjson; charset=utf-8"}
+	exportFormatVCard     = exportFormat{Name: "vcf", ContentType: "text/vcard; charset=utf-8"}
+
+	exportFormats = []exportFormat{
+		exportFormatCSV,
+		exportFormatJSONLines,
+		exportFormatVCard,
+	}
+)
+
+var (
+	errUnknownExportFormat = validate.NewError("export.format.unknown", "Unknown export format. Expected \"csv\", \"jsonl\" or \"vcf\".")
+)
+
+// contactWriter writes contacts in an export format. Writes may be buffered, so Flush must
+// be called once every contact has been written.
+type contactWriter interface {
+	Write(record contact.Contact) error
+	Flush() error
+}
+
+// jsonLinesWriter writes contacts as JSON lines, one JSON object per line.
+type jsonLinesWriter struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newJSONLinesWriter(w io.Writer) *jsonLinesWriter {
+	writer := bufio.NewWriter(w)
+	return &jsonLinesWriter{
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+	}
+}
+
+func (w *jsonLinesWriter) Write(record contact.Contact) error {
+	// Encode adds the trailing newline
+	return w.encoder.Encode(record)
+}
+
+func (w *jsonLinesWriter) Flush() error {
+	return w.writer.Flush()
+}
+
+// findExportFormat returns the export format with the given name.
+func findExportFormat(name string) (exportFormat, error) {
+	for _, format := range exportFormats {
+		if format.Name == name {
+			return format, nil
+		}
+	}
+	return exportFormat{}, errUnknownExportFormat
+}
+
+// newContactWriter returns a writer for the format. The vCard version is only used by vCards,
+// and defaults to 4.0 if blank.
+func newContactWriter(w io.Writer, format exportFormat, vCardVersion string) (contactWriter, error) {
+	switch format {
+	case exportFormatCSV:
+		return contactcsv.NewWriter(w), nil
+	case exportFormatJSONLines:
+		return newJSONLinesWriter(w), nil
+	case exportFormatVCard:
+		version := contactvcard.Version4
+		if vCardVersion != "" {
+			var err error
+			version, err = contactvcard.ParseVersion(vCardVersion)
+			if err != nil {
+				return nil, validate.NewError("export.version.invalid", "Invalid vCard version provided. Expected \"3.0\" or \"4.0\".")
+			}
+		}
+		return contactvcard.NewWriter(w, version), nil
+	}
+	return nil, errUnknownExportFormat
+}
+
+// exportContacts writes every contact that matches the options, a page at a time.
+func exportContacts(writer contactWriter, options contact.ListOptions) error {
+	if err := contact.ForEach(options, writer.Write); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// exportURL builds a link to export the contacts matching the options, ie. the ones currently
+// being shown, as the given format.
+func exportURL(options contact.ListOptions, format exportFormat) string {
+	// Exports always have every matching contact, not just the current page
+	options.Limit = 0
+	options.Offset = 0
+	return listOptionsURL(exportPath+"contacts."+format.Name, options)
+}
+
+// handleExport handles "/export/contacts.{format}", where format is "csv", "jsonl" or "vcf".
+//
+// The contacts can be filtered and sorted with the same query parameters as listing contacts,
+// and "version" can be given to pick the vCard version.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	fileName := strings.TrimPrefix(r.URL.Path, exportPath)
+	if !strings.HasPrefix(fileName, "contacts.") {
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+		return
+	}
+	format, err := findExportFormat(strings.TrimPrefix(fileName, "contacts."))
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+		return
+	}
+	query := r.URL.Query()
+	options, err := parseListOptions(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorCode(err), err.Error())
+		return
+	}
+	writer, err := newContactWriter(w, format, query.Get("version"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorCode(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
+	if err := exportContacts(writer, options); err != nil {
+		// Headers and some contacts may have already been sent at this point, so all we can
+		// do is log it. The client will see a truncated file.
+		log.Printf("Failed to export contacts: %v", err)
+	}
+}
+
+// mustExport handles the --export flag, writing the contacts to stdout.
+func mustExport(formatName string, vCardVersion string, filter string) {
+	format, err := findExportFormat(formatName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	query, err := url.ParseQuery(filter)
+	if err != nil {
+		log.Fatalf("Invalid --export-filter: %s", err)
+	}
+	options, err := parseListOptions(query)
+	if err != nil {
+		log.Fatalf("Invalid --export-filter: %s", err)
+	}
+	writer, err := newContactWriter(os.Stdout, format, vCardVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := exportContacts(writer, options); err != nil {
+		log.Fatal(err)
+	}
+}
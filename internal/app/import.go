@@ -0,0 +1,109 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/silbinarywolf/contact-site/internal/config"
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/contactcsv"
+	"github.com/silbinarywolf/contact-site/internal/contactvcard"
+)
+
+// Formats that contacts can be imported from
+const (
+	importFormatCSV   = "csv"
+	importFormatVCard = "vcf"
+)
+
+// readImportFile reads the records to import from a file of the given format. The error is
+// suitable to show to the user.
+func readImportFile(r io.Reader, format string) ([]contact.ImportRecord, error) {
+	switch format {
+	case importFormatCSV, "":
+		records, err := contactcsv.Read(r)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV: %s", err)
+		}
+		return records, nil
+	case importFormatVCard:
+		records, err := contactvcard.Read(r)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid vCard: %s", err)
+		}
+		return records, nil
+	}
+	return nil, fmt.Errorf("Unknown import format %q. Expected \"%s\" or \"%s\".", format, importFormatCSV, importFormatVCard)
+}
+
+// importFormatForFileName returns the format of a file from its extension, or blank if it's
+// not known.
+func importFormatForFileName(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv":
+		return importFormatCSV
+	case ".vcf", ".vcard":
+		return importFormatVCard
+	}
+	return ""
+}
+
+// importFormatForContentType returns the format of a file from its MIME type, or blank if
+// it's not known.
+func importFormatForContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return importFormatCSV
+	case "text/vcard", "text/x-vcard", "text/directory":
+		return importFormatVCard
+	}
+	return ""
+}
+
+// mustImport handles the --import flag. Prints what happened to each row and returns false
+// if any of them failed. Files ending in ".vcf" or ".vcard" are read as vCards, anything else
+// as CSV.
+func mustImport(path string) bool {
+	if !hasDatabase() && !flagImportDryRun {
+		log.Fatalf("Cannot import when using the \"%s\" database driver, as the contacts would be lost on exit. Use --import-dry-run to only check the file.", config.DatabaseDriverMemory)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	records, err := readImportFile(file, importFormatForFileName(path))
+	if err != nil {
+		log.Fatalf("%s: %s", path, err)
+	}
+	report, err := contact.Import(contact.SystemActor, records, contact.ImportOptions{
+		DryRun:          flagImportDryRun,
+		AllOrNothing:    flagImportAllOrNothing,
+		AllowDuplicates: flagImportAllowDuplicates,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROW\tSTATUS\tNAME\tERROR")
+	for _, result := range report.Results {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", result.Row, result.Status, result.FullName, result.Error)
+	}
+	w.Flush()
+	switch {
+	case report.DryRun:
+		log.Printf("Dry run, %d of %d row(s) are valid.", len(report.Results)-report.Failed, len(report.Results))
+	case report.AllOrNothing && report.Failed > 0:
+		log.Printf("Nothing imported, %d of %d row(s) failed.", report.Failed, len(report.Results))
+	default:
+		log.Printf("Imported %d of %d row(s).", report.Inserted, len(report.Results))
+	}
+	return report.Failed == 0
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+var (
+	errInvalidLimit  = validate.NewError("request.limit.invalid", "Invalid limit provided. Must be a positive number.")
+	errInvalidOffset = validate.NewError("request.offset.invalid", "Invalid offset provided. Must be a positive number.")
+)
+
+// parseListOptions will read the query parameters used for listing contacts.
+// This is shared between the home page and the JSON API so they behave the same.
+//
+// - limit: maximum contacts per page
+// - offset: amount of contacts to skip
+// - sort: "id", "name", "email" or "relevance", prefix with "-" to sort descending. ie. "-name"
+// - q: search
+// - fullName, email, phoneNumber: filters
+func parseListOptions(query url.Values) (contact.ListOptions, error) {
+	var options contact.ListOptions
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return contact.ListOptions{}, errInvalidLimit
+		}
+		options.Limit = limit
+	}
+	if s := query.Get("offset"); s != "" {
+		offset, err := strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return contact.ListOptions{}, errInvalidOffset
+		}
+		options.Offset = offset
+	}
+	if s := query.Get("sort"); s != "" {
+		if strings.HasPrefix(s, "-") {
+			options.SortDescending = true
+			s = s[1:]
+		}
+		options.SortBy = contact.SortField(s)
+		if !contact.IsValidSortField(options.SortBy) {
+			return contact.ListOptions{}, contact.ErrInvalidSortField
+		}
+	}
+	options.Search = strings.TrimSpace(query.Get("q"))
+	options.FullName = strings.TrimSpace(query.Get("fullName"))
+	options.Email = strings.TrimSpace(query.Get("email"))
+	options.PhoneNumber = strings.TrimSpace(query.Get("phoneNumber"))
+	return options, nil
+}
+
+// listOptionsQuery is the inverse of parseListOptions, it turns the options back into
+// query parameters so we can build next/previous/sort links.
+func listOptionsQuery(options contact.ListOptions) url.Values {
+	query := url.Values{}
+	if options.Limit != 0 && options.Limit != contact.DefaultListLimit {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.Offset != 0 {
+		query.Set("offset", strconv.Itoa(options.Offset))
+	}
+	if options.SortBy != "" && (options.SortBy != options.DefaultSortBy() || options.SortDescending) {
+		sort := string(options.SortBy)
+		if options.SortDescending {
+			sort = "-" + sort
+		}
+		query.Set("sort", sort)
+	}
+	if options.Search != "" {
+		query.Set("q", options.Search)
+	}
+	if options.FullName != "" {
+		query.Set("fullName", options.FullName)
+	}
+	if options.Email != "" {
+		query.Set("email", options.Email)
+	}
+	if options.PhoneNumber != "" {
+		query.Set("phoneNumber", options.PhoneNumber)
+	}
+	return query
+}
+
+// listOptionsURL will build a URL for the given path and list options.
+func listOptionsURL(path string, options contact.ListOptions) string {
+	query := listOptionsQuery(options).Encode()
+	if query == "" {
+		return path
+	}
+	return path + "?" + query
+}
+
+// sortURL builds a link that sorts by the given field, starting from the current options.
+// If we're already sorting by that field, the link will flip the sort direction.
+func sortURL(path string, options contact.ListOptions, field contact.SortField) string {
+	isDescending := options.SortBy == field && !options.SortDescending
+	options.SortBy = field
+	options.SortDescending = isDescending
+	// Changing the sort order should take you back to the first page
+	options.Offset = 0
+	return listOptionsURL(path, options)
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+func TestParseListOptions(t *testing.T) {
+	type TestData struct {
+		In      string
+		Out     contact.ListOptions
+		IsValid bool
+	}
+	testDataList := []TestData{
+		{In: "", Out: contact.ListOptions{}, IsValid: true},
+		{In: "limit=10&offset=20", Out: contact.ListOptions{Limit: 10, Offset: 20}, IsValid: true},
+		{In: "sort=-name", Out: contact.ListOptions{SortBy: contact.SortByFullName, SortDescending: true}, IsValid: true},
+		{In: "sort=email&fullName=+alex+&phoneNumber=6688", Out: contact.ListOptions{SortBy: contact.SortByEmail, FullName: "alex", PhoneNumber: "6688"}, IsValid: true},
+		{In: "q=perlmen", Out: contact.ListOptions{Search: "perlmen"}, IsValid: true},
+		{In: "q=perlmen&sort=-relevance", Out: contact.ListOptions{Search: "perlmen", SortBy: contact.SortByRelevance, SortDescending: true}, IsValid: true},
+		{In: "sort=password"},
+		{In: "limit=-1"},
+		{In: "offset=abc"},
+	}
+	for _, testData := range testDataList {
+		query, err := url.ParseQuery(testData.In)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options, err := parseListOptions(query)
+		if !testData.IsValid {
+			if err == nil {
+				t.Errorf("%q: expected an error but got none", testData.In)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", testData.In, err)
+			continue
+		}
+		if options != testData.Out {
+			t.Errorf("%q: expected %+v but got %+v", testData.In, testData.Out, options)
+		}
+		// Converting back to a query and parsing again should give the same options
+		roundTripOptions, err := parseListOptions(listOptionsQuery(options))
+		if err != nil {
+			t.Errorf("%q: unexpected error on round-trip: %s", testData.In, err)
+			continue
+		}
+		if roundTripOptions != options {
+			t.Errorf("%q: expected round-trip to give %+v but got %+v", testData.In, options, roundTripOptions)
+		}
+	}
+}
+
+func TestSortURL(t *testing.T) {
+	options := contact.ListOptions{Offset: 50}
+	if got := sortURL("/", options, contact.SortByFullName); got != "/?sort=name" {
+		t.Errorf("expected sorting to reset the offset but got %s", got)
+	}
+	options.SortBy = contact.SortByFullName
+	if got := sortURL("/", options, contact.SortByFullName); got != "/?sort=-name" {
+		t.Errorf("expected sorting by the current field to flip direction but got %s", got)
+	}
+}
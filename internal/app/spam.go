@@ -0,0 +1,207 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/config"
+	"github.com/silbinarywolf/contact-site/internal/ratelimit"
+)
+
+const (
+	// honeypotField is a field on the add contact form that's hidden from people, so only bots
+	// that fill in every field they find will give it a value
+	honeypotField = "Website"
+	// formStartedAtField holds when the add contact form was shown, see formStartedAt
+	formStartedAtField = "FormStartedAt"
+)
+
+var (
+	// postContactPerIP and postContactGlobal limit how often the add contact form can be
+	// submitted, they're nil if the limit has been turned off
+	postContactPerIP  *ratelimit.Limiter
+	postContactGlobal *ratelimit.Limiter
+
+	// formSigningKey signs the time in formStartedAtField so that bots can't make it up. It's
+	// made each time the application starts, so forms opened before a restart must be reloaded.
+	formSigningKey = mustRandomKey()
+
+	// spamRejections counts submissions of the add contact form that were refused, they're
+	// served by handleAdminMetrics
+	spamRejections spamRejectionCounts
+)
+
+// spamRejectionCounts is how many submissions were refused by each check in preventSpam. The
+// counts must only be changed with sync/atomic.
+type spamRejectionCounts struct {
+	RateLimitedByIP     uint64 `json:"rateLimitedByIP"`
+	RateLimitedGlobally uint64 `json:"rateLimitedGlobally"`
+	Honeypot            uint64 `json:"honeypot"`
+	TooFast             uint64 `json:"tooFast"`
+	Expired             uint64 `json:"expired"`
+	InvalidForm         uint64 `json:"invalidForm"`
+}
+
+// snapshot returns a copy of the counts that's safe to read.
+func (counts *spamRejectionCounts) snapshot() spamRejectionCounts {
+	return spamRejectionCounts{
+		RateLimitedByIP:     atomic.LoadUint64(&counts.RateLimitedByIP),
+		RateLimitedGlobally: atomic.LoadUint64(&counts.RateLimitedGlobally),
+		Honeypot:            atomic.LoadUint64(&counts.Honeypot),
+		TooFast:             atomic.LoadUint64(&counts.TooFast),
+		Expired:             atomic.LoadUint64(&counts.Expired),
+		InvalidForm:         atomic.LoadUint64(&counts.InvalidForm),
+	}
+}
+
+// mustSetupSpamProtection creates the rate limiters for the add contact form from the config.
+func mustSetupSpamProtection() {
+	settings := config.Get().Spam
+	store := ratelimit.NewMemoryStore()
+	postContactPerIP = nil
+	if !settings.PerIP.IsOff() {
+		postContactPerIP = ratelimit.New(ratelimit.PerMinute(settings.PerIP.Burst, settings.PerIP.PerMinute), store)
+	}
+	postContactGlobal = nil
+	if !settings.Global.IsOff() {
+		postContactGlobal = ratelimit.New(ratelimit.PerMinute(settings.Global.Burst, settings.Global.PerMinute), store)
+	}
+}
+
+// preventSpam refuses submissions of the add contact form that look like they're from a bot or
+// that are over the rate limits. The form must include the fields from formStartedAt.
+//
+// Rate limited submissions get a "429 Too Many Requests" response with a Retry-After header.
+func preventSpam(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			handler(w, r)
+			return
+		}
+		if r.PostFormValue(honeypotField) != "" {
+			atomic.AddUint64(&spamRejections.Honeypot, 1)
+			writeError(w, http.StatusBadRequest, codeInvalidSubmission, "Invalid submission.")
+			return
+		}
+		if settings := config.Get().Spam; settings.MinSubmitSeconds > 0 || settings.MaxFormAgeHours > 0 {
+			startedAt, ok := parseFormStartedAt(r.PostFormValue(formStartedAtField))
+			if !ok {
+				atomic.AddUint64(&spamRejections.InvalidForm, 1)
+				writeError(w, http.StatusBadRequest, codeFormExpired, "The form has expired. Reload the page and try again.")
+				return
+			}
+			age := time.Since(startedAt)
+			if settings.MaxFormAgeHours > 0 && age > time.Duration(settings.MaxFormAgeHours*float64(time.Hour)) {
+				atomic.AddUint64(&spamRejections.Expired, 1)
+				writeError(w, http.StatusBadRequest, codeFormExpired, "The form has expired. Reload the page and try again.")
+				return
+			}
+			minSubmitTime := time.Duration(settings.MinSubmitSeconds * float64(time.Second))
+			if wait := minSubmitTime - age; settings.MinSubmitSeconds > 0 && wait > 0 {
+				atomic.AddUint64(&spamRejections.TooFast, 1)
+				writeTooManyRequests(w, wait)
+				return
+			}
+		}
+		ipKey := "postContact:ip:" + clientIP(r)
+		if postContactPerIP != nil {
+			if ok, retryAfter := postContactPerIP.Allow(ipKey); !ok {
+				atomic.AddUint64(&spamRejections.RateLimitedByIP, 1)
+				writeTooManyRequests(w, retryAfter)
+				return
+			}
+		}
+		if postContactGlobal != nil {
+			if ok, retryAfter := postContactGlobal.Allow("postContact:global"); !ok {
+				// The submission wasn't made, so it shouldn't count against the IP. Otherwise
+				// they'd stay blocked after the global limit recovers. The IP is checked first
+				// so that one IP can't use up the global limit for everyone else.
+				if postContactPerIP != nil {
+					postContactPerIP.Refund(ipKey)
+				}
+				atomic.AddUint64(&spamRejections.RateLimitedGlobally, 1)
+				writeTooManyRequests(w, retryAfter)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// writeTooManyRequests tells the client to wait for retryAfter before trying again.
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	// Retry-After is in whole seconds, so round up so that clients don't come back too early
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeError(w, http.StatusTooManyRequests, codeRateLimited, "Too many contacts have been submitted. Try again in "+strconv.FormatInt(seconds, 10)+" seconds.")
+}
+
+// clientIP returns the IP address that made the request.
+func clientIP(r *http.Request) string {
+	if config.Get().Web.TrustForwardedFor {
+		// Each proxy appends the address it got the request from, so the last one is from ours
+		// and the ones before it could've been sent by the client
+		if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+			addresses := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+			// The address is kept in the audit log, so ignore anything that isn't an IP address
+			if ip := net.ParseIP(strings.TrimSpace(addresses[len(addresses)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// formStartedAt returns the value for the formStartedAtField of a form being shown at now.
+// It's the unix time in milliseconds followed by a signature of it, ie. "1594468800000.<signature>"
+func formStartedAt(now time.Time) string {
+	timestamp := strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+	return timestamp + "." + signFormValue(timestamp)
+}
+
+// parseFormStartedAt returns the time from formStartedAt, or false if it wasn't made by us.
+func parseFormStartedAt(value string) (time.Time, bool) {
+	i := strings.IndexByte(value, '.')
+	if i == -1 {
+		return time.Time{}, false
+	}
+	timestamp, signature := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signFormValue(timestamp))) {
+		return time.Time{}, false
+	}
+	milliseconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, milliseconds*int64(time.Millisecond)), true
+}
+
+func signFormValue(value string) string {
+	mac := hmac.New(sha256.New, formSigningKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func mustRandomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
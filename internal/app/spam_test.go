@@ -0,0 +1,127 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/config"
+	"github.com/silbinarywolf/contact-site/internal/ratelimit"
+)
+
+func TestFormStartedAt(t *testing.T) {
+	now := time.Date(2020, 7, 11, 12, 0, 0, int(250*time.Millisecond), time.UTC)
+	value := formStartedAt(now)
+	if startedAt, ok := parseFormStartedAt(value); !ok || !startedAt.Equal(now) {
+		t.Fatalf("expected %v but got %v (%v)", now, startedAt, ok)
+	}
+	timestamp := value[:strings.IndexByte(value, '.')]
+	for _, value := range []string{
+		"",
+		timestamp,
+		timestamp + ".",
+		strings.Replace(value, timestamp, "1", 1),
+		value + "a",
+	} {
+		if _, ok := parseFormStartedAt(value); ok {
+			t.Errorf("expected %q to be refused", value)
+		}
+	}
+}
+
+func TestPreventSpamFormAge(t *testing.T) {
+	defer config.Set(config.Get())
+
+	var settings config.Config
+	settings.Spam.MinSubmitSeconds = -1
+	settings.Spam.MaxFormAgeHours = 1
+	config.Set(settings)
+	submit := func(startedAt time.Time) (*httptest.ResponseRecorder, bool) {
+		form := url.Values{formStartedAtField: {formStartedAt(startedAt)}}
+		r := httptest.NewRequest("POST", "/postContact", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handled := false
+		preventSpam(func(w http.ResponseWriter, r *http.Request) {
+			handled = true
+		})(w, r)
+		return w, handled
+	}
+
+	if _, handled := submit(time.Now().Add(-30 * time.Minute)); !handled {
+		t.Errorf("expected a form opened 30 minutes ago to be allowed")
+	}
+	w, handled := submit(time.Now().Add(-2 * time.Hour))
+	if handled || w.Code != http.StatusBadRequest || w.Header().Get(errorCodeHeader) != codeFormExpired {
+		t.Errorf("expected a form opened 2 hours ago to be refused as expired, got status %d with %q", w.Code, w.Header().Get(errorCodeHeader))
+	}
+
+	settings.Spam.MaxFormAgeHours = -1
+	config.Set(settings)
+	if _, handled := submit(time.Now().Add(-2 * time.Hour)); !handled {
+		t.Errorf("expected any age to be allowed when the check is off")
+	}
+}
+
+func TestPreventSpamRateLimits(t *testing.T) {
+	// Deferred calls run last first, so the limiters are set up again from the restored config
+	defer mustSetupSpamProtection()
+	defer config.Set(config.Get())
+
+	var settings config.Config
+	settings.Spam.MinSubmitSeconds = -1
+	settings.Spam.MaxFormAgeHours = -1
+	settings.Spam.PerIP = config.RateLimit{Burst: 2}
+	settings.Spam.Global = config.RateLimit{Burst: 1}
+	config.Set(settings)
+	mustSetupSpamProtection()
+	submit := func() int {
+		r := httptest.NewRequest("POST", "/postContact", strings.NewReader(""))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		preventSpam(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+		})(w, r)
+		return w.Code
+	}
+
+	if code := submit(); code != http.StatusCreated {
+		t.Fatalf("expected the first submission to be allowed but got status %d", code)
+	}
+	if code := submit(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the global limit to refuse the second submission but got status %d", code)
+	}
+	// Once the global limit recovers, the IP can submit again, as the refused submission
+	// didn't count against it
+	postContactGlobal = ratelimit.New(ratelimit.Limit{Burst: 1}, ratelimit.NewMemoryStore())
+	if code := submit(); code != http.StatusCreated {
+		t.Fatalf("expected the IP to have a submission left but got status %d", code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer config.Set(config.Get())
+
+	r := httptest.NewRequest("POST", "/postContact", nil)
+	r.RemoteAddr = "192.0.2.1:51234"
+	r.Header.Add("X-Forwarded-For", "198.51.100.1, 198.51.100.2")
+	r.Header.Add("X-Forwarded-For", "198.51.100.3")
+
+	var settings config.Config
+	config.Set(settings)
+	if ip := clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("expected the remote address when X-Forwarded-For isn't trusted, not %q", ip)
+	}
+	settings.Web.TrustForwardedFor = true
+	config.Set(settings)
+	if ip := clientIP(r); ip != "198.51.100.3" {
+		t.Errorf("expected the last X-Forwarded-For address, not %q", ip)
+	}
+	r.Header.Set("X-Forwarded-For", "<script>")
+	if ip := clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("expected the remote address when X-Forwarded-For isn't an IP address, not %q", ip)
+	}
+}
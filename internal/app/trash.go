@@ -0,0 +1,203 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/config"
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+const (
+	trashPath = "/trash"
+
+	// trashPurgeInterval is how often deleted contacts past the retention period are purged
+	trashPurgeInterval = time.Hour
+)
+
+// Actions that can be submitted with the trash page form
+const (
+	trashActionRestore = "restore"
+	trashActionPurge   = "purge"
+)
+
+// parseTrashOptions will read the query parameters used for browsing the trash.
+//
+// - limit: maximum items per page
+// - offset: amount of items to skip
+func parseTrashOptions(query url.Values) (contact.TrashOptions, error) {
+	var options contact.TrashOptions
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			return contact.TrashOptions{}, errInvalidLimit
+		}
+		options.Limit = limit
+	}
+	if s := query.Get("offset"); s != "" {
+		offset, err := strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return contact.TrashOptions{}, errInvalidOffset
+		}
+		options.Offset = offset
+	}
+	return options, nil
+}
+
+// trashOptionsURL is the inverse of parseTrashOptions, it builds a URL for the trash page with
+// the given options so we can link to next/previous pages.
+func trashOptionsURL(options contact.TrashOptions) string {
+	query := url.Values{}
+	if options.Limit != 0 && options.Limit != contact.DefaultListLimit {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.Offset != 0 {
+		query.Set("offset", strconv.Itoa(options.Offset))
+	}
+	if len(query) == 0 {
+		return trashPath
+	}
+	return trashPath + "?" + query.Encode()
+}
+
+// handleTrash lists deleted contacts and phone numbers and lets them be restored or purged.
+//
+// The form posts "Action" as "restore" or "purge", with "ContactID" and, if it's a single phone
+// number rather than the whole contact, "PhoneNumberID".
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeTrashPage(w, r, http.StatusOK, "")
+	case http.MethodPost:
+		r.ParseForm()
+		contactID, err := strconv.ParseInt(r.FormValue("ContactID"), 10, 64)
+		if err != nil {
+			setErrorCode(w, codeInvalidRequest)
+			writeTrashPage(w, r, http.StatusBadRequest, "Invalid ContactID provided.")
+			return
+		}
+		var phoneNumberID int64
+		if s := r.FormValue("PhoneNumberID"); s != "" {
+			phoneNumberID, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				setErrorCode(w, codeInvalidRequest)
+				writeTrashPage(w, r, http.StatusBadRequest, "Invalid PhoneNumberID provided.")
+				return
+			}
+		}
+		actor := requestActor(r)
+		switch action := r.FormValue("Action"); {
+		case action == trashActionRestore && phoneNumberID == 0:
+			err = contact.Restore(actor, contactID)
+		case action == trashActionRestore:
+			err = contact.RestorePhoneNumber(actor, contactID, phoneNumberID)
+		case action == trashActionPurge && phoneNumberID == 0:
+			err = contact.Purge(actor, contactID)
+		case action == trashActionPurge:
+			err = contact.PurgePhoneNumber(actor, contactID, phoneNumberID)
+		default:
+			setErrorCode(w, codeInvalidRequest)
+			writeTrashPage(w, r, http.StatusBadRequest, "Invalid Action provided. Must be \"restore\" or \"purge\".")
+			return
+		}
+		switch err {
+		case nil:
+			// Stay on the same page of the trash
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		case contact.ErrNotFound:
+			setErrorCode(w, codeContactNotFound)
+			writeTrashPage(w, r, http.StatusNotFound, "Contact not found in the trash. It may have already been restored or purged.")
+		case contact.ErrPhoneNumberNotFound:
+			setErrorCode(w, codePhoneNumberNotFound)
+			writeTrashPage(w, r, http.StatusNotFound, "Phone number not found in the trash. It may have already been restored or purged.")
+		case contact.ErrRestoreMergedAway:
+			setErrorCode(w, contact.ErrRestoreMergedAway.Code())
+			writeTrashPage(w, r, http.StatusConflict, contact.ErrRestoreMergedAway.Error())
+		default:
+			log.Print(err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred restoring or purging from the trash")
+		}
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// writeTrashPage renders a page of the trash, with an error if restoring or purging failed.
+func writeTrashPage(w http.ResponseWriter, r *http.Request, statusCode int, errorMessage string) {
+	type TemplateData struct {
+		Items   []contact.TrashItem
+		Options contact.TrashOptions
+		// PageURL is where the forms are posted, so that we come back to the same page after
+		PageURL string
+		// NextURL and PreviousURL are blank if there's no page in that direction
+		NextURL     string
+		PreviousURL string
+		// RetentionDays is how long items stay in the trash, -1 if they're kept until purged
+		RetentionDays int
+		// Region is where the viewer is, phone numbers are formatted for it
+		Region string
+		// Username of the signed in user
+		Username  string
+		Error     string
+		CSRFToken string
+	}
+	options, err := parseTrashOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorCode(err), err.Error())
+		return
+	}
+	result, err := contact.ListTrash(options)
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "An unexpected error occurred listing the trash")
+		return
+	}
+	templateData := TemplateData{
+		Items:         result.Items,
+		Options:       result.Options,
+		PageURL:       trashOptionsURL(result.Options),
+		RetentionDays: config.Get().Trash.RetentionDays,
+		Region:        contact.DefaultRegion(),
+		Error:         errorMessage,
+		CSRFToken:     csrfToken(w, r),
+	}
+	if result.HasNext {
+		templateData.NextURL = trashOptionsURL(result.NextOptions())
+	}
+	if result.HasPrevious() {
+		templateData.PreviousURL = trashOptionsURL(result.PreviousOptions())
+	}
+	if record, ok := currentUser(r); ok {
+		templateData.Username = record.Username
+	}
+	w.WriteHeader(statusCode)
+	if err := templates.ExecuteTemplate(w, "trash.html", templateData); err != nil {
+		log.Print(err)
+	}
+}
+
+// startPurgingTrash purges everything that's been in the trash longer than the retention
+// period, straight away and then every trashPurgeInterval until the application stops.
+func startPurgingTrash() {
+	retentionDays := config.Get().Trash.RetentionDays
+	if retentionDays < 0 {
+		// Kept until they're purged by hand
+		return
+	}
+	retention := time.Duration(retentionDays) * 24 * time.Hour
+	go func() {
+		for {
+			purged, err := contact.PurgeDeletedBefore(contact.SystemActor, time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("Failed to purge the trash: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d contacts and phone numbers deleted more than %d days ago", purged, retentionDays)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
@@ -10,21 +10,93 @@ const (
 	configBasename = "config.json"
 )
 
+// Database drivers that can be set for "database.driver"
+const (
+	DatabaseDriverPostgres = "postgres"
+	DatabaseDriverSQLite   = "sqlite"
+	DatabaseDriverMemory   = "memory"
+)
+
 var (
 	config Config
+	isSet  bool
 )
 
 // Config structure that maps to a configuration file.
 type Config struct {
 	Web struct {
 		Port int `json:"port,omitempty"`
+		// SecureCookies marks the session cookie as HTTPS only. It's always set for requests made
+		// over HTTPS, this is for when HTTPS is handled by a reverse proxy in front of us.
+		SecureCookies bool `json:"secureCookies,omitempty"`
+		// TrustForwardedFor uses the last address in the X-Forwarded-For header as the address
+		// requests came from. Only set this when a reverse proxy in front of us sets the header,
+		// otherwise anyone can pretend to be any address.
+		TrustForwardedFor bool `json:"trustForwardedFor,omitempty"`
 	} `json:"web,omitempty"`
 	Database struct {
+		// Driver is one of "postgres", "sqlite" or "memory". Defaults to "postgres".
+		//
+		// "memory" keeps everything in memory and loses it when the application stops,
+		// it only exists so that the application and tests can be run without a database server.
+		Driver string `json:"driver,omitempty"`
+		// Path is the file that SQLite stores the database in.
+		Path     string `json:"path,omitempty"`
 		Host     string `json:"host,omitempty"`
 		Port     int    `json:"port,omitempty"`
 		User     string `json:"user,omitempty"`
 		Password string `json:"password,omitempty"`
 	} `json:"database,omitempty"`
+	Phone struct {
+		// DefaultRegion is the 2 letter country code that phone numbers written in local format
+		// are assumed to be from, ie. "NZ". Defaults to "AU".
+		DefaultRegion string `json:"defaultRegion,omitempty"`
+	} `json:"phone,omitempty"`
+	// Spam stops bots from filling the database with the add contact form.
+	Spam struct {
+		// PerIP limits how many contacts each IP address can add with the form.
+		// Defaults to 5 at once and then 1 a minute.
+		PerIP RateLimit `json:"perIP,omitempty"`
+		// Global limits how many contacts can be added with the form by everyone together.
+		// Defaults to 50 at once and then 20 a minute.
+		Global RateLimit `json:"global,omitempty"`
+		// MinSubmitSeconds is how long the form must have been open before it's submitted,
+		// as people can't fill it in instantly. Defaults to 2, set to -1 to turn it off.
+		MinSubmitSeconds float64 `json:"minSubmitSeconds,omitempty"`
+		// MaxFormAgeHours is how long the form can be open before it has to be reloaded, so
+		// that a bot can't load it once and then keep submitting it. Defaults to 24, set to -1
+		// to turn it off.
+		MaxFormAgeHours float64 `json:"maxFormAgeHours,omitempty"`
+	} `json:"spam,omitempty"`
+	// Trash holds deleted contacts and phone numbers so they can be restored.
+	Trash struct {
+		// RetentionDays is how long deleted contacts and phone numbers are kept before they're
+		// purged for good. Defaults to 30, set to -1 to keep them until they're purged by hand.
+		RetentionDays int `json:"retentionDays,omitempty"`
+	} `json:"trash,omitempty"`
+}
+
+// RateLimit allows Burst requests at once, and then PerMinute more each minute.
+// Set Burst to -1 to turn the limit off.
+type RateLimit struct {
+	Burst     int     `json:"burst,omitempty"`
+	PerMinute float64 `json:"perMinute,omitempty"`
+}
+
+// IsOff returns true if the limit has been turned off.
+func (limit RateLimit) IsOff() bool {
+	return limit.Burst < 0
+}
+
+// withDefault returns the limit, or defaultLimit if it isn't set.
+func (limit RateLimit) withDefault(defaultLimit RateLimit) RateLimit {
+	if limit.Burst == 0 {
+		limit.Burst = defaultLimit.Burst
+	}
+	if limit.PerMinute == 0 {
+		limit.PerMinute = defaultLimit.PerMinute
+	}
+	return limit
 }
 
 // Get will return a copy of the current application configuration.
@@ -33,6 +105,32 @@ func Get() Config {
 	return config
 }
 
+// IsSet will return true if the configuration has been loaded or set.
+func IsSet() bool {
+	return isSet
+}
+
+// Set will replace the current application configuration without reading config.json.
+// This was implemented for use by integration tests, so they can run without a config file.
+func Set(newConfig Config) {
+	if newConfig.Database.Driver == "" {
+		newConfig.Database.Driver = DatabaseDriverPostgres
+	}
+	newConfig.Spam.PerIP = newConfig.Spam.PerIP.withDefault(RateLimit{Burst: 5, PerMinute: 1})
+	newConfig.Spam.Global = newConfig.Spam.Global.withDefault(RateLimit{Burst: 50, PerMinute: 20})
+	if newConfig.Spam.MinSubmitSeconds == 0 {
+		newConfig.Spam.MinSubmitSeconds = 2
+	}
+	if newConfig.Spam.MaxFormAgeHours == 0 {
+		newConfig.Spam.MaxFormAgeHours = 24
+	}
+	if newConfig.Trash.RetentionDays == 0 {
+		newConfig.Trash.RetentionDays = 30
+	}
+	config = newConfig
+	isSet = true
+}
+
 // Exists will check if the config file exists or not.
 // This was implemented for use by integration tests.
 func Exists() bool {
@@ -80,25 +178,59 @@ func MustLoad() {
 		log.Printf("\"web.port\" JSON key for environment variable cannot be empty or set to 0.")
 		shouldEarlyExit = true
 	}
-	if newConfig.Database.User == "" {
-		log.Printf("\"database.user\" JSON key for environment variable cannot be empty.")
+	switch newConfig.Database.Driver {
+	case "", DatabaseDriverPostgres:
+		if newConfig.Database.User == "" {
+			log.Printf("\"database.user\" JSON key for environment variable cannot be empty.")
+			shouldEarlyExit = true
+		}
+		if newConfig.Database.Password == "" {
+			log.Printf("\"database.password\" JSON key for environment variable cannot be empty.")
+			shouldEarlyExit = true
+		}
+		if newConfig.Database.Host == "" {
+			log.Printf("\"database.host\" JSON key for environment variable cannot be empty.")
+			shouldEarlyExit = true
+		}
+		if newConfig.Database.Port == 0 {
+			log.Printf("\"database.port\" JSON key for environment variable cannot be empty or set to 0.")
+			shouldEarlyExit = true
+		}
+	case DatabaseDriverSQLite:
+		if newConfig.Database.Path == "" {
+			log.Printf("\"database.path\" JSON key for environment variable cannot be empty when using the \"sqlite\" driver.")
+			shouldEarlyExit = true
+		}
+	case DatabaseDriverMemory:
+		// Nothing to configure
+	default:
+		log.Printf("\"database.driver\" JSON key must be \"postgres\", \"sqlite\" or \"memory\", not %q.", newConfig.Database.Driver)
 		shouldEarlyExit = true
 	}
-	if newConfig.Database.Password == "" {
-		log.Printf("\"database.password\" JSON key for environment variable cannot be empty.")
+	for name, limit := range map[string]RateLimit{
+		"spam.perIP":  newConfig.Spam.PerIP,
+		"spam.global": newConfig.Spam.Global,
+	} {
+		if !limit.IsOff() && limit.PerMinute < 0 {
+			log.Printf("\"%s.perMinute\" JSON key cannot be negative, set \"%s.burst\" to -1 to turn the limit off.", name, name)
+			shouldEarlyExit = true
+		}
+	}
+	if newConfig.Spam.MinSubmitSeconds < -1 {
+		log.Printf("\"spam.minSubmitSeconds\" JSON key cannot be negative, set it to -1 to turn the check off.")
 		shouldEarlyExit = true
 	}
-	if newConfig.Database.Host == "" {
-		log.Printf("\"database.host\" JSON key for environment variable cannot be empty.")
+	if newConfig.Spam.MaxFormAgeHours < -1 {
+		log.Printf("\"spam.maxFormAgeHours\" JSON key cannot be negative, set it to -1 to turn the check off.")
 		shouldEarlyExit = true
 	}
-	if newConfig.Database.Port == 0 {
-		log.Printf("\"database.port\" JSON key for environment variable cannot be empty or set to 0.")
+	if newConfig.Trash.RetentionDays < -1 {
+		log.Printf("\"trash.retentionDays\" JSON key cannot be negative, set it to -1 to keep deleted contacts forever.")
 		shouldEarlyExit = true
 	}
 	if shouldEarlyExit {
 		os.Exit(1)
 	}
 	// Set config on success
-	config = newConfig
+	Set(newConfig)
 }
@@ -0,0 +1,270 @@
+package contact
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditAction is what was done to a Contact, see AuditEntry.
+type AuditAction string
+
+const (
+	AuditActionCreate AuditAction = "create"
+	AuditActionUpdate AuditAction = "update"
+	AuditActionDelete AuditAction = "delete"
+	// AuditActionRestore is a Contact or PhoneNumber being taken out of the trash
+	AuditActionRestore AuditAction = "restore"
+	// AuditActionPurge is a Contact or PhoneNumber in the trash being permanently deleted
+	AuditActionPurge AuditAction = "purge"
+)
+
+// Actor is who made a change and where from, so that it can be recorded in the audit log.
+//
+// It's copied into each AuditEntry rather than referring to the user, so that the log still
+// says who made a change after they're deleted or renamed.
+type Actor struct {
+	// UserID is 0 for changes made by the application itself, see SystemActor
+	UserID   int64  `json:"userId"`
+	Username string `json:"username"`
+	// IP is the address the change was requested from, blank if it wasn't over HTTP
+	IP string `json:"ip"`
+}
+
+// SystemActor is who makes changes that aren't requested by a user, ie. the mock data and
+// the --import flag, which can only be used by someone with access to the server.
+var SystemActor = Actor{Username: "system"}
+
+// AuditEntry records a single change to a Contact. Every create, update and delete done with
+// this package is recorded, with a snapshot of the Contact before and after, by the same
+// transaction that makes the change. Entries are never changed or deleted.
+//
+// Changes to a Contacts emails and phone numbers are recorded as an update of the Contact.
+// A merge is recorded as an update of the target and a delete of the source. Restoring and
+// purging a PhoneNumber is recorded against its Contact, with the PhoneNumber only in After
+// or Before respectively.
+type AuditEntry struct {
+	ID        int64       `json:"id"`
+	ContactID int64       `json:"contactId"`
+	Action    AuditAction `json:"action"`
+	Actor     Actor       `json:"actor"`
+	ChangedAt time.Time   `json:"changedAt"`
+	// Before is the Contact before the change, nil if it was created
+	Before *Contact `json:"before"`
+	// After is the Contact after the change, nil if it was deleted
+	After *Contact `json:"after"`
+}
+
+// AuditOptions controls which entries are returned by ListAudit. Entries are always newest first.
+type AuditOptions struct {
+	// Limit is the maximum amount of entries to return. If 0, DefaultListLimit is used.
+	Limit int
+	// Offset is the amount of entries to skip.
+	Offset int
+
+	// ContactID only returns the changes to one Contact, if it's not 0
+	ContactID int64
+	// UserID only returns the changes made by one user, if it's not 0
+	UserID int64
+}
+
+// AuditResult is a single page of entries from ListAudit.
+type AuditResult struct {
+	Entries []AuditEntry
+	// Options are the options that were used, after defaults were applied.
+	Options AuditOptions
+	// HasNext is true if there are more entries after this page.
+	HasNext bool
+}
+
+// HasPrevious is true if there are entries before this page.
+func (result AuditResult) HasPrevious() bool {
+	return result.Options.Offset > 0
+}
+
+// NextOptions returns the options needed to fetch the page after this one.
+func (result AuditResult) NextOptions() AuditOptions {
+	options := result.Options
+	options.Offset += options.Limit
+	return options
+}
+
+// PreviousOptions returns the options needed to fetch the page before this one.
+func (result AuditResult) PreviousOptions() AuditOptions {
+	options := result.Options
+	options.Offset -= options.Limit
+	if options.Offset < 0 {
+		options.Offset = 0
+	}
+	return options
+}
+
+// ListAudit will return a page of the audit log, newest first.
+func ListAudit(options AuditOptions) (AuditResult, error) {
+	if options.Limit <= 0 {
+		options.Limit = DefaultListLimit
+	}
+	if options.Limit > MaxListLimit {
+		options.Limit = MaxListLimit
+	}
+	if options.Offset < 0 {
+		options.Offset = 0
+	}
+	return currentStore().ListAudit(options)
+}
+
+// ForEachAuditEntry calls fn for every entry that matches the options, newest first, stopping
+// at the first error. Limit and Offset are ignored.
+//
+// Like ForEach, entries are fetched a page at a time. Entries made while iterating push older
+// ones onto later pages, so they may be repeated.
+func ForEachAuditEntry(options AuditOptions, fn func(entry AuditEntry) error) error {
+	options.Limit = MaxListLimit
+	options.Offset = 0
+	for {
+		result, err := ListAudit(options)
+		if err != nil {
+			return err
+		}
+		for _, entry := range result.Entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		if !result.HasNext {
+			return nil
+		}
+		options = result.NextOptions()
+	}
+}
+
+// Changes describes what the change did to the Contact, ie. `Full Name changed from "Alex" to "Alex Bell"`
+// or "Phone Number +61388886688 added". Used to show the audit log to people, the snapshots are
+// the full record of what changed.
+func (entry AuditEntry) Changes() []string {
+	var changes []string
+	switch {
+	case entry.Before == nil && entry.After != nil && entry.Action == AuditActionRestore:
+		changes = append(changes, fmt.Sprintf("Restored %q", entry.After.FullName))
+	case entry.Before == nil && entry.After != nil:
+		changes = append(changes, fmt.Sprintf("Created %q", entry.After.FullName))
+	case entry.Before != nil && entry.After == nil && entry.Action == AuditActionPurge:
+		changes = append(changes, fmt.Sprintf("Purged %q", entry.Before.FullName))
+	case entry.Before != nil && entry.After == nil:
+		changes = append(changes, fmt.Sprintf("Deleted %q", entry.Before.FullName))
+	case entry.Before != nil && entry.After != nil:
+		if entry.Before.FullName != entry.After.FullName {
+			changes = append(changes, fmt.Sprintf("Full Name changed from %q to %q", entry.Before.FullName, entry.After.FullName))
+		}
+		before := make(map[int64]EmailAddress, len(entry.Before.Emails))
+		for _, email := range entry.Before.Emails {
+			before[email.ID] = email
+		}
+		for _, email := range entry.After.Emails {
+			old, ok := before[email.ID]
+			delete(before, email.ID)
+			switch {
+			case !ok:
+				changes = append(changes, "Email "+describeEmail(email)+" added")
+			case old != email:
+				changes = append(changes, "Email "+describeEmail(old)+" changed to "+describeEmail(email))
+			}
+		}
+		for _, email := range entry.Before.Emails {
+			if _, ok := before[email.ID]; ok {
+				changes = append(changes, "Email "+describeEmail(email)+" removed")
+			}
+		}
+		beforePhoneNumbers := make(map[int64]PhoneNumber, len(entry.Before.PhoneNumbers))
+		for _, phoneNumber := range entry.Before.PhoneNumbers {
+			beforePhoneNumbers[phoneNumber.ID] = phoneNumber
+		}
+		for _, phoneNumber := range entry.After.PhoneNumbers {
+			old, ok := beforePhoneNumbers[phoneNumber.ID]
+			delete(beforePhoneNumbers, phoneNumber.ID)
+			switch {
+			case !ok:
+				changes = append(changes, "Phone Number "+describePhoneNumber(phoneNumber)+" added")
+			case old != phoneNumber:
+				changes = append(changes, "Phone Number "+describePhoneNumber(old)+" changed to "+describePhoneNumber(phoneNumber))
+			}
+		}
+		for _, phoneNumber := range entry.Before.PhoneNumbers {
+			if _, ok := beforePhoneNumbers[phoneNumber.ID]; ok {
+				changes = append(changes, "Phone Number "+describePhoneNumber(phoneNumber)+" removed")
+			}
+		}
+	}
+	return changes
+}
+
+func describeEmail(email EmailAddress) string {
+	var details []string
+	if email.Label != "" {
+		details = append(details, email.Label)
+	}
+	if email.IsPrimary {
+		details = append(details, "primary")
+	}
+	return describe(email.Address, details)
+}
+
+func describePhoneNumber(phoneNumber PhoneNumber) string {
+	var details []string
+	if phoneNumber.Extension != "" {
+		details = append(details, "ext. "+phoneNumber.Extension)
+	}
+	if phoneNumber.Label != "" {
+		details = append(details, phoneNumber.Label)
+	}
+	if phoneNumber.IsPrimary {
+		details = append(details, "primary")
+	}
+	return describe(phoneNumber.Number, details)
+}
+
+// describe returns the value followed by its details in brackets, ie. "+61388886688 (work, primary)"
+func describe(value string, details []string) string {
+	if len(details) == 0 {
+		return value
+	}
+	return value + " (" + strings.Join(details, ", ") + ")"
+}
+
+// newAuditEntry returns the entry that records the change to a Contact. Before is nil when the
+// Contact is created and after is nil when it's deleted. Stores must call this while making
+// the change, so that the snapshots are exactly what changed.
+//
+// The action is worked out from the snapshots, use newAuditEntryWithAction for the trash.
+func newAuditEntry(actor Actor, before *Contact, after *Contact) AuditEntry {
+	entry := AuditEntry{
+		Actor:     actor,
+		ChangedAt: time.Now().UTC(),
+	}
+	switch {
+	case before == nil:
+		entry.Action = AuditActionCreate
+		entry.ContactID = after.ID
+	case after == nil:
+		entry.Action = AuditActionDelete
+		entry.ContactID = before.ID
+	default:
+		entry.Action = AuditActionUpdate
+		entry.ContactID = after.ID
+	}
+	if before != nil {
+		entry.Before = copyContact(before)
+	}
+	if after != nil {
+		entry.After = copyContact(after)
+	}
+	return entry
+}
+
+// newAuditEntryWithAction is newAuditEntry for changes that the snapshots can't tell apart
+// from a create, update or delete, ie. restoring and purging.
+func newAuditEntryWithAction(actor Actor, action AuditAction, before *Contact, after *Contact) AuditEntry {
+	entry := newAuditEntry(actor, before, after)
+	entry.Action = action
+	return entry
+}
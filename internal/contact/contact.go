@@ -3,272 +3,478 @@ package contact
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
-	"github.com/lib/pq"
 	"github.com/nyaruka/phonenumbers"
 
-	"github.com/silbinarywolf/contact-site/internal/db"
 	"github.com/silbinarywolf/contact-site/internal/validate"
 )
 
 var (
-	// User-facing errors
-	ErrInvalidFullName     = validate.NewError("Invalid Full Name provided. Name provided is too long.")
-	ErrInvalidEmail        = validate.NewError("Invalid Email provided")
-	ErrMissingPhoneNumbers = validate.NewError("No Phone Number(s) provided. Must provide at least 1 phone number.")
-	ErrInvalidPhoneNumber  = validate.NewError("Invalid Phone Number provided")
+	// User-facing errors, each with a code that must never change, see validate.NewError
+	ErrInvalidFullName             = validate.NewError("contact.full_name.too_long", "Invalid Full Name provided. Name provided is too long.")
+	ErrInvalidEmail                = validate.NewError("contact.email.invalid", "Invalid Email provided")
+	ErrMissingPhoneNumbers         = validate.NewError("contact.phone.missing", "No Phone Number(s) provided. Must provide at least 1 phone number.")
+	ErrInvalidPhoneNumber          = validate.NewError("contact.phone.not_a_number", "Invalid Phone Number provided")
+	ErrPhoneNumberTooShort         = validate.NewError("contact.phone.too_short", "Invalid Phone Number provided. It's too short, check it has the area code.")
+	ErrPhoneNumberTooLong          = validate.NewError("contact.phone.too_long", "Invalid Phone Number provided. It's too long.")
+	ErrPhoneNumberInvalidForRegion = validate.NewError("contact.phone.invalid_for_country", "Invalid Phone Number provided. It isn't a valid number for its country, check the Country is right.")
+	ErrInvalidCountryCode          = validate.NewError("contact.phone.invalid_country", "Invalid Country provided. Must be a 2 letter country code, ie. \"AU\".")
+	ErrInvalidPhoneNumberLabel     = validate.NewError("contact.phone.label_too_long", "Invalid Phone Number label provided. Label provided is too long.")
+	ErrInvalidPhoneNumberExtension = validate.NewError("contact.phone.invalid_extension", "Invalid Phone Number extension provided. Must only contain digits.")
+	ErrMultiplePrimaryPhoneNumbers = validate.NewError("contact.phone.multiple_primary", "Only 1 Phone Number can be the primary phone number.")
+	ErrInvalidEmailLabel           = validate.NewError("contact.email.label_too_long", "Invalid Email label provided. Label provided is too long.")
+	ErrMultiplePrimaryEmails       = validate.NewError("contact.email.multiple_primary", "Only 1 Email can be the primary email.")
+	ErrInvalidSortField            = validate.NewError("contact.list.invalid_sort", "Invalid sort field provided")
+	ErrInvalidUID                  = validate.NewError("contact.uid.invalid", "Invalid UID provided. Must be between 1 and 255 characters.")
+	ErrUIDAlreadyExists            = validate.NewError("contact.uid.already_exists", "Invalid UID provided. Another contact already has that UID.")
+	ErrVersionConflict             = validate.NewError("contact.version_conflict", "This contact has been changed by someone else since you loaded it. Reload it to see their changes and then make yours again.")
+
+	// ErrNotFound is returned when trying to get, update or delete a Contact
+	// that doesn't exist.
+	ErrNotFound = errors.New("contact not found")
+	// ErrPhoneNumberNotFound is returned when trying to update or delete a PhoneNumber
+	// that doesn't exist or doesn't belong to the given Contact.
+	ErrPhoneNumberNotFound = errors.New("phone number not found")
+	// ErrEmailNotFound is returned when updating a Contact with an EmailAddress
+	// that doesn't exist or doesn't belong to the Contact.
+	ErrEmailNotFound = errors.New("email not found")
 
 	// Internal (developer) errors
 	errContactAlreadyExists     = errors.New("cannot insert Contact record that already exists")
+	errContactMissingID         = errors.New("cannot update Contact record that has no ID")
 	errPhoneNumberAlreadyExists = errors.New("cannot insert PhoneNumber record that already exists")
+	errEmailAlreadyExists       = errors.New("cannot insert EmailAddress record that already exists")
 )
 
 type PhoneNumber struct {
-	ID        int64
-	ContactID int64
-	Number    string
+	ID        int64  `json:"id"`
+	ContactID int64  `json:"contactId"`
+	Number    string `json:"number"`
+	// CountryCode is the 2 letter ISO 3166-1 country code of the phone number, ie. "NZ".
+	// Not to be confused with the calling code, ie. "+64".
+	//
+	// When saving, this is the country used to interpret numbers written in local format and
+	// defaults to DefaultRegion. Once saved, it's the country the number belongs to, which is
+	// blank if it can't be determined. (ie. for numbers that aren't tied to a country)
+	CountryCode string `json:"countryCode"`
+	// Extension is dialed after connecting to the number, ie. "123" for "(03) 9333 7119 ext. 123".
+	// It's stored separately as E.164 has no way to represent it.
+	Extension string `json:"extension"`
+	// Label describes what the number is for, ie. "mobile" or "work". It can be one of the
+	// Label* constants or any custom text.
+	Label string `json:"label"`
+	// IsPrimary is true for the number that should be tried first. A Contact can have at most
+	// one primary number.
+	IsPrimary bool `json:"isPrimary"`
+	// LineType is detected from the number when it's saved, ie. "mobile" or "fixed_line".
+	// Any value given is overwritten. Blank for numbers saved before line types were detected.
+	LineType string `json:"lineType"`
+}
+
+// EmailAddress is one of the email addresses of a Contact.
+//
+// Contacts used to have a single Email field, but real contacts have work and personal
+// addresses, so they're now stored the same way as PhoneNumbers.
+type EmailAddress struct {
+	ID        int64  `json:"id"`
+	ContactID int64  `json:"contactId"`
+	Address   string `json:"address"`
+	// Label describes what the address is for, ie. "work" or "personal". It can be one of
+	// the Label* constants or any custom text.
+	Label string `json:"label"`
+	// IsPrimary is true for the address that should be used first. A Contact can have at
+	// most one primary email.
+	IsPrimary bool `json:"isPrimary"`
 }
 
 type Contact struct {
-	ID           int64
-	FullName     string
-	Email        string
-	PhoneNumbers []PhoneNumber
+	ID int64 `json:"id"`
+	// UID identifies the contact when syncing with other address books, ie. over CardDAV.
+	// It's given one when inserted, if it doesn't already have one, and can't be changed.
+	UID      string `json:"uid"`
+	FullName string `json:"fullName"`
+	// Emails are optional, so this is empty rather than nil if the Contact has none,
+	// so that it's encoded as an empty JSON array.
+	Emails       []EmailAddress `json:"emails"`
+	PhoneNumbers []PhoneNumber  `json:"phoneNumbers"`
+	// Version starts at 1 and goes up each time the contact, or one of its emails or phone
+	// numbers, is changed. It's ignored when inserting, see Update for how it's used when
+	// saving changes.
+	Version int64 `json:"version"`
 }
 
-func InsertNew(record *Contact) (rErr error) {
-	// Validate
-	//
-	// This could be in a new function, but that'd be premature as it'd only be called in one place, here.
-	// So we leverage the amazing forgotten 70's technology of block-scoping
-	// Aesthetically unappealing? Agreed. Practical and improves linear readability? Definitely.
-	//
-	// Also very easy to copy-paste to a new function when/if the time comes that I need this called
-	// in two or more seperate places.
-	{
-		if record.ID != 0 {
-			return errContactAlreadyExists
+// validateRecord will check the Contact and its PhoneNumbers against our validation rules
+// and normalize the phone numbers into E.164 format.
+//
+// Every problem is found, rather than only the first, and returned as a single
+// *validate.ValidationError with the field each is about, ie. "phoneNumbers[1].number".
+//
+// This used to live in a block-scope within InsertNew, but now that Update also needs it, it's
+// been moved here.
+func validateRecord(record *Contact) error {
+	return validateChangedRecord(record, nil)
+}
+
+// storedPhoneNumbers are phone numbers, in E.164 format, that are already stored.
+//
+// Numbers that are already stored are only checked for being a number, not for being one that
+// can exist, see phoneNumberValidityError. Contacts stored before we checked that, ie. with
+// numbers like "+6143", can then still be changed without having to fix their numbers first.
+type storedPhoneNumbers map[string]bool
+
+// newStoredPhoneNumbers returns the phone numbers of the given stored Contacts.
+func newStoredPhoneNumbers(records ...*Contact) storedPhoneNumbers {
+	stored := make(storedPhoneNumbers)
+	for _, record := range records {
+		for _, phoneNumber := range record.PhoneNumbers {
+			stored[phoneNumber.Number] = true
 		}
-		// I could probably make this FullName validation a bit better by only
-		// allowing a limited subset of UTF-8 characters such as disallowing emojis.
-		if len(record.FullName) >= 255 {
-			return ErrInvalidFullName
+	}
+	return stored
+}
+
+// validateChangedRecord is validateRecord for a Contact that's already stored, where the
+// numbers it already has don't need to be valid by our current rules, see storedPhoneNumbers.
+func validateChangedRecord(record *Contact, stored storedPhoneNumbers) error {
+	var errs validate.Errors
+	// I could probably make this FullName validation a bit better by only
+	// allowing a limited subset of UTF-8 characters such as disallowing emojis.
+	if len(record.FullName) >= 255 {
+		errs.Add("fullName", ErrInvalidFullName)
+	}
+	// We allow a record to have no email addresses, but each address given must be valid.
+	if record.Emails == nil {
+		record.Emails = []EmailAddress{}
+	}
+	primaryEmails := 0
+	for i := range record.Emails {
+		childRecord := &record.Emails[i]
+		field := "emails[" + strconv.Itoa(i) + "]"
+		childRecord.Address = strings.TrimSpace(childRecord.Address)
+		if !validate.IsValidEmail(childRecord.Address) {
+			errs.Add(field+".address", ErrInvalidEmail)
 		}
-		// We allow a blank email address for these records
-		// but that doesn't mean I want my email validation code to allow
-		// blank strings, so we capture that information at this level
-		if len(record.Email) != 0 &&
-			!validate.IsValidEmail(record.Email) {
-			return ErrInvalidEmail
+		label, ok := normalizeLabel(childRecord.Label)
+		if ok {
+			childRecord.Label = label
+		} else {
+			errs.Add(field+".label", ErrInvalidEmailLabel)
 		}
-		if len(record.PhoneNumbers) == 0 {
-			return ErrMissingPhoneNumbers
+		if childRecord.IsPrimary {
+			primaryEmails++
 		}
-		for i, _ := range record.PhoneNumbers {
-			childRecord := &record.PhoneNumbers[i]
-			if childRecord.ID != 0 {
-				return errPhoneNumberAlreadyExists
-			}
-			phoneNumber := strings.TrimSpace(childRecord.Number)
-			// Validate phone number against Australian format as the test data provided to me
-			// implied that we should infer Australian numbers.
-			//
-			// I initially stumbled across this parsing/formatting implementation: https://github.com/dongri/phonenumber
-			// but it didn't fill me with much confidence as E.164 is seemingly like timezones, wherein they change
-			// requirements over time. I ideally want to buy-in to something that is maintained or easy to take over maintenance for.
-			//
-			// So then I discovered that Google had libraries dedicated to parsing this but only C/Java/JavaScript implementations:
-			// - https://github.com/google/libphonenumber
-			//
-			// So finally, after more googling I lucked upon this Golang implementation based on Google's Java implementation.
-			// It has reasonable tests and instructions on how to update the binary data. Promising! So I'm rolling with it.
-			// - https://github.com/nyaruka/phonenumbers
-			parsedNumber, err := phonenumbers.Parse(phoneNumber, "AU")
-			if err != nil {
-				return ErrInvalidPhoneNumber
-			}
-			formattedNum := phonenumbers.Format(parsedNumber, phonenumbers.E164)
-
-			// It feels like a bit of a code smell for the validation of this record
-			// to modify the phone numbers. But seems to be the best spot
-			// to put this logic for now, so, I'll just do it. If I get a better idea
-			// on where to place this, I'll can always move it later.
-			childRecord.Number = formattedNum
+	}
+	if primaryEmails > 1 {
+		errs.Add("emails", ErrMultiplePrimaryEmails)
+	}
+	if len(record.PhoneNumbers) == 0 {
+		errs.Add("phoneNumbers", ErrMissingPhoneNumbers)
+	}
+	primaryPhoneNumbers := 0
+	for i := range record.PhoneNumbers {
+		if record.PhoneNumbers[i].IsPrimary {
+			primaryPhoneNumbers++
 		}
+		// It feels like a bit of a code smell for the validation of this record
+		// to modify the phone numbers. But seems to be the best spot
+		// to put this logic for now, so, I'll just do it. If I get a better idea
+		// on where to place this, I'll can always move it later.
+		if err := normalizePhoneNumber(&record.PhoneNumbers[i], stored); err != nil {
+			errs.Add("phoneNumbers["+strconv.Itoa(i)+"]", err.(*validate.ValidationError))
+		}
+	}
+	if primaryPhoneNumbers > 1 {
+		errs.Add("phoneNumbers", ErrMultiplePrimaryPhoneNumbers)
 	}
+	return errs.Err()
+}
 
-	// Insert record into DB
+// normalizePhoneNumber will validate the given phone number and convert it into E.164 format.
+// The CountryCode is used to interpret local-format numbers and is then replaced with the
+// country the number belongs to.
+//
+// Any extension written as part of the number, ie. "(03) 9333 7119 ext. 123", is moved into
+// the Extension field. The LineType is also detected here.
+//
+// Every problem is found, and returned as a single *validate.ValidationError with the field
+// each is about, ie. "number" or "label". The phone number is only changed if it's valid.
+//
+// Numbers in stored don't have to be ones that can exist, see storedPhoneNumbers. It can be nil.
+func normalizePhoneNumber(phoneNumber *PhoneNumber, stored storedPhoneNumbers) error {
+	var errs validate.Errors
+	region := defaultRegion
+	if phoneNumber.CountryCode != "" {
+		var ok bool
+		region, ok = normalizeRegion(phoneNumber.CountryCode)
+		if !ok {
+			errs.Add("countryCode", ErrInvalidCountryCode)
+		}
+	}
+	// Previously we always validated against Australian format as the test data provided to me
+	// implied that we should infer Australian numbers. Now it's configurable, see SetDefaultRegion.
 	//
-	// We use an SQL transaction here so that if any errors occur during record creation, we don't
-	// end up with a Contact being partially created.
-	// (ie. if a PhoneNumber fails to insert for unknown reasons)
+	// I initially stumbled across this parsing/formatting implementation: https://github.com/dongri/phonenumber
+	// but it didn't fill me with much confidence as E.164 is seemingly like timezones, wherein they change
+	// requirements over time. I ideally want to buy-in to something that is maintained or easy to take over maintenance for.
 	//
-	// This transaction logic came in a bit later, the initial code didnt use them.
-	// In hindsight, I wish I explored using them when creating tables / setting up the mock data
-	// in the setup step. I want to redo it but I really just need to ship this.
-	tx, err := db.Get().Begin()
-	if err != nil {
+	// So then I discovered that Google had libraries dedicated to parsing this but only C/Java/JavaScript implementations:
+	// - https://github.com/google/libphonenumber
+	//
+	// So finally, after more googling I lucked upon this Golang implementation based on Google's Java implementation.
+	// It has reasonable tests and instructions on how to update the binary data. Promising! So I'm rolling with it.
+	// - https://github.com/nyaruka/phonenumbers
+	var parsedNumber *phonenumbers.PhoneNumber
+	if errs.Len() == 0 {
+		var err error
+		parsedNumber, err = phonenumbers.Parse(strings.TrimSpace(phoneNumber.Number), region)
+		if err != nil {
+			errs.Add("number", phoneNumberParseError(err))
+			parsedNumber = nil
+		} else if stored[phonenumbers.Format(parsedNumber, phonenumbers.E164)] {
+			// Already stored, so it's not new or changed
+		} else if err := phoneNumberValidityError(parsedNumber); err != nil {
+			errs.Add("number", err)
+		}
+	}
+	// Prefer the extension from the number itself, if it has one
+	extension := parsedNumber.GetExtension()
+	if extension == "" {
+		extension = strings.TrimSpace(phoneNumber.Extension)
+	}
+	if !isValidExtension(extension) {
+		errs.Add("extension", ErrInvalidPhoneNumberExtension)
+	}
+	label, ok := normalizeLabel(phoneNumber.Label)
+	if !ok {
+		errs.Add("label", ErrInvalidPhoneNumberLabel)
+	}
+	if err := errs.Err(); err != nil {
 		return err
 	}
-	hasCommitted := false
-	defer func() {
-		if hasCommitted {
-			return
-		}
-		// I haven't tested what happens in this case and I'm honestly not sure
-		// how robust this Rollback() call is.
-		// Will force this case to occur at a later date and see if I'm using this correctly
-		if err := tx.Rollback(); err != nil {
-			rErr = err
-		}
-	}()
-	err = tx.QueryRow(`INSERT INTO Contact (FullName, Email) VALUES ($1, $2) RETURNING ID`, record.FullName, record.Email).Scan(&record.ID)
-	if err != nil {
+	phoneNumber.Number = phonenumbers.Format(parsedNumber, phonenumbers.E164)
+	phoneNumber.CountryCode = regionForNumber(parsedNumber, region)
+	phoneNumber.Extension = extension
+	phoneNumber.Label = label
+	phoneNumber.LineType = lineTypeName(phonenumbers.GetNumberType(parsedNumber))
+	return nil
+}
+
+// InsertNew will validate and then store a new Contact, setting the IDs of it and its
+// Emails and PhoneNumbers. The actor is who's adding it, for the audit log, see AuditEntry.
+//
+// Returns a *DuplicateError, without storing anything, if the record looks like the same
+// person as an existing Contact. See FindDuplicates and InsertNewAllowingDuplicates.
+func InsertNew(actor Actor, record *Contact) error {
+	return insertNew(actor, record, false, nil)
+}
+
+// InsertNewAllowingDuplicates is the same as InsertNew, except that it will store the record
+// even if it looks like the same person as an existing Contact. ie. when the user has been
+// warned and still wants to go ahead.
+func InsertNewAllowingDuplicates(actor Actor, record *Contact) error {
+	return insertNew(actor, record, true, nil)
+}
+
+func insertNew(actor Actor, record *Contact, allowDuplicates bool, stored storedPhoneNumbers) error {
+	if err := validateNewRecord(record, stored); err != nil {
 		return err
 	}
-	if record.ID == 0 {
-		panic("Unexpected error. Failed get ID after inserting Contact record.")
+	if err := checkUIDIsUnused(record); err != nil {
+		return err
 	}
-	for _, childRecord := range record.PhoneNumbers {
-		err := tx.QueryRow(`INSERT INTO PhoneNumber (ContactID, Number) VALUES($1, $2) RETURNING ID`, record.ID, childRecord.Number).Scan(&childRecord.ID)
+	if !allowDuplicates {
+		// Two people submitting the same person at the same time could both get through
+		// this check. That's fine, this is to catch mistakes, not to enforce uniqueness.
+		duplicates, err := FindDuplicates(record)
 		if err != nil {
 			return err
 		}
-		if childRecord.ID == 0 {
-			panic("Unexpected error. Failed get ID after inserting PhoneNumber record.")
+		if len(duplicates) > 0 {
+			return &DuplicateError{Duplicates: duplicates}
 		}
 	}
-	if err := tx.Commit(); err != nil {
+	return currentStore().Insert(actor, record)
+}
+
+// validateNewRecord checks that the record hasn't been stored yet and then validates it,
+// see validateChangedRecord. stored is usually nil.
+func validateNewRecord(record *Contact, stored storedPhoneNumbers) error {
+	if record.ID != 0 {
+		return errContactAlreadyExists
+	}
+	for _, childRecord := range record.PhoneNumbers {
+		if childRecord.ID != 0 {
+			return errPhoneNumberAlreadyExists
+		}
+	}
+	for _, childRecord := range record.Emails {
+		if childRecord.ID != 0 {
+			return errEmailAlreadyExists
+		}
+	}
+	// A UID is generated if there isn't one, but one given by another address book must fit
+	if len(record.UID) > maxUIDLength || (record.UID != "" && strings.TrimSpace(record.UID) == "") {
+		return ErrInvalidUID
+	}
+	return validateChangedRecord(record, stored)
+}
+
+// checkUIDIsUnused returns ErrUIDAlreadyExists if the record was given a UID that an existing
+// Contact has, or ErrUIDInTrash if a deleted one has it. The UID column is unique anyway, this
+// is so the caller gets a validation error.
+func checkUIDIsUnused(record *Contact) error {
+	if record.UID == "" {
+		return nil
+	}
+	_, err := currentStore().GetByUID(record.UID)
+	if err == nil {
+		return ErrUIDAlreadyExists
+	}
+	if err != ErrNotFound {
 		return err
 	}
-	hasCommitted = true
-	return
+	isDeleted, err := currentStore().IsUIDInTrash(record.UID)
+	if err != nil {
+		return err
+	}
+	if isDeleted {
+		return ErrUIDInTrash
+	}
+	return nil
 }
 
-func GetAll() []Contact {
-	db := db.Get()
+// Update will validate and then overwrite the FullName, Emails and PhoneNumbers of an
+// existing Contact.
+//
+// Emails and PhoneNumbers are synchronized with what's stored against the Contact:
+// - Ones with an ID are updated in-place
+// - Ones without an ID are inserted
+// - Stored ones missing from the record are deleted. They don't go to the trash, as the
+// change is in the audit log, but deleted PhoneNumbers already in the trash are left alone.
+//
+// If the records Version isn't 0, it must be the Version that's stored, otherwise someone
+// else has changed the Contact since it was loaded and ErrVersionConflict is returned rather
+// than overwriting their changes. Leave it as 0 to overwrite whatever is stored.
+//
+// Returns ErrNotFound if no Contact exists with the records ID. Returns ErrEmailNotFound
+// or ErrPhoneNumberNotFound if an EmailAddress or PhoneNumber has an ID that doesn't belong
+// to the Contact.
+func Update(actor Actor, record *Contact) error {
+	if record.ID == 0 {
+		return errContactMissingID
+	}
+	stored, err := storedPhoneNumbersOf(record.ID)
+	if err != nil {
+		return err
+	}
+	if err := validateChangedRecord(record, stored); err != nil {
+		return err
+	}
+	return currentStore().Update(actor, record)
+}
 
-	// I considered using an INNER JOIN like this:
-	// - INNER JOIN PhoneNumber ON PhoneNumber.ContactID = Contact.ID
-	// But ultimately just opted to do a query per records has_many for simplicity
-	// and easier extensibility. (ie. adding more relationships, etc)
-	rows, err := db.Query(`SELECT ID, FullName, Email FROM Contact`)
+// storedPhoneNumbersOf returns the phone numbers the Contact with the given ID already has.
+// There are none if it doesn't exist, as the store returns ErrNotFound for that.
+func storedPhoneNumbersOf(id int64) (storedPhoneNumbers, error) {
+	existing, err := currentStore().Get(id)
+	if err == ErrNotFound {
+		return nil, nil
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	var contacts []Contact
-	for rows.Next() {
-		record := Contact{}
-		err := rows.Scan(&record.ID, &record.FullName, &record.Email)
-		if err != nil {
-			panic(err)
-		}
-		childRows, err := db.Query(`SELECT ID, ContactID, Number FROM PhoneNumber WHERE ContactID = $1`, record.ID)
-		if err != nil {
-			panic(err)
-		}
-		for childRows.Next() {
-			childRecord := PhoneNumber{}
-			err := childRows.Scan(&childRecord.ID, &childRecord.ContactID, &childRecord.Number)
-			if err != nil {
-				panic(err)
-			}
-			record.PhoneNumbers = append(record.PhoneNumbers, childRecord)
-		}
-		contacts = append(contacts, record)
+	return newStoredPhoneNumbers(&existing), nil
+}
+
+// Delete will move the Contact, with its Emails and PhoneNumbers, to the trash. It's hidden
+// from everything but the trash until it's restored or purged, see ListTrash.
+//
+// Returns ErrNotFound if no Contact exists with the given ID.
+func Delete(actor Actor, id int64) error {
+	return currentStore().Delete(actor, id, 0)
+}
+
+// DeleteIfVersion is the same as Delete, but returns ErrVersionConflict rather than deleting
+// the Contact if it's been changed since it was at the given Version.
+func DeleteIfVersion(actor Actor, id int64, version int64) error {
+	return currentStore().Delete(actor, id, version)
+}
+
+// Get will return the Contact with the given ID, including its PhoneNumbers.
+//
+// Returns ErrNotFound if no Contact exists with the given ID.
+func Get(id int64) (Contact, error) {
+	return currentStore().Get(id)
+}
+
+// GetByUID will return the Contact with the given UID, including its PhoneNumbers.
+//
+// Returns ErrNotFound if no Contact exists with the given UID.
+func GetByUID(uid string) (Contact, error) {
+	return currentStore().GetByUID(uid)
+}
+
+// GetAll will return every contact.
+//
+// This loads everything into memory, so prefer List where possible.
+func GetAll() []Contact {
+	contacts, err := currentStore().GetAll()
+	if err != nil {
+		panic(err)
 	}
 	return contacts
 }
 
-// MustInitialize will setup the necessary tables and add some mock data into the
-// database.
+// MustInsertMockData will add some mock data into the database if there are no
+// Contact records yet.
 //
 // This function will panic if an error occurs.
-func MustInitialize() {
-	db := db.Get()
-
-	// Create tables
-	didTablesAlreadyExist := false
-	createTables := []string{
-		`CREATE TABLE Contact(
-			ID        SERIAL PRIMARY KEY NOT NULL,
-			FullName  VARCHAR(255)       NOT NULL,
-			Email     VARCHAR(255)       NOT NULL
-		)`,
-		`CREATE TABLE PhoneNumber(
-			ID        SERIAL PRIMARY KEY NOT NULL,
-			ContactID INT                NOT NULL,
-			Number    VARCHAR(16)        NOT NULL,
-			CONSTRAINT FkContactID FOREIGN KEY (ContactID) REFERENCES Contact (ID)
-		)`,
-	}
-	for _, createTableQuery := range createTables {
-		if _, err := db.Query(createTableQuery); err != nil {
-			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P07" {
-				// do nothing if "duplicate_table" error, we've already created this table
-				didTablesAlreadyExist = true
-			} else {
-				panic(err)
-			}
-		}
+func MustInsertMockData() {
+	// Previously this only ran if the tables didn't already exist. Now that tables are created
+	// by migrations, we just check if there's any data so that running this against an existing
+	// deployment won't add a second copy of the mock data.
+	count, err := currentStore().Count()
+	if err != nil {
+		panic(err)
+	}
+	if count > 0 {
+		return
 	}
 
-	// This isn't the nicest way to insert dummy data but it's good enough for now.
-	// Ideally, we'd just check if these specific records were already in there and if not, insert them.
-	if !didTablesAlreadyExist {
-		// Fill with data
-		records := []*Contact{
-			{
-				FullName: "Alex Bell",
-				PhoneNumbers: []PhoneNumber{
-					{Number: "03 8578 6688"},
-					{Number: "1800728069"},
-				},
+	records := []*Contact{
+		{
+			FullName: "Alex Bell",
+			PhoneNumbers: []PhoneNumber{
+				{Number: "03 8578 6688"},
+				{Number: "1800728069"},
 			},
-			{
-				FullName: "Fredrik Idestam",
-				PhoneNumbers: []PhoneNumber{
-					{Number: "+6139888998"},
-				},
+		},
+		{
+			FullName: "Fredrik Idestam",
+			PhoneNumbers: []PhoneNumber{
+				{Number: "+6139888998"},
 			},
-			{
-				FullName: "Radia Perlman",
-				Email:    "rperl001@mit.edu",
-				PhoneNumbers: []PhoneNumber{
-					{Number: "(03) 9333 7119"},
-					{Number: "0488445688"},
-					{Number: "+61488224568"},
-				},
+		},
+		{
+			FullName: "Radia Perlman",
+			Emails: []EmailAddress{
+				{Address: "rperl001@mit.edu", IsPrimary: true},
 			},
-		}
-		for i, record := range records {
-			if err := InsertNew(record); err != nil {
-				panic(fmt.Sprintf("Failed to insert record %d: %s", i, err))
-			}
-		}
+			PhoneNumbers: []PhoneNumber{
+				{Number: "(03) 9333 7119"},
+				{Number: "0488445688"},
+				{Number: "+61488224568"},
+			},
+		},
 	}
-}
-
-func MustDestroy() {
-	db := db.Get()
-
-	// The TABLE constraint on PhoneNumber means we need to DROP it first or else
-	// there will be an SQL error. Generally when I need to DROP all tables, I run some
-	// SQL to remove any constraints on them so I can drop them out-of-order and not have
-	// to think too hard about it.
-	dropTables := []string{
-		`DROP TABLE PhoneNumber`,
-		`DROP TABLE Contact`,
-	}
-	for _, dropTableQuery := range dropTables {
-		if _, err := db.Query(dropTableQuery); err != nil {
-			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P01" {
-				// Do nothing if "undefined_table" error.
-				// Just means table doesn't exist so if it never existed, thats fine.
-			} else {
-				panic(err)
-			}
+	// "+6139888998" isn't a number that can exist, but the mock data is kept as it was from
+	// before we checked that, the same as numbers that are already stored.
+	stored := newStoredPhoneNumbers(records...)
+	for i, record := range records {
+		if err := insertNew(SystemActor, record, false, stored); err != nil {
+			panic(fmt.Sprintf("Failed to insert record %d: %s", i, err))
 		}
 	}
 }
@@ -0,0 +1,106 @@
+package contact
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+func TestValidateRecord(t *testing.T) {
+	record := Contact{
+		FullName: strings.Repeat("a", 255),
+		Emails: []EmailAddress{
+			{Address: "jake@example.com", IsPrimary: true},
+			{Address: "not an email", Label: strings.Repeat("a", maxLabelLength+1)},
+			{Address: "jake@work.example.com", IsPrimary: true},
+		},
+		PhoneNumbers: []PhoneNumber{
+			{Number: "(03) 9333 7119"},
+			{Number: "not a number"},
+			{Number: "043", Extension: "reception"},
+			{Number: "0400 000 000", CountryCode: "XX"},
+		},
+	}
+	err := validateRecord(&record)
+	validationErr, ok := err.(*validate.ValidationError)
+	if !ok {
+		t.Fatalf("expected a *validate.ValidationError but got %v", err)
+	}
+	// Every problem is found, not only the first. The codes are checked against the strings
+	// rather than the errors, as clients depend on them never changing.
+	want := []validate.FieldError{
+		{Field: "fullName", Code: "contact.full_name.too_long", Message: ErrInvalidFullName.Error()},
+		{Field: "emails[1].address", Code: "contact.email.invalid", Message: ErrInvalidEmail.Error()},
+		{Field: "emails[1].label", Code: "contact.email.label_too_long", Message: ErrInvalidEmailLabel.Error()},
+		{Field: "emails", Code: "contact.email.multiple_primary", Message: ErrMultiplePrimaryEmails.Error()},
+		{Field: "phoneNumbers[1].number", Code: "contact.phone.not_a_number", Message: ErrInvalidPhoneNumber.Error()},
+		{Field: "phoneNumbers[2].number", Code: "contact.phone.too_short", Message: ErrPhoneNumberTooShort.Error()},
+		{Field: "phoneNumbers[2].extension", Code: "contact.phone.invalid_extension", Message: ErrInvalidPhoneNumberExtension.Error()},
+		{Field: "phoneNumbers[3].countryCode", Code: "contact.phone.invalid_country", Message: ErrInvalidCountryCode.Error()},
+	}
+	got := validationErr.Fields()
+	if len(got) != len(want) {
+		t.Fatalf("expected problems %+v but got %+v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected problem %d to be %+v but got %+v", i, want[i], got[i])
+		}
+	}
+	if !errors.Is(err, ErrInvalidEmail) || errors.Is(err, ErrMissingPhoneNumbers) {
+		t.Errorf("expected errors.Is to find the problems")
+	}
+
+	err = validateRecord(&Contact{FullName: "Jake"})
+	if !errors.Is(err, ErrMissingPhoneNumbers) {
+		t.Errorf("expected %v but got %v", ErrMissingPhoneNumbers, err)
+	}
+	err = validateRecord(&Contact{FullName: "Jake", PhoneNumbers: []PhoneNumber{{Number: "0488 445 688", IsPrimary: true}, {Number: "(03) 9333 7119", IsPrimary: true}}})
+	if fields := err.(*validate.ValidationError).Fields(); len(fields) != 1 || fields[0].Field != "phoneNumbers" || fields[0].Code != "contact.phone.multiple_primary" {
+		t.Errorf("expected multiple primary phone numbers to be refused but got %+v", fields)
+	}
+	if err := validateRecord(&Contact{FullName: "Jake", PhoneNumbers: []PhoneNumber{{Number: "(03) 9333 7119"}}}); err != nil {
+		t.Errorf("expected no problems but got %v", err)
+	}
+}
+
+func TestUpdateStoredPhoneNumbers(t *testing.T) {
+	SetStore(NewMemoryStore())
+	defer SetStore(nil)
+
+	// Stored before we checked that numbers can exist, so it's inserted without validation
+	record := Contact{
+		FullName:     "Fredrik Idestam",
+		PhoneNumbers: []PhoneNumber{{Number: "+6143", CountryCode: "AU"}},
+	}
+	if err := currentStore().Insert(testActor, &record); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+
+	// Changing anything else, or the number's details, is fine
+	record.FullName = "Fredrik Idestam Jr."
+	if err := Update(testActor, &record); err != nil {
+		t.Fatalf("update: expected the stored number to be kept but got %v", err)
+	}
+	phoneNumber := record.PhoneNumbers[0]
+	phoneNumber.Label = LabelWork
+	if _, err := UpdatePhoneNumber(testActor, 0, &phoneNumber); err != nil {
+		t.Fatalf("update phone number: expected the stored number to be kept but got %v", err)
+	}
+
+	// New or changed numbers must be ones that can exist
+	record, err := Get(record.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	record.PhoneNumbers = append(record.PhoneNumbers, PhoneNumber{Number: "+61 4"})
+	if err := Update(testActor, &record); !errors.Is(err, ErrPhoneNumberTooShort) {
+		t.Errorf("update: expected %v for a new number but got %v", ErrPhoneNumberTooShort, err)
+	}
+	phoneNumber.Number = "+61 4"
+	if _, err := UpdatePhoneNumber(testActor, 0, &phoneNumber); !errors.Is(err, ErrPhoneNumberTooShort) {
+		t.Errorf("update phone number: expected %v for a changed number but got %v", ErrPhoneNumberTooShort, err)
+	}
+}
@@ -0,0 +1,172 @@
+package contact
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/trigram"
+)
+
+// DuplicateReason is why a Contact is considered a possible duplicate of another.
+type DuplicateReason string
+
+const (
+	// DuplicateReasonPhoneNumber is when both contacts have the same phone number and extension,
+	// after being normalized into E.164 format.
+	DuplicateReasonPhoneNumber DuplicateReason = "phoneNumber"
+	// DuplicateReasonEmail is when both contacts have the same email, ignoring case.
+	DuplicateReasonEmail DuplicateReason = "email"
+	// DuplicateReasonFullName is when both contacts have a similar name, ie. "Radia Perlman"
+	// and "Radia Perlmen".
+	DuplicateReasonFullName DuplicateReason = "fullName"
+)
+
+// Description returns the reason in a human readable form, ie. "Phone Number"
+func (reason DuplicateReason) Description() string {
+	switch reason {
+	case DuplicateReasonPhoneNumber:
+		return "Phone Number"
+	case DuplicateReasonEmail:
+		return "Email"
+	case DuplicateReasonFullName:
+		return "Full Name"
+	}
+	return string(reason)
+}
+
+// duplicateNameThreshold is how similar (0 to 1) two full names must be for the contacts to be
+// considered duplicates. Similarity is measured with trigrams, see the "trigram" package.
+//
+// This was chosen by trying a few names, ie. "Alex Bell" and "Alexander Bell" are 0.56, whereas
+// "John Smith" and "Jane Smith" are 0.47.
+const duplicateNameThreshold = 0.5
+
+// Duplicate is an existing Contact that looks like the same person as another.
+type Duplicate struct {
+	Contact Contact           `json:"contact"`
+	Reasons []DuplicateReason `json:"reasons"`
+}
+
+// DuplicateError is returned by InsertNew when the record looks like the same person as
+// one or more existing contacts.
+type DuplicateError struct {
+	Duplicates []Duplicate
+}
+
+func (err *DuplicateError) Error() string {
+	names := make([]string, len(err.Duplicates))
+	for i, duplicate := range err.Duplicates {
+		names[i] = duplicate.Contact.FullName
+	}
+	return "Contact may be a duplicate of: " + strings.Join(names, ", ")
+}
+
+// FindDuplicates returns the existing contacts that look like the same person as the record.
+// The record should already be validated, so that its phone numbers are in E.164 format.
+//
+// The record itself is never returned as a duplicate, so this can be used for records that
+// have already been inserted. Duplicates are ordered by ID.
+func FindDuplicates(record *Contact) ([]Duplicate, error) {
+	// We use the existing List filters to find candidates and then check each candidate
+	// properly, as the filters are "contains" matches rather than exact ones.
+	var candidateOptions []ListOptions
+	for _, phoneNumber := range record.PhoneNumbers {
+		candidateOptions = append(candidateOptions, ListOptions{PhoneNumber: phoneNumber.Number})
+	}
+	for _, email := range record.Emails {
+		candidateOptions = append(candidateOptions, ListOptions{Email: email.Address})
+	}
+	if fullName := strings.TrimSpace(record.FullName); fullName != "" {
+		candidateOptions = append(candidateOptions, ListOptions{Search: fullName})
+	}
+	candidates := make(map[int64]Contact)
+	for _, options := range candidateOptions {
+		contacts, err := findDuplicateCandidates(options)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range contacts {
+			if candidate.ID != record.ID {
+				candidates[candidate.ID] = candidate
+			}
+		}
+	}
+
+	duplicates := []Duplicate{}
+	for _, candidate := range candidates {
+		candidate := candidate
+		reasons := duplicateReasons(&candidate, record)
+		if len(reasons) == 0 {
+			continue
+		}
+		duplicates = append(duplicates, Duplicate{
+			Contact: candidate,
+			Reasons: reasons,
+		})
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Contact.ID < duplicates[j].Contact.ID
+	})
+	return duplicates, nil
+}
+
+// duplicateReasons returns why the record looks like the same person as the existing Contact,
+// or nothing if it doesn't.
+func duplicateReasons(existing *Contact, record *Contact) []DuplicateReason {
+	var reasons []DuplicateReason
+	for _, phoneNumber := range record.PhoneNumbers {
+		if hasPhoneNumber(existing, phoneNumber) {
+			reasons = append(reasons, DuplicateReasonPhoneNumber)
+			break
+		}
+	}
+	for _, email := range record.Emails {
+		if hasEmail(existing, email.Address) {
+			reasons = append(reasons, DuplicateReasonEmail)
+			break
+		}
+	}
+	if isSimilarFullName(existing.FullName, record.FullName) {
+		reasons = append(reasons, DuplicateReasonFullName)
+	}
+	return reasons
+}
+
+// findDuplicateCandidates lists the contacts matching the filters in options. Only the first
+// page of the most relevant contacts is considered, as anything past that is unlikely to be
+// a duplicate.
+func findDuplicateCandidates(options ListOptions) ([]Contact, error) {
+	options.Limit = MaxListLimit
+	options.SortBy = options.DefaultSortBy()
+	result, err := currentStore().List(options)
+	if err != nil {
+		return nil, err
+	}
+	return result.Contacts, nil
+}
+
+// hasPhoneNumber returns true if the record has the same phone number and extension. Different
+// extensions are different people, ie. two people at the same business.
+func hasPhoneNumber(record *Contact, phoneNumber PhoneNumber) bool {
+	for _, existing := range record.PhoneNumbers {
+		if existing.Number == phoneNumber.Number &&
+			existing.Extension == phoneNumber.Extension {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEmail returns true if the record has the same email, ignoring case.
+func hasEmail(record *Contact, address string) bool {
+	for _, existing := range record.Emails {
+		if strings.EqualFold(existing.Address, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSimilarFullName(a, b string) bool {
+	return trigram.Similarity(strings.ToLower(a), strings.ToLower(b)) >= duplicateNameThreshold
+}
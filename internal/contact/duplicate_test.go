@@ -0,0 +1,177 @@
+package contact
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInsertNewDuplicates(t *testing.T) {
+	SetStore(NewMemoryStore())
+	defer SetStore(nil)
+
+	existing := Contact{
+		FullName: "Radia Perlman",
+		Emails:   []EmailAddress{{Address: "rperl001@mit.edu"}},
+		PhoneNumbers: []PhoneNumber{
+			{Number: "(03) 9333 7119", Extension: "123"},
+		},
+	}
+	if err := InsertNew(testActor, &existing); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+
+	type TestData struct {
+		Record  Contact
+		Reasons []DuplicateReason
+	}
+	testDataList := []TestData{
+		{
+			Record:  Contact{FullName: "Radia Perlmen", PhoneNumbers: []PhoneNumber{{Number: "0488445688"}}},
+			Reasons: []DuplicateReason{DuplicateReasonFullName},
+		},
+		{
+			// Same number in a different format
+			Record:  Contact{FullName: "Someone Else", PhoneNumbers: []PhoneNumber{{Number: "+61 3 9333 7119 ext. 123"}}},
+			Reasons: []DuplicateReason{DuplicateReasonPhoneNumber},
+		},
+		{
+			Record: Contact{
+				FullName:     "R. Perlman",
+				Emails:       []EmailAddress{{Address: "RPERL001@MIT.EDU"}},
+				PhoneNumbers: []PhoneNumber{{Number: "(03) 9333 7119", Extension: "123"}},
+			},
+			Reasons: []DuplicateReason{DuplicateReasonPhoneNumber, DuplicateReasonEmail, DuplicateReasonFullName},
+		},
+		// Not duplicates
+		{
+			Record: Contact{FullName: "John Smith", PhoneNumbers: []PhoneNumber{{Number: "0488445688"}}},
+		},
+		{
+			// A different extension on the same number is a different person
+			Record: Contact{FullName: "Someone Else", PhoneNumbers: []PhoneNumber{{Number: "(03) 9333 7119", Extension: "456"}}},
+		},
+		{
+			// Only part of the email matches
+			Record: Contact{FullName: "Someone Else", Emails: []EmailAddress{{Address: "perl001@mit.edu"}}, PhoneNumbers: []PhoneNumber{{Number: "0488445688"}}},
+		},
+	}
+	for _, testData := range testDataList {
+		record := testData.Record
+		err := InsertNew(testActor, &record)
+		if testData.Reasons == nil {
+			if err != nil {
+				t.Errorf("%s: expected no error but got %v", testData.Record.FullName, err)
+			} else if err := Delete(testActor, record.ID); err != nil {
+				t.Fatalf("delete: %s", err)
+			}
+			continue
+		}
+		duplicateErr, ok := err.(*DuplicateError)
+		if !ok {
+			t.Errorf("%s: expected a duplicate error but got %v", testData.Record.FullName, err)
+			continue
+		}
+		if len(duplicateErr.Duplicates) != 1 ||
+			duplicateErr.Duplicates[0].Contact.ID != existing.ID ||
+			!reflect.DeepEqual(duplicateErr.Duplicates[0].Reasons, testData.Reasons) {
+			t.Errorf("%s: expected reasons %v but got %+v", testData.Record.FullName, testData.Reasons, duplicateErr.Duplicates)
+		}
+		if record.ID != 0 {
+			t.Errorf("%s: expected duplicate to not be inserted", testData.Record.FullName)
+		}
+		if err := InsertNewAllowingDuplicates(testActor, &record); err != nil {
+			t.Errorf("%s: expected to be able to insert the duplicate anyway but got %v", testData.Record.FullName, err)
+		} else if err := Delete(testActor, record.ID); err != nil {
+			t.Fatalf("delete: %s", err)
+		}
+	}
+
+	// A record isn't a duplicate of itself
+	if duplicates, err := FindDuplicates(&existing); err != nil || len(duplicates) != 0 {
+		t.Errorf("expected no duplicates of itself but got %+v (%v)", duplicates, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	SetStore(NewMemoryStore())
+	defer SetStore(nil)
+
+	target := Contact{
+		FullName: "Radia Perlman",
+		Emails:   []EmailAddress{{Address: "rperl001@mit.edu", IsPrimary: true}},
+		PhoneNumbers: []PhoneNumber{
+			{Number: "(03) 9333 7119"},
+		},
+	}
+	if err := InsertNew(testActor, &target); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	source := Contact{
+		FullName: "Radia Perlmen",
+		Emails: []EmailAddress{
+			{Address: "RPERL001@mit.edu"},
+			{Address: "radia@work.com", Label: LabelWork, IsPrimary: true},
+		},
+		PhoneNumbers: []PhoneNumber{
+			{Number: "+61393337119"},
+			{Number: "0488445688", IsPrimary: true},
+		},
+	}
+	if err := InsertNewAllowingDuplicates(testActor, &source); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+
+	if _, _, err := Merge(testActor, target.ID, 0, target.ID, 0); err != ErrMergeSameContact {
+		t.Fatalf("expected %v but got %v", ErrMergeSameContact, err)
+	}
+	if _, _, err := Merge(testActor, target.ID, 0, -1, 0); err != ErrNotFound {
+		t.Fatalf("expected %v but got %v", ErrNotFound, err)
+	}
+	if _, _, err := Merge(testActor, target.ID, target.Version+1, source.ID, source.Version); err != ErrVersionConflict {
+		t.Fatalf("expected %v for a stale target but got %v", ErrVersionConflict, err)
+	}
+	if _, _, err := Merge(testActor, target.ID, target.Version, source.ID, source.Version+1); err != ErrVersionConflict {
+		t.Fatalf("expected %v for a stale source but got %v", ErrVersionConflict, err)
+	}
+	merged, audit, err := Merge(testActor, target.ID, target.Version, source.ID, source.Version)
+	if err != nil {
+		t.Fatalf("merge: %s", err)
+	}
+	if merged.FullName != "Radia Perlman" {
+		t.Errorf("expected the targets name to be kept but got %q", merged.FullName)
+	}
+	// The duplicate email and phone number aren't copied and the target keeps its
+	// primary email. The target had no primary phone number, so the sources is kept.
+	if len(merged.Emails) != 2 ||
+		!merged.Emails[0].IsPrimary ||
+		merged.Emails[1].Address != "radia@work.com" || merged.Emails[1].IsPrimary || merged.Emails[1].Label != LabelWork {
+		t.Errorf("unexpected emails: %+v", merged.Emails)
+	}
+	if len(merged.PhoneNumbers) != 2 ||
+		merged.PhoneNumbers[0].IsPrimary ||
+		merged.PhoneNumbers[1].Number != "+61488445688" || !merged.PhoneNumbers[1].IsPrimary {
+		t.Errorf("unexpected phone numbers: %+v", merged.PhoneNumbers)
+	}
+	if audit.ID == 0 ||
+		audit.TargetContactID != target.ID ||
+		audit.SourceContactID != source.ID ||
+		!reflect.DeepEqual(audit.Source, source) ||
+		!reflect.DeepEqual(audit.AddedEmails, []EmailAddress{source.Emails[1]}) ||
+		!reflect.DeepEqual(audit.AddedPhoneNumbers, []PhoneNumber{source.PhoneNumbers[1]}) {
+		t.Errorf("unexpected audit: %+v", audit)
+	}
+	if _, err := Get(source.ID); err != ErrNotFound {
+		t.Errorf("expected source to be deleted but got %v", err)
+	}
+	// Restoring the source would bring back the duplicate
+	if err := Restore(testActor, source.ID); err != ErrRestoreMergedAway {
+		t.Errorf("expected %v when restoring the source but got %v", ErrRestoreMergedAway, err)
+	}
+	merges, err := GetMerges(target.ID)
+	if err != nil {
+		t.Fatalf("get merges: %s", err)
+	}
+	if len(merges) != 1 || merges[0].ID != audit.ID {
+		t.Errorf("expected the merge to be stored but got %+v", merges)
+	}
+}
@@ -0,0 +1,206 @@
+package contact
+
+import (
+	"strconv"
+
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+// ImportStatus is what happened to a single record when importing.
+type ImportStatus string
+
+const (
+	// ImportStatusInserted is a record that was valid and has been inserted
+	ImportStatusInserted ImportStatus = "inserted"
+	// ImportStatusValid is a record that is valid but wasn't inserted, either because it was
+	// a dry run or because another record failed when importing all or nothing.
+	ImportStatusValid ImportStatus = "valid"
+	// ImportStatusInvalid is a record that failed validation
+	ImportStatusInvalid ImportStatus = "invalid"
+	// ImportStatusDuplicate is a record that looks like the same person as an existing Contact
+	// or an earlier record in the same import.
+	ImportStatusDuplicate ImportStatus = "duplicate"
+	// ImportStatusFailed is a valid record that couldn't be inserted, ie. the database is down.
+	// The other records are still inserted, unless importing all or nothing.
+	ImportStatusFailed ImportStatus = "failed"
+)
+
+// ImportOptions changes how records are imported.
+type ImportOptions struct {
+	// DryRun will validate every record and report what would happen, without inserting anything.
+	DryRun bool
+	// AllOrNothing will only insert the records if every record is valid. Otherwise each valid
+	// record is inserted, regardless of whether other records failed.
+	AllOrNothing bool
+	// AllowDuplicates will insert records even if they look like the same person as an existing
+	// Contact, see InsertNewAllowingDuplicates.
+	AllowDuplicates bool
+}
+
+// ImportRecord is a Contact to be imported and where it came from.
+type ImportRecord struct {
+	// Row is where the record is in the file being imported, ie. the row of a CSV file or
+	// the line a vCard starts on. It's only used for reporting.
+	Row     int
+	Contact Contact
+}
+
+// ImportResult is what happened to a single ImportRecord.
+type ImportResult struct {
+	Row      int          `json:"row"`
+	FullName string       `json:"fullName"`
+	Status   ImportStatus `json:"status"`
+	// Error is why the record failed, if it did
+	Error string `json:"error,omitempty"`
+	// Fields is every problem with the record, with the field each is about, if it failed
+	// validation
+	Fields []validate.FieldError `json:"fields,omitempty"`
+	// ContactID is the ID the record was inserted with, if it was
+	ContactID int64 `json:"contactId,omitempty"`
+}
+
+// ImportReport is the result of Import.
+type ImportReport struct {
+	DryRun       bool           `json:"dryRun"`
+	AllOrNothing bool           `json:"allOrNothing"`
+	Inserted     int            `json:"inserted"`
+	Failed       int            `json:"failed"`
+	Results      []ImportResult `json:"results"`
+}
+
+// Import will validate and then insert each of the records, the same as InsertNew, and report
+// what happened to each of them.
+//
+// Records that fail validation or look like duplicates are reported rather than returned as an
+// error, as are records that fail to be inserted, so that the report says which records were
+// inserted. An error is only returned if something unexpected went wrong before inserting any
+// records, ie. the database is down while checking for duplicates, or when importing all or
+// nothing.
+func Import(actor Actor, records []ImportRecord, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{
+		DryRun:       options.DryRun,
+		AllOrNothing: options.AllOrNothing,
+		Results:      make([]ImportResult, len(records)),
+	}
+	validRecords := make([]*Contact, 0, len(records))
+	validResults := make([]*ImportResult, 0, len(records))
+	for i := range records {
+		// Validation normalizes the record, so copy it to leave the callers records as they were
+		record := *copyContact(&records[i].Contact)
+		result := &report.Results[i]
+		result.Row = records[i].Row
+		result.FullName = record.FullName
+		if err := validateNewRecord(&record, nil); err != nil {
+			validationErr, ok := err.(*validate.ValidationError)
+			if !ok {
+				return ImportReport{}, err
+			}
+			result.Status = ImportStatusInvalid
+			result.Error = validationErr.Error()
+			result.Fields = validationErr.Fields()
+			report.Failed++
+			continue
+		}
+		uidErr := checkUIDIsUnused(&record)
+		if uidErr == nil && hasUID(validRecords, record.UID) {
+			uidErr = ErrUIDAlreadyExists
+		}
+		if uidErr != nil {
+			// ie. ErrUIDAlreadyExists or ErrUIDInTrash
+			validationErr, ok := uidErr.(*validate.ValidationError)
+			if !ok {
+				return ImportReport{}, uidErr
+			}
+			var errs validate.Errors
+			errs.Add("uid", validationErr)
+			result.Status = ImportStatusInvalid
+			result.Error = validationErr.Error()
+			result.Fields = errs.Err().(*validate.ValidationError).Fields()
+			report.Failed++
+			continue
+		}
+		if !options.AllowDuplicates {
+			duplicates, err := FindDuplicates(&record)
+			if err != nil {
+				return ImportReport{}, err
+			}
+			if len(duplicates) > 0 {
+				result.Status = ImportStatusDuplicate
+				result.Error = (&DuplicateError{Duplicates: duplicates}).Error()
+				report.Failed++
+				continue
+			}
+			// Earlier records won't have been inserted yet, so check against them too
+			if duplicateResult := findDuplicateResult(validRecords, validResults, &record); duplicateResult != nil {
+				result.Status = ImportStatusDuplicate
+				result.Error = "Contact may be a duplicate of row " + strconv.Itoa(duplicateResult.Row)
+				report.Failed++
+				continue
+			}
+		}
+		result.Status = ImportStatusValid
+		validRecords = append(validRecords, &record)
+		validResults = append(validResults, result)
+	}
+
+	if options.DryRun ||
+		(options.AllOrNothing && report.Failed > 0) {
+		return report, nil
+	}
+	if options.AllOrNothing {
+		if err := currentStore().InsertAll(actor, validRecords); err != nil {
+			return ImportReport{}, err
+		}
+		for i, record := range validRecords {
+			validResults[i].Status = ImportStatusInserted
+			validResults[i].ContactID = record.ID
+		}
+		report.Inserted = len(validRecords)
+		return report, nil
+	}
+	for i, record := range validRecords {
+		result := validResults[i]
+		if err := currentStore().Insert(actor, record); err != nil {
+			// Keep going, so that the rows already inserted, and any after this that can be,
+			// are in the report
+			result.Status = ImportStatusFailed
+			result.Error = err.Error()
+			if validationErr, ok := err.(*validate.ValidationError); ok {
+				// ie. ErrUIDAlreadyExists, if another request inserted the same UID since
+				// it was checked
+				result.Fields = validationErr.Fields()
+			}
+			report.Failed++
+			continue
+		}
+		result.Status = ImportStatusInserted
+		result.ContactID = record.ID
+		report.Inserted++
+	}
+	return report, nil
+}
+
+// hasUID returns true if one of the records has the given UID. Records without a UID are
+// given a unique one when inserted, so they never match.
+func hasUID(records []*Contact, uid string) bool {
+	if uid == "" {
+		return false
+	}
+	for _, record := range records {
+		if record.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// findDuplicateResult returns the result of the first record that looks like the same person
+// as the given record, or nil if there isn't one.
+func findDuplicateResult(records []*Contact, results []*ImportResult, record *Contact) *ImportResult {
+	for i, existing := range records {
+		if len(duplicateReasons(existing, record)) > 0 {
+			return results[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package contact
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestImport(t *testing.T) {
+	SetStore(NewMemoryStore())
+	defer SetStore(nil)
+
+	existing := Contact{
+		FullName:     "Radia Perlman",
+		PhoneNumbers: []PhoneNumber{{Number: "(03) 9333 7119"}},
+	}
+	if err := InsertNew(testActor, &existing); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	records := []ImportRecord{
+		{Row: 2, Contact: Contact{FullName: "Alex Bell", PhoneNumbers: []PhoneNumber{{Number: "03 8578 6688"}}}},
+		{Row: 3, Contact: Contact{FullName: "Bad Email", Emails: []EmailAddress{{Address: "BAD_EMAIL"}}, PhoneNumbers: []PhoneNumber{{Number: "0488445688"}}}},
+		{Row: 4, Contact: Contact{FullName: "R. Perlman", PhoneNumbers: []PhoneNumber{{Number: "+61393337119"}}}},
+		{Row: 5, Contact: Contact{FullName: "Alexander Bell", PhoneNumbers: []PhoneNumber{{Number: "1800728069"}}}},
+		{Row: 6, Contact: Contact{FullName: "Fredrik Idestam", PhoneNumbers: []PhoneNumber{{Number: "+61398889980"}}}},
+	}
+	expectedStatuses := []ImportStatus{
+		ImportStatusValid,
+		ImportStatusInvalid,
+		ImportStatusDuplicate,
+		ImportStatusDuplicate,
+		ImportStatusValid,
+	}
+	checkStatuses := func(name string, report ImportReport, expected []ImportStatus) {
+		t.Helper()
+		if len(report.Results) != len(expected) {
+			t.Fatalf("%s: expected %d results but got %+v", name, len(expected), report.Results)
+		}
+		for i, result := range report.Results {
+			if result.Row != records[i].Row || result.Status != expected[i] {
+				t.Errorf("%s: row %d: expected %s but got %+v", name, records[i].Row, expected[i], result)
+			}
+			if (result.Error != "") != (expected[i] == ImportStatusInvalid || expected[i] == ImportStatusDuplicate) {
+				t.Errorf("%s: row %d: unexpected error %q", name, result.Row, result.Error)
+			}
+		}
+	}
+
+	// Dry run, nothing is inserted
+	report, err := Import(testActor, records, ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses("dry run", report, expectedStatuses)
+	if report.Failed != 3 || report.Inserted != 0 {
+		t.Errorf("dry run: expected 3 failed and 0 inserted but got %+v", report)
+	}
+	if report.Results[3].Error != "Contact may be a duplicate of row 2" {
+		t.Errorf("dry run: expected row 5 to be a duplicate of row 2 but got %q", report.Results[3].Error)
+	}
+	if records[0].Contact.PhoneNumbers[0].Number != "03 8578 6688" {
+		t.Errorf("expected the given records to not be modified")
+	}
+
+	// All or nothing, nothing is inserted as some rows failed
+	report, err = Import(testActor, records, ImportOptions{AllOrNothing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses("all or nothing", report, expectedStatuses)
+	if count, _ := currentStore().Count(); count != 1 || report.Inserted != 0 {
+		t.Errorf("all or nothing: expected nothing to be inserted but there are %d contacts", count)
+	}
+
+	// Otherwise the valid rows are inserted
+	report, err = Import(testActor, records, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses("import", report, []ImportStatus{
+		ImportStatusInserted,
+		ImportStatusInvalid,
+		ImportStatusDuplicate,
+		ImportStatusDuplicate,
+		ImportStatusInserted,
+	})
+	if report.Inserted != 2 || report.Results[0].ContactID == 0 {
+		t.Errorf("import: expected 2 inserted contacts but got %+v", report)
+	}
+	if count, _ := currentStore().Count(); count != 3 {
+		t.Errorf("import: expected 3 contacts but got %d", count)
+	}
+
+	// All or nothing, with only valid rows
+	report, err = Import(testActor, []ImportRecord{
+		{Row: 2, Contact: Contact{FullName: "Hedy Lamarr", PhoneNumbers: []PhoneNumber{{Number: "(03) 9555 1234"}}}},
+		{Row: 3, Contact: Contact{FullName: "Kate Sheppard", PhoneNumbers: []PhoneNumber{{Number: "021 234 5678", CountryCode: "NZ"}}}},
+	}, ImportOptions{AllOrNothing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != 2 || report.Failed != 0 {
+		t.Errorf("all or nothing: expected 2 inserted contacts but got %+v", report)
+	}
+
+	// UIDs can't be used by an existing contact or an earlier row
+	report, err = Import(testActor, []ImportRecord{
+		{Row: 2, Contact: Contact{UID: existing.UID, FullName: "Grace Hopper", PhoneNumbers: []PhoneNumber{{Number: "(03) 9555 4321"}}}},
+		{Row: 3, Contact: Contact{UID: "ada-lovelace", FullName: "Ada Lovelace", PhoneNumbers: []PhoneNumber{{Number: "(03) 9555 8765"}}}},
+		{Row: 4, Contact: Contact{UID: "ada-lovelace", FullName: "Ada King", PhoneNumbers: []PhoneNumber{{Number: "(03) 9555 5678"}}}},
+	}, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Inserted != 1 ||
+		report.Results[0].Status != ImportStatusInvalid || report.Results[0].Error != ErrUIDAlreadyExists.Error() ||
+		report.Results[1].Status != ImportStatusInserted ||
+		report.Results[2].Status != ImportStatusInvalid {
+		t.Errorf("uid: expected only row 3 to be inserted but got %+v", report)
+	}
+
+	// Nor by a contact in the trash, which is reported rather than failing the whole import
+	trashed := Contact{UID: "grace-hopper", FullName: "Grace Hopper", PhoneNumbers: []PhoneNumber{{Number: "(03) 9555 4321"}}}
+	if err := InsertNew(testActor, &trashed); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	if err := Delete(testActor, trashed.ID); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	trashRecords := []ImportRecord{
+		{Row: 2, Contact: Contact{UID: "grace-hopper", FullName: "Grace Brewster Hopper", PhoneNumbers: []PhoneNumber{{Number: "(03) 9555 1111"}}}},
+		{Row: 3, Contact: Contact{FullName: "Joan Clarke", PhoneNumbers: []PhoneNumber{{Number: "(03) 9555 2222"}}}},
+	}
+	for _, options := range []ImportOptions{{DryRun: true}, {}} {
+		report, err = Import(testActor, trashRecords, options)
+		if err != nil {
+			t.Fatalf("uid in trash: %s", err)
+		}
+		result := report.Results[0]
+		if result.Status != ImportStatusInvalid || result.Error != ErrUIDInTrash.Error() ||
+			len(result.Fields) != 1 || result.Fields[0].Field != "uid" || result.Fields[0].Code != "contact.uid.in_trash" {
+			t.Errorf("uid in trash: expected row 2 to be invalid but got %+v", result)
+		}
+		if report.Results[1].Status == ImportStatusInvalid {
+			t.Errorf("uid in trash: expected row 3 to still be imported but got %+v", report.Results[1])
+		}
+	}
+}
+
+// failingInsertStore fails to insert the contact with the given FullName, as if the database
+// went down part way through an import.
+type failingInsertStore struct {
+	ContactStore
+	fullName string
+}
+
+func (store failingInsertStore) Insert(actor Actor, record *Contact) error {
+	if record.FullName == store.fullName {
+		return errors.New("database is down")
+	}
+	return store.ContactStore.Insert(actor, record)
+}
+
+func TestImportInsertFailure(t *testing.T) {
+	SetStore(failingInsertStore{ContactStore: NewMemoryStore(), fullName: "Radia Perlman"})
+	defer SetStore(nil)
+
+	report, err := Import(testActor, []ImportRecord{
+		{Row: 2, Contact: Contact{FullName: "Alex Bell", PhoneNumbers: []PhoneNumber{{Number: "03 8578 6688"}}}},
+		{Row: 3, Contact: Contact{FullName: "Radia Perlman", PhoneNumbers: []PhoneNumber{{Number: "(03) 9333 7119"}}}},
+		{Row: 4, Contact: Contact{FullName: "Fredrik Idestam", PhoneNumbers: []PhoneNumber{{Number: "+61398889980"}}}},
+	}, ImportOptions{})
+	if err != nil {
+		t.Fatalf("expected the failed row to be reported rather than %v", err)
+	}
+	if report.Inserted != 2 || report.Failed != 1 {
+		t.Errorf("expected 2 inserted and 1 failed but got %+v", report)
+	}
+	for i, status := range []ImportStatus{ImportStatusInserted, ImportStatusFailed, ImportStatusInserted} {
+		result := report.Results[i]
+		if result.Status != status || (result.ContactID != 0) != (status == ImportStatusInserted) {
+			t.Errorf("row %d: expected %s but got %+v", result.Row, status, result)
+		}
+	}
+	if report.Results[1].Error != "database is down" {
+		t.Errorf("expected the reason row 3 failed but got %q", report.Results[1].Error)
+	}
+	if count, _ := currentStore().Count(); count != 2 {
+		t.Errorf("expected 2 contacts but got %d", count)
+	}
+}
@@ -0,0 +1,30 @@
+package contact
+
+import "strings"
+
+// Labels that we suggest for phone numbers and emails. Any other text can also be used
+// as a custom label.
+const (
+	LabelMobile   = "mobile"
+	LabelWork     = "work"
+	LabelHome     = "home"
+	LabelFax      = "fax"
+	LabelPersonal = "personal"
+)
+
+// maxLabelLength matches the size of the Label columns
+const maxLabelLength = 64
+
+// normalizeLabel will lower-case our suggested labels so they're stored consistently and
+// check that custom labels fit in the database.
+func normalizeLabel(label string) (string, bool) {
+	label = strings.TrimSpace(label)
+	switch lowerLabel := strings.ToLower(label); lowerLabel {
+	case LabelMobile, LabelWork, LabelHome, LabelFax, LabelPersonal:
+		return lowerLabel, true
+	}
+	if len(label) > maxLabelLength {
+		return "", false
+	}
+	return label, true
+}
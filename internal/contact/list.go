@@ -0,0 +1,165 @@
+package contact
+
+const (
+	// DefaultListLimit is the amount of contacts returned by List if no limit is given.
+	DefaultListLimit = 25
+	// MaxListLimit is the most contacts that can be returned by a single call to List.
+	MaxListLimit = 100
+)
+
+// SortField is a field that List can sort contacts by.
+type SortField string
+
+const (
+	SortByID       SortField = "id"
+	SortByFullName SortField = "name"
+	// SortByEmail sorts by the first of each contacts emails alphabetically. Contacts
+	// without any emails sort first.
+	SortByEmail SortField = "email"
+	// SortByRelevance sorts the best matches for ListOptions.Search first.
+	// This is the default when searching.
+	SortByRelevance SortField = "relevance"
+)
+
+// ListOptions controls which contacts are returned by List and in what order.
+type ListOptions struct {
+	// Limit is the maximum amount of contacts to return. If 0, DefaultListLimit is used.
+	Limit int
+	// Offset is the amount of contacts to skip.
+	Offset int
+
+	SortBy         SortField
+	SortDescending bool
+
+	// Search will find contacts with a FullName or any Email similar to it, or with a
+	// phone number that ends with it or that it normalizes to. Ignored if blank.
+	Search string
+
+	// Filters, these are all case-insensitive "contains" matches and are ignored if blank.
+	// Email and PhoneNumber match if any of the contacts emails or phone numbers match.
+	FullName    string
+	Email       string
+	PhoneNumber string
+
+	// after, if set, only includes contacts sorted after it, ie. the contacts after a page,
+	// rather than skipping Offset contacts. See ForEach.
+	after *listCursor
+}
+
+// listCursor is where a contact is in the sort order of List. Text or Number is the value it's
+// sorted by before its ID, depending on ListOptions.SortBy, as the store calculated it.
+type listCursor struct {
+	Text   string
+	Number float64
+	ID     int64
+}
+
+// less is true if the cursor is sorted before other, when sorting ascending.
+func (cursor listCursor) less(other listCursor) bool {
+	if cursor.Text != other.Text {
+		return cursor.Text < other.Text
+	}
+	if cursor.Number != other.Number {
+		return cursor.Number < other.Number
+	}
+	return cursor.ID < other.ID
+}
+
+// ListResult is a single page of contacts from List.
+type ListResult struct {
+	Contacts []Contact
+	// Options are the options that were used, after defaults were applied.
+	Options ListOptions
+	// HasNext is true if there are more contacts after this page.
+	HasNext bool
+	// last is where the last contact of the page is in the sort order, see ForEach.
+	last listCursor
+}
+
+// HasPrevious is true if there are contacts before this page.
+func (result ListResult) HasPrevious() bool {
+	return result.Options.Offset > 0
+}
+
+// NextOptions returns the options needed to fetch the page after this one.
+func (result ListResult) NextOptions() ListOptions {
+	options := result.Options
+	options.Offset += options.Limit
+	return options
+}
+
+// PreviousOptions returns the options needed to fetch the page before this one.
+func (result ListResult) PreviousOptions() ListOptions {
+	options := result.Options
+	options.Offset -= options.Limit
+	if options.Offset < 0 {
+		options.Offset = 0
+	}
+	return options
+}
+
+// DefaultSortBy is the field contacts are sorted by if SortBy isn't set.
+func (options ListOptions) DefaultSortBy() SortField {
+	if options.Search != "" {
+		return SortByRelevance
+	}
+	return SortByID
+}
+
+// IsValidSortField will return true if the field can be used with ListOptions.SortBy
+func IsValidSortField(field SortField) bool {
+	switch field {
+	case SortByID, SortByFullName, SortByEmail, SortByRelevance:
+		return true
+	}
+	return false
+}
+
+// List will return a page of contacts, filtered and sorted by the given options.
+func List(options ListOptions) (ListResult, error) {
+	if options.Limit <= 0 {
+		options.Limit = DefaultListLimit
+	}
+	if options.Limit > MaxListLimit {
+		options.Limit = MaxListLimit
+	}
+	if options.Offset < 0 {
+		options.Offset = 0
+	}
+	if options.SortBy == "" {
+		options.SortBy = options.DefaultSortBy()
+	}
+	if !IsValidSortField(options.SortBy) {
+		return ListResult{}, ErrInvalidSortField
+	}
+	return currentStore().List(options)
+}
+
+// ForEach calls fn for every contact that matches the options, in the order they're sorted
+// by, stopping at the first error. Limit and Offset are ignored.
+//
+// Contacts are fetched a page at a time, so this can be used to export every contact without
+// holding them all in memory. Each page starts after the last contact of the page before it,
+// rather than at an offset, so inserting or deleting contacts while iterating doesn't cause
+// others to be skipped or repeated. A contact whose sort value changes while iterating, ie.
+// it's renamed when sorting by name, can still be skipped or repeated.
+func ForEach(options ListOptions, fn func(record Contact) error) error {
+	options.Limit = MaxListLimit
+	options.Offset = 0
+	options.after = nil
+	for {
+		result, err := List(options)
+		if err != nil {
+			return err
+		}
+		for _, record := range result.Contacts {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		if !result.HasNext {
+			return nil
+		}
+		options.after = &result.last
+	}
+}
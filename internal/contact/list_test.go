@@ -0,0 +1,78 @@
+package contact
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestForEach(t *testing.T) {
+	store := NewMemoryStore()
+	SetStore(store)
+	defer SetStore(nil)
+
+	// More than a single page, so ForEach has to fetch the next one
+	for i := 0; i < MaxListLimit+5; i++ {
+		fullName := "Alex Bell " + strconv.Itoa(i)
+		if i%2 == 1 {
+			fullName = "Radia Perlman " + strconv.Itoa(i)
+		}
+		if err := store.Insert(testActor, &Contact{
+			FullName:     fullName,
+			PhoneNumbers: []PhoneNumber{{Number: "+6139333" + strconv.Itoa(1000+i)}},
+		}); err != nil {
+			t.Fatalf("insert: %s", err)
+		}
+	}
+	var ids []int64
+	if err := ForEach(ListOptions{Limit: 1, Offset: 3}, func(record Contact) error {
+		ids = append(ids, record.ID)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != MaxListLimit+5 {
+		t.Fatalf("expected %d contacts but got %d", MaxListLimit+5, len(ids))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("expected contacts to be sorted by ID but got %v", ids)
+		}
+	}
+
+	// Deleting contacts as they're visited doesn't cause any to be skipped, as each page
+	// starts after the last contact rather than at an offset
+	seen := make(map[int64]bool)
+	if err := ForEach(ListOptions{SortBy: SortByFullName, SortDescending: true, FullName: "alex"}, func(record Contact) error {
+		if seen[record.ID] {
+			t.Fatalf("expected each contact once but got %d again", record.ID)
+		}
+		seen[record.ID] = true
+		return store.Delete(testActor, record.ID, 0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != (MaxListLimit+6)/2 {
+		t.Errorf("expected %d contacts but got %d", (MaxListLimit+6)/2, len(seen))
+	}
+
+	count := 0
+	if err := ForEach(ListOptions{FullName: "radia"}, func(record Contact) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != (MaxListLimit+5)/2 {
+		t.Errorf("expected %d contacts but got %d", (MaxListLimit+5)/2, count)
+	}
+
+	errStop := errors.New("stop")
+	count = 0
+	if err := ForEach(ListOptions{}, func(record Contact) error {
+		count++
+		return errStop
+	}); err != errStop || count != 1 {
+		t.Errorf("expected to stop at the first error but got %v after %d contacts", err, count)
+	}
+}
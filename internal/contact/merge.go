@@ -0,0 +1,110 @@
+package contact
+
+import (
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+var (
+	ErrMergeSameContact = validate.NewError("contact.merge.same_contact", "Cannot merge a Contact into itself.")
+)
+
+// MergeAudit records what happened when one Contact was merged into another, so that
+// a bad merge can be reviewed and fixed up by hand.
+type MergeAudit struct {
+	ID int64 `json:"id"`
+	// TargetContactID is the Contact that was kept
+	TargetContactID int64 `json:"targetContactId"`
+	// SourceContactID is the Contact that was merged into the target and then deleted
+	SourceContactID int64 `json:"sourceContactId"`
+	// Source is a copy of the source Contact as it was before the merge
+	Source Contact `json:"source"`
+	// AddedEmails and AddedPhoneNumbers are what was copied from the source onto the target,
+	// as they were on the source. Anything else the source had, the target already had.
+	AddedEmails       []EmailAddress `json:"addedEmails"`
+	AddedPhoneNumbers []PhoneNumber  `json:"addedPhoneNumbers"`
+	MergedAt          time.Time      `json:"mergedAt"`
+}
+
+// Merge will combine the source Contact into the target Contact and then delete the source.
+//
+// - The targets FullName is kept
+// - Emails and PhoneNumbers the target doesn't already have are copied from the source
+// - The targets primary email and phone number are kept. The sources only stay primary if the target had none.
+//
+// If targetVersion or sourceVersion isn't 0, it must be the stored Version of that Contact,
+// otherwise ErrVersionConflict is returned and nothing is merged, the same as Update.
+//
+// Returns the updated target and an audit of what was merged, which is also stored, see GetMerges.
+// Returns ErrNotFound if either Contact doesn't exist.
+func Merge(actor Actor, targetID int64, targetVersion int64, sourceID int64, sourceVersion int64) (Contact, MergeAudit, error) {
+	if targetID == sourceID {
+		return Contact{}, MergeAudit{}, ErrMergeSameContact
+	}
+	target, err := currentStore().Get(targetID)
+	if err != nil {
+		return Contact{}, MergeAudit{}, err
+	}
+	source, err := currentStore().Get(sourceID)
+	if err != nil {
+		return Contact{}, MergeAudit{}, err
+	}
+	// The store checks the Versions we fetched, so that neither Contact can change between
+	// here and the merge being stored
+	if (targetVersion != 0 && targetVersion != target.Version) ||
+		(sourceVersion != 0 && sourceVersion != source.Version) {
+		return Contact{}, MergeAudit{}, ErrVersionConflict
+	}
+	// Both contacts numbers are already stored, so are only checked for being numbers
+	stored := newStoredPhoneNumbers(&target, &source)
+	audit := MergeAudit{
+		TargetContactID:   target.ID,
+		SourceContactID:   source.ID,
+		Source:            source,
+		AddedEmails:       []EmailAddress{},
+		AddedPhoneNumbers: []PhoneNumber{},
+		MergedAt:          time.Now().UTC(),
+	}
+
+	hasPrimaryEmail := false
+	for _, email := range target.Emails {
+		hasPrimaryEmail = hasPrimaryEmail || email.IsPrimary
+	}
+	for _, email := range source.Emails {
+		if hasEmail(&target, email.Address) {
+			continue
+		}
+		audit.AddedEmails = append(audit.AddedEmails, email)
+		email.ID = 0
+		email.IsPrimary = email.IsPrimary && !hasPrimaryEmail
+		target.Emails = append(target.Emails, email)
+	}
+	hasPrimaryPhoneNumber := false
+	for _, phoneNumber := range target.PhoneNumbers {
+		hasPrimaryPhoneNumber = hasPrimaryPhoneNumber || phoneNumber.IsPrimary
+	}
+	for _, phoneNumber := range source.PhoneNumbers {
+		if hasPhoneNumber(&target, phoneNumber) {
+			continue
+		}
+		audit.AddedPhoneNumbers = append(audit.AddedPhoneNumbers, phoneNumber)
+		phoneNumber.ID = 0
+		phoneNumber.IsPrimary = phoneNumber.IsPrimary && !hasPrimaryPhoneNumber
+		target.PhoneNumbers = append(target.PhoneNumbers, phoneNumber)
+	}
+
+	if err := validateChangedRecord(&target, stored); err != nil {
+		return Contact{}, MergeAudit{}, err
+	}
+	if err := currentStore().Merge(actor, &target, &audit); err != nil {
+		return Contact{}, MergeAudit{}, err
+	}
+	return target, audit, nil
+}
+
+// GetMerges returns the audit of every Contact that was merged into the given Contact,
+// oldest first.
+func GetMerges(contactID int64) ([]MergeAudit, error) {
+	return currentStore().GetMerges(contactID)
+}
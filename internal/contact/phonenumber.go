@@ -0,0 +1,210 @@
+package contact
+
+import (
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+const (
+	// maxExtensionLength matches the size of the Extension column
+	maxExtensionLength = 16
+)
+
+// lineTypeNames are what we store as the LineType for each type of number the phonenumbers
+// library can detect. We store names rather than the numeric values from the library so that
+// the database is readable and doesn't depend on the order of the library's constants.
+var lineTypeNames = map[phonenumbers.PhoneNumberType]string{
+	phonenumbers.FIXED_LINE:           "fixed_line",
+	phonenumbers.MOBILE:               "mobile",
+	phonenumbers.FIXED_LINE_OR_MOBILE: "fixed_line_or_mobile",
+	phonenumbers.TOLL_FREE:            "toll_free",
+	phonenumbers.PREMIUM_RATE:         "premium_rate",
+	phonenumbers.SHARED_COST:          "shared_cost",
+	phonenumbers.VOIP:                 "voip",
+	phonenumbers.PERSONAL_NUMBER:      "personal_number",
+	phonenumbers.PAGER:                "pager",
+	phonenumbers.UAN:                  "uan",
+	phonenumbers.VOICEMAIL:            "voicemail",
+	phonenumbers.UNKNOWN:              "unknown",
+}
+
+// defaultRegion is the country that phone numbers written in local format are assumed to be from,
+// unless told otherwise. It's also the region that phone numbers are formatted for when displayed.
+//
+// Australia was hardcoded originally as the test data provided to me implied that we should
+// infer Australian numbers, so that's still the default.
+var defaultRegion = "AU"
+
+// SetDefaultRegion changes the country that phone numbers written in local format are assumed
+// to be from. The region is a 2 letter ISO 3166-1 country code, ie. "NZ".
+//
+// This should only be called at startup, before any requests are handled.
+func SetDefaultRegion(region string) error {
+	region, ok := normalizeRegion(region)
+	if !ok {
+		return ErrInvalidCountryCode
+	}
+	defaultRegion = region
+	return nil
+}
+
+// DefaultRegion returns the country that phone numbers written in local format are assumed to be from.
+func DefaultRegion() string {
+	return defaultRegion
+}
+
+// normalizeRegion will upper-case the region and check that it's a country we know the phone
+// number format of.
+func normalizeRegion(region string) (string, bool) {
+	region = strings.ToUpper(strings.TrimSpace(region))
+	if !phonenumbers.GetSupportedRegions()[region] {
+		return "", false
+	}
+	return region, true
+}
+
+// regionForNumber returns the country the phone number belongs to. parsedRegion is the
+// region it was parsed with, used as a fallback for numbers that aren't valid enough for
+// the library to tell which country they belong to but still have that countries calling code.
+func regionForNumber(parsedNumber *phonenumbers.PhoneNumber, parsedRegion string) string {
+	region := phonenumbers.GetRegionCodeForNumber(parsedNumber)
+	if region == "" &&
+		int(parsedNumber.GetCountryCode()) == phonenumbers.GetCountryCodeForRegion(parsedRegion) {
+		return parsedRegion
+	}
+	if _, ok := normalizeRegion(region); !ok {
+		// ie. "001" for numbers that are global rather than tied to a country
+		return ""
+	}
+	return region
+}
+
+// isValidExtension returns true if the extension is blank or only made up of digits.
+func isValidExtension(extension string) bool {
+	if len(extension) > maxExtensionLength {
+		return false
+	}
+	for _, r := range extension {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func lineTypeName(numberType phonenumbers.PhoneNumberType) string {
+	if name, ok := lineTypeNames[numberType]; ok {
+		return name
+	}
+	return lineTypeNames[phonenumbers.UNKNOWN]
+}
+
+// phoneNumberParseError returns the user-facing error for why phonenumbers.Parse couldn't
+// read the number.
+func phoneNumberParseError(err error) *validate.ValidationError {
+	switch err {
+	case phonenumbers.ErrTooShortNSN, phonenumbers.ErrTooShortAfterIDD:
+		return ErrPhoneNumberTooShort
+	case phonenumbers.ErrNumTooLong:
+		return ErrPhoneNumberTooLong
+	}
+	return ErrInvalidPhoneNumber
+}
+
+// phoneNumberValidityError returns the user-facing error if the parsed number isn't one that
+// can exist, ie. it has the wrong amount of digits or starts with digits that aren't used in
+// the country it's from. Returns nil for valid numbers.
+func phoneNumberValidityError(parsedNumber *phonenumbers.PhoneNumber) *validate.ValidationError {
+	switch phonenumbers.IsPossibleNumberWithReason(parsedNumber) {
+	case phonenumbers.IS_POSSIBLE:
+	case phonenumbers.TOO_SHORT, phonenumbers.IS_POSSIBLE_LOCAL_ONLY:
+		// Local only numbers are missing the area code, so we can't tell which number it is
+		return ErrPhoneNumberTooShort
+	case phonenumbers.TOO_LONG:
+		return ErrPhoneNumberTooLong
+	default:
+		return ErrPhoneNumberInvalidForRegion
+	}
+	if !phonenumbers.IsValidNumber(parsedNumber) {
+		return ErrPhoneNumberInvalidForRegion
+	}
+	return nil
+}
+
+// LineTypeDescription returns the LineType in a human readable form, ie. "fixed line".
+func (phoneNumber PhoneNumber) LineTypeDescription() string {
+	return strings.Replace(phoneNumber.LineType, "_", " ", -1)
+}
+
+// Format will return the phone number formatted for someone in the given region, including
+// the extension if there is one.
+//
+// Numbers from the same country are shown in national format, ie. "(03) 9333 7119" for an
+// Australian number viewed in Australia, and everything else is shown in international format,
+// ie. "+64 9 123 4567".
+func (phoneNumber PhoneNumber) Format(region string) string {
+	parsedNumber, err := phonenumbers.Parse(phoneNumber.Number, region)
+	if err != nil {
+		// Should never happen as we store valid E.164 numbers, but showing the raw number
+		// is better than showing nothing.
+		return phoneNumber.Number
+	}
+	if phoneNumber.Extension != "" {
+		extension := phoneNumber.Extension
+		parsedNumber.Extension = &extension
+	}
+	if int(parsedNumber.GetCountryCode()) == phonenumbers.GetCountryCodeForRegion(region) {
+		return phonenumbers.Format(parsedNumber, phonenumbers.NATIONAL)
+	}
+	return phonenumbers.Format(parsedNumber, phonenumbers.INTERNATIONAL)
+}
+
+// AddPhoneNumber will validate and then insert a single PhoneNumber against an existing Contact.
+// The phone number is normalized into E.164 format, see PhoneNumber.CountryCode for how
+// local-format numbers are interpreted.
+//
+// If version isn't 0, it must be the Version of the Contact that's stored, otherwise
+// ErrVersionConflict is returned, the same as Update. This applies to UpdatePhoneNumber
+// and DeletePhoneNumber too. They all return the Version the Contact has after the change.
+//
+// Returns ErrNotFound if no Contact exists with the given ID.
+func AddPhoneNumber(actor Actor, contactID int64, version int64, phoneNumber *PhoneNumber) (int64, error) {
+	if phoneNumber.ID != 0 {
+		return 0, errPhoneNumberAlreadyExists
+	}
+	if err := normalizePhoneNumber(phoneNumber, nil); err != nil {
+		return 0, err
+	}
+	phoneNumber.ContactID = contactID
+	return currentStore().AddPhoneNumber(actor, contactID, version, phoneNumber)
+}
+
+// UpdatePhoneNumber will validate and then replace the number of an existing PhoneNumber.
+// The ID and ContactID fields must be set.
+//
+// Returns ErrNotFound if the Contact doesn't exist or ErrPhoneNumberNotFound if the
+// PhoneNumber doesn't exist or belongs to a different Contact.
+func UpdatePhoneNumber(actor Actor, version int64, phoneNumber *PhoneNumber) (int64, error) {
+	if phoneNumber.ID == 0 {
+		return 0, ErrPhoneNumberNotFound
+	}
+	stored, err := storedPhoneNumbersOf(phoneNumber.ContactID)
+	if err != nil {
+		return 0, err
+	}
+	if err := normalizePhoneNumber(phoneNumber, stored); err != nil {
+		return 0, err
+	}
+	return currentStore().UpdatePhoneNumber(actor, version, phoneNumber)
+}
+
+// DeletePhoneNumber will move a single PhoneNumber of a Contact to the trash, see ListTrash.
+//
+// As with InsertNew, a Contact must always have at least 1 phone number, so this will return
+// ErrMissingPhoneNumbers if you try to remove the last one.
+func DeletePhoneNumber(actor Actor, contactID int64, phoneNumberID int64, version int64) (int64, error) {
+	return currentStore().DeletePhoneNumber(actor, contactID, phoneNumberID, version)
+}
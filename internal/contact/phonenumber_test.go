@@ -0,0 +1,73 @@
+package contact
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	type TestData struct {
+		In  PhoneNumber
+		Out PhoneNumber
+		Err error
+	}
+	testDataList := []TestData{
+		// Local numbers default to the default region
+		{In: PhoneNumber{Number: "(03) 9333 7119"}, Out: PhoneNumber{Number: "+61393337119", CountryCode: "AU", LineType: "fixed_line"}},
+		{In: PhoneNumber{Number: "021 234 5678", CountryCode: "nz"}, Out: PhoneNumber{Number: "+64212345678", CountryCode: "NZ", LineType: "mobile"}},
+		{In: PhoneNumber{Number: "020 7946 0958", CountryCode: "GB"}, Out: PhoneNumber{Number: "+442079460958", CountryCode: "GB", LineType: "fixed_line"}},
+		{In: PhoneNumber{Number: "(415) 555-2671", CountryCode: "US"}, Out: PhoneNumber{Number: "+14155552671", CountryCode: "US", LineType: "fixed_line_or_mobile"}},
+		// International format ignores the given country, the number says where it's from
+		{In: PhoneNumber{Number: "+44 20 7946 0958", CountryCode: "AU"}, Out: PhoneNumber{Number: "+442079460958", CountryCode: "GB", LineType: "fixed_line"}},
+		// Numbers that aren't tied to a country
+		{In: PhoneNumber{Number: "+800 1234 5678"}, Out: PhoneNumber{Number: "+80012345678", LineType: "toll_free"}},
+		{In: PhoneNumber{Number: "0400 000 000", CountryCode: "XX"}, Err: ErrInvalidCountryCode},
+		{In: PhoneNumber{Number: "not a number"}, Err: ErrInvalidPhoneNumber},
+		{In: PhoneNumber{Number: "043"}, Err: ErrPhoneNumberTooShort},
+		{In: PhoneNumber{Number: "+61 4"}, Err: ErrPhoneNumberTooShort},
+		{In: PhoneNumber{Number: "+61 3 9333 7119 1234 5678 9"}, Err: ErrPhoneNumberTooLong},
+		{In: PhoneNumber{Number: "0188 445 688"}, Err: ErrPhoneNumberInvalidForRegion},
+		// Extensions
+		{In: PhoneNumber{Number: "(03) 9333 7119 ext. 123"}, Out: PhoneNumber{Number: "+61393337119", CountryCode: "AU", Extension: "123", LineType: "fixed_line"}},
+		{In: PhoneNumber{Number: "(03) 9333 7119", Extension: " 45 "}, Out: PhoneNumber{Number: "+61393337119", CountryCode: "AU", Extension: "45", LineType: "fixed_line"}},
+		{In: PhoneNumber{Number: "(03) 9333 7119", Extension: "reception"}, Err: ErrInvalidPhoneNumberExtension},
+		// Labels
+		{In: PhoneNumber{Number: "0488 445 688", Label: " Mobile ", IsPrimary: true}, Out: PhoneNumber{Number: "+61488445688", CountryCode: "AU", Label: LabelMobile, IsPrimary: true, LineType: "mobile"}},
+		{In: PhoneNumber{Number: "0488 445 688", Label: "After Hours"}, Out: PhoneNumber{Number: "+61488445688", CountryCode: "AU", Label: "After Hours", LineType: "mobile"}},
+		{In: PhoneNumber{Number: "0488 445 688", Label: strings.Repeat("a", maxLabelLength+1)}, Err: ErrInvalidPhoneNumberLabel},
+	}
+	for _, testData := range testDataList {
+		got := testData.In
+		err := normalizePhoneNumber(&got, nil)
+		if !errors.Is(err, testData.Err) {
+			t.Errorf("%+v: expected error %v but got %v", testData.In, testData.Err, err)
+			continue
+		}
+		if err == nil && got != testData.Out {
+			t.Errorf("%+v: expected %+v but got %+v", testData.In, testData.Out, got)
+		}
+	}
+}
+
+func TestPhoneNumberFormat(t *testing.T) {
+	type TestData struct {
+		Number    string
+		Extension string
+		Region    string
+		Out       string
+	}
+	testDataList := []TestData{
+		{Number: "+61393337119", Region: "AU", Out: "(03) 9333 7119"},
+		{Number: "+61393337119", Region: "NZ", Out: "+61 3 9333 7119"},
+		{Number: "+442079460958", Region: "GB", Out: "020 7946 0958"},
+		{Number: "+442079460958", Region: "AU", Out: "+44 20 7946 0958"},
+		{Number: "+61393337119", Extension: "123", Region: "AU", Out: "(03) 9333 7119 ext. 123"},
+	}
+	for _, testData := range testDataList {
+		phoneNumber := PhoneNumber{Number: testData.Number, Extension: testData.Extension}
+		if got := phoneNumber.Format(testData.Region); got != testData.Out {
+			t.Errorf("%s in %s: expected %q but got %q", testData.Number, testData.Region, testData.Out, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package contact
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/nyaruka/phonenumbers"
+
+	"github.com/silbinarywolf/contact-site/internal/trigram"
+)
+
+const (
+	// minSearchSuffixDigits is the least amount of digits a search needs before we'll
+	// try to match it against the end of phone numbers. Without this, searching for
+	// "3" would match a large chunk of the phone book.
+	minSearchSuffixDigits = 3
+
+	// searchSimilarityThreshold is how similar (0 to 1) a word in the FullName or an Email needs
+	// to be to the search for it to be considered a fuzzy match. Similarity is measured with
+	// trigrams, see the "trigram" package.
+	//
+	// Picked by trying typos against the mock data, ie. "perlmen" still finds "Radia Perlman",
+	// but low enough values start matching unrelated names.
+	searchSimilarityThreshold = 0.5
+)
+
+// searchQuery holds the different ways we interpret what the user typed into the search box.
+type searchQuery struct {
+	// Text is the search lower-cased, used for matching against FullName and Emails.
+	Text string
+	// Digits is only the digits of the search, used to match the end of phone numbers.
+	// ie. "66 88" becomes "6688". Blank if there aren't enough digits.
+	Digits string
+	// PhoneNumber is the search normalized into E.164 format, if the search could be
+	// parsed as a phone number. ie. "(03) 9333 7119" becomes "+61393337119"
+	PhoneNumber string
+}
+
+func parseSearchQuery(search string) searchQuery {
+	search = strings.TrimSpace(search)
+	query := searchQuery{
+		Text: strings.ToLower(search),
+	}
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, search)
+	if len(digits) >= minSearchSuffixDigits {
+		query.Digits = digits
+	}
+	// Parsing phone numbers is lenient enough that almost any short string of digits
+	// parses, so we only treat the search as a phone number if it's a valid one.
+	if parsedNumber, err := phonenumbers.Parse(search, defaultRegion); err == nil &&
+		phonenumbers.IsValidNumber(parsedNumber) {
+		query.PhoneNumber = phonenumbers.Format(parsedNumber, phonenumbers.E164)
+	}
+	return query
+}
+
+// matches returns true if the record matches the search. Used by stores that can't
+// search in SQL.
+//
+// This mirrors the SQL in sqlStore, see searchCondition.
+func (query searchQuery) matches(record *Contact) bool {
+	if strings.Contains(strings.ToLower(record.FullName), query.Text) ||
+		query.relevance(record) >= searchSimilarityThreshold {
+		return true
+	}
+	for _, email := range record.Emails {
+		if strings.Contains(strings.ToLower(email.Address), query.Text) {
+			return true
+		}
+	}
+	for _, phoneNumber := range record.PhoneNumbers {
+		if query.Digits != "" && strings.HasSuffix(phoneNumber.Number, query.Digits) {
+			return true
+		}
+		if query.PhoneNumber != "" && phoneNumber.Number == query.PhoneNumber {
+			return true
+		}
+	}
+	return false
+}
+
+// relevance is how similar the search is to the FullName or any Email of the record,
+// whichever is most similar.
+func (query searchQuery) relevance(record *Contact) float64 {
+	relevance := trigram.WordSimilarity(query.Text, strings.ToLower(record.FullName))
+	for _, email := range record.Emails {
+		relevance = math.Max(relevance, trigram.WordSimilarity(query.Text, strings.ToLower(email.Address)))
+	}
+	return relevance
+}
@@ -0,0 +1,23 @@
+package contact
+
+import "testing"
+
+func TestParseSearchQuery(t *testing.T) {
+	type TestData struct {
+		In  string
+		Out searchQuery
+	}
+	testDataList := []TestData{
+		{In: "Radia Perlmen", Out: searchQuery{Text: "radia perlmen"}},
+		{In: "6688", Out: searchQuery{Text: "6688", Digits: "6688"}},
+		// too few digits to be worth matching against the end of phone numbers
+		{In: "66", Out: searchQuery{Text: "66"}},
+		{In: "(03) 9333 7119", Out: searchQuery{Text: "(03) 9333 7119", Digits: "0393337119", PhoneNumber: "+61393337119"}},
+		{In: " +61488224568 ", Out: searchQuery{Text: "+61488224568", Digits: "61488224568", PhoneNumber: "+61488224568"}},
+	}
+	for _, testData := range testDataList {
+		if got := parseSearchQuery(testData.In); got != testData.Out {
+			t.Errorf("%q: expected %+v but got %+v", testData.In, testData.Out, got)
+		}
+	}
+}
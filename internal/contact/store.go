@@ -0,0 +1,96 @@
+package contact
+
+import (
+	"time"
+)
+
+// ContactStore is where contacts, their emails and phone numbers are persisted.
+//
+// The functions in this package validate records and then hand them off to the current store,
+// so implementations can assume that the records they're given are valid and that phone numbers
+// are already normalized into E.164 format.
+//
+// Implementations must:
+// - Set the ID (and ContactID for PhoneNumbers) of records they insert
+// - Give inserted records a UID from newUID if they don't already have one. A UID never changes.
+// - Set Version to 1 on insert and increment it each time the Contact or its PhoneNumbers
+// change, setting the new Version on the given record
+// - Return ErrVersionConflict, changing nothing, if they're given a Version of a Contact that
+// isn't 0 and isn't the stored Version. This must be checked atomically with the change.
+// - Return ErrNotFound / ErrPhoneNumberNotFound when a record doesn't exist. Records in the
+// trash don't exist, except to the trash methods.
+// - Move records to the trash when they're deleted, rather than deleting them. This includes
+// the source of a Merge, but not Emails and PhoneNumbers removed by Update.
+// - Apply each call atomically, ie. a failure part way through Update should change nothing
+// - Store an AuditEntry from newAuditEntry for each Contact a call creates, updates, deletes,
+// restores or purges, atomically with the change. The entries must never be changed or deleted.
+// - Be safe for concurrent use
+type ContactStore interface {
+	Insert(actor Actor, record *Contact) error
+	// InsertAll must insert all of the records or, if any fail, none of them
+	InsertAll(actor Actor, records []*Contact) error
+	// Update follows the same rules for synchronizing PhoneNumbers as the Update function
+	Update(actor Actor, record *Contact) error
+	// Delete is given the Version to check, or 0 to delete whatever is stored
+	Delete(actor Actor, id int64, version int64) error
+	Get(id int64) (Contact, error)
+	GetByUID(uid string) (Contact, error)
+	GetAll() ([]Contact, error)
+	// List is given options that already have defaults applied, see List
+	List(options ListOptions) (ListResult, error)
+	Count() (int, error)
+
+	// AddPhoneNumber and UpdatePhoneNumber must make any other PhoneNumber of the Contact
+	// not primary, if the given PhoneNumber is primary. Like Delete, the PhoneNumber methods are
+	// given the Version of the Contact to check, or 0 to change whatever is stored, and return
+	// the Version the Contact has after the change.
+	AddPhoneNumber(actor Actor, contactID int64, version int64, phoneNumber *PhoneNumber) (int64, error)
+	UpdatePhoneNumber(actor Actor, version int64, phoneNumber *PhoneNumber) (int64, error)
+	// DeletePhoneNumber must return ErrMissingPhoneNumbers if it's the Contacts last phone number
+	DeletePhoneNumber(actor Actor, contactID int64, phoneNumberID int64, version int64) (int64, error)
+
+	// Merge must, all at once, update the target the same as Update, delete the Contact with
+	// the audits SourceContactID and store the audit, setting its ID. The Version of the audits
+	// Source is checked the same as the Version given to Delete.
+	Merge(actor Actor, target *Contact, audit *MergeAudit) error
+	// GetMerges returns the audits of Contacts merged into the given Contact, ordered by ID.
+	GetMerges(contactID int64) ([]MergeAudit, error)
+
+	// ListAudit is given options that already have defaults applied, see ListAudit
+	ListAudit(options AuditOptions) (AuditResult, error)
+
+	// ListTrash is given options that already have defaults applied, see ListTrash
+	ListTrash(options TrashOptions) (TrashResult, error)
+	// IsUIDInTrash returns true if a Contact in the trash has the UID
+	IsUIDInTrash(uid string) (bool, error)
+	// Restore must return ErrRestoreMergedAway, changing nothing, if the Contact is the
+	// SourceContactID of a stored Merge
+	Restore(actor Actor, id int64) error
+	// RestorePhoneNumber follows the same rules as AddPhoneNumber for a primary PhoneNumber
+	RestorePhoneNumber(actor Actor, contactID int64, phoneNumberID int64) error
+	Purge(actor Actor, id int64) error
+	PurgePhoneNumber(actor Actor, contactID int64, phoneNumberID int64) error
+	// PurgeDeletedBefore purges Contacts, and then PhoneNumbers of Contacts that aren't in the
+	// trash, that were deleted before the given time. It returns how many were purged.
+	PurgeDeletedBefore(actor Actor, deletedBefore time.Time) (int, error)
+}
+
+var (
+	store ContactStore
+)
+
+// SetStore will change where contacts are stored. This must be called before any other
+// functions in this package are used.
+//
+// Like the "db" package, we keep the current store in a package variable rather than passing
+// it around. There's only ever one store for the lifetime of the application.
+func SetStore(newStore ContactStore) {
+	store = newStore
+}
+
+func currentStore() ContactStore {
+	if store == nil {
+		panic("contact.SetStore must be called before using the contact package.")
+	}
+	return store
+}
@@ -0,0 +1,758 @@
+package contact
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps contacts in memory, so they're lost when the application stops.
+//
+// This exists so that developers and CI can run the application and its tests without
+// needing a database server. It tries to behave exactly like sqlStore, including the order
+// that IDs are handed out, so that tests pass against either.
+type memoryStore struct {
+	mu                 sync.RWMutex
+	contacts           map[int64]*Contact
+	lastContactID      int64
+	lastPhoneNumberID  int64
+	lastEmailAddressID int64
+	merges             []MergeAudit
+	lastMergeID        int64
+	audit              []AuditEntry
+	// trash holds deleted Contacts by ID and deletedPhoneNumbers holds deleted PhoneNumbers
+	// by ID, so that everything else only has to look at contacts
+	trash               map[int64]deletedContact
+	deletedPhoneNumbers map[int64]deletedPhoneNumber
+}
+
+// deletedContact is a Contact in the trash, see ListTrash.
+type deletedContact struct {
+	record    *Contact
+	deletedAt time.Time
+}
+
+// deletedPhoneNumber is a PhoneNumber in the trash, see ListTrash.
+type deletedPhoneNumber struct {
+	PhoneNumber
+	deletedAt time.Time
+}
+
+// assert at compile-time that this type satisfies the ContactStore interface
+var _ ContactStore = new(memoryStore)
+
+// NewMemoryStore returns an empty ContactStore that keeps everything in memory.
+func NewMemoryStore() ContactStore {
+	return &memoryStore{
+		contacts:            make(map[int64]*Contact),
+		trash:               make(map[int64]deletedContact),
+		deletedPhoneNumbers: make(map[int64]deletedPhoneNumber),
+	}
+}
+
+func (store *memoryStore) Insert(actor Actor, record *Contact) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.insert(actor, record)
+	return nil
+}
+
+func (store *memoryStore) InsertAll(actor Actor, records []*Contact) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Inserting into memory can't fail, so there's nothing to roll back
+	for _, record := range records {
+		store.insert(actor, record)
+	}
+	return nil
+}
+
+// insert is Insert without taking the lock. The caller must hold the lock.
+func (store *memoryStore) insert(actor Actor, record *Contact) {
+	store.lastContactID++
+	record.ID = store.lastContactID
+	if record.UID == "" {
+		record.UID = newUID()
+	}
+	record.Version = 1
+	for i := range record.Emails {
+		childRecord := &record.Emails[i]
+		store.lastEmailAddressID++
+		childRecord.ID = store.lastEmailAddressID
+		childRecord.ContactID = record.ID
+	}
+	for i := range record.PhoneNumbers {
+		childRecord := &record.PhoneNumbers[i]
+		store.lastPhoneNumberID++
+		childRecord.ID = store.lastPhoneNumberID
+		childRecord.ContactID = record.ID
+	}
+	store.contacts[record.ID] = copyContact(record)
+	store.appendAudit(newAuditEntry(actor, nil, record))
+}
+
+func (store *memoryStore) Update(actor Actor, record *Contact) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.update(actor, record)
+}
+
+// update is Update without taking the lock, so that Merge can use it.
+// The caller must hold the lock.
+func (store *memoryStore) update(actor Actor, record *Contact) error {
+	existing, ok := store.contacts[record.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if record.Version != 0 && record.Version != existing.Version {
+		return ErrVersionConflict
+	}
+	// Check everything up-front so that a failure doesn't leave the record half-updated,
+	// and so that IDs aren't consumed by a failed update.
+	existingEmailIDs := make(map[int64]bool, len(existing.Emails))
+	for _, childRecord := range existing.Emails {
+		existingEmailIDs[childRecord.ID] = true
+	}
+	for _, childRecord := range record.Emails {
+		if childRecord.ID != 0 && !existingEmailIDs[childRecord.ID] {
+			return ErrEmailNotFound
+		}
+	}
+	existingPhoneNumberIDs := make(map[int64]bool, len(existing.PhoneNumbers))
+	for _, childRecord := range existing.PhoneNumbers {
+		existingPhoneNumberIDs[childRecord.ID] = true
+	}
+	for _, childRecord := range record.PhoneNumbers {
+		if childRecord.ID != 0 && !existingPhoneNumberIDs[childRecord.ID] {
+			return ErrPhoneNumberNotFound
+		}
+	}
+	record.UID = existing.UID
+	record.Version = existing.Version + 1
+	for i := range record.Emails {
+		childRecord := &record.Emails[i]
+		childRecord.ContactID = record.ID
+		if childRecord.ID == 0 {
+			store.lastEmailAddressID++
+			childRecord.ID = store.lastEmailAddressID
+		}
+	}
+	for i := range record.PhoneNumbers {
+		childRecord := &record.PhoneNumbers[i]
+		childRecord.ContactID = record.ID
+		if childRecord.ID == 0 {
+			store.lastPhoneNumberID++
+			childRecord.ID = store.lastPhoneNumberID
+		}
+	}
+	updated := copyContact(record)
+	// Keep emails and phone numbers ordered by ID, the same as they would come out of the database.
+	sort.Slice(updated.Emails, func(i, j int) bool {
+		return updated.Emails[i].ID < updated.Emails[j].ID
+	})
+	sortPhoneNumbers(updated.PhoneNumbers)
+	store.contacts[record.ID] = updated
+	store.appendAudit(newAuditEntry(actor, existing, updated))
+	return nil
+}
+
+func (store *memoryStore) Delete(actor Actor, id int64, version int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if existing, ok := store.contacts[id]; ok && version != 0 && version != existing.Version {
+		return ErrVersionConflict
+	}
+	return store.delete(actor, id)
+}
+
+// delete is Delete without taking the lock, so that Merge can use it.
+// The caller must hold the lock.
+func (store *memoryStore) delete(actor Actor, id int64) error {
+	existing, ok := store.contacts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	before := copyContact(existing)
+	existing.Version++
+	delete(store.contacts, id)
+	store.trash[id] = deletedContact{
+		record:    existing,
+		deletedAt: time.Now().UTC(),
+	}
+	store.appendAudit(newAuditEntry(actor, before, nil))
+	return nil
+}
+
+func (store *memoryStore) Merge(actor Actor, target *Contact, audit *MergeAudit) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Check the source up-front so a failure doesn't leave the target updated
+	source, ok := store.contacts[audit.SourceContactID]
+	if !ok {
+		return ErrNotFound
+	}
+	if audit.Source.Version != 0 && audit.Source.Version != source.Version {
+		return ErrVersionConflict
+	}
+	if err := store.update(actor, target); err != nil {
+		return err
+	}
+	if err := store.delete(actor, audit.SourceContactID); err != nil {
+		return err
+	}
+	store.lastMergeID++
+	audit.ID = store.lastMergeID
+	store.merges = append(store.merges, copyMergeAudit(audit))
+	return nil
+}
+
+func (store *memoryStore) GetMerges(contactID int64) ([]MergeAudit, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	merges := []MergeAudit{}
+	for i := range store.merges {
+		if store.merges[i].TargetContactID == contactID {
+			merges = append(merges, copyMergeAudit(&store.merges[i]))
+		}
+	}
+	return merges, nil
+}
+
+func (store *memoryStore) Get(id int64) (Contact, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	record, ok := store.contacts[id]
+	if !ok {
+		return Contact{}, ErrNotFound
+	}
+	return *copyContact(record), nil
+}
+
+func (store *memoryStore) GetByUID(uid string) (Contact, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, record := range store.contacts {
+		if record.UID == uid {
+			return *copyContact(record), nil
+		}
+	}
+	return Contact{}, ErrNotFound
+}
+
+func (store *memoryStore) GetAll() ([]Contact, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.sortedContacts(), nil
+}
+
+func (store *memoryStore) List(options ListOptions) (ListResult, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var search searchQuery
+	if options.Search != "" {
+		search = parseSearchQuery(options.Search)
+	}
+	fullNameFilter := strings.ToLower(options.FullName)
+	emailFilter := strings.ToLower(options.Email)
+
+	var contacts []Contact
+	relevance := make(map[int64]float64)
+	for _, record := range store.sortedContacts() {
+		if options.Search != "" {
+			if !search.matches(&record) {
+				continue
+			}
+			relevance[record.ID] = search.relevance(&record)
+		}
+		if fullNameFilter != "" &&
+			!strings.Contains(strings.ToLower(record.FullName), fullNameFilter) {
+			continue
+		}
+		if emailFilter != "" &&
+			!hasEmailContaining(&record, emailFilter) {
+			continue
+		}
+		if options.PhoneNumber != "" &&
+			!hasPhoneNumberContaining(&record, options.PhoneNumber) {
+			continue
+		}
+		contacts = append(contacts, record)
+	}
+
+	// cursor is what a contact is sorted by, with ID as the tie-breaker. The same as the
+	// ORDER BY in sqlStore.
+	cursor := func(record *Contact) listCursor {
+		switch options.SortBy {
+		case SortByFullName:
+			return listCursor{Text: strings.ToLower(record.FullName), ID: record.ID}
+		case SortByEmail:
+			return listCursor{Text: firstEmail(record), ID: record.ID}
+		case SortByRelevance:
+			// Most relevant first
+			return listCursor{Number: -relevance[record.ID], ID: record.ID}
+		}
+		return listCursor{ID: record.ID}
+	}
+	less := func(a, b listCursor) bool {
+		if options.SortDescending {
+			return b.less(a)
+		}
+		return a.less(b)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return less(cursor(&contacts[i]), cursor(&contacts[j]))
+	})
+	if options.after != nil {
+		// Skip to the first contact sorted after the cursor
+		start := sort.Search(len(contacts), func(i int) bool {
+			return less(*options.after, cursor(&contacts[i]))
+		})
+		contacts = contacts[start:]
+	}
+
+	result := ListResult{
+		Options: options,
+	}
+	if options.Offset >= len(contacts) {
+		return result, nil
+	}
+	contacts = contacts[options.Offset:]
+	if len(contacts) > options.Limit {
+		contacts = contacts[:options.Limit]
+		result.HasNext = true
+	}
+	result.Contacts = contacts
+	result.last = cursor(&contacts[len(contacts)-1])
+	return result, nil
+}
+
+func (store *memoryStore) Count() (int, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return len(store.contacts), nil
+}
+
+func (store *memoryStore) AddPhoneNumber(actor Actor, contactID int64, version int64, phoneNumber *PhoneNumber) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record, ok := store.contacts[contactID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if version != 0 && version != record.Version {
+		return 0, ErrVersionConflict
+	}
+	before := copyContact(record)
+	if phoneNumber.IsPrimary {
+		clearPrimaryFlags(record)
+	}
+	store.lastPhoneNumberID++
+	phoneNumber.ID = store.lastPhoneNumberID
+	phoneNumber.ContactID = contactID
+	record.PhoneNumbers = append(record.PhoneNumbers, *phoneNumber)
+	record.Version++
+	store.appendAudit(newAuditEntry(actor, before, record))
+	return record.Version, nil
+}
+
+func (store *memoryStore) UpdatePhoneNumber(actor Actor, version int64, phoneNumber *PhoneNumber) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record, ok := store.contacts[phoneNumber.ContactID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if version != 0 && version != record.Version {
+		return 0, ErrVersionConflict
+	}
+	for i := range record.PhoneNumbers {
+		if record.PhoneNumbers[i].ID != phoneNumber.ID {
+			continue
+		}
+		before := copyContact(record)
+		if phoneNumber.IsPrimary {
+			clearPrimaryFlags(record)
+		}
+		record.PhoneNumbers[i] = *phoneNumber
+		record.Version++
+		store.appendAudit(newAuditEntry(actor, before, record))
+		return record.Version, nil
+	}
+	return 0, ErrPhoneNumberNotFound
+}
+
+func (store *memoryStore) DeletePhoneNumber(actor Actor, contactID int64, phoneNumberID int64, version int64) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record, ok := store.contacts[contactID]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if version != 0 && version != record.Version {
+		return 0, ErrVersionConflict
+	}
+	for i := range record.PhoneNumbers {
+		if record.PhoneNumbers[i].ID != phoneNumberID {
+			continue
+		}
+		if len(record.PhoneNumbers) <= 1 {
+			return 0, ErrMissingPhoneNumbers
+		}
+		before := copyContact(record)
+		store.deletedPhoneNumbers[phoneNumberID] = deletedPhoneNumber{
+			PhoneNumber: record.PhoneNumbers[i],
+			deletedAt:   time.Now().UTC(),
+		}
+		record.PhoneNumbers = append(record.PhoneNumbers[:i], record.PhoneNumbers[i+1:]...)
+		record.Version++
+		store.appendAudit(newAuditEntry(actor, before, record))
+		return record.Version, nil
+	}
+	return 0, ErrPhoneNumberNotFound
+}
+
+func (store *memoryStore) ListAudit(options AuditOptions) (AuditResult, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	result := AuditResult{
+		Options: options,
+		Entries: []AuditEntry{},
+	}
+	skipped := 0
+	// Newest first
+	for i := len(store.audit) - 1; i >= 0; i-- {
+		entry := &store.audit[i]
+		if (options.ContactID != 0 && entry.ContactID != options.ContactID) ||
+			(options.UserID != 0 && entry.Actor.UserID != options.UserID) {
+			continue
+		}
+		if skipped < options.Offset {
+			skipped++
+			continue
+		}
+		if len(result.Entries) == options.Limit {
+			result.HasNext = true
+			break
+		}
+		result.Entries = append(result.Entries, copyAuditEntry(entry))
+	}
+	return result, nil
+}
+
+func (store *memoryStore) ListTrash(options TrashOptions) (TrashResult, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	items := make([]TrashItem, 0, len(store.trash)+len(store.deletedPhoneNumbers))
+	for _, deleted := range store.trash {
+		items = append(items, TrashItem{
+			Contact:   *copyContact(deleted.record),
+			DeletedAt: deleted.deletedAt,
+		})
+	}
+	for _, deleted := range store.deletedPhoneNumbers {
+		record, ok := store.contacts[deleted.ContactID]
+		if !ok {
+			// The Contact is in the trash too, so this comes back if it's restored
+			continue
+		}
+		phoneNumber := deleted.PhoneNumber
+		items = append(items, TrashItem{
+			Contact:     *copyContact(record),
+			PhoneNumber: &phoneNumber,
+			DeletedAt:   deleted.deletedAt,
+		})
+	}
+	// The same as the ORDER BY in sqlStore
+	sort.Slice(items, func(i, j int) bool {
+		a, b := &items[i], &items[j]
+		if !a.DeletedAt.Equal(b.DeletedAt) {
+			return a.DeletedAt.After(b.DeletedAt)
+		}
+		if a.Contact.ID != b.Contact.ID {
+			return a.Contact.ID > b.Contact.ID
+		}
+		return trashPhoneNumberID(a) > trashPhoneNumberID(b)
+	})
+
+	result := TrashResult{
+		Options: options,
+		Items:   []TrashItem{},
+	}
+	if options.Offset >= len(items) {
+		return result, nil
+	}
+	items = items[options.Offset:]
+	if len(items) > options.Limit {
+		items = items[:options.Limit]
+		result.HasNext = true
+	}
+	result.Items = items
+	return result, nil
+}
+
+func (store *memoryStore) IsUIDInTrash(uid string) (bool, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, deleted := range store.trash {
+		if deleted.record.UID == uid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (store *memoryStore) Restore(actor Actor, id int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	deleted, ok := store.trash[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for i := range store.merges {
+		if store.merges[i].SourceContactID == id {
+			return ErrRestoreMergedAway
+		}
+	}
+	record := deleted.record
+	record.Version++
+	delete(store.trash, id)
+	store.contacts[id] = record
+	store.appendAudit(newAuditEntryWithAction(actor, AuditActionRestore, nil, record))
+	return nil
+}
+
+func (store *memoryStore) RestorePhoneNumber(actor Actor, contactID int64, phoneNumberID int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record, ok := store.contacts[contactID]
+	if !ok {
+		return ErrNotFound
+	}
+	deleted, ok := store.deletedPhoneNumbers[phoneNumberID]
+	if !ok || deleted.ContactID != contactID {
+		return ErrPhoneNumberNotFound
+	}
+	before := copyContact(record)
+	if deleted.IsPrimary {
+		clearPrimaryFlags(record)
+	}
+	delete(store.deletedPhoneNumbers, phoneNumberID)
+	record.PhoneNumbers = append(record.PhoneNumbers, deleted.PhoneNumber)
+	sortPhoneNumbers(record.PhoneNumbers)
+	record.Version++
+	store.appendAudit(newAuditEntryWithAction(actor, AuditActionRestore, before, record))
+	return nil
+}
+
+func (store *memoryStore) Purge(actor Actor, id int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.trash[id]; !ok {
+		return ErrNotFound
+	}
+	store.purge(actor, id)
+	return nil
+}
+
+// purge is Purge without taking the lock, the Contact must be in the trash.
+// The caller must hold the lock.
+func (store *memoryStore) purge(actor Actor, id int64) {
+	deleted := store.trash[id]
+	delete(store.trash, id)
+	for phoneNumberID, phoneNumber := range store.deletedPhoneNumbers {
+		if phoneNumber.ContactID == id {
+			delete(store.deletedPhoneNumbers, phoneNumberID)
+		}
+	}
+	store.appendAudit(newAuditEntryWithAction(actor, AuditActionPurge, deleted.record, nil))
+}
+
+func (store *memoryStore) PurgePhoneNumber(actor Actor, contactID int64, phoneNumberID int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.contacts[contactID]; !ok {
+		return ErrNotFound
+	}
+	deleted, ok := store.deletedPhoneNumbers[phoneNumberID]
+	if !ok || deleted.ContactID != contactID {
+		return ErrPhoneNumberNotFound
+	}
+	store.purgePhoneNumber(actor, phoneNumberID)
+	return nil
+}
+
+// purgePhoneNumber is PurgePhoneNumber without taking the lock, the PhoneNumber must be in
+// the trash and its Contact must not be. The caller must hold the lock.
+func (store *memoryStore) purgePhoneNumber(actor Actor, phoneNumberID int64) {
+	deleted := store.deletedPhoneNumbers[phoneNumberID]
+	record := store.contacts[deleted.ContactID]
+	delete(store.deletedPhoneNumbers, phoneNumberID)
+	// The Contact itself doesn't change, so Before is the Contact with the PhoneNumber to
+	// record what was purged
+	before := copyContact(record)
+	before.PhoneNumbers = append(before.PhoneNumbers, deleted.PhoneNumber)
+	sortPhoneNumbers(before.PhoneNumbers)
+	store.appendAudit(newAuditEntryWithAction(actor, AuditActionPurge, before, record))
+}
+
+func (store *memoryStore) PurgeDeletedBefore(actor Actor, deletedBefore time.Time) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Purge in ID order so that the audit log is in the same order as sqlStore
+	var contactIDs []int64
+	for id, deleted := range store.trash {
+		if deleted.deletedAt.Before(deletedBefore) {
+			contactIDs = append(contactIDs, id)
+		}
+	}
+	sort.Slice(contactIDs, func(i, j int) bool {
+		return contactIDs[i] < contactIDs[j]
+	})
+	for _, id := range contactIDs {
+		store.purge(actor, id)
+	}
+	var phoneNumberIDs []int64
+	for id, deleted := range store.deletedPhoneNumbers {
+		if _, ok := store.contacts[deleted.ContactID]; ok && deleted.deletedAt.Before(deletedBefore) {
+			phoneNumberIDs = append(phoneNumberIDs, id)
+		}
+	}
+	sort.Slice(phoneNumberIDs, func(i, j int) bool {
+		return phoneNumberIDs[i] < phoneNumberIDs[j]
+	})
+	for _, id := range phoneNumberIDs {
+		store.purgePhoneNumber(actor, id)
+	}
+	return len(contactIDs) + len(phoneNumberIDs), nil
+}
+
+// appendAudit stores the entry, giving it the next ID. The caller must hold the lock.
+func (store *memoryStore) appendAudit(entry AuditEntry) {
+	entry.ID = int64(len(store.audit)) + 1
+	store.audit = append(store.audit, entry)
+}
+
+// sortedContacts returns a copy of every contact, ordered by ID.
+// The caller must hold the lock.
+func (store *memoryStore) sortedContacts() []Contact {
+	contacts := make([]Contact, 0, len(store.contacts))
+	for _, record := range store.contacts {
+		contacts = append(contacts, *copyContact(record))
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].ID < contacts[j].ID
+	})
+	return contacts
+}
+
+// sortPhoneNumbers orders the PhoneNumbers by ID, the same as they would come out of the database.
+func sortPhoneNumbers(phoneNumbers []PhoneNumber) {
+	sort.Slice(phoneNumbers, func(i, j int) bool {
+		return phoneNumbers[i].ID < phoneNumbers[j].ID
+	})
+}
+
+// trashPhoneNumberID returns the ID of the items PhoneNumber, or 0 if it's a whole Contact.
+func trashPhoneNumberID(item *TrashItem) int64 {
+	if item.PhoneNumber == nil {
+		return 0
+	}
+	return item.PhoneNumber.ID
+}
+
+// clearPrimaryFlags will make it so that none of the Contacts PhoneNumbers are primary.
+func clearPrimaryFlags(record *Contact) {
+	for i := range record.PhoneNumbers {
+		record.PhoneNumbers[i].IsPrimary = false
+	}
+}
+
+// hasEmailContaining returns true if any of the records emails contain s, which must
+// be lower-case.
+func hasEmailContaining(record *Contact, s string) bool {
+	for _, email := range record.Emails {
+		if strings.Contains(strings.ToLower(email.Address), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstEmail returns the records alphabetically first email in lower-case, or blank if it
+// has none. Used for sorting by email, the same as sqlStore.
+func firstEmail(record *Contact) string {
+	result := ""
+	for i, email := range record.Emails {
+		if address := strings.ToLower(email.Address); i == 0 || address < result {
+			result = address
+		}
+	}
+	return result
+}
+
+func hasPhoneNumberContaining(record *Contact, s string) bool {
+	for _, phoneNumber := range record.PhoneNumbers {
+		if strings.Contains(phoneNumber.Number, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyContact makes a deep copy of the record, so that callers can't modify what
+// we have stored by holding onto a reference, and vice-versa.
+func copyContact(record *Contact) *Contact {
+	result := *record
+	// Emails are never nil so they encode as an empty JSON array, the same as sqlStore
+	result.Emails = make([]EmailAddress, len(record.Emails))
+	copy(result.Emails, record.Emails)
+	if record.PhoneNumbers != nil {
+		result.PhoneNumbers = make([]PhoneNumber, len(record.PhoneNumbers))
+		copy(result.PhoneNumbers, record.PhoneNumbers)
+	}
+	return &result
+}
+
+// copyMergeAudit makes a deep copy of the audit, for the same reasons as copyContact.
+func copyMergeAudit(audit *MergeAudit) MergeAudit {
+	result := *audit
+	result.Source = *copyContact(&audit.Source)
+	result.AddedEmails = append([]EmailAddress{}, audit.AddedEmails...)
+	result.AddedPhoneNumbers = append([]PhoneNumber{}, audit.AddedPhoneNumbers...)
+	return result
+}
+
+// copyAuditEntry makes a deep copy of the entry, for the same reasons as copyContact.
+func copyAuditEntry(entry *AuditEntry) AuditEntry {
+	result := *entry
+	if entry.Before != nil {
+		result.Before = copyContact(entry.Before)
+	}
+	if entry.After != nil {
+		result.After = copyContact(entry.After)
+	}
+	return result
+}
@@ -0,0 +1,1338 @@
+package contact
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/db"
+)
+
+// sqlStore stores contacts in the database connected to by the "db" package.
+//
+// The same SQL is used for both Postgres and SQLite. Queries are written for Postgres and
+// then passed through db.Rebind, and the few Postgres functions we use that SQLite lacks
+// are registered on SQLite connections by the "db" package.
+//
+// Deleted Contacts and PhoneNumbers have a DeletedAt, so every query outside of the trash
+// must have "DeletedAt IS NULL" for each of them.
+type sqlStore struct{}
+
+// assert at compile-time that this type satisfies the ContactStore interface
+var _ ContactStore = new(sqlStore)
+
+// NewSQLStore returns a ContactStore backed by the current database connection.
+// Supports both Postgres and SQLite, db.MustConnect must be called before it's used.
+func NewSQLStore() ContactStore {
+	return &sqlStore{}
+}
+
+// The columns selected for each Contact, EmailAddress and PhoneNumber, in the order they're scanned.
+const (
+	contactColumns      = `ID, UID, FullName, Version`
+	emailAddressColumns = `ID, ContactID, Address, Label, IsPrimary`
+	phoneNumberColumns  = `ID, ContactID, Number, CountryCode, Extension, Label, IsPrimary, LineType`
+	auditColumns        = `ID, ContactID, Action, UserID, Username, IP, ContactBefore, ContactAfter, ChangedAt`
+)
+
+// queryer runs queries on either the database connection or a transaction.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sortColumns maps what a SortField sorts on in SQL.
+//
+// We never put user input directly into an ORDER BY clause, only values from this map.
+// LOWER() is used so that sorting is case-insensitive regardless of the database collation.
+var sortColumns = map[SortField]string{
+	SortByID:       "ID",
+	SortByFullName: "LOWER(FullName)",
+	// Contacts without an email sort first, the same as a blank email used to.
+	SortByEmail: "COALESCE((SELECT MIN(LOWER(Address)) FROM EmailAddress WHERE EmailAddress.ContactID = Contact.ID), '')",
+	// Relevance depends on the search, so it's built in List. Without a search,
+	// every contact is equally relevant and so they're just sorted by ID.
+	SortByRelevance: "",
+}
+
+func (store *sqlStore) Insert(actor Actor, record *Contact) error {
+	// We use an SQL transaction here so that if any errors occur during record creation, we don't
+	// end up with a Contact being partially created.
+	// (ie. if a PhoneNumber fails to insert for unknown reasons)
+	//
+	// This transaction logic came in a bit later, the initial code didnt use them.
+	// In hindsight, I wish I explored using them when creating tables / setting up the mock data
+	// in the setup step. I want to redo it but I really just need to ship this.
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		return insertContact(tx, actor, record)
+	})
+}
+
+func (store *sqlStore) InsertAll(actor Actor, records []*Contact) error {
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		for _, record := range records {
+			if err := insertContact(tx, actor, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *sqlStore) Update(actor Actor, record *Contact) error {
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		return updateContact(tx, actor, record)
+	})
+}
+
+func (store *sqlStore) Delete(actor Actor, id int64, version int64) error {
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		return deleteContact(tx, actor, id, version)
+	})
+}
+
+func (store *sqlStore) Merge(actor Actor, target *Contact, audit *MergeAudit) error {
+	details, err := json.Marshal(mergeAuditDetails{
+		Source:            audit.Source,
+		AddedEmails:       audit.AddedEmails,
+		AddedPhoneNumbers: audit.AddedPhoneNumbers,
+	})
+	if err != nil {
+		return err
+	}
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		// Check the source up-front, so that the target isn't given IDs for emails and phone
+		// numbers that are then rolled back. It's not locked until it's deleted, as locking it
+		// twice would increment its Version in the audit log.
+		source, err := getContactInTx(tx, audit.SourceContactID)
+		if err != nil {
+			return err
+		}
+		if audit.Source.Version != 0 && audit.Source.Version != source.Version {
+			return ErrVersionConflict
+		}
+		if err := updateContact(tx, actor, target); err != nil {
+			return err
+		}
+		if err := deleteContact(tx, actor, audit.SourceContactID, audit.Source.Version); err != nil {
+			return err
+		}
+		return tx.QueryRow(db.Rebind(`INSERT INTO ContactMerge (TargetContactID, SourceContactID, Details, MergedAt) VALUES ($1, $2, $3, $4) RETURNING ID`),
+			audit.TargetContactID,
+			audit.SourceContactID,
+			string(details),
+			audit.MergedAt,
+		).Scan(&audit.ID)
+	})
+}
+
+func (store *sqlStore) GetMerges(contactID int64) ([]MergeAudit, error) {
+	rows, err := db.Get().Query(db.Rebind(`SELECT ID, TargetContactID, SourceContactID, Details, MergedAt FROM ContactMerge WHERE TargetContactID = $1 ORDER BY ID`), contactID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	merges := []MergeAudit{}
+	for rows.Next() {
+		var audit MergeAudit
+		var details string
+		if err := rows.Scan(&audit.ID, &audit.TargetContactID, &audit.SourceContactID, &details, &audit.MergedAt); err != nil {
+			return nil, err
+		}
+		var decoded mergeAuditDetails
+		if err := json.Unmarshal([]byte(details), &decoded); err != nil {
+			return nil, err
+		}
+		audit.Source = decoded.Source
+		audit.AddedEmails = decoded.AddedEmails
+		audit.AddedPhoneNumbers = decoded.AddedPhoneNumbers
+		audit.MergedAt = audit.MergedAt.UTC()
+		merges = append(merges, audit)
+	}
+	return merges, rows.Err()
+}
+
+func (store *sqlStore) Get(id int64) (Contact, error) {
+	conn := db.Get()
+
+	return getContact(conn, db.Rebind(`SELECT `+contactColumns+` FROM Contact WHERE ID = $1 AND DeletedAt IS NULL`), id)
+}
+
+func (store *sqlStore) GetByUID(uid string) (Contact, error) {
+	return getContact(db.Get(), db.Rebind(`SELECT `+contactColumns+` FROM Contact WHERE UID = $1 AND DeletedAt IS NULL`), uid)
+}
+
+func (store *sqlStore) GetAll() ([]Contact, error) {
+	conn := db.Get()
+
+	// I originally did a query per records has_many for simplicity, but that meant one extra
+	// query per contact. Now we just grab all the phone numbers and emails in one go and match them up.
+	contacts, err := queryContacts(conn, `SELECT `+contactColumns+` FROM Contact WHERE DeletedAt IS NULL ORDER BY ID`)
+	if err != nil {
+		return nil, err
+	}
+	emailsByContactID, err := queryEmailAddresses(conn, `SELECT `+emailAddressColumns+` FROM EmailAddress ORDER BY ID`)
+	if err != nil {
+		return nil, err
+	}
+	phoneNumbersByContactID, err := queryPhoneNumbers(conn, `SELECT `+phoneNumberColumns+` FROM PhoneNumber WHERE DeletedAt IS NULL ORDER BY ID`)
+	if err != nil {
+		return nil, err
+	}
+	assignChildren(contacts, emailsByContactID, phoneNumbersByContactID)
+	return contacts, nil
+}
+
+func (store *sqlStore) List(options ListOptions) (ListResult, error) {
+	sortColumn, ok := sortColumns[options.SortBy]
+	if !ok {
+		return ListResult{}, ErrInvalidSortField
+	}
+
+	var (
+		conditions = []string{`Contact.DeletedAt IS NULL`}
+		args       []interface{}
+	)
+	addArg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if options.Search != "" {
+		condition, relevance := searchCondition(options.Search, addArg)
+		conditions = append(conditions, condition)
+		if options.SortBy == SortByRelevance {
+			// The most relevant results have the highest similarity, so we sort by the
+			// negated similarity so that ascending order puts them first.
+			sortColumn = `-` + relevance
+		}
+	}
+	if options.FullName != "" {
+		conditions = append(conditions, `LOWER(FullName) LIKE LOWER(`+addArg(containsPattern(options.FullName))+`) ESCAPE '\'`)
+	}
+	if options.Email != "" {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM EmailAddress WHERE EmailAddress.ContactID = Contact.ID AND LOWER(EmailAddress.Address) LIKE LOWER(`+addArg(containsPattern(options.Email))+`) ESCAPE '\')`)
+	}
+	if options.PhoneNumber != "" {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM PhoneNumber WHERE PhoneNumber.ContactID = Contact.ID AND PhoneNumber.DeletedAt IS NULL AND PhoneNumber.Number LIKE `+addArg(containsPattern(options.PhoneNumber))+` ESCAPE '\')`)
+	}
+
+	// hasSortColumn is false when sorting by ID alone, otherwise the value of sortColumn is
+	// selected for each contact so that ForEach can continue after the last one. That's a
+	// number when sorting by relevance and text otherwise.
+	hasSortColumn := sortColumn != "ID" && sortColumn != ""
+	isNumberSort := options.SortBy == SortByRelevance
+	direction, after := ` ASC`, ` > `
+	if options.SortDescending {
+		direction, after = ` DESC`, ` < `
+	}
+	if cursor := options.after; cursor != nil {
+		id := addArg(cursor.ID)
+		if !hasSortColumn {
+			conditions = append(conditions, `ID`+after+id)
+		} else {
+			var value string
+			if isNumberSort {
+				value = addArg(cursor.Number)
+			} else {
+				value = addArg(cursor.Text)
+			}
+			conditions = append(conditions, `(`+sortColumn+after+value+` OR (`+sortColumn+` = `+value+` AND ID`+after+id+`))`)
+		}
+	}
+
+	query := `SELECT ` + contactColumns
+	if hasSortColumn {
+		query += `, ` + sortColumn
+	}
+	query += ` FROM Contact WHERE ` + strings.Join(conditions, ` AND `)
+	query += ` ORDER BY `
+	if hasSortColumn {
+		query += sortColumn + direction + `, `
+	}
+	// ID is always used as a tie-breaker so that the order is stable between pages.
+	query += `ID` + direction
+	// Fetch one more than we need so we know if there's a next page
+	query += ` LIMIT ` + addArg(options.Limit+1)
+	if options.after == nil {
+		query += ` OFFSET ` + addArg(options.Offset)
+	}
+
+	conn := db.Get()
+	rows, err := conn.Query(db.Rebind(query), args...)
+	if err != nil {
+		return ListResult{}, err
+	}
+	defer rows.Close()
+	result := ListResult{
+		Options: options,
+	}
+	var contacts []Contact
+	for rows.Next() {
+		if len(contacts) == options.Limit {
+			result.HasNext = true
+			break
+		}
+		record := Contact{}
+		cursor := listCursor{}
+		dest := []interface{}{&record.ID, &record.UID, &record.FullName, &record.Version}
+		if hasSortColumn && isNumberSort {
+			dest = append(dest, &cursor.Number)
+		} else if hasSortColumn {
+			dest = append(dest, &cursor.Text)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return ListResult{}, err
+		}
+		cursor.ID = record.ID
+		contacts = append(contacts, record)
+		result.last = cursor
+	}
+	if err := rows.Err(); err != nil {
+		return ListResult{}, err
+	}
+	rows.Close()
+	if err := loadChildren(conn, contacts); err != nil {
+		return ListResult{}, err
+	}
+	result.Contacts = contacts
+	return result, nil
+}
+
+func (store *sqlStore) Count() (int, error) {
+	var count int
+	err := db.Get().QueryRow(`SELECT COUNT(*) FROM Contact WHERE DeletedAt IS NULL`).Scan(&count)
+	return count, err
+}
+
+func (store *sqlStore) AddPhoneNumber(actor Actor, contactID int64, version int64, phoneNumber *PhoneNumber) (int64, error) {
+	var after *Contact
+	err := db.RunInTransaction(func(tx *sql.Tx) error {
+		before, err := lockContact(tx, contactID)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != before.Version {
+			return ErrVersionConflict
+		}
+		phoneNumber.ContactID = contactID
+		if phoneNumber.IsPrimary {
+			if err := clearPrimaryPhoneNumber(tx, contactID); err != nil {
+				return err
+			}
+		}
+		if err := insertPhoneNumber(tx, phoneNumber); err != nil {
+			return err
+		}
+		after, err = auditUpdate(tx, actor, before)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return after.Version, nil
+}
+
+func (store *sqlStore) UpdatePhoneNumber(actor Actor, version int64, phoneNumber *PhoneNumber) (int64, error) {
+	var after *Contact
+	err := db.RunInTransaction(func(tx *sql.Tx) error {
+		before, err := lockContact(tx, phoneNumber.ContactID)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != before.Version {
+			return ErrVersionConflict
+		}
+		if phoneNumber.IsPrimary {
+			if err := clearPrimaryPhoneNumber(tx, phoneNumber.ContactID); err != nil {
+				return err
+			}
+		}
+		if err := updatePhoneNumber(tx, phoneNumber); err != nil {
+			return err
+		}
+		after, err = auditUpdate(tx, actor, before)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return after.Version, nil
+}
+
+func (store *sqlStore) DeletePhoneNumber(actor Actor, contactID int64, phoneNumberID int64, version int64) (int64, error) {
+	var after *Contact
+	err := db.RunInTransaction(func(tx *sql.Tx) error {
+		before, err := lockContact(tx, contactID)
+		if err != nil {
+			return err
+		}
+		if version != 0 && version != before.Version {
+			return ErrVersionConflict
+		}
+		existingIDs, err := getChildIDs(tx, "PhoneNumber", contactID)
+		if err != nil {
+			return err
+		}
+		if !existingIDs[phoneNumberID] {
+			return ErrPhoneNumberNotFound
+		}
+		if len(existingIDs) <= 1 {
+			return ErrMissingPhoneNumbers
+		}
+		if _, err := tx.Exec(db.Rebind(`UPDATE PhoneNumber SET DeletedAt = $1 WHERE ID = $2`), time.Now().UTC(), phoneNumberID); err != nil {
+			return err
+		}
+		after, err = auditUpdate(tx, actor, before)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return after.Version, nil
+}
+
+func (store *sqlStore) ListAudit(options AuditOptions) (AuditResult, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	if options.ContactID != 0 {
+		args = append(args, options.ContactID)
+		conditions = append(conditions, `ContactID = $`+strconv.Itoa(len(args)))
+	}
+	if options.UserID != 0 {
+		args = append(args, options.UserID)
+		conditions = append(conditions, `UserID = $`+strconv.Itoa(len(args)))
+	}
+	query := `SELECT ` + auditColumns + ` FROM ContactAudit`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	// Fetch one extra entry to know if there's a next page
+	args = append(args, options.Limit+1, options.Offset)
+	query += ` ORDER BY ID DESC LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
+	rows, err := db.Get().Query(db.Rebind(query), args...)
+	if err != nil {
+		return AuditResult{}, err
+	}
+	defer rows.Close()
+	result := AuditResult{
+		Options: options,
+		Entries: []AuditEntry{},
+	}
+	for rows.Next() {
+		var (
+			entry  AuditEntry
+			userID sql.NullInt64
+			before sql.NullString
+			after  sql.NullString
+		)
+		if err := rows.Scan(&entry.ID, &entry.ContactID, &entry.Action, &userID, &entry.Actor.Username, &entry.Actor.IP, &before, &after, &entry.ChangedAt); err != nil {
+			return AuditResult{}, err
+		}
+		entry.Actor.UserID = userID.Int64
+		entry.ChangedAt = entry.ChangedAt.UTC()
+		if before.Valid {
+			if err := json.Unmarshal([]byte(before.String), &entry.Before); err != nil {
+				return AuditResult{}, err
+			}
+		}
+		if after.Valid {
+			if err := json.Unmarshal([]byte(after.String), &entry.After); err != nil {
+				return AuditResult{}, err
+			}
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return AuditResult{}, err
+	}
+	if len(result.Entries) > options.Limit {
+		result.Entries = result.Entries[:options.Limit]
+		result.HasNext = true
+	}
+	return result, nil
+}
+
+func (store *sqlStore) ListTrash(options TrashOptions) (TrashResult, error) {
+	conn := db.Get()
+	// Find the page of items first, then load them all at once, like List. PhoneNumbers of a
+	// Contact in the trash are left out, the same as the memory store.
+	rows, err := conn.Query(db.Rebind(`SELECT ContactID, PhoneNumberID FROM (
+		SELECT ID AS ContactID, 0 AS PhoneNumberID, DeletedAt FROM Contact WHERE DeletedAt IS NOT NULL
+		UNION ALL
+		SELECT PhoneNumber.ContactID, PhoneNumber.ID, PhoneNumber.DeletedAt FROM PhoneNumber
+			JOIN Contact ON Contact.ID = PhoneNumber.ContactID
+			WHERE PhoneNumber.DeletedAt IS NOT NULL AND Contact.DeletedAt IS NULL
+	) AS Trash ORDER BY DeletedAt DESC, ContactID DESC, PhoneNumberID DESC LIMIT $1 OFFSET $2`), options.Limit+1, options.Offset)
+	if err != nil {
+		return TrashResult{}, err
+	}
+	defer rows.Close()
+	type trashKey struct {
+		ContactID     int64
+		PhoneNumberID int64
+	}
+	var keys []trashKey
+	for rows.Next() {
+		var key trashKey
+		if err := rows.Scan(&key.ContactID, &key.PhoneNumberID); err != nil {
+			return TrashResult{}, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return TrashResult{}, err
+	}
+	rows.Close()
+	result := TrashResult{
+		Options: options,
+		Items:   []TrashItem{},
+	}
+	if len(keys) > options.Limit {
+		keys = keys[:options.Limit]
+		result.HasNext = true
+	}
+	if len(keys) == 0 {
+		return result, nil
+	}
+
+	var contactIDs, phoneNumberIDs []int64
+	for _, key := range keys {
+		contactIDs = append(contactIDs, key.ContactID)
+		if key.PhoneNumberID != 0 {
+			phoneNumberIDs = append(phoneNumberIDs, key.PhoneNumberID)
+		}
+	}
+	contacts, err := queryDeletedContacts(conn, contactIDs)
+	if err != nil {
+		return TrashResult{}, err
+	}
+	phoneNumbers, err := queryDeletedPhoneNumbers(conn, phoneNumberIDs)
+	if err != nil {
+		return TrashResult{}, err
+	}
+	for _, key := range keys {
+		item := TrashItem{
+			Contact:   contacts[key.ContactID].Contact,
+			DeletedAt: contacts[key.ContactID].deletedAt,
+		}
+		if key.PhoneNumberID != 0 {
+			deleted := phoneNumbers[key.PhoneNumberID]
+			item.PhoneNumber = &deleted.PhoneNumber
+			item.DeletedAt = deleted.deletedAt
+		}
+		result.Items = append(result.Items, item)
+	}
+	return result, nil
+}
+
+func (store *sqlStore) IsUIDInTrash(uid string) (bool, error) {
+	var count int
+	err := db.Get().QueryRow(db.Rebind(`SELECT COUNT(*) FROM Contact WHERE UID = $1 AND DeletedAt IS NOT NULL`), uid).Scan(&count)
+	return count > 0, err
+}
+
+func (store *sqlStore) Restore(actor Actor, id int64) error {
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(db.Rebind(`UPDATE Contact SET DeletedAt = NULL, Version = Version + 1 WHERE ID = $1 AND DeletedAt IS NOT NULL`), id)
+		if err != nil {
+			return err
+		}
+		if err := expectRowsAffected(res, ErrNotFound); err != nil {
+			return err
+		}
+		var mergeCount int
+		if err := tx.QueryRow(db.Rebind(`SELECT COUNT(*) FROM ContactMerge WHERE SourceContactID = $1`), id).Scan(&mergeCount); err != nil {
+			return err
+		}
+		if mergeCount > 0 {
+			return ErrRestoreMergedAway
+		}
+		after, err := getContactInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return insertAuditEntry(tx, newAuditEntryWithAction(actor, AuditActionRestore, nil, &after))
+	})
+}
+
+func (store *sqlStore) RestorePhoneNumber(actor Actor, contactID int64, phoneNumberID int64) error {
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		before, err := lockContact(tx, contactID)
+		if err != nil {
+			return err
+		}
+		phoneNumber, err := getDeletedPhoneNumber(tx, contactID, phoneNumberID)
+		if err != nil {
+			return err
+		}
+		if phoneNumber.IsPrimary {
+			if err := clearPrimaryPhoneNumber(tx, contactID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(db.Rebind(`UPDATE PhoneNumber SET DeletedAt = NULL WHERE ID = $1`), phoneNumberID); err != nil {
+			return err
+		}
+		after, err := getContactInTx(tx, contactID)
+		if err != nil {
+			return err
+		}
+		return insertAuditEntry(tx, newAuditEntryWithAction(actor, AuditActionRestore, before, &after))
+	})
+}
+
+func (store *sqlStore) Purge(actor Actor, id int64) error {
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		before, err := getContact(tx, db.Rebind(`SELECT `+contactColumns+` FROM Contact WHERE ID = $1 AND DeletedAt IS NOT NULL`), id)
+		if err != nil {
+			return err
+		}
+		// EmailAddress and PhoneNumber rows must go first due to their foreign key constraints.
+		if _, err := tx.Exec(db.Rebind(`DELETE FROM EmailAddress WHERE ContactID = $1`), id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(db.Rebind(`DELETE FROM PhoneNumber WHERE ContactID = $1`), id); err != nil {
+			return err
+		}
+		res, err := tx.Exec(db.Rebind(`DELETE FROM Contact WHERE ID = $1 AND DeletedAt IS NOT NULL`), id)
+		if err != nil {
+			return err
+		}
+		if err := expectRowsAffected(res, ErrNotFound); err != nil {
+			return err
+		}
+		return insertAuditEntry(tx, newAuditEntryWithAction(actor, AuditActionPurge, &before, nil))
+	})
+}
+
+func (store *sqlStore) PurgePhoneNumber(actor Actor, contactID int64, phoneNumberID int64) error {
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		after, err := getContactInTx(tx, contactID)
+		if err != nil {
+			return err
+		}
+		phoneNumber, err := getDeletedPhoneNumber(tx, contactID, phoneNumberID)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(db.Rebind(`DELETE FROM PhoneNumber WHERE ID = $1 AND DeletedAt IS NOT NULL`), phoneNumberID)
+		if err != nil {
+			return err
+		}
+		if err := expectRowsAffected(res, ErrPhoneNumberNotFound); err != nil {
+			return err
+		}
+		// The Contact itself doesn't change, so Before is the Contact with the PhoneNumber to
+		// record what was purged
+		before := *copyContact(&after)
+		before.PhoneNumbers = append(before.PhoneNumbers, phoneNumber)
+		sortPhoneNumbers(before.PhoneNumbers)
+		return insertAuditEntry(tx, newAuditEntryWithAction(actor, AuditActionPurge, &before, &after))
+	})
+}
+
+func (store *sqlStore) PurgeDeletedBefore(actor Actor, deletedBefore time.Time) (int, error) {
+	conn := db.Get()
+	// Each record is purged in its own transaction, so that a large trash doesn't lock the
+	// tables for long. Records restored in the meantime are skipped.
+	rows, err := conn.Query(db.Rebind(`SELECT ID FROM Contact WHERE DeletedAt < $1 ORDER BY ID`), deletedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	contactIDs, err := scanIDs(rows)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, id := range contactIDs {
+		err := store.Purge(actor, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	rows, err = conn.Query(db.Rebind(`SELECT PhoneNumber.ID, PhoneNumber.ContactID FROM PhoneNumber
+		JOIN Contact ON Contact.ID = PhoneNumber.ContactID
+		WHERE PhoneNumber.DeletedAt < $1 AND Contact.DeletedAt IS NULL
+		ORDER BY PhoneNumber.ID`), deletedBefore.UTC())
+	if err != nil {
+		return purged, err
+	}
+	defer rows.Close()
+	type phoneNumberKey struct {
+		ID        int64
+		ContactID int64
+	}
+	var phoneNumbers []phoneNumberKey
+	for rows.Next() {
+		var key phoneNumberKey
+		if err := rows.Scan(&key.ID, &key.ContactID); err != nil {
+			return purged, err
+		}
+		phoneNumbers = append(phoneNumbers, key)
+	}
+	if err := rows.Err(); err != nil {
+		return purged, err
+	}
+	rows.Close()
+	for _, key := range phoneNumbers {
+		err := store.PurgePhoneNumber(actor, key.ContactID, key.ID)
+		if err == ErrNotFound || err == ErrPhoneNumberNotFound {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// getDeletedPhoneNumber returns the PhoneNumber of the Contact that's in the trash.
+// Returns ErrPhoneNumberNotFound if there's no such PhoneNumber in the trash.
+func getDeletedPhoneNumber(tx *sql.Tx, contactID int64, phoneNumberID int64) (PhoneNumber, error) {
+	phoneNumbersByContactID, err := queryPhoneNumbers(tx, db.Rebind(`SELECT `+phoneNumberColumns+` FROM PhoneNumber WHERE ID = $1 AND ContactID = $2 AND DeletedAt IS NOT NULL`), phoneNumberID, contactID)
+	if err != nil {
+		return PhoneNumber{}, err
+	}
+	phoneNumbers := phoneNumbersByContactID[contactID]
+	if len(phoneNumbers) == 0 {
+		return PhoneNumber{}, ErrPhoneNumberNotFound
+	}
+	return phoneNumbers[0], nil
+}
+
+// trashedContact is a Contact from the trash, or the Contact of a PhoneNumber in the trash,
+// with when it was deleted.
+type trashedContact struct {
+	Contact
+	// deletedAt is zero if the Contact isn't deleted
+	deletedAt time.Time
+}
+
+// queryDeletedContacts returns the Contacts with the given IDs, whether they're in the trash
+// or not, by ID.
+func queryDeletedContacts(conn queryer, ids []int64) (map[int64]trashedContact, error) {
+	rows, err := conn.Query(db.Rebind(`SELECT `+contactColumns+`, DeletedAt FROM Contact WHERE ID IN (`+placeholders(len(ids))+`)`), int64Args(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		contacts  []Contact
+		deletedAt = make(map[int64]time.Time)
+	)
+	err = func() error {
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				record         Contact
+				maybeDeletedAt sql.NullTime
+			)
+			if err := rows.Scan(&record.ID, &record.UID, &record.FullName, &record.Version, &maybeDeletedAt); err != nil {
+				return err
+			}
+			contacts = append(contacts, record)
+			if maybeDeletedAt.Valid {
+				deletedAt[record.ID] = maybeDeletedAt.Time.UTC()
+			}
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if err := loadChildren(conn, contacts); err != nil {
+		return nil, err
+	}
+	result := make(map[int64]trashedContact, len(contacts))
+	for _, record := range contacts {
+		result[record.ID] = trashedContact{
+			Contact:   record,
+			deletedAt: deletedAt[record.ID],
+		}
+	}
+	return result, nil
+}
+
+// queryDeletedPhoneNumbers returns the PhoneNumbers in the trash with the given IDs, by ID.
+func queryDeletedPhoneNumbers(conn queryer, ids []int64) (map[int64]deletedPhoneNumber, error) {
+	phoneNumbers := make(map[int64]deletedPhoneNumber)
+	if len(ids) == 0 {
+		return phoneNumbers, nil
+	}
+	rows, err := conn.Query(db.Rebind(`SELECT `+phoneNumberColumns+`, DeletedAt FROM PhoneNumber WHERE DeletedAt IS NOT NULL AND ID IN (`+placeholders(len(ids))+`)`), int64Args(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deleted deletedPhoneNumber
+		if err := rows.Scan(
+			&deleted.ID,
+			&deleted.ContactID,
+			&deleted.Number,
+			&deleted.CountryCode,
+			&deleted.Extension,
+			&deleted.Label,
+			&deleted.IsPrimary,
+			&deleted.LineType,
+			&deleted.deletedAt,
+		); err != nil {
+			return nil, err
+		}
+		deleted.deletedAt = deleted.deletedAt.UTC()
+		phoneNumbers[deleted.ID] = deleted
+	}
+	return phoneNumbers, rows.Err()
+}
+
+// placeholders returns "$1, $2, ..." for an IN clause with n values.
+func placeholders(n int) string {
+	result := make([]string, n)
+	for i := range result {
+		result[i] = "$" + strconv.Itoa(i+1)
+	}
+	return strings.Join(result, ", ")
+}
+
+func int64Args(values []int64) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
+
+// scanIDs reads a single ID column from each row and closes them.
+func scanIDs(rows *sql.Rows) ([]int64, error) {
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// mergeAuditDetails is the part of a MergeAudit that's stored as JSON. A snapshot of the
+// source doesn't need to be queried, so there's no benefit to giving it its own tables.
+type mergeAuditDetails struct {
+	Source            Contact        `json:"source"`
+	AddedEmails       []EmailAddress `json:"addedEmails"`
+	AddedPhoneNumbers []PhoneNumber  `json:"addedPhoneNumbers"`
+}
+
+// insertContact is the body of Insert, so that it can be used within other transactions.
+func insertContact(tx *sql.Tx, actor Actor, record *Contact) error {
+	if record.UID == "" {
+		record.UID = newUID()
+	}
+	err := tx.QueryRow(db.Rebind(`INSERT INTO Contact (UID, FullName) VALUES ($1, $2) RETURNING ID, Version`), record.UID, record.FullName).Scan(&record.ID, &record.Version)
+	if err != nil {
+		return err
+	}
+	if record.ID == 0 {
+		panic("Unexpected error. Failed get ID after inserting Contact record.")
+	}
+	for i := range record.Emails {
+		childRecord := &record.Emails[i]
+		childRecord.ContactID = record.ID
+		if err := insertEmailAddress(tx, childRecord); err != nil {
+			return err
+		}
+	}
+	for i := range record.PhoneNumbers {
+		childRecord := &record.PhoneNumbers[i]
+		childRecord.ContactID = record.ID
+		if err := insertPhoneNumber(tx, childRecord); err != nil {
+			return err
+		}
+	}
+	return insertAuditEntry(tx, newAuditEntry(actor, nil, record))
+}
+
+// updateContact is the body of Update, so that it can be used within other transactions.
+func updateContact(tx *sql.Tx, actor Actor, record *Contact) error {
+	// Version is incremented by lockContact
+	before, err := lockContact(tx, record.ID)
+	if err != nil {
+		return err
+	}
+	if record.Version != 0 && record.Version != before.Version {
+		// Rolling back takes back the Version increment
+		return ErrVersionConflict
+	}
+	err = tx.QueryRow(db.Rebind(`UPDATE Contact SET FullName = $1 WHERE ID = $2 RETURNING UID, Version`), record.FullName, record.ID).Scan(&record.UID, &record.Version)
+	if err != nil {
+		return err
+	}
+	if err := syncEmailAddresses(tx, record); err != nil {
+		return err
+	}
+	if err := syncPhoneNumbers(tx, record); err != nil {
+		return err
+	}
+	_, err = auditUpdate(tx, actor, before)
+	return err
+}
+
+// deleteContact is the body of Delete, so that it can be used within other transactions.
+func deleteContact(tx *sql.Tx, actor Actor, id int64, version int64) error {
+	before, err := lockContact(tx, id)
+	if err != nil {
+		return err
+	}
+	if version != 0 && version != before.Version {
+		return ErrVersionConflict
+	}
+	// Its Emails and PhoneNumbers are left as they are, so they come back if it's restored
+	if _, err := tx.Exec(db.Rebind(`UPDATE Contact SET DeletedAt = $1 WHERE ID = $2`), time.Now().UTC(), id); err != nil {
+		return err
+	}
+	return insertAuditEntry(tx, newAuditEntry(actor, before, nil))
+}
+
+// expectRowsAffected will return notFoundErr if the statement didn't affect any rows.
+func expectRowsAffected(res sql.Result, notFoundErr error) error {
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return notFoundErr
+	}
+	return nil
+}
+
+// lockContact will lock the Contact row for the remainder of the transaction so that
+// concurrent changes to its PhoneNumbers can't interleave with ours. (ie. two requests
+// both deleting what they each think isn't the last phone number)
+//
+// Every caller is about to change the Contact, so this also increments its Version. The
+// Contact is returned as it was before, for the audit log.
+// Returns ErrNotFound if the Contact doesn't exist or is in the trash.
+func lockContact(tx *sql.Tx, contactID int64) (*Contact, error) {
+	// An UPDATE takes a row lock just like "SELECT ... FOR UPDATE" does, but unlike
+	// "FOR UPDATE", it also works on SQLite. (which just locks the whole database)
+	res, err := tx.Exec(db.Rebind(`UPDATE Contact SET Version = Version + 1 WHERE ID = $1 AND DeletedAt IS NULL`), contactID)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectRowsAffected(res, ErrNotFound); err != nil {
+		return nil, err
+	}
+	// Read once it's locked so that nothing can change it in between, which means taking back
+	// the Version increment above
+	before, err := getContactInTx(tx, contactID)
+	if err != nil {
+		return nil, err
+	}
+	before.Version--
+	return &before, nil
+}
+
+// getContactInTx returns the Contact as it is within the transaction.
+// Returns ErrNotFound if the Contact doesn't exist or is in the trash.
+func getContactInTx(tx *sql.Tx, id int64) (Contact, error) {
+	return getContact(tx, db.Rebind(`SELECT `+contactColumns+` FROM Contact WHERE ID = $1 AND DeletedAt IS NULL`), id)
+}
+
+// auditUpdate stores the audit entry for a change to the Contact, which was before as given
+// and is now as it is within the transaction. Returns the Contact as it is now.
+func auditUpdate(tx *sql.Tx, actor Actor, before *Contact) (*Contact, error) {
+	after, err := getContactInTx(tx, before.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertAuditEntry(tx, newAuditEntry(actor, before, &after)); err != nil {
+		return nil, err
+	}
+	return &after, nil
+}
+
+func insertAuditEntry(tx *sql.Tx, entry AuditEntry) error {
+	// The snapshots are stored as JSON, like mergeAuditDetails, as they're only ever read back whole
+	var before, after sql.NullString
+	if entry.Before != nil {
+		data, err := json.Marshal(entry.Before)
+		if err != nil {
+			return err
+		}
+		before = sql.NullString{String: string(data), Valid: true}
+	}
+	if entry.After != nil {
+		data, err := json.Marshal(entry.After)
+		if err != nil {
+			return err
+		}
+		after = sql.NullString{String: string(data), Valid: true}
+	}
+	userID := sql.NullInt64{Int64: entry.Actor.UserID, Valid: entry.Actor.UserID != 0}
+	_, err := tx.Exec(db.Rebind(`INSERT INTO ContactAudit (ContactID, Action, UserID, Username, IP, ContactBefore, ContactAfter, ChangedAt) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`),
+		entry.ContactID,
+		string(entry.Action),
+		userID,
+		entry.Actor.Username,
+		entry.Actor.IP,
+		before,
+		after,
+		entry.ChangedAt,
+	)
+	return err
+}
+
+// getChildIDs returns the IDs of all rows in the table belonging to the Contact as a set.
+// The table must be a constant, ie. "PhoneNumber", never user input.
+func getChildIDs(tx *sql.Tx, table string, contactID int64) (map[int64]bool, error) {
+	query := `SELECT ID FROM ` + table + ` WHERE ContactID = $1`
+	if table == "PhoneNumber" {
+		// PhoneNumbers in the trash are only changed by the trash methods
+		query += ` AND DeletedAt IS NULL`
+	}
+	rows, err := tx.Query(db.Rebind(query), contactID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// clearPrimaryPhoneNumber will make it so that none of the Contacts PhoneNumbers are primary.
+func clearPrimaryPhoneNumber(tx *sql.Tx, contactID int64) error {
+	_, err := tx.Exec(db.Rebind(`UPDATE PhoneNumber SET IsPrimary = FALSE WHERE ContactID = $1 AND IsPrimary AND DeletedAt IS NULL`), contactID)
+	return err
+}
+
+func insertPhoneNumber(tx *sql.Tx, phoneNumber *PhoneNumber) error {
+	err := tx.QueryRow(db.Rebind(`INSERT INTO PhoneNumber (ContactID, Number, CountryCode, Extension, Label, IsPrimary, LineType) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING ID`),
+		phoneNumber.ContactID,
+		phoneNumber.Number,
+		phoneNumber.CountryCode,
+		phoneNumber.Extension,
+		phoneNumber.Label,
+		phoneNumber.IsPrimary,
+		phoneNumber.LineType,
+	).Scan(&phoneNumber.ID)
+	if err != nil {
+		return err
+	}
+	if phoneNumber.ID == 0 {
+		panic("Unexpected error. Failed get ID after inserting PhoneNumber record.")
+	}
+	return nil
+}
+
+func updatePhoneNumber(tx *sql.Tx, phoneNumber *PhoneNumber) error {
+	res, err := tx.Exec(db.Rebind(`UPDATE PhoneNumber SET Number = $1, CountryCode = $2, Extension = $3, Label = $4, IsPrimary = $5, LineType = $6 WHERE ID = $7 AND ContactID = $8 AND DeletedAt IS NULL`),
+		phoneNumber.Number,
+		phoneNumber.CountryCode,
+		phoneNumber.Extension,
+		phoneNumber.Label,
+		phoneNumber.IsPrimary,
+		phoneNumber.LineType,
+		phoneNumber.ID,
+		phoneNumber.ContactID,
+	)
+	if err != nil {
+		return err
+	}
+	return expectRowsAffected(res, ErrPhoneNumberNotFound)
+}
+
+// syncEmailAddresses will make the Contacts stored EmailAddresses match the records,
+// following the rules documented on Update.
+func syncEmailAddresses(tx *sql.Tx, record *Contact) error {
+	existingIDs, err := getChildIDs(tx, "EmailAddress", record.ID)
+	if err != nil {
+		return err
+	}
+	// Clear the primary email up-front, otherwise moving the primary flag from one email
+	// to another would break the unique index if the new one is saved first.
+	if _, err := tx.Exec(db.Rebind(`UPDATE EmailAddress SET IsPrimary = FALSE WHERE ContactID = $1 AND IsPrimary`), record.ID); err != nil {
+		return err
+	}
+	keepIDs := make(map[int64]bool, len(record.Emails))
+	for i := range record.Emails {
+		childRecord := &record.Emails[i]
+		childRecord.ContactID = record.ID
+		if childRecord.ID == 0 {
+			if err := insertEmailAddress(tx, childRecord); err != nil {
+				return err
+			}
+			continue
+		}
+		if !existingIDs[childRecord.ID] {
+			return ErrEmailNotFound
+		}
+		res, err := tx.Exec(db.Rebind(`UPDATE EmailAddress SET Address = $1, Label = $2, IsPrimary = $3 WHERE ID = $4 AND ContactID = $5`),
+			childRecord.Address,
+			childRecord.Label,
+			childRecord.IsPrimary,
+			childRecord.ID,
+			childRecord.ContactID,
+		)
+		if err != nil {
+			return err
+		}
+		if err := expectRowsAffected(res, ErrEmailNotFound); err != nil {
+			return err
+		}
+		keepIDs[childRecord.ID] = true
+	}
+	for id := range existingIDs {
+		if keepIDs[id] {
+			continue
+		}
+		if _, err := tx.Exec(db.Rebind(`DELETE FROM EmailAddress WHERE ID = $1`), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncPhoneNumbers will make the Contacts stored PhoneNumbers match the records,
+// following the rules documented on Update.
+func syncPhoneNumbers(tx *sql.Tx, record *Contact) error {
+	existingIDs, err := getChildIDs(tx, "PhoneNumber", record.ID)
+	if err != nil {
+		return err
+	}
+	// Clear the primary number up-front, otherwise moving the primary flag from one number
+	// to another would break the unique index if the new one is saved first.
+	if err := clearPrimaryPhoneNumber(tx, record.ID); err != nil {
+		return err
+	}
+	keepIDs := make(map[int64]bool, len(record.PhoneNumbers))
+	for i := range record.PhoneNumbers {
+		childRecord := &record.PhoneNumbers[i]
+		childRecord.ContactID = record.ID
+		if childRecord.ID == 0 {
+			if err := insertPhoneNumber(tx, childRecord); err != nil {
+				return err
+			}
+			continue
+		}
+		if !existingIDs[childRecord.ID] {
+			return ErrPhoneNumberNotFound
+		}
+		if err := updatePhoneNumber(tx, childRecord); err != nil {
+			return err
+		}
+		keepIDs[childRecord.ID] = true
+	}
+	for id := range existingIDs {
+		if keepIDs[id] {
+			continue
+		}
+		if _, err := tx.Exec(db.Rebind(`DELETE FROM PhoneNumber WHERE ID = $1`), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertEmailAddress(tx *sql.Tx, email *EmailAddress) error {
+	err := tx.QueryRow(db.Rebind(`INSERT INTO EmailAddress (ContactID, Address, Label, IsPrimary) VALUES($1, $2, $3, $4) RETURNING ID`),
+		email.ContactID,
+		email.Address,
+		email.Label,
+		email.IsPrimary,
+	).Scan(&email.ID)
+	if err != nil {
+		return err
+	}
+	if email.ID == 0 {
+		panic("Unexpected error. Failed get ID after inserting EmailAddress record.")
+	}
+	return nil
+}
+
+// getContact runs a query that selects contactColumns from the Contact table for a single
+// Contact, and loads its children. Returns ErrNotFound if there's no such Contact.
+func getContact(conn queryer, query string, args ...interface{}) (Contact, error) {
+	contacts, err := queryContacts(conn, query, args...)
+	if err != nil {
+		return Contact{}, err
+	}
+	if len(contacts) == 0 {
+		return Contact{}, ErrNotFound
+	}
+	if err := loadChildren(conn, contacts); err != nil {
+		return Contact{}, err
+	}
+	return contacts[0], nil
+}
+
+// queryContacts runs a query that selects contactColumns from the Contact table
+// and scans the results.
+func queryContacts(conn queryer, query string, args ...interface{}) ([]Contact, error) {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var contacts []Contact
+	for rows.Next() {
+		record := Contact{}
+		if err := rows.Scan(&record.ID, &record.UID, &record.FullName, &record.Version); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, record)
+	}
+	return contacts, rows.Err()
+}
+
+// loadChildren will fetch the EmailAddresses and PhoneNumbers for all the given contacts,
+// with one query for each.
+func loadChildren(conn queryer, contacts []Contact) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(contacts))
+	args := make([]interface{}, len(contacts))
+	for i, record := range contacts {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+		args[i] = record.ID
+	}
+	inContactIDs := `ContactID IN (` + strings.Join(placeholders, ", ") + `)`
+	emailsByContactID, err := queryEmailAddresses(conn, db.Rebind(`SELECT `+emailAddressColumns+` FROM EmailAddress WHERE `+inContactIDs+` ORDER BY ID`), args...)
+	if err != nil {
+		return err
+	}
+	phoneNumbersByContactID, err := queryPhoneNumbers(conn, db.Rebind(`SELECT `+phoneNumberColumns+` FROM PhoneNumber WHERE `+inContactIDs+` AND DeletedAt IS NULL ORDER BY ID`), args...)
+	if err != nil {
+		return err
+	}
+	assignChildren(contacts, emailsByContactID, phoneNumbersByContactID)
+	return nil
+}
+
+// assignChildren will match up EmailAddresses and PhoneNumbers, grouped by ContactID, with their Contact.
+func assignChildren(contacts []Contact, emailsByContactID map[int64][]EmailAddress, phoneNumbersByContactID map[int64][]PhoneNumber) {
+	for i := range contacts {
+		record := &contacts[i]
+		record.Emails = emailsByContactID[record.ID]
+		if record.Emails == nil {
+			record.Emails = []EmailAddress{}
+		}
+		record.PhoneNumbers = phoneNumbersByContactID[record.ID]
+	}
+}
+
+// queryEmailAddresses runs a query that selects emailAddressColumns and groups the results by ContactID.
+func queryEmailAddresses(conn queryer, query string, args ...interface{}) (map[int64][]EmailAddress, error) {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emailsByContactID := make(map[int64][]EmailAddress)
+	for rows.Next() {
+		childRecord := EmailAddress{}
+		if err := rows.Scan(
+			&childRecord.ID,
+			&childRecord.ContactID,
+			&childRecord.Address,
+			&childRecord.Label,
+			&childRecord.IsPrimary,
+		); err != nil {
+			return nil, err
+		}
+		emailsByContactID[childRecord.ContactID] = append(emailsByContactID[childRecord.ContactID], childRecord)
+	}
+	return emailsByContactID, rows.Err()
+}
+
+// queryPhoneNumbers runs a query that selects phoneNumberColumns and groups the results by ContactID.
+func queryPhoneNumbers(conn queryer, query string, args ...interface{}) (map[int64][]PhoneNumber, error) {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	phoneNumbersByContactID := make(map[int64][]PhoneNumber)
+	for rows.Next() {
+		childRecord := PhoneNumber{}
+		if err := rows.Scan(
+			&childRecord.ID,
+			&childRecord.ContactID,
+			&childRecord.Number,
+			&childRecord.CountryCode,
+			&childRecord.Extension,
+			&childRecord.Label,
+			&childRecord.IsPrimary,
+			&childRecord.LineType,
+		); err != nil {
+			return nil, err
+		}
+		phoneNumbersByContactID[childRecord.ContactID] = append(phoneNumbersByContactID[childRecord.ContactID], childRecord)
+	}
+	return phoneNumbersByContactID, rows.Err()
+}
+
+// containsPattern will turn user input into a LIKE pattern that matches the input
+// anywhere in a column. Wildcard characters in the input are escaped so they're matched literally.
+func containsPattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+// searchCondition will build the WHERE condition and relevance expression used to
+// search contacts. addArg should add an argument to the query and return its placeholder.
+//
+// FullName and Emails are matched case-insensitively, either by containing the search
+// or by being similar to it. Similarity uses the trigram functions from the "pg_trgm" extension.
+// word_similarity() is used rather than similarity() as it compares the search against the most
+// similar part of the value, so "perlmen" is similar to "Radia Perlman".
+//
+// Phone numbers match if they end with the digits of the search, or if the search is
+// the same phone number in any other format.
+//
+// If you change this, also update searchQuery.matches which does the same thing in Go.
+func searchCondition(search string, addArg func(value interface{}) string) (condition string, relevance string) {
+	query := parseSearchQuery(search)
+	text := addArg(query.Text)
+	contains := addArg(containsPattern(query.Text))
+	threshold := addArg(searchSimilarityThreshold)
+	nameSimilarity := `word_similarity(` + text + `, LOWER(FullName))`
+	emailSimilarity := `word_similarity(` + text + `, LOWER(EmailAddress.Address))`
+
+	conditions := []string{
+		`LOWER(FullName) LIKE ` + contains + ` ESCAPE '\'`,
+		nameSimilarity + ` >= ` + threshold,
+		`EXISTS (SELECT 1 FROM EmailAddress WHERE EmailAddress.ContactID = Contact.ID AND (LOWER(EmailAddress.Address) LIKE ` + contains + ` ESCAPE '\' OR ` + emailSimilarity + ` >= ` + threshold + `))`,
+	}
+	var phoneConditions []string
+	if query.Digits != "" {
+		phoneConditions = append(phoneConditions, `PhoneNumber.Number LIKE `+addArg("%"+query.Digits))
+	}
+	if query.PhoneNumber != "" {
+		phoneConditions = append(phoneConditions, `PhoneNumber.Number = `+addArg(query.PhoneNumber))
+	}
+	if len(phoneConditions) > 0 {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM PhoneNumber WHERE PhoneNumber.ContactID = Contact.ID AND PhoneNumber.DeletedAt IS NULL AND (`+strings.Join(phoneConditions, ` OR `)+`))`)
+	}
+	condition = `(` + strings.Join(conditions, ` OR `) + `)`
+	// Contacts without emails have a NULL email similarity, which GREATEST would ignore in Postgres
+	// but not in SQLite, hence the COALESCE.
+	relevance = `GREATEST(` + nameSimilarity + `, COALESCE((SELECT MAX(` + emailSimilarity + `) FROM EmailAddress WHERE EmailAddress.ContactID = Contact.ID), 0.0))`
+	return condition, relevance
+}
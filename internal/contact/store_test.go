@@ -0,0 +1,603 @@
+package contact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/db"
+)
+
+// testActor is who the tests make changes as, for the audit log
+var testActor = Actor{UserID: 7, Username: "tester", IP: "192.0.2.1"}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contact-site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db.MustConnect(db.Settings{
+		Dialect: db.DialectSQLite,
+		Path:    filepath.Join(dir, "test.db"),
+	})
+	defer db.MustClose()
+	if err := db.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, NewSQLStore())
+
+	// The audit log is append-only, even for queries that skip the store
+	for _, query := range []string{
+		"UPDATE ContactAudit SET Username = 'someone else'",
+		"DELETE FROM ContactAudit",
+	} {
+		if _, err := db.Get().Exec(query); err == nil {
+			t.Errorf("expected %q to be refused", query)
+		}
+	}
+}
+
+// testStore checks the behaviour that every ContactStore must share, so that swapping
+// the driver in config.json doesn't change how the application behaves.
+func testStore(t *testing.T, store ContactStore) {
+	record := Contact{
+		FullName: "Alex Bell",
+		Emails: []EmailAddress{
+			{Address: "alex@bell.com", IsPrimary: true},
+			{Address: "alexander@work.com", Label: LabelWork},
+		},
+		PhoneNumbers: []PhoneNumber{
+			{Number: "+61393337119"},
+			{Number: "+61488224568"},
+		},
+	}
+	if err := store.Insert(testActor, &record); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	if record.ID == 0 ||
+		record.Emails[0].ID == 0 || record.Emails[1].ContactID != record.ID ||
+		record.PhoneNumbers[0].ID == 0 || record.PhoneNumbers[1].ContactID != record.ID {
+		t.Fatalf("insert: expected IDs to be set but got %+v", record)
+	}
+	other := Contact{
+		FullName:     "radia perlman",
+		Emails:       []EmailAddress{{Address: "rad@perl.com"}},
+		PhoneNumbers: []PhoneNumber{{Number: "+61455566688"}},
+	}
+	if err := store.Insert(testActor, &other); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+
+	got, err := store.Get(record.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !reflect.DeepEqual(got, record) {
+		t.Fatalf("get: expected %+v but got %+v", record, got)
+	}
+	if _, err := store.Get(-1); err != ErrNotFound {
+		t.Fatalf("get: expected %v but got %v", ErrNotFound, err)
+	}
+	if count, err := store.Count(); err != nil || count != 2 {
+		t.Fatalf("count: expected 2 but got %d (%v)", count, err)
+	}
+
+	// Keep the first email and phone number, drop the second and add a new one
+	record.FullName = "Alexander Bell"
+	record.Emails = []EmailAddress{
+		{ID: record.Emails[0].ID, Address: "alex@bell.com"},
+		{Address: "al@bell.com", Label: LabelHome, IsPrimary: true},
+	}
+	record.PhoneNumbers = []PhoneNumber{
+		{ID: record.PhoneNumbers[0].ID, Number: "+61393337000"},
+		{Number: "+61400000000"},
+	}
+	if err := store.Update(testActor, &record); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	got, err = store.Get(record.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !reflect.DeepEqual(got, record) {
+		t.Fatalf("update: expected %+v but got %+v", record, got)
+	}
+	invalid := record
+	invalid.PhoneNumbers = []PhoneNumber{{ID: other.PhoneNumbers[0].ID, Number: "+61400000001"}}
+	if err := store.Update(testActor, &invalid); err != ErrPhoneNumberNotFound {
+		t.Fatalf("update: expected %v when using another contacts phone number but got %v", ErrPhoneNumberNotFound, err)
+	}
+	invalid = record
+	invalid.Emails = []EmailAddress{{ID: other.Emails[0].ID, Address: "rad@perl.com"}}
+	if err := store.Update(testActor, &invalid); err != ErrEmailNotFound {
+		t.Fatalf("update: expected %v when using another contacts email but got %v", ErrEmailNotFound, err)
+	}
+	withoutEmails := Contact{
+		FullName:     "Nobody",
+		PhoneNumbers: []PhoneNumber{{Number: "+61455566600"}},
+	}
+	if err := store.Insert(testActor, &withoutEmails); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	if got, err := store.Get(withoutEmails.ID); err != nil || got.Emails == nil || len(got.Emails) != 0 {
+		t.Fatalf("get: expected an empty list of emails but got %+v (%v)", got.Emails, err)
+	}
+	if err := store.Delete(testActor, withoutEmails.ID, 0); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+
+	// Phone numbers
+	phoneNumber := PhoneNumber{Number: "+61411111111"}
+	if _, err := store.AddPhoneNumber(testActor, other.ID, 0, &phoneNumber); err != nil {
+		t.Fatalf("add phone number: %s", err)
+	}
+	if phoneNumber.ID == 0 || phoneNumber.ContactID != other.ID {
+		t.Fatalf("add phone number: expected IDs to be set but got %+v", phoneNumber)
+	}
+	phoneNumber.Number = "+61422222222"
+	if _, err := store.UpdatePhoneNumber(testActor, 0, &phoneNumber); err != nil {
+		t.Fatalf("update phone number: %s", err)
+	}
+	if _, err := store.DeletePhoneNumber(testActor, other.ID, other.PhoneNumbers[0].ID, 0); err != nil {
+		t.Fatalf("delete phone number: %s", err)
+	}
+	if _, err := store.DeletePhoneNumber(testActor, other.ID, phoneNumber.ID, 0); err != ErrMissingPhoneNumbers {
+		t.Fatalf("delete phone number: expected %v for the last phone number but got %v", ErrMissingPhoneNumbers, err)
+	}
+	if _, err := store.DeletePhoneNumber(testActor, other.ID, record.PhoneNumbers[0].ID, 0); err != ErrPhoneNumberNotFound {
+		t.Fatalf("delete phone number: expected %v for another contacts phone number but got %v", ErrPhoneNumberNotFound, err)
+	}
+	got, err = store.Get(other.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if want := []PhoneNumber{phoneNumber}; !reflect.DeepEqual(got.PhoneNumbers, want) {
+		t.Fatalf("phone numbers: expected %+v but got %+v", want, got.PhoneNumbers)
+	}
+
+	// Primary phone numbers, there can only be one per contact
+	primary := PhoneNumber{Number: "+61433333333", IsPrimary: true}
+	if _, err := store.AddPhoneNumber(testActor, other.ID, 0, &primary); err != nil {
+		t.Fatalf("add primary phone number: %s", err)
+	}
+	phoneNumber.IsPrimary = true
+	if _, err := store.UpdatePhoneNumber(testActor, 0, &phoneNumber); err != nil {
+		t.Fatalf("update primary phone number: %s", err)
+	}
+	got, err = store.Get(other.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	primary.IsPrimary = false
+	if want := []PhoneNumber{phoneNumber, primary}; !reflect.DeepEqual(got.PhoneNumbers, want) {
+		t.Fatalf("primary phone numbers: expected %+v but got %+v", want, got.PhoneNumbers)
+	}
+	// Move the primary flag back in a single update
+	got.PhoneNumbers[0].IsPrimary = false
+	got.PhoneNumbers[1].IsPrimary = true
+	if err := store.Update(testActor, &got); err != nil {
+		t.Fatalf("update primary phone number: %s", err)
+	}
+	if _, err := store.DeletePhoneNumber(testActor, other.ID, primary.ID, 0); err != nil {
+		t.Fatalf("delete phone number: %s", err)
+	}
+
+	// Listing
+	listIDs := func(options ListOptions) []int64 {
+		t.Helper()
+		if options.Limit == 0 {
+			options.Limit = DefaultListLimit
+		}
+		if options.SortBy == "" {
+			options.SortBy = options.DefaultSortBy()
+		}
+		result, err := store.List(options)
+		if err != nil {
+			t.Fatalf("list %+v: %s", options, err)
+		}
+		ids := []int64{}
+		for _, record := range result.Contacts {
+			ids = append(ids, record.ID)
+		}
+		return ids
+	}
+	type ListTestData struct {
+		Options ListOptions
+		Out     []int64
+	}
+	listTestDataList := []ListTestData{
+		{Options: ListOptions{}, Out: []int64{record.ID, other.ID}},
+		{Options: ListOptions{SortDescending: true}, Out: []int64{other.ID, record.ID}},
+		// "radia perlman" is lower-case, so would sort last if sorting was case-sensitive
+		{Options: ListOptions{SortBy: SortByFullName, SortDescending: true}, Out: []int64{other.ID, record.ID}},
+		{Options: ListOptions{SortBy: SortByEmail}, Out: []int64{record.ID, other.ID}},
+		{Options: ListOptions{Limit: 1}, Out: []int64{record.ID}},
+		{Options: ListOptions{Offset: 1}, Out: []int64{other.ID}},
+		{Options: ListOptions{Offset: 2}, Out: []int64{}},
+		{Options: ListOptions{FullName: "PERL"}, Out: []int64{other.ID}},
+		{Options: ListOptions{Email: "bell"}, Out: []int64{record.ID}},
+		{Options: ListOptions{Email: "PERL"}, Out: []int64{other.ID}},
+		{Options: ListOptions{FullName: "%"}, Out: []int64{}},
+		{Options: ListOptions{PhoneNumber: "2222"}, Out: []int64{other.ID}},
+		{Options: ListOptions{Search: "perlmen"}, Out: []int64{other.ID}},
+		{Options: ListOptions{Search: "al@bell"}, Out: []int64{record.ID}},
+		{Options: ListOptions{Search: "7000"}, Out: []int64{record.ID}},
+		{Options: ListOptions{Search: "(03) 9333 7000"}, Out: []int64{record.ID}},
+	}
+	for _, testData := range listTestDataList {
+		if got := listIDs(testData.Options); !reflect.DeepEqual(got, testData.Out) {
+			t.Errorf("list %+v: expected %v but got %v", testData.Options, testData.Out, got)
+		}
+	}
+
+	// Continuing after the last contact of a page, as ForEach does, gives the same order
+	for _, options := range []ListOptions{
+		{SortBy: SortByID},
+		{SortBy: SortByID, SortDescending: true},
+		{SortBy: SortByFullName},
+		{SortBy: SortByEmail, SortDescending: true},
+		{SortBy: SortByRelevance, Search: "l"},
+		{SortBy: SortByRelevance, Search: "l", SortDescending: true},
+	} {
+		want := listIDs(options)
+		if len(want) != 2 {
+			t.Fatalf("list %+v: expected 2 contacts but got %v", options, want)
+		}
+		got := []int64{}
+		options.Limit = 1
+		for {
+			result, err := store.List(options)
+			if err != nil {
+				t.Fatalf("list %+v: %s", options, err)
+			}
+			for _, record := range result.Contacts {
+				got = append(got, record.ID)
+			}
+			if !result.HasNext {
+				break
+			}
+			options.after = &result.last
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("list after %+v: expected %v but got %v", options, want, got)
+		}
+	}
+
+	// Relevance is still calculated for contacts without any emails
+	withoutEmails = Contact{
+		FullName:     "Grace Hopper",
+		PhoneNumbers: []PhoneNumber{{Number: "+61455566600"}},
+	}
+	if err := store.Insert(testActor, &withoutEmails); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	if got := listIDs(ListOptions{Search: "hoper"}); !reflect.DeepEqual(got, []int64{withoutEmails.ID}) {
+		t.Errorf("list: expected %v but got %v", []int64{withoutEmails.ID}, got)
+	}
+	if err := store.Delete(testActor, withoutEmails.ID, 0); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+
+	// Merging, record is merged into other
+	merged, err := store.Get(other.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	merged.Emails = append(merged.Emails, EmailAddress{Address: "alex@bell.com"})
+	audit := MergeAudit{
+		TargetContactID:   other.ID,
+		SourceContactID:   record.ID,
+		Source:            record,
+		AddedEmails:       []EmailAddress{record.Emails[0]},
+		AddedPhoneNumbers: []PhoneNumber{},
+		MergedAt:          time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC),
+	}
+	missingSource := audit
+	missingSource.SourceContactID = -1
+	if err := store.Merge(testActor, &merged, &missingSource); err != ErrNotFound {
+		t.Fatalf("merge: expected %v for a missing source but got %v", ErrNotFound, err)
+	}
+	staleSource := audit
+	staleSource.Source.Version++
+	if err := store.Merge(testActor, &merged, &staleSource); err != ErrVersionConflict {
+		t.Fatalf("merge: expected %v for a changed source but got %v", ErrVersionConflict, err)
+	}
+	if got, err := store.Get(other.ID); err != nil || len(got.Emails) != 1 {
+		t.Fatalf("merge: expected a failed merge to not change the target but got %+v (%v)", got, err)
+	}
+	if err := store.Merge(testActor, &merged, &audit); err != nil {
+		t.Fatalf("merge: %s", err)
+	}
+	if audit.ID == 0 {
+		t.Fatalf("merge: expected audit ID to be set")
+	}
+	if _, err := store.Get(record.ID); err != ErrNotFound {
+		t.Fatalf("merge: expected source to be deleted but got %v", err)
+	}
+	if err := store.Restore(testActor, record.ID); err != ErrRestoreMergedAway {
+		t.Fatalf("restore: expected %v for the source of a merge but got %v", ErrRestoreMergedAway, err)
+	}
+	got, err = store.Get(other.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !reflect.DeepEqual(got, merged) {
+		t.Fatalf("merge: expected %+v but got %+v", merged, got)
+	}
+	merges, err := store.GetMerges(other.ID)
+	if err != nil {
+		t.Fatalf("get merges: %s", err)
+	}
+	if len(merges) != 1 ||
+		!merges[0].MergedAt.Equal(audit.MergedAt) {
+		t.Fatalf("get merges: expected %+v but got %+v", audit, merges)
+	}
+	merges[0].MergedAt = audit.MergedAt
+	if !reflect.DeepEqual(merges[0], audit) {
+		t.Fatalf("get merges: expected %+v but got %+v", audit, merges[0])
+	}
+	if merges, err := store.GetMerges(record.ID); err != nil || len(merges) != 0 {
+		t.Fatalf("get merges: expected no merges for the source but got %+v (%v)", merges, err)
+	}
+	if err := store.Delete(testActor, record.ID, 0); err != ErrNotFound {
+		t.Fatalf("delete: expected %v but got %v", ErrNotFound, err)
+	}
+	all, err := store.GetAll()
+	if err != nil {
+		t.Fatalf("get all: %s", err)
+	}
+	if len(all) != 1 || all[0].ID != other.ID {
+		t.Fatalf("get all: expected only contact %d but got %+v", other.ID, all)
+	}
+
+	// UIDs are generated if not given and versions go up with each change
+	if record.UID == "" || record.UID == other.UID || record.Version != 2 {
+		t.Fatalf("update: expected a unique UID and version 2 but got %+v and %+v", record, other)
+	}
+	versioned := Contact{
+		UID:          "2f1b4c9e-uid@example.com",
+		FullName:     "Hedy",
+		Emails:       []EmailAddress{},
+		PhoneNumbers: []PhoneNumber{{Number: "+61395550000"}},
+	}
+	if err := store.Insert(testActor, &versioned); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	if versioned.UID != "2f1b4c9e-uid@example.com" || versioned.Version != 1 {
+		t.Fatalf("insert: expected the given UID and version 1 but got %+v", versioned)
+	}
+	if got, err := store.GetByUID(versioned.UID); err != nil || !reflect.DeepEqual(got, versioned) {
+		t.Fatalf("get by uid: expected %+v but got %+v (%v)", versioned, got, err)
+	}
+	if _, err := store.GetByUID("missing"); err != ErrNotFound {
+		t.Fatalf("get by uid: expected %v but got %v", ErrNotFound, err)
+	}
+	versioned.UID = ""
+	versioned.FullName = "Hedy Lamarr"
+	if err := store.Update(testActor, &versioned); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if versioned.UID != "2f1b4c9e-uid@example.com" || versioned.Version != 2 {
+		t.Fatalf("update: expected the UID to be kept and version 2 but got %+v", versioned)
+	}
+	newVersion, err := store.AddPhoneNumber(testActor, versioned.ID, 0, &PhoneNumber{Number: "+61395550001"})
+	if err != nil {
+		t.Fatalf("add phone number: %s", err)
+	}
+	if got, err := store.Get(versioned.ID); err != nil || got.Version != 3 || newVersion != got.Version {
+		t.Fatalf("add phone number: expected version 3 to be stored and returned but got %d and %+v (%v)", newVersion, got, err)
+	}
+
+	// Changes made from an old Version are refused rather than overwriting what's changed since
+	stale := versioned
+	stale.FullName = "Stale"
+	if err := store.Update(testActor, &stale); err != ErrVersionConflict {
+		t.Fatalf("update: expected %v for version 2 but got %v", ErrVersionConflict, err)
+	}
+	if err := store.Delete(testActor, versioned.ID, 2); err != ErrVersionConflict {
+		t.Fatalf("delete: expected %v for version 2 but got %v", ErrVersionConflict, err)
+	}
+	if _, err := store.AddPhoneNumber(testActor, versioned.ID, 2, &PhoneNumber{Number: "+61395550003"}); err != ErrVersionConflict {
+		t.Fatalf("add phone number: expected %v for version 2 but got %v", ErrVersionConflict, err)
+	}
+	stalePhoneNumber := versioned.PhoneNumbers[0]
+	stalePhoneNumber.Number = "+61395550004"
+	if _, err := store.UpdatePhoneNumber(testActor, 2, &stalePhoneNumber); err != ErrVersionConflict {
+		t.Fatalf("update phone number: expected %v for version 2 but got %v", ErrVersionConflict, err)
+	}
+	if _, err := store.DeletePhoneNumber(testActor, versioned.ID, stalePhoneNumber.ID, 2); err != ErrVersionConflict {
+		t.Fatalf("delete phone number: expected %v for version 2 but got %v", ErrVersionConflict, err)
+	}
+	if got, err := store.Get(versioned.ID); err != nil || got.FullName != "Hedy Lamarr" || got.Version != 3 {
+		t.Fatalf("version conflict: expected nothing to change but got %+v (%v)", got, err)
+	}
+	if err := store.Delete(testActor, versioned.ID, 3); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+
+	// Every change is in the audit log, newest first, with snapshots from before and after
+	result, err := store.ListAudit(AuditOptions{ContactID: versioned.ID, Limit: 10})
+	if err != nil {
+		t.Fatalf("list audit: %s", err)
+	}
+	type auditSummary struct {
+		Action        AuditAction
+		Actor         Actor
+		BeforeVersion int64
+		AfterVersion  int64
+		AfterName     string
+		AfterPhones   int
+	}
+	var summaries []auditSummary
+	for _, entry := range result.Entries {
+		if entry.ContactID != versioned.ID || entry.ChangedAt.IsZero() {
+			t.Fatalf("list audit: unexpected entry %+v", entry)
+		}
+		summary := auditSummary{Action: entry.Action, Actor: entry.Actor}
+		if entry.Before != nil {
+			summary.BeforeVersion = entry.Before.Version
+		}
+		if entry.After != nil {
+			summary.AfterVersion = entry.After.Version
+			summary.AfterName = entry.After.FullName
+			summary.AfterPhones = len(entry.After.PhoneNumbers)
+		}
+		summaries = append(summaries, summary)
+	}
+	expectedSummaries := []auditSummary{
+		{Action: AuditActionDelete, Actor: testActor, BeforeVersion: 3},
+		{Action: AuditActionUpdate, Actor: testActor, BeforeVersion: 2, AfterVersion: 3, AfterName: "Hedy Lamarr", AfterPhones: 2},
+		{Action: AuditActionUpdate, Actor: testActor, BeforeVersion: 1, AfterVersion: 2, AfterName: "Hedy Lamarr", AfterPhones: 1},
+		{Action: AuditActionCreate, Actor: testActor, AfterVersion: 1, AfterName: "Hedy", AfterPhones: 1},
+	}
+	if result.HasNext || !reflect.DeepEqual(summaries, expectedSummaries) {
+		t.Fatalf("list audit: expected %+v but got %+v", expectedSummaries, summaries)
+	}
+	if result.Entries[2].Before.FullName != "Hedy" {
+		t.Fatalf("list audit: expected the name before the update but got %+v", result.Entries[2].Before)
+	}
+	result, err = store.ListAudit(AuditOptions{UserID: testActor.UserID, Limit: 2, Offset: 1})
+	if err != nil || len(result.Entries) != 2 || !result.HasNext || result.Entries[0].Action != AuditActionUpdate {
+		t.Fatalf("list audit: expected the 2nd and 3rd newest entries for the user but got %+v (%v)", result, err)
+	}
+	if result, err := store.ListAudit(AuditOptions{UserID: testActor.UserID + 1, Limit: 10}); err != nil || len(result.Entries) != 0 {
+		t.Fatalf("list audit: expected no entries for another user but got %+v (%v)", result, err)
+	}
+
+	// Inserting many at once
+	records := []*Contact{
+		{FullName: "Hedy Lamarr", Emails: []EmailAddress{}, PhoneNumbers: []PhoneNumber{{Number: "+61395551234"}}},
+		{FullName: "Kate Sheppard", Emails: []EmailAddress{{Address: "kate@shep.nz", IsPrimary: true}}, PhoneNumbers: []PhoneNumber{{Number: "+64212345678"}}},
+	}
+	if err := store.InsertAll(testActor, records); err != nil {
+		t.Fatalf("insert all: %s", err)
+	}
+	for _, record := range records {
+		got, err := store.Get(record.ID)
+		if err != nil {
+			t.Fatalf("insert all: %s", err)
+		}
+		if !reflect.DeepEqual(got, *record) {
+			t.Fatalf("insert all: expected %+v but got %+v", *record, got)
+		}
+	}
+	if count, err := store.Count(); err != nil || count != 3 {
+		t.Fatalf("count: expected 3 but got %d (%v)", count, err)
+	}
+
+	// Deleted contacts and phone numbers are kept in the trash, the most recently deleted first
+	trash, err := store.ListTrash(TrashOptions{Limit: 10})
+	if err != nil {
+		t.Fatalf("list trash: %s", err)
+	}
+	if len(trash.Items) != 6 || trash.HasNext {
+		t.Fatalf("list trash: expected 4 contacts and 2 phone numbers but got %+v", trash)
+	}
+	if item := trash.Items[0]; item.Contact.ID != versioned.ID || item.PhoneNumber != nil || item.DeletedAt.IsZero() {
+		t.Fatalf("list trash: expected the last deleted contact first but got %+v", item)
+	}
+	var deletedPrimary *TrashItem
+	for i, item := range trash.Items {
+		if item.PhoneNumber != nil && item.PhoneNumber.ID == primary.ID {
+			deletedPrimary = &trash.Items[i]
+		}
+	}
+	if deletedPrimary == nil || deletedPrimary.Contact.ID != other.ID || !deletedPrimary.PhoneNumber.IsPrimary {
+		t.Fatalf("list trash: expected the deleted primary phone number with its contact but got %+v", deletedPrimary)
+	}
+	page, err := store.ListTrash(TrashOptions{Limit: 2, Offset: 1})
+	if err != nil || len(page.Items) != 2 || !page.HasNext || !reflect.DeepEqual(page.Items[0], trash.Items[1]) {
+		t.Fatalf("list trash: expected the 2nd and 3rd items but got %+v (%v)", page, err)
+	}
+	if isDeleted, err := store.IsUIDInTrash(versioned.UID); err != nil || !isDeleted {
+		t.Fatalf("uid in trash: expected true but got %v (%v)", isDeleted, err)
+	}
+	if isDeleted, err := store.IsUIDInTrash(other.UID); err != nil || isDeleted {
+		t.Fatalf("uid in trash: expected false but got %v (%v)", isDeleted, err)
+	}
+
+	// Records in the trash can't be changed
+	if err := store.Update(testActor, &versioned); err != ErrNotFound {
+		t.Fatalf("update: expected %v for a deleted contact but got %v", ErrNotFound, err)
+	}
+	if _, err := store.AddPhoneNumber(testActor, versioned.ID, 0, &PhoneNumber{Number: "+61395550002"}); err != ErrNotFound {
+		t.Fatalf("add phone number: expected %v for a deleted contact but got %v", ErrNotFound, err)
+	}
+	deletedPhoneNumber := *deletedPrimary.PhoneNumber
+	if _, err := store.UpdatePhoneNumber(testActor, 0, &deletedPhoneNumber); err != ErrPhoneNumberNotFound {
+		t.Fatalf("update phone number: expected %v for a deleted phone number but got %v", ErrPhoneNumberNotFound, err)
+	}
+
+	// Restoring
+	if err := store.Restore(testActor, versioned.ID); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if got, err := store.Get(versioned.ID); err != nil || got.Version != 5 || len(got.PhoneNumbers) != 2 {
+		t.Fatalf("restore: expected version 5 with 2 phone numbers but got %+v (%v)", got, err)
+	}
+	if err := store.Restore(testActor, versioned.ID); err != ErrNotFound {
+		t.Fatalf("restore: expected %v for a contact that isn't deleted but got %v", ErrNotFound, err)
+	}
+	if err := store.RestorePhoneNumber(testActor, other.ID, primary.ID); err != nil {
+		t.Fatalf("restore phone number: %s", err)
+	}
+	got, err = store.Get(other.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	primary.IsPrimary = true
+	phoneNumber.IsPrimary = false
+	if want := []PhoneNumber{phoneNumber, primary}; !reflect.DeepEqual(got.PhoneNumbers, want) {
+		t.Fatalf("restore phone number: expected %+v but got %+v", want, got.PhoneNumbers)
+	}
+	if count, err := store.Count(); err != nil || count != 4 {
+		t.Fatalf("count: expected 4 but got %d (%v)", count, err)
+	}
+
+	// Purging
+	if err := store.Purge(testActor, versioned.ID); err != ErrNotFound {
+		t.Fatalf("purge: expected %v for a contact that isn't deleted but got %v", ErrNotFound, err)
+	}
+	if err := store.Purge(testActor, record.ID); err != nil {
+		t.Fatalf("purge: %s", err)
+	}
+	if err := store.Restore(testActor, record.ID); err != ErrNotFound {
+		t.Fatalf("restore: expected %v for a purged contact but got %v", ErrNotFound, err)
+	}
+	if err := store.PurgePhoneNumber(testActor, other.ID, other.PhoneNumbers[0].ID); err != nil {
+		t.Fatalf("purge phone number: %s", err)
+	}
+	if err := store.PurgePhoneNumber(testActor, other.ID, other.PhoneNumbers[0].ID); err != ErrPhoneNumberNotFound {
+		t.Fatalf("purge phone number: expected %v but got %v", ErrPhoneNumberNotFound, err)
+	}
+	result, err = store.ListAudit(AuditOptions{ContactID: record.ID, Limit: 1})
+	if err != nil || len(result.Entries) != 1 || result.Entries[0].Action != AuditActionPurge || result.Entries[0].After != nil {
+		t.Fatalf("list audit: expected the purge of contact %d but got %+v (%v)", record.ID, result, err)
+	}
+	result, err = store.ListAudit(AuditOptions{ContactID: other.ID, Limit: 1})
+	if err != nil || len(result.Entries) != 1 {
+		t.Fatalf("list audit: %+v (%v)", result, err)
+	}
+	if changes := result.Entries[0].Changes(); result.Entries[0].Action != AuditActionPurge || len(changes) != 1 || changes[0] != "Phone Number "+other.PhoneNumbers[0].Number+" removed" {
+		t.Fatalf("list audit: expected the purge of phone number %d but got %+v %v", other.PhoneNumbers[0].ID, result.Entries[0], changes)
+	}
+
+	// The retention period purges everything deleted before a time
+	if purged, err := store.PurgeDeletedBefore(SystemActor, time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+		t.Fatalf("purge deleted before: expected nothing to be purged but got %d (%v)", purged, err)
+	}
+	if purged, err := store.PurgeDeletedBefore(SystemActor, time.Now().Add(time.Hour)); err != nil || purged != 2 {
+		t.Fatalf("purge deleted before: expected 2 contacts to be purged but got %d (%v)", purged, err)
+	}
+	if trash, err := store.ListTrash(TrashOptions{Limit: 10}); err != nil || len(trash.Items) != 0 {
+		t.Fatalf("list trash: expected the trash to be empty but got %+v (%v)", trash, err)
+	}
+}
@@ -0,0 +1,121 @@
+package contact
+
+import (
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+var (
+	ErrUIDInTrash        = validate.NewError("contact.uid.in_trash", "Invalid UID provided. A deleted contact in the trash has that UID, restore or purge it first.")
+	ErrRestoreMergedAway = validate.NewError("contact.merge.cannot_restore", "This contact was merged into another contact, so it can't be restored. What it had before the merge is kept with the contact it was merged into.")
+)
+
+// TrashItem is a deleted Contact or PhoneNumber. Deleting only hides records, they're kept
+// until they're restored or purged, which is done for you after the retention period.
+type TrashItem struct {
+	// Contact is the deleted Contact, or the Contact that the deleted PhoneNumber belongs to
+	Contact Contact `json:"contact"`
+	// PhoneNumber is the deleted PhoneNumber, nil if the whole Contact was deleted
+	PhoneNumber *PhoneNumber `json:"phoneNumber"`
+	DeletedAt   time.Time    `json:"deletedAt"`
+}
+
+// TrashOptions controls which items are returned by ListTrash. Items are always the most
+// recently deleted first.
+type TrashOptions struct {
+	// Limit is the maximum amount of items to return. If 0, DefaultListLimit is used.
+	Limit int
+	// Offset is the amount of items to skip.
+	Offset int
+}
+
+// TrashResult is a single page of items from ListTrash.
+type TrashResult struct {
+	Items []TrashItem
+	// Options are the options that were used, after defaults were applied.
+	Options TrashOptions
+	// HasNext is true if there are more items after this page.
+	HasNext bool
+}
+
+// HasPrevious is true if there are items before this page.
+func (result TrashResult) HasPrevious() bool {
+	return result.Options.Offset > 0
+}
+
+// NextOptions returns the options needed to fetch the page after this one.
+func (result TrashResult) NextOptions() TrashOptions {
+	options := result.Options
+	options.Offset += options.Limit
+	return options
+}
+
+// PreviousOptions returns the options needed to fetch the page before this one.
+func (result TrashResult) PreviousOptions() TrashOptions {
+	options := result.Options
+	options.Offset -= options.Limit
+	if options.Offset < 0 {
+		options.Offset = 0
+	}
+	return options
+}
+
+// ListTrash will return a page of deleted Contacts and PhoneNumbers, the most recently
+// deleted first.
+//
+// PhoneNumbers that were deleted from a Contact that's since been deleted too aren't listed,
+// they come back with the Contact if it's restored.
+func ListTrash(options TrashOptions) (TrashResult, error) {
+	if options.Limit <= 0 {
+		options.Limit = DefaultListLimit
+	}
+	if options.Limit > MaxListLimit {
+		options.Limit = MaxListLimit
+	}
+	if options.Offset < 0 {
+		options.Offset = 0
+	}
+	return currentStore().ListTrash(options)
+}
+
+// Restore will take a deleted Contact out of the trash, along with its PhoneNumbers.
+//
+// Returns ErrNotFound if the Contact isn't in the trash. Returns ErrRestoreMergedAway if it
+// was put in the trash by being merged into another Contact, as restoring it would bring back
+// the duplicate. See GetMerges for what it was.
+func Restore(actor Actor, id int64) error {
+	return currentStore().Restore(actor, id)
+}
+
+// RestorePhoneNumber will take a deleted PhoneNumber out of the trash and give it back to
+// its Contact.
+//
+// Returns ErrNotFound if the Contact doesn't exist or is deleted itself, and
+// ErrPhoneNumberNotFound if the PhoneNumber isn't in the trash.
+func RestorePhoneNumber(actor Actor, contactID int64, phoneNumberID int64) error {
+	return currentStore().RestorePhoneNumber(actor, contactID, phoneNumberID)
+}
+
+// Purge will permanently delete a Contact in the trash, along with its Emails and
+// PhoneNumbers. The audit log keeps a snapshot of it.
+//
+// Returns ErrNotFound if the Contact isn't in the trash.
+func Purge(actor Actor, id int64) error {
+	return currentStore().Purge(actor, id)
+}
+
+// PurgePhoneNumber will permanently delete a PhoneNumber in the trash.
+//
+// Returns ErrNotFound if the Contact doesn't exist or is deleted itself, and
+// ErrPhoneNumberNotFound if the PhoneNumber isn't in the trash.
+func PurgePhoneNumber(actor Actor, contactID int64, phoneNumberID int64) error {
+	return currentStore().PurgePhoneNumber(actor, contactID, phoneNumberID)
+}
+
+// PurgeDeletedBefore will permanently delete every Contact and PhoneNumber that was deleted
+// before the given time, returning how many were purged. This is how the trash is emptied
+// after the retention period.
+func PurgeDeletedBefore(actor Actor, deletedBefore time.Time) (int, error) {
+	return currentStore().PurgeDeletedBefore(actor, deletedBefore)
+}
@@ -0,0 +1,24 @@
+package contact
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// maxUIDLength matches the size of the UID column
+const maxUIDLength = 255
+
+// newUID returns a random (version 4) UUID, ie. "1b4e28ba-2fa1-41d2-883f-0016d3cca427".
+//
+// Other address books use UUIDs for their UIDs too, so contacts created here look the same
+// as contacts created there.
+func newUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// The operating system's random number generator should never fail
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,177 @@
+// Package contactcsv reads and writes contacts as CSV files, ie. contact lists exported from
+// or opened in a spreadsheet.
+//
+// The first row must be a header naming each column. Columns can be in any order and the
+// names are case-insensitive, ignoring spaces and underscores, so "Full Name" and "full_name"
+// both work. The columns are:
+// - FullName (or Name), required
+// - PhoneNumbers (or PhoneNumber, Phone), required
+// - Emails (or Email), optional
+// - CountryCode (or Country), optional. Used for phone numbers not starting with a "+".
+//
+// Multiple phone numbers or emails can be put in one cell, separated by ";" or a newline.
+// The first email is the contacts primary email, the same as the HTML form. A "'" before a
+// name or email starting with "=", "+", "-" or "@" is removed, see Writer.
+package contactcsv
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+const (
+	ColumnFullName     = "FullName"
+	ColumnEmails       = "Emails"
+	ColumnPhoneNumbers = "PhoneNumbers"
+	ColumnCountryCode  = "CountryCode"
+)
+
+// columnAliases maps what a header can be called, once normalized by normalizeHeader, to the column.
+var columnAliases = map[string]string{
+	"fullname":       ColumnFullName,
+	"name":           ColumnFullName,
+	"emails":         ColumnEmails,
+	"email":          ColumnEmails,
+	"emailaddress":   ColumnEmails,
+	"emailaddresses": ColumnEmails,
+	"phonenumbers":   ColumnPhoneNumbers,
+	"phonenumber":    ColumnPhoneNumbers,
+	"phones":         ColumnPhoneNumbers,
+	"phone":          ColumnPhoneNumbers,
+	"countrycode":    ColumnCountryCode,
+	"country":        ColumnCountryCode,
+}
+
+var (
+	ErrMissingHeader = errors.New("missing header row")
+)
+
+// Read will parse the CSV into records that can be given to contact.Import.
+//
+// Each records Row is the row it was on in the spreadsheet, where the header is row 1. Returns
+// an error if the CSV is malformed or the header is invalid, but doesn't validate the records.
+func Read(r io.Reader) ([]contact.ImportRecord, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, ErrMissingHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []contact.ImportRecord
+	row := 1
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row++
+		if isBlank(fields) {
+			// Spreadsheets often export empty rows as a row of commas
+			continue
+		}
+		var record contact.Contact
+		var countryCode string
+		for i, field := range fields {
+			switch columns[i] {
+			case ColumnFullName:
+				record.FullName = unescapeFormula(strings.TrimSpace(field))
+			case ColumnEmails:
+				for _, address := range splitValues(unescapeFormula(strings.TrimSpace(field))) {
+					record.Emails = append(record.Emails, contact.EmailAddress{
+						Address:   address,
+						IsPrimary: len(record.Emails) == 0,
+					})
+				}
+			case ColumnPhoneNumbers:
+				for _, number := range splitValues(field) {
+					record.PhoneNumbers = append(record.PhoneNumbers, contact.PhoneNumber{
+						Number: number,
+					})
+				}
+			case ColumnCountryCode:
+				countryCode = strings.TrimSpace(field)
+			}
+		}
+		for i := range record.PhoneNumbers {
+			record.PhoneNumbers[i].CountryCode = countryCode
+		}
+		records = append(records, contact.ImportRecord{
+			Row:     row,
+			Contact: record,
+		})
+	}
+	return records, nil
+}
+
+// parseHeader returns the column for each field in the header, or an error if a column is
+// unknown, repeated or a required column is missing.
+func parseHeader(header []string) ([]string, error) {
+	columns := make([]string, len(header))
+	hasColumn := make(map[string]bool)
+	for i, name := range header {
+		if i == 0 {
+			// Excel puts a byte order mark at the start of UTF-8 CSV files
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		column, ok := columnAliases[normalizeHeader(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		if hasColumn[column] {
+			return nil, fmt.Errorf("column %q is given more than once", column)
+		}
+		hasColumn[column] = true
+		columns[i] = column
+	}
+	for _, column := range []string{ColumnFullName, ColumnPhoneNumbers} {
+		if !hasColumn[column] {
+			return nil, fmt.Errorf("missing %q column", column)
+		}
+	}
+	return columns, nil
+}
+
+// normalizeHeader lower-cases the header and removes spaces, underscores and dashes, so that
+// "Full Name", "full_name" and "FullName" are all the same.
+func normalizeHeader(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(name)
+}
+
+// splitValues splits a cell holding multiple values, ignoring blank ones.
+func splitValues(field string) []string {
+	var values []string
+	for _, value := range strings.FieldsFunc(field, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	}) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func isBlank(fields []string) bool {
+	for _, field := range fields {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
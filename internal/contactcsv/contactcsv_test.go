@@ -0,0 +1,124 @@
+package contactcsv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+func TestRead(t *testing.T) {
+	records, err := Read(strings.NewReader("\ufeffFull Name,phone_number,Email,Country\n" +
+		"Alex Bell,03 8578 6688; 1800728069,,\n" +
+		",,,\n" +
+		"\"Perlman, Radia\",\"021 234 5678\n+61488224568\",rperl001@mit.edu;radia@work.com,NZ\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []contact.ImportRecord{
+		{
+			Row: 2,
+			Contact: contact.Contact{
+				FullName: "Alex Bell",
+				PhoneNumbers: []contact.PhoneNumber{
+					{Number: "03 8578 6688"},
+					{Number: "1800728069"},
+				},
+			},
+		},
+		{
+			Row: 4,
+			Contact: contact.Contact{
+				FullName: "Perlman, Radia",
+				Emails: []contact.EmailAddress{
+					{Address: "rperl001@mit.edu", IsPrimary: true},
+					{Address: "radia@work.com"},
+				},
+				PhoneNumbers: []contact.PhoneNumber{
+					{Number: "021 234 5678", CountryCode: "NZ"},
+					{Number: "+61488224568", CountryCode: "NZ"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %+v but got %+v", expected, records)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	testDataList := []string{
+		"",
+		"FullName,Password\nAlex Bell,hunter2\n",
+		"FullName,Email\nAlex Bell,alex@bell.com\n",
+		"FullName,Name,PhoneNumbers\nAlex Bell,Alex,0385786688\n",
+		"FullName,PhoneNumbers\nAlex Bell,0385786688,extra\n",
+		"FullName,PhoneNumbers\n\"Alex Bell,0385786688\n",
+	}
+	for _, testData := range testDataList {
+		if _, err := Read(strings.NewReader(testData)); err == nil {
+			t.Errorf("%q: expected an error", testData)
+		}
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	records := []contact.Contact{
+		{
+			ID:       1,
+			FullName: "Perlman, \"Radia\"",
+			Emails: []contact.EmailAddress{
+				{Address: "radia@work.com"},
+				{Address: "rperl001@mit.edu", IsPrimary: true},
+			},
+			PhoneNumbers: []contact.PhoneNumber{
+				{Number: "+61393337119", Extension: "123"},
+				{Number: "+64212345678", CountryCode: "NZ"},
+			},
+		},
+		{
+			ID:           2,
+			FullName:     "=HYPERLINK(\"http://example.com\")",
+			Emails:       []contact.EmailAddress{},
+			PhoneNumbers: []contact.PhoneNumber{{Number: "+61488224568"}},
+		},
+	}
+	var out strings.Builder
+	writer := NewWriter(&out)
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectedCSV := "FullName,PhoneNumbers,Emails\n" +
+		"\"Perlman, \"\"Radia\"\"\",+61393337119 ext. 123; +64212345678,rperl001@mit.edu; radia@work.com\n" +
+		"\"'=HYPERLINK(\"\"http://example.com\"\")\",+61488224568,\n"
+	if out.String() != expectedCSV {
+		t.Fatalf("expected:\n%s\nbut got:\n%s", expectedCSV, out.String())
+	}
+
+	got, err := Read(strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 ||
+		got[0].Contact.FullName != records[0].FullName ||
+		got[0].Contact.PhoneNumbers[0].Number != "+61393337119 ext. 123" ||
+		!got[0].Contact.Emails[0].IsPrimary || got[0].Contact.Emails[0].Address != "rperl001@mit.edu" ||
+		got[1].Contact.FullName != records[1].FullName {
+		t.Errorf("expected to read back what was written but got %+v", got)
+	}
+
+	// Only the header is written if there are no contacts
+	out.Reset()
+	if err := NewWriter(&out).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "FullName,PhoneNumbers,Emails\n" {
+		t.Errorf("expected only the header but got %q", out.String())
+	}
+}
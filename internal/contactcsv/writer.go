@@ -0,0 +1,99 @@
+package contactcsv
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+// header is the header row written by Writer. Columns are named the same as Read expects,
+// so an exported file can be imported again.
+var header = []string{ColumnFullName, ColumnPhoneNumbers, ColumnEmails}
+
+// Writer writes contacts as CSV, one row per contact.
+//
+// Rows are buffered, so Flush must be called once every contact has been written.
+type Writer struct {
+	writer      *csv.Writer
+	wroteHeader bool
+}
+
+// NewWriter returns a Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		writer: csv.NewWriter(w),
+	}
+}
+
+// Write writes the contact as a single row, writing the header row first if this is the
+// first contact.
+//
+// Phone numbers are written in E.164 format, followed by their extension if they have one,
+// and multiple phone numbers or emails are separated by "; ". The primary email is written
+// first, as Read treats the first email as the primary email.
+func (w *Writer) Write(record contact.Contact) error {
+	if !w.wroteHeader {
+		if err := w.writer.Write(header); err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+	phoneNumbers := make([]string, 0, len(record.PhoneNumbers))
+	for _, phoneNumber := range record.PhoneNumbers {
+		number := phoneNumber.Number
+		if phoneNumber.Extension != "" {
+			number += " ext. " + phoneNumber.Extension
+		}
+		phoneNumbers = append(phoneNumbers, number)
+	}
+	emails := make([]string, 0, len(record.Emails))
+	for _, email := range record.Emails {
+		if email.IsPrimary {
+			emails = append([]string{email.Address}, emails...)
+			continue
+		}
+		emails = append(emails, email.Address)
+	}
+	return w.writer.Write([]string{
+		escapeFormula(record.FullName),
+		strings.Join(phoneNumbers, "; "),
+		escapeFormula(strings.Join(emails, "; ")),
+	})
+}
+
+// Flush writes any buffered rows, writing the header row if no contacts were written.
+func (w *Writer) Flush() error {
+	if !w.wroteHeader {
+		if err := w.writer.Write(header); err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// formulaPrefixes are the characters that make a spreadsheet treat a cell as a formula.
+const formulaPrefixes = "=+-@\t\r"
+
+// escapeFormula stops spreadsheets from running a cell as a formula, ie. a contact named
+// "=HYPERLINK(...)", by prefixing it with a "'". Read removes the "'" again.
+//
+// Phone numbers aren't escaped as they're always E.164, which starts with a "+" but can't
+// be a formula.
+func escapeFormula(field string) string {
+	if field != "" && strings.IndexByte(formulaPrefixes, field[0]) != -1 {
+		return "'" + field
+	}
+	return field
+}
+
+// unescapeFormula is the inverse of escapeFormula.
+func unescapeFormula(field string) string {
+	if len(field) > 1 && field[0] == '\'' && strings.IndexByte(formulaPrefixes, field[1]) != -1 {
+		return field[1:]
+	}
+	return field
+}
@@ -0,0 +1,212 @@
+// Package contactvcard reads and writes contacts as vCards, the format used by phones and
+// address books to share contacts. Both vCard 3.0 (RFC 2426) and vCard 4.0 (RFC 6350) are
+// supported, and vCard 2.1 can also be read as older phones still export it.
+//
+// Labels that vCard has a TYPE for, ie. "work" or "mobile", are written as that TYPE. Any other
+// label is written as an "X-ABLabel" property grouped with the email or phone number, which is
+// what Apple and Google contacts use for custom labels.
+package contactvcard
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+// Version is the version of the vCard format.
+type Version string
+
+const (
+	Version3 Version = "3.0"
+	Version4 Version = "4.0"
+)
+
+// maxLineLength is the most octets a line can be before it must be folded onto the next line,
+// not including the line break.
+const maxLineLength = 75
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported vCard version, expected \"3.0\" or \"4.0\"")
+	ErrNoVCards           = errors.New("no vCards found, expected BEGIN:VCARD")
+)
+
+// ParseVersion returns the Version for s, which can be given with or without the minor version,
+// ie. "4" or "4.0".
+func ParseVersion(s string) (Version, error) {
+	switch strings.TrimSpace(s) {
+	case "3", string(Version3):
+		return Version3, nil
+	case "4", string(Version4):
+		return Version4, nil
+	}
+	return "", ErrUnsupportedVersion
+}
+
+// phoneNumberTypes maps labels to the TYPE a phone number is written with.
+var phoneNumberTypes = map[string]string{
+	contact.LabelMobile:   "cell",
+	contact.LabelWork:     "work",
+	contact.LabelHome:     "home",
+	contact.LabelPersonal: "home",
+	contact.LabelFax:      "fax",
+}
+
+// emailTypes maps labels to the TYPE an email is written with.
+var emailTypes = map[string]string{
+	contact.LabelWork:     "work",
+	contact.LabelHome:     "home",
+	contact.LabelPersonal: "home",
+}
+
+// Writer writes contacts as vCards, one card per contact.
+//
+// Cards are buffered, so Flush must be called once every contact has been written.
+type Writer struct {
+	writer  *bufio.Writer
+	version Version
+}
+
+// NewWriter returns a Writer that writes vCards of the given version to w.
+func NewWriter(w io.Writer, version Version) *Writer {
+	return &Writer{
+		writer:  bufio.NewWriter(w),
+		version: version,
+	}
+}
+
+// Write writes the contact as a single vCard.
+func (w *Writer) Write(record contact.Contact) error {
+	card := cardBuilder{
+		version: w.version,
+	}
+	card.writeLine("BEGIN:VCARD")
+	card.writeLine("VERSION:" + string(w.version))
+	card.writeLine("FN:" + escapeText(record.FullName))
+	if w.version == Version3 {
+		// N is required by vCard 3.0, but we don't know which part of the full name is the
+		// family name, so leave each part of it blank.
+		card.writeLine("N:;;;;")
+	}
+	if record.UID != "" {
+		card.writeLine("UID:" + escapeText(record.UID))
+	}
+	for _, email := range record.Emails {
+		var types []string
+		if w.version == Version3 {
+			types = append(types, "INTERNET")
+		}
+		card.writeProperty("EMAIL", email.Label, emailTypes, types, email.IsPrimary, escapeText(email.Address))
+	}
+	for _, phoneNumber := range record.PhoneNumbers {
+		card.writeProperty("TEL", phoneNumber.Label, phoneNumberTypes, nil, phoneNumber.IsPrimary, formatPhoneNumber(w.version, phoneNumber))
+	}
+	card.writeLine("END:VCARD")
+	_, err := w.writer.WriteString(card.String())
+	return err
+}
+
+// Flush writes any buffered cards.
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
+}
+
+// formatPhoneNumber returns the value of a TEL property. vCard 4.0 expects a "tel:" URI
+// (RFC 3966), which has its own way of giving the extension.
+func formatPhoneNumber(version Version, phoneNumber contact.PhoneNumber) string {
+	if version == Version3 {
+		if phoneNumber.Extension != "" {
+			return escapeText(phoneNumber.Number + " ext. " + phoneNumber.Extension)
+		}
+		return escapeText(phoneNumber.Number)
+	}
+	value := "tel:" + phoneNumber.Number
+	if phoneNumber.Extension != "" {
+		value += ";ext=" + phoneNumber.Extension
+	}
+	return value
+}
+
+// cardBuilder builds up the lines of a single vCard.
+type cardBuilder struct {
+	strings.Builder
+	version Version
+	// lastGroup is the number of the last "itemN" group used for a custom label
+	lastGroup int
+}
+
+// writeProperty writes an EMAIL or TEL property with its TYPE parameters, and its label if
+// it doesn't have a TYPE.
+func (card *cardBuilder) writeProperty(name string, label string, labelTypes map[string]string, types []string, isPrimary bool, value string) {
+	group := ""
+	labelType, hasLabelType := labelTypes[label]
+	if hasLabelType {
+		types = append(types, labelType)
+	}
+	if label != "" && !hasLabelType {
+		card.lastGroup++
+		group = "item" + strconv.Itoa(card.lastGroup) + "."
+	}
+	var params string
+	if name == "TEL" && card.version == Version4 {
+		params += ";VALUE=uri"
+	}
+	if isPrimary {
+		if card.version == Version3 {
+			types = append(types, "pref")
+		} else {
+			params += ";PREF=1"
+		}
+	}
+	if len(types) > 0 {
+		if card.version == Version3 {
+			params = ";TYPE=" + strings.ToUpper(strings.Join(types, ",")) + params
+		} else {
+			params = ";TYPE=" + strings.Join(types, ",") + params
+		}
+	}
+	card.writeLine(group + name + params + ":" + value)
+	if group != "" {
+		card.writeLine(group + "X-ABLabel:" + escapeText(label))
+	}
+}
+
+// writeLine writes a content line, folding it onto multiple lines if it's too long.
+//
+// Lines are folded by inserting a line break followed by a space. A folded line is never
+// split in the middle of a multi-byte UTF-8 character, as some readers can't handle it.
+func (card *cardBuilder) writeLine(line string) {
+	limit := maxLineLength
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		card.WriteString(line[:i])
+		card.WriteString("\r\n ")
+		line = line[i:]
+		// The leading space of the folded line counts towards its length
+		limit = maxLineLength - 1
+	}
+	card.WriteString(line)
+	card.WriteString("\r\n")
+}
+
+// textEscaper escapes the characters that have a special meaning in a text value.
+var textEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	",", `\,`,
+	";", `\;`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+	"\r", `\n`,
+)
+
+// escapeText escapes a text value, ie. a contacts full name.
+func escapeText(value string) string {
+	return textEscaper.Replace(value)
+}
@@ -0,0 +1,109 @@
+package contactvcard
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+var testContact = contact.Contact{
+	ID:       1,
+	UID:      "urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1",
+	FullName: "Perlman; Radia, \\ \"Mother of the Internet\"",
+	Emails: []contact.EmailAddress{
+		{Address: "rperl001@mit.edu", Label: contact.LabelWork, IsPrimary: true},
+		{Address: "radia@example.com", Label: "Old, unused"},
+	},
+	PhoneNumbers: []contact.PhoneNumber{
+		{Number: "+61393337119", Extension: "123", Label: contact.LabelWork},
+		{Number: "+61488224568", Label: contact.LabelMobile, IsPrimary: true},
+		{Number: "+61455566688"},
+	},
+}
+
+func TestWriteVersion4(t *testing.T) {
+	expected := "BEGIN:VCARD\r\n" +
+		"VERSION:4.0\r\n" +
+		"FN:Perlman\\; Radia\\, \\\\ \"Mother of the Internet\"\r\n" +
+		"UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1\r\n" +
+		"EMAIL;TYPE=work;PREF=1:rperl001@mit.edu\r\n" +
+		"item1.EMAIL:radia@example.com\r\n" +
+		"item1.X-ABLabel:Old\\, unused\r\n" +
+		"TEL;TYPE=work;VALUE=uri:tel:+61393337119;ext=123\r\n" +
+		"TEL;TYPE=cell;VALUE=uri;PREF=1:tel:+61488224568\r\n" +
+		"TEL;VALUE=uri:tel:+61455566688\r\n" +
+		"END:VCARD\r\n"
+	if got := writeString(t, Version4, testContact); got != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, got)
+	}
+}
+
+func TestWriteVersion3(t *testing.T) {
+	expected := "BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"FN:Perlman\\; Radia\\, \\\\ \"Mother of the Internet\"\r\n" +
+		"N:;;;;\r\n" +
+		"UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1\r\n" +
+		"EMAIL;TYPE=INTERNET,WORK,PREF:rperl001@mit.edu\r\n" +
+		"item1.EMAIL;TYPE=INTERNET:radia@example.com\r\n" +
+		"item1.X-ABLabel:Old\\, unused\r\n" +
+		"TEL;TYPE=WORK:+61393337119 ext. 123\r\n" +
+		"TEL;TYPE=CELL,PREF:+61488224568\r\n" +
+		"TEL:+61455566688\r\n" +
+		"END:VCARD\r\n"
+	if got := writeString(t, Version3, testContact); got != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, got)
+	}
+}
+
+func TestWriteFoldsLongLines(t *testing.T) {
+	// Each "é" is 2 bytes, so a line can't be folded at exactly 75 bytes without splitting one
+	record := contact.Contact{
+		FullName:     strings.Repeat("é", 80),
+		Emails:       []contact.EmailAddress{},
+		PhoneNumbers: []contact.PhoneNumber{{Number: "+61488224568"}},
+	}
+	got := writeString(t, Version4, record)
+	lines := strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n")
+	var fullName strings.Builder
+	for _, line := range lines {
+		if len(line) > maxLineLength {
+			t.Errorf("expected lines to be at most %d bytes but got %d: %q", maxLineLength, len(line), line)
+		}
+		if strings.HasPrefix(line, "FN:") {
+			fullName.WriteString(strings.TrimPrefix(line, "FN:"))
+		} else if strings.HasPrefix(line, " ") {
+			fullName.WriteString(line[1:])
+		}
+	}
+	if fullName.String() != record.FullName {
+		t.Errorf("expected unfolded name to be %q but got %q", record.FullName, fullName.String())
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for s, expected := range map[string]Version{"3": Version3, "3.0": Version3, "4": Version4, " 4.0": Version4} {
+		if version, err := ParseVersion(s); err != nil || version != expected {
+			t.Errorf("%q: expected %s but got %s (%v)", s, expected, version, err)
+		}
+	}
+	if _, err := ParseVersion("2.1"); err != ErrUnsupportedVersion {
+		t.Errorf("expected %v but got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func writeString(t *testing.T, version Version, records ...contact.Contact) string {
+	t.Helper()
+	var out strings.Builder
+	writer := NewWriter(&out, version)
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
@@ -0,0 +1,489 @@
+package contactvcard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+// maxPhysicalLineLength is the longest line we'll read. vCard 2.1 files often have photos as a
+// single long line of base64 that we skip, so this is much longer than any line we actually use.
+const maxPhysicalLineLength = 10 << 20
+
+// contentLine is a single property of a vCard, after unfolding, ie.
+// "item1.TEL;TYPE=work,voice:+61393337119"
+type contentLine struct {
+	// Line is the line number the property starts on
+	Line  int
+	Group string
+	// Name is upper-cased, ie. "TEL"
+	Name string
+	// Params are keyed by the upper-cased parameter name. vCard 2.1 parameters without a
+	// name, ie. "TEL;CELL:", are treated as TYPE parameters.
+	Params map[string][]string
+	// Value is the raw value, which may still be escaped or encoded. For EMAIL and TEL it has
+	// been decoded once the line has been added to a card, see card.add.
+	Value string
+}
+
+// card is the properties of a single vCard that we use.
+type card struct {
+	Line       int
+	UID        string
+	FullName   string
+	Name       string
+	Emails     []contentLine
+	Phones     []contentLine
+	GroupLabel map[string]string
+}
+
+// Read parses every vCard in r into records that can be given to contact.Import. vCards 2.1,
+// 3.0 and 4.0 can be read, including files exported from phones that have many vCards.
+//
+// Only the UID, FN (or N if there is no FN), EMAIL and TEL properties are used, everything else
+// is ignored. Each records Row is the line its "BEGIN:VCARD" is on. Returns an error if the file
+// is malformed, but doesn't validate the records.
+func Read(r io.Reader) ([]contact.ImportRecord, error) {
+	lines, err := readContentLines(r)
+	if err != nil {
+		return nil, err
+	}
+	var records []contact.ImportRecord
+	var current *card
+	for _, line := range lines {
+		switch {
+		case line.Name == "BEGIN" && strings.EqualFold(line.Value, "VCARD"):
+			if current != nil {
+				return nil, fmt.Errorf("line %d: unexpected BEGIN:VCARD, the vCard on line %d is missing its END:VCARD", line.Line, current.Line)
+			}
+			current = &card{
+				Line:       line.Line,
+				GroupLabel: make(map[string]string),
+			}
+		case current == nil:
+			return nil, fmt.Errorf("line %d: expected BEGIN:VCARD", line.Line)
+		case line.Name == "END" && strings.EqualFold(line.Value, "VCARD"):
+			records = append(records, contact.ImportRecord{
+				Row:     current.Line,
+				Contact: current.toContact(),
+			})
+			current = nil
+		default:
+			if err := current.add(line); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line.Line, err)
+			}
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("line %d: vCard is missing its END:VCARD", current.Line)
+	}
+	if len(records) == 0 {
+		return nil, ErrNoVCards
+	}
+	return records, nil
+}
+
+// add stores the property if it's one we use.
+func (c *card) add(line contentLine) error {
+	switch line.Name {
+	case "FN", "N", "UID", "X-ABLABEL":
+		value, err := line.decodedValue()
+		if err != nil {
+			return err
+		}
+		switch line.Name {
+		case "FN":
+			c.FullName = unescapeText(value)
+		case "N":
+			c.Name = fullNameFromName(value)
+		case "UID":
+			c.UID = strings.TrimSpace(unescapeText(value))
+		case "X-ABLABEL":
+			if line.Group != "" {
+				c.GroupLabel[line.Group] = appleLabel(unescapeText(value))
+			}
+		}
+	case "EMAIL", "TEL":
+		value, err := line.decodedValue()
+		if err != nil {
+			return err
+		}
+		line.Value = value
+		if line.Name == "EMAIL" {
+			c.Emails = append(c.Emails, line)
+		} else {
+			c.Phones = append(c.Phones, line)
+		}
+	}
+	return nil
+}
+
+// toContact converts the card into a Contact. Only the first email and the first phone number
+// that are preferred are made primary, as a Contact can only have one of each.
+func (c *card) toContact() contact.Contact {
+	record := contact.Contact{
+		UID:      c.UID,
+		FullName: c.FullName,
+	}
+	if record.FullName == "" {
+		record.FullName = c.Name
+	}
+	hasPrimary := false
+	for _, line := range c.Emails {
+		email := contact.EmailAddress{
+			Address: strings.TrimSpace(unescapeText(line.Value)),
+			Label:   c.label(line, emailLabels),
+		}
+		if !hasPrimary && line.isPreferred() {
+			email.IsPrimary = true
+			hasPrimary = true
+		}
+		record.Emails = append(record.Emails, email)
+	}
+	hasPrimary = false
+	for _, line := range c.Phones {
+		phoneNumber := parsePhoneNumber(line)
+		phoneNumber.Label = c.label(line, phoneNumberLabels)
+		if !hasPrimary && line.isPreferred() {
+			phoneNumber.IsPrimary = true
+			hasPrimary = true
+		}
+		record.PhoneNumbers = append(record.PhoneNumbers, phoneNumber)
+	}
+	return record
+}
+
+// label returns the X-ABLabel grouped with the property, if there is one, otherwise the label
+// for the first of its types that has one.
+func (c *card) label(line contentLine, labels []typeLabel) string {
+	if label, ok := c.GroupLabel[line.Group]; ok && line.Group != "" {
+		return label
+	}
+	types := line.types()
+	for _, typeLabel := range labels {
+		for _, t := range types {
+			if t == typeLabel.Type {
+				return typeLabel.Label
+			}
+		}
+	}
+	return ""
+}
+
+// typeLabel maps a TYPE parameter value to a label.
+type typeLabel struct {
+	Type  string
+	Label string
+}
+
+// phoneNumberLabels are in order of preference, ie. a "work,fax" number is labelled "fax"
+var phoneNumberLabels = []typeLabel{
+	{Type: "fax", Label: contact.LabelFax},
+	{Type: "cell", Label: contact.LabelMobile},
+	{Type: "work", Label: contact.LabelWork},
+	{Type: "home", Label: contact.LabelHome},
+}
+
+var emailLabels = []typeLabel{
+	{Type: "work", Label: contact.LabelWork},
+	{Type: "home", Label: contact.LabelHome},
+}
+
+// types returns the lower-cased TYPE parameter values.
+func (line contentLine) types() []string {
+	var types []string
+	for _, value := range line.Params["TYPE"] {
+		types = append(types, strings.ToLower(value))
+	}
+	return types
+}
+
+// isPreferred returns true if the property has a PREF parameter (vCard 4.0) or the "pref"
+// type (vCard 2.1 and 3.0).
+func (line contentLine) isPreferred() bool {
+	if _, ok := line.Params["PREF"]; ok {
+		return true
+	}
+	for _, t := range line.types() {
+		if t == "pref" {
+			return true
+		}
+	}
+	return false
+}
+
+// decodedValue returns the value with any quoted-printable encoding and non UTF-8 character
+// set removed. It may still have text escapes.
+func (line contentLine) decodedValue() (string, error) {
+	value := line.Value
+	encoding := ""
+	if values := line.Params["ENCODING"]; len(values) > 0 {
+		encoding = strings.ToUpper(values[0])
+	}
+	for _, t := range line.Params["TYPE"] {
+		// vCard 2.1 allows the encoding to be given without a parameter name
+		if strings.EqualFold(t, "QUOTED-PRINTABLE") {
+			encoding = "QUOTED-PRINTABLE"
+		}
+	}
+	if encoding == "QUOTED-PRINTABLE" {
+		decoded, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted-printable %s value: %s", line.Name, err)
+		}
+		value = string(decoded)
+	}
+	if values := line.Params["CHARSET"]; len(values) > 0 {
+		switch strings.ToUpper(values[0]) {
+		case "ISO-8859-1", "LATIN1":
+			value = latin1ToUTF8(value)
+		}
+	}
+	return value, nil
+}
+
+// latin1ToUTF8 converts ISO-8859-1 text, which older phones export vCard 2.1 files as, into
+// UTF-8. Each byte is the same as the unicode code point.
+func latin1ToUTF8(value string) string {
+	runes := make([]rune, len(value))
+	for i := 0; i < len(value); i++ {
+		runes[i] = rune(value[i])
+	}
+	return string(runes)
+}
+
+// parsePhoneNumber reads a decoded TEL value, which is a "tel:" URI (RFC 3966) in vCard 4.0
+// and text in earlier versions.
+func parsePhoneNumber(line contentLine) contact.PhoneNumber {
+	value := line.Value
+	isURI := false
+	for _, valueType := range line.Params["VALUE"] {
+		isURI = isURI || strings.EqualFold(valueType, "uri")
+	}
+	if !isURI && !strings.HasPrefix(strings.ToLower(value), "tel:") {
+		return contact.PhoneNumber{
+			Number: strings.TrimSpace(unescapeText(value)),
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(value), "tel:") {
+		value = value[len("tel:"):]
+	}
+	parts := strings.Split(value, ";")
+	phoneNumber := contact.PhoneNumber{
+		Number: strings.TrimSpace(parts[0]),
+	}
+	for _, param := range parts[1:] {
+		if strings.HasPrefix(strings.ToLower(param), "ext=") {
+			phoneNumber.Extension = param[len("ext="):]
+		}
+	}
+	return phoneNumber
+}
+
+// fullNameFromName builds a full name from the N property, which is made up of the family
+// name, given name, additional names, prefixes and suffixes, in that order.
+func fullNameFromName(value string) string {
+	components := splitUnescaped(value, ';')
+	for len(components) < 5 {
+		components = append(components, "")
+	}
+	var names []string
+	for _, i := range []int{3, 1, 2, 0, 4} {
+		// Each component can have multiple values separated by a ","
+		for _, name := range splitUnescaped(components[i], ',') {
+			if name = strings.TrimSpace(unescapeText(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// appleLabel removes the wrapping that Apple contacts put around its own labels, ie.
+// "_$!<Mobile>!$_" is "Mobile".
+func appleLabel(label string) string {
+	if strings.HasPrefix(label, "_$!<") && strings.HasSuffix(label, ">!$_") {
+		return label[len("_$!<") : len(label)-len(">!$_")]
+	}
+	return label
+}
+
+// readContentLines reads every line, unfolding lines that have been folded.
+func readContentLines(r io.Reader) ([]contentLine, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxPhysicalLineLength)
+	var lines []contentLine
+	var logical strings.Builder
+	logicalLine := 0
+	lineNumber := 0
+	flush := func() error {
+		if strings.TrimSpace(logical.String()) == "" {
+			logical.Reset()
+			return nil
+		}
+		line, err := parseContentLine(logical.String())
+		if err != nil {
+			return fmt.Errorf("line %d: %s", logicalLine, err)
+		}
+		line.Line = logicalLine
+		lines = append(lines, line)
+		logical.Reset()
+		return nil
+	}
+	for scanner.Scan() {
+		lineNumber++
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if lineNumber == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+		if logical.Len() > 0 && isQuotedPrintableSoftBreak(logical.String()) {
+			// vCard 2.1 quoted-printable values are continued by ending the line with "=",
+			// rather than folding. Keep the "=" so the decoder removes the soft line break.
+			logical.WriteString("\r\n")
+			logical.WriteString(text)
+			continue
+		}
+		if logical.Len() > 0 && len(text) > 0 && (text[0] == ' ' || text[0] == '\t') {
+			// Folded onto this line, the single whitespace character isn't part of the value
+			logical.WriteString(text[1:])
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		logical.WriteString(text)
+		logicalLine = lineNumber
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// isQuotedPrintableSoftBreak returns true if the line is a quoted-printable value that ends
+// with a soft line break, ie. "NOTE;ENCODING=QUOTED-PRINTABLE:Hello=", so continues on the
+// next line.
+func isQuotedPrintableSoftBreak(line string) bool {
+	if !strings.HasSuffix(line, "=") {
+		return false
+	}
+	colon := indexUnquoted(line, ':')
+	if colon == -1 {
+		return false
+	}
+	return strings.Contains(strings.ToUpper(line[:colon]), "QUOTED-PRINTABLE")
+}
+
+// parseContentLine parses a single unfolded line, ie. "item1.TEL;TYPE=work,voice:+61393337119"
+func parseContentLine(text string) (contentLine, error) {
+	colon := indexUnquoted(text, ':')
+	if colon == -1 {
+		return contentLine{}, fmt.Errorf("expected a \":\" in %q", text)
+	}
+	line := contentLine{
+		Params: make(map[string][]string),
+		Value:  text[colon+1:],
+	}
+	parts := splitQuoted(text[:colon], ';')
+	name := parts[0]
+	if dot := strings.LastIndexByte(name, '.'); dot != -1 {
+		line.Group = strings.ToLower(name[:dot])
+		name = name[dot+1:]
+	}
+	line.Name = strings.ToUpper(strings.TrimSpace(name))
+	if line.Name == "" {
+		return contentLine{}, fmt.Errorf("missing property name in %q", text)
+	}
+	for _, param := range parts[1:] {
+		key, value := "TYPE", param
+		if equals := strings.IndexByte(param, '='); equals != -1 {
+			key, value = strings.ToUpper(strings.TrimSpace(param[:equals])), param[equals+1:]
+		}
+		for _, value := range splitQuoted(value, ',') {
+			value = strings.Trim(value, `"`)
+			if key == "TYPE" {
+				// Quoting a list of types doesn't change its meaning, ie. TYPE="work,voice"
+				line.Params[key] = append(line.Params[key], strings.Split(value, ",")...)
+				continue
+			}
+			line.Params[key] = append(line.Params[key], value)
+		}
+	}
+	return line, nil
+}
+
+// indexUnquoted returns the index of the first c that isn't inside double quotes, or -1.
+func indexUnquoted(s string, c byte) int {
+	isQuoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			isQuoted = !isQuoted
+		case c:
+			if !isQuoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitQuoted splits s on each sep that isn't inside double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	for {
+		i := indexUnquoted(s, sep)
+		if i == -1 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// splitUnescaped splits s on each sep that hasn't been escaped with a "\".
+func splitUnescaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			// Skip the escaped character
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeText is the inverse of escapeText.
+func unescapeText(value string) string {
+	if strings.IndexByte(value, '\\') == -1 {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,140 @@
+package contactvcard
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/silbinarywolf/contact-site/internal/contact"
+)
+
+func TestRead(t *testing.T) {
+	// A vCard 2.1 file from an older phone, followed by a 3.0 card from Apple contacts and
+	// a 4.0 card, as phones export every contact into a single file.
+	file := "BEGIN:VCARD\r\n" +
+		"VERSION:2.1\r\n" +
+		"N;CHARSET=UTF-8;ENCODING=QUOTED-PRINTABLE:Idestam;Fredrik;;Dr.;\r\n" +
+		"FN;ENCODING=QUOTED-PRINTABLE:Fredrik Idest=C3=A4m, the founder of Nokia who lived a long =\r\n" +
+		"time ago\r\n" +
+		"TEL;CELL;PREF:+6139888998\r\n" +
+		"TEL;WORK;FAX:0385786688\r\n" +
+		"PHOTO;ENCODING=BASE64;TYPE=JPEG:" + strings.Repeat("QUFB", 1000) + "\r\n" +
+		"END:VCARD\r\n" +
+		"\r\n" +
+		"BEGIN:VCARD\n" +
+		"VERSION:3.0\n" +
+		"N:Perlman;Radia;;;\n" +
+		"UID:0f7d1c2e-radia\n" +
+		"EMAIL;type=INTERNET;type=WORK;type=pref:rperl001@mit.edu\n" +
+		"item1.EMAIL;type=INTERNET:radia@\n" +
+		" example.com\n" +
+		"item1.X-ABLabel:Old\\, unused\n" +
+		"item2.TEL:(03) 9333 7119\n" +
+		"item2.X-ABLabel:_$!<Mobile>!$_\n" +
+		"END:VCARD\n" +
+		"begin:vcard\r\n" +
+		"version:4.0\r\n" +
+		"fn:Alex Bell\\; Inventor\r\n" +
+		"tel;value=uri;type=\"voice,home\";pref=1:tel:+61393337119;ext=123\r\n" +
+		"TEL;VALUE=uri;TYPE=work;PREF=2:tel:+61488224568\r\n" +
+		"end:vcard\r\n"
+	records, err := Read(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []contact.ImportRecord{
+		{
+			Row: 1,
+			Contact: contact.Contact{
+				FullName: "Fredrik Idestäm, the founder of Nokia who lived a long time ago",
+				PhoneNumbers: []contact.PhoneNumber{
+					{Number: "+6139888998", Label: contact.LabelMobile, IsPrimary: true},
+					{Number: "0385786688", Label: contact.LabelFax},
+				},
+			},
+		},
+		{
+			Row: 11,
+			Contact: contact.Contact{
+				UID:      "0f7d1c2e-radia",
+				FullName: "Radia Perlman",
+				Emails: []contact.EmailAddress{
+					{Address: "rperl001@mit.edu", Label: contact.LabelWork, IsPrimary: true},
+					{Address: "radia@example.com", Label: "Old, unused"},
+				},
+				PhoneNumbers: []contact.PhoneNumber{
+					{Number: "(03) 9333 7119", Label: "Mobile"},
+				},
+			},
+		},
+		{
+			Row: 22,
+			Contact: contact.Contact{
+				FullName: "Alex Bell; Inventor",
+				PhoneNumbers: []contact.PhoneNumber{
+					{Number: "+61393337119", Extension: "123", Label: contact.LabelHome, IsPrimary: true},
+					{Number: "+61488224568", Label: contact.LabelWork},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected:\n%+v\nbut got:\n%+v", expected, records)
+	}
+}
+
+func TestReadName(t *testing.T) {
+	records, err := Read(strings.NewReader("BEGIN:VCARD\nVERSION:3.0\nN:Hopper;Grace;Brewster Murray;Rear Admiral;\nTEL:+61455566600\nEND:VCARD\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Contact.FullName != "Rear Admiral Grace Brewster Murray Hopper" {
+		t.Errorf("expected the full name to be built from N but got %+v", records)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, version := range []Version{Version3, Version4} {
+		records, err := Read(strings.NewReader(writeString(t, version, testContact)))
+		if err != nil {
+			t.Fatalf("%s: %s", version, err)
+		}
+		expected := contact.Contact{
+			UID:      testContact.UID,
+			FullName: testContact.FullName,
+			Emails: []contact.EmailAddress{
+				{Address: "rperl001@mit.edu", Label: contact.LabelWork, IsPrimary: true},
+				{Address: "radia@example.com", Label: "Old, unused"},
+			},
+			PhoneNumbers: []contact.PhoneNumber{
+				{Number: "+61393337119", Extension: "123", Label: contact.LabelWork},
+				{Number: "+61488224568", Label: contact.LabelMobile, IsPrimary: true},
+				{Number: "+61455566688"},
+			},
+		}
+		if version == Version3 {
+			// The extension is part of the text, which is parsed when the number is validated
+			expected.PhoneNumbers[0].Number = "+61393337119 ext. 123"
+			expected.PhoneNumbers[0].Extension = ""
+		}
+		if len(records) != 1 || !reflect.DeepEqual(records[0].Contact, expected) {
+			t.Errorf("%s: expected:\n%+v\nbut got:\n%+v", version, expected, records)
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	testDataList := []string{
+		"",
+		"FN:Alex Bell\n",
+		"BEGIN:VCARD\nFN:Alex Bell\n",
+		"BEGIN:VCARD\nFN:Alex Bell\nBEGIN:VCARD\nEND:VCARD\n",
+		"BEGIN:VCARD\nFN Alex Bell\nEND:VCARD\n",
+		"BEGIN:VCARD\n:Alex Bell\nEND:VCARD\n",
+	}
+	for _, testData := range testDataList {
+		if _, err := Read(strings.NewReader(testData)); err == nil {
+			t.Errorf("%q: expected an error", testData)
+		}
+	}
+}
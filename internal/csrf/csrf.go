@@ -0,0 +1,132 @@
+// Package csrf stops other sites from submitting forms as a signed in user, known as
+// cross-site request forgery.
+//
+// It uses the "double submit cookie" pattern. Each browser is given a random token in a
+// cookie, and every form includes the same token as a hidden field. Other sites can make a
+// browser submit a form, but they can't read the cookie to know what to put in the field.
+//
+// The Origin header is checked as well, for requests that don't have a field to put a token
+// in, ie. JSON sent to the API.
+package csrf
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+const (
+	// FieldName is the form field that must hold the token
+	FieldName = "CSRFToken"
+	// HeaderName can hold the token instead of FieldName, for requests that aren't forms
+	HeaderName = "X-CSRF-Token"
+
+	cookieName = "csrf"
+	// tokenLength is the number of characters in a token, 32 random bytes base64 encoded
+	tokenLength = 43
+)
+
+var (
+	ErrInvalidToken = validate.NewError("csrf.invalid_token", "Invalid or missing CSRF token. Reload the page and try again.")
+	ErrCrossOrigin  = validate.NewError("csrf.cross_origin", "Forbidden. Requests from other sites aren't allowed.")
+)
+
+// Token returns the token to put in forms, setting the cookie if the browser doesn't have one
+// yet. It must be called before anything is written to the response.
+//
+// Set secure when the site is served over HTTPS, so that the cookie is too.
+func Token(w http.ResponseWriter, r *http.Request, secure bool) string {
+	if cookie, err := r.Cookie(cookieName); err == nil && isValidToken(cookie.Value) {
+		return cookie.Value
+	}
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// The operating system has no randomness, nothing secure will work
+		panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   secure,
+		HttpOnly: true,
+		// Strict, as it's only ever needed by forms on this site
+		SameSite: http.SameSiteStrictMode,
+	})
+	// Let the rest of this request see the cookie too, so calling Token again gives the same token
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: token})
+	return token
+}
+
+// Verify returns nil if the request is safe to act on. Requests that can't change anything,
+// ie. GET, are always safe. Anything else must come from this site and have the token from
+// Token in either its FieldName form field or its HeaderName header.
+//
+// Returns ErrCrossOrigin or ErrInvalidToken if it's not safe.
+func Verify(r *http.Request) error {
+	if IsSafeMethod(r.Method) {
+		return nil
+	}
+	if err := VerifyOrigin(r); err != nil {
+		return err
+	}
+	cookie, err := r.Cookie(cookieName)
+	if err != nil || !isValidToken(cookie.Value) {
+		return ErrInvalidToken
+	}
+	token := r.Header.Get(HeaderName)
+	if token == "" {
+		token = r.PostFormValue(FieldName)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// VerifyOrigin returns ErrCrossOrigin if a browser says the request came from another site.
+//
+// Browsers send Origin with every POST, and Sec-Fetch-Site with every request in newer
+// browsers. Requests without either, ie. from scripts, are allowed as only browsers are
+// tricked into sending requests.
+func VerifyOrigin(r *http.Request) error {
+	if IsSafeMethod(r.Method) {
+		return nil
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		// "same-site" is refused too, as a sibling subdomain is still another site to us
+		return ErrCrossOrigin
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(originURL.Host, r.Host) {
+		// Privacy settings can make the Origin "null", which is refused too
+		return ErrCrossOrigin
+	}
+	return nil
+}
+
+// IsSafeMethod returns true for HTTP methods that don't change anything, see RFC 7231
+// section 4.2.1. Only these can be used without a token.
+func IsSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func isValidToken(token string) bool {
+	return len(token) == tokenLength
+}
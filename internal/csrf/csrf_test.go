@@ -0,0 +1,86 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://contacts.test/", nil)
+	w := httptest.NewRecorder()
+	token := Token(w, r, true)
+	if !isValidToken(token) {
+		t.Fatalf("expected a %d character token but got %q", tokenLength, token)
+	}
+	if again := Token(w, r, true); again != token {
+		t.Fatalf("expected the same token within a request but got %q and %q", token, again)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token || !cookies[0].Secure || !cookies[0].HttpOnly {
+		t.Fatalf("expected one secure, HTTP only cookie with the token but got %+v", cookies)
+	}
+
+	// A browser that already has a token keeps it
+	r = httptest.NewRequest(http.MethodGet, "http://contacts.test/", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	if got := Token(w, r, true); got != token {
+		t.Fatalf("expected the token from the cookie %q but got %q", token, got)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatalf("expected no new cookie to be set")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	token := strings.Repeat("a", tokenLength)
+	type TestData struct {
+		Name    string
+		Method  string
+		Cookie  string
+		Field   string
+		Header  string
+		Origin  string
+		FetchBy string
+		Err     error
+	}
+	for _, testData := range []TestData{
+		{Name: "get without token", Method: http.MethodGet, Err: nil},
+		{Name: "form field", Method: http.MethodPost, Cookie: token, Field: token, Err: nil},
+		{Name: "header", Method: http.MethodDelete, Cookie: token, Header: token, Err: nil},
+		{Name: "same origin", Method: http.MethodPost, Cookie: token, Field: token, Origin: "http://contacts.test", FetchBy: "same-origin", Err: nil},
+		{Name: "no cookie", Method: http.MethodPost, Field: token, Err: ErrInvalidToken},
+		{Name: "no field", Method: http.MethodPost, Cookie: token, Err: ErrInvalidToken},
+		{Name: "wrong field", Method: http.MethodPost, Cookie: token, Field: strings.Repeat("b", tokenLength), Err: ErrInvalidToken},
+		{Name: "short cookie", Method: http.MethodPost, Cookie: "a", Field: "a", Err: ErrInvalidToken},
+		{Name: "other origin", Method: http.MethodPost, Cookie: token, Field: token, Origin: "https://evil.test", Err: ErrCrossOrigin},
+		{Name: "null origin", Method: http.MethodPost, Cookie: token, Field: token, Origin: "null", Err: ErrCrossOrigin},
+		{Name: "cross site", Method: http.MethodPost, Cookie: token, Field: token, FetchBy: "cross-site", Err: ErrCrossOrigin},
+		{Name: "same site", Method: http.MethodPost, Cookie: token, Field: token, FetchBy: "same-site", Err: ErrCrossOrigin},
+	} {
+		form := url.Values{}
+		if testData.Field != "" {
+			form.Set(FieldName, testData.Field)
+		}
+		r := httptest.NewRequest(testData.Method, "http://contacts.test/postContact", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if testData.Cookie != "" {
+			r.AddCookie(&http.Cookie{Name: cookieName, Value: testData.Cookie})
+		}
+		if testData.Header != "" {
+			r.Header.Set(HeaderName, testData.Header)
+		}
+		if testData.Origin != "" {
+			r.Header.Set("Origin", testData.Origin)
+		}
+		if testData.FetchBy != "" {
+			r.Header.Set("Sec-Fetch-Site", testData.FetchBy)
+		}
+		if err := Verify(r); err != testData.Err {
+			t.Errorf("%s: expected %v but got %v", testData.Name, testData.Err, err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"time"
 )
 
@@ -15,17 +16,33 @@ const (
 	timeBetweenDBRetries = 2 * time.Second
 )
 
+// Dialect is the flavour of SQL spoken by the connected database.
+type Dialect string
+
+const (
+	DialectPostgres Dialect = "postgres"
+	DialectSQLite   Dialect = "sqlite"
+)
+
 var (
-	db *sql.DB
+	db      *sql.DB
+	dialect Dialect
 )
 
 type Settings struct {
+	// Dialect is the database we're connecting to. Defaults to Postgres.
+	Dialect Dialect
+
+	// Postgres settings
 	Host     string
 	Port     int
 	User     string
 	Password string
 	// Opted to not implement for time reasons. We just use Postgres's default database.
 	// DatabaseName string
+
+	// Path is the file path of the database, only used by SQLite.
+	Path string
 }
 
 // Get will get an active database connection.
@@ -44,17 +61,81 @@ func Get() *sql.DB {
 	return db
 }
 
+// RunInTransaction will execute the given function within an SQL transaction.
+//
+// If the function returns an error or panics, the transaction is rolled back, otherwise
+// it's committed. This exists so that I stop copy-pasting the same "hasCommitted" and
+// Rollback() boilerplate into every function that needs to change more than one row.
+func RunInTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	hasCommitted := false
+	defer func() {
+		if hasCommitted {
+			return
+		}
+		// We log rather than return the rollback error as the error that caused
+		// us to rollback is far more useful to the caller.
+		if err := tx.Rollback(); err != nil {
+			log.Printf("Failed to rollback transaction: %v\n", err)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	hasCommitted = true
+	return nil
+}
+
+// CurrentDialect will return the SQL dialect of the active database connection.
+func CurrentDialect() Dialect {
+	return dialect
+}
+
+// placeholderRegex matches Postgres-style placeholders, ie. "$1"
+var placeholderRegex = regexp.MustCompile(`\$([0-9]+)`)
+
+// Rebind will convert the Postgres-style "$1" placeholders in a query into the
+// placeholder style used by the current database.
+//
+// All the SQL in this codebase is written with Postgres-style placeholders. SQLite accepts "$1" too,
+// but treats it as a named parameter and numbers them in the order they first appear in the query
+// rather than by the number in them. So if "$2" appears before "$1", the arguments get swapped.
+// Converting them to "?1" avoids that.
+func Rebind(query string) string {
+	if dialect != DialectSQLite {
+		return query
+	}
+	return placeholderRegex.ReplaceAllString(query, "?$1")
+}
+
 func MustConnect(settings Settings) {
+	if settings.Dialect == "" {
+		settings.Dialect = DialectPostgres
+	}
 	var err error
-	db, err = sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s sslmode=disable",
-		settings.Host,
-		settings.Port,
-		settings.User,
-		settings.Password,
-	))
+	switch settings.Dialect {
+	case DialectPostgres:
+		db, err = sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s sslmode=disable",
+			settings.Host,
+			settings.Port,
+			settings.User,
+			settings.Password,
+		))
+	case DialectSQLite:
+		db, err = openSQLite(settings.Path)
+	default:
+		panic(fmt.Sprintf("Unsupported database dialect: %s", settings.Dialect))
+	}
 	if err != nil {
 		panic(err)
 	}
+	dialect = settings.Dialect
 
 	// Test connection to the database
 	//
@@ -83,6 +164,7 @@ func MustClose() error {
 			return err
 		}
 		db = nil
+		dialect = ""
 	}
 	return nil
 }
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration is a single versioned change to the database schema.
+//
+// Each migration is run inside its own transaction, so if any statement fails, none of the
+// statements for that migration will have been applied.
+type Migration struct {
+	// Version must be unique and migrations are applied in ascending order of it.
+	Version int
+	// Name is a short human readable description, ie. "create_contact_tables"
+	Name string
+	// Up holds the SQL statements to apply this migration
+	Up []string
+	// Down holds the SQL statements to revert this migration
+	Down []string
+}
+
+// MigrationStatus is the state of a single migration, used for reporting.
+type MigrationStatus struct {
+	Migration
+	IsApplied bool
+	AppliedAt time.Time
+}
+
+const createSchemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations(
+	Version   INT PRIMARY KEY NOT NULL,
+	Name      VARCHAR(255)    NOT NULL,
+	AppliedAt TIMESTAMP       NOT NULL
+)`
+
+// currentMigrations returns the list of migrations for the current database dialect.
+func currentMigrations() []Migration {
+	if dialect == DialectSQLite {
+		return sqliteMigrations
+	}
+	return postgresMigrations
+}
+
+// CurrentVersion will return the version of the latest migration applied to the database.
+// Returns 0 if no migrations have been applied.
+func CurrentVersion() (int, error) {
+	if err := ensureSchemaMigrationsTable(); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(Version) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// MigrateUp will apply all migrations that haven't been applied yet, in order.
+func MigrateUp() error {
+	migrations := currentMigrations()
+	if err := validateMigrations(migrations); err != nil {
+		return err
+	}
+	applied, err := getAppliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := RunInTransaction(func(tx *sql.Tx) error {
+			for _, query := range migration.Up {
+				if _, err := tx.Exec(query); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(Rebind(`INSERT INTO schema_migrations (Version, Name, AppliedAt) VALUES ($1, $2, $3)`), migration.Version, migration.Name, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown will revert the given amount of applied migrations, starting from the latest.
+func MigrateDown(steps int) error {
+	migrations := currentMigrations()
+	if err := validateMigrations(migrations); err != nil {
+		return err
+	}
+	applied, err := getAppliedMigrations()
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		err := RunInTransaction(func(tx *sql.Tx) error {
+			for _, query := range migration.Down {
+				if _, err := tx.Exec(query); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(Rebind(`DELETE FROM schema_migrations WHERE Version = $1`), migration.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// MigrationStatuses will return every known migration and whether it has been applied or not.
+func MigrationStatuses() ([]MigrationStatus, error) {
+	migrations := currentMigrations()
+	if err := validateMigrations(migrations); err != nil {
+		return nil, err
+	}
+	applied, err := getAppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		appliedAt, isApplied := applied[migration.Version]
+		statuses[i] = MigrationStatus{
+			Migration: migration,
+			IsApplied: isApplied,
+			AppliedAt: appliedAt,
+		}
+	}
+	return statuses, nil
+}
+
+// MustDestroy will revert every applied migration and then drop the bookkeeping table.
+//
+// This only exists for developer convenience so the database can be reset back to a blank slate.
+func MustDestroy() {
+	applied, err := getAppliedMigrations()
+	if err != nil {
+		panic(err)
+	}
+	if err := MigrateDown(len(applied)); err != nil {
+		panic(err)
+	}
+	if _, err := db.Exec(`DROP TABLE IF EXISTS schema_migrations`); err != nil {
+		panic(err)
+	}
+}
+
+// getAppliedMigrations returns a map of applied versions to the time they were applied.
+func getAppliedMigrations() (map[int]time.Time, error) {
+	if err := ensureSchemaMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT Version, AppliedAt FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func ensureSchemaMigrationsTable() error {
+	_, err := db.Exec(createSchemaMigrationsTable)
+	return err
+}
+
+// validateMigrations will catch developer mistakes in the list of migrations, such as
+// two migrations sharing the same version or being out of order.
+func validateMigrations(migrations []Migration) error {
+	lastVersion := 0
+	for _, migration := range migrations {
+		if migration.Version <= 0 {
+			return fmt.Errorf("migration %q must have a version greater than 0", migration.Name)
+		}
+		if migration.Version <= lastVersion {
+			return fmt.Errorf("migration %d (%s) must have a version greater than the migration before it (%d)", migration.Version, migration.Name, lastVersion)
+		}
+		if len(migration.Up) == 0 {
+			return fmt.Errorf("migration %d (%s) has no up statements", migration.Version, migration.Name)
+		}
+		if len(migration.Down) == 0 {
+			return fmt.Errorf("migration %d (%s) has no down statements", migration.Version, migration.Name)
+		}
+		lastVersion = migration.Version
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package db
+
+import "testing"
+
+func TestMigrationsAreValid(t *testing.T) {
+	if err := validateMigrations(postgresMigrations); err != nil {
+		t.Fatalf("postgres: %s", err)
+	}
+	if err := validateMigrations(sqliteMigrations); err != nil {
+		t.Fatalf("sqlite: %s", err)
+	}
+}
+
+func TestMigrationsMatchBetweenDialects(t *testing.T) {
+	if len(postgresMigrations) != len(sqliteMigrations) {
+		t.Fatalf("expected the same amount of migrations for each dialect, postgres has %d, sqlite has %d", len(postgresMigrations), len(sqliteMigrations))
+	}
+	for i, postgresMigration := range postgresMigrations {
+		sqliteMigration := sqliteMigrations[i]
+		if postgresMigration.Version != sqliteMigration.Version ||
+			postgresMigration.Name != sqliteMigration.Name {
+			t.Errorf("migration %d does not match between dialects, postgres: %d (%s), sqlite: %d (%s)", i, postgresMigration.Version, postgresMigration.Name, sqliteMigration.Version, sqliteMigration.Name)
+		}
+	}
+}
+
+func TestValidateMigrations(t *testing.T) {
+	type TestData struct {
+		Name       string
+		Migrations []Migration
+		IsValid    bool
+	}
+	up := []string{"CREATE TABLE A(ID INT)"}
+	down := []string{"DROP TABLE A"}
+	testDataList := []TestData{
+		{
+			Name: "ascending versions",
+			Migrations: []Migration{
+				{Version: 1, Name: "a", Up: up, Down: down},
+				{Version: 2, Name: "b", Up: up, Down: down},
+			},
+			IsValid: true,
+		},
+		{
+			Name: "gaps in versions are allowed",
+			Migrations: []Migration{
+				{Version: 1, Name: "a", Up: up, Down: down},
+				{Version: 5, Name: "b", Up: up, Down: down},
+			},
+			IsValid: true,
+		},
+		{
+			Name: "duplicate versions",
+			Migrations: []Migration{
+				{Version: 1, Name: "a", Up: up, Down: down},
+				{Version: 1, Name: "b", Up: up, Down: down},
+			},
+		},
+		{
+			Name: "out of order versions",
+			Migrations: []Migration{
+				{Version: 2, Name: "a", Up: up, Down: down},
+				{Version: 1, Name: "b", Up: up, Down: down},
+			},
+		},
+		{
+			Name: "zero version",
+			Migrations: []Migration{
+				{Version: 0, Name: "a", Up: up, Down: down},
+			},
+		},
+		{
+			Name: "missing down",
+			Migrations: []Migration{
+				{Version: 1, Name: "a", Up: up},
+			},
+		},
+	}
+	for _, testData := range testDataList {
+		err := validateMigrations(testData.Migrations)
+		if testData.IsValid && err != nil {
+			t.Errorf("%s: expected no error but got: %s", testData.Name, err)
+		}
+		if !testData.IsValid && err == nil {
+			t.Errorf("%s: expected an error but got none", testData.Name)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package db
+
+// sqliteMigrations are the SQLite equivalents of postgresMigrations.
+//
+// They must have the same versions and names as their Postgres counterparts so that
+// switching the storage driver in config.json doesn't change what "--migrate status" means.
+// The main differences are:
+//   - "INTEGER PRIMARY KEY AUTOINCREMENT" rather than "SERIAL PRIMARY KEY"
+//   - There is no "pg_trgm" extension, the search functions we need are registered in Go instead.
+//     (see sqlite.go)
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_contact_tables",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS Contact(
+				ID        INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+				FullName  VARCHAR(255)                      NOT NULL,
+				Email     VARCHAR(255)                      NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS PhoneNumber(
+				ID        INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+				ContactID INT                               NOT NULL,
+				Number    VARCHAR(16)                       NOT NULL,
+				CONSTRAINT FkContactID FOREIGN KEY (ContactID) REFERENCES Contact (ID)
+			)`,
+		},
+		Down: []string{
+			`DROP TABLE PhoneNumber`,
+			`DROP TABLE Contact`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add_phone_number_contact_id_index",
+		Up: []string{
+			`CREATE INDEX PhoneNumberContactIDIndex ON PhoneNumber (ContactID)`,
+		},
+		Down: []string{
+			`DROP INDEX PhoneNumberContactIDIndex`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add_contact_search_indexes",
+		// SQLite has no trigram indexes, but we can at least index what we sort by.
+		Up: []string{
+			`CREATE INDEX ContactFullNameLowerIndex ON Contact (LOWER(FullName))`,
+			`CREATE INDEX ContactEmailLowerIndex ON Contact (LOWER(Email))`,
+		},
+		Down: []string{
+			`DROP INDEX ContactEmailLowerIndex`,
+			`DROP INDEX ContactFullNameLowerIndex`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add_phone_number_country_code",
+		// Requires SQLite 3.35.0 or later for DROP COLUMN, which the driver we use bundles.
+		Up: []string{
+			`ALTER TABLE PhoneNumber ADD COLUMN CountryCode VARCHAR(2) NOT NULL DEFAULT ''`,
+		},
+		Down: []string{
+			`ALTER TABLE PhoneNumber DROP COLUMN CountryCode`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add_phone_number_metadata",
+		// SQLite can only add one column per ALTER TABLE, so the Postgres migration does the same
+		// to keep them easy to compare.
+		Up: []string{
+			`ALTER TABLE PhoneNumber ADD COLUMN Extension VARCHAR(16) NOT NULL DEFAULT ''`,
+			`ALTER TABLE PhoneNumber ADD COLUMN Label VARCHAR(64) NOT NULL DEFAULT ''`,
+			`ALTER TABLE PhoneNumber ADD COLUMN IsPrimary BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE PhoneNumber ADD COLUMN LineType VARCHAR(32) NOT NULL DEFAULT ''`,
+			`CREATE UNIQUE INDEX PhoneNumberPrimaryIndex ON PhoneNumber (ContactID) WHERE IsPrimary`,
+		},
+		Down: []string{
+			`DROP INDEX PhoneNumberPrimaryIndex`,
+			`ALTER TABLE PhoneNumber DROP COLUMN LineType`,
+			`ALTER TABLE PhoneNumber DROP COLUMN IsPrimary`,
+			`ALTER TABLE PhoneNumber DROP COLUMN Label`,
+			`ALTER TABLE PhoneNumber DROP COLUMN Extension`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "move_contact_emails_to_email_address_table",
+		// Contacts can now have multiple emails. Existing emails become the contacts primary email.
+		Up: []string{
+			`CREATE TABLE EmailAddress(
+				ID        INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+				ContactID INT                               NOT NULL,
+				Address   VARCHAR(255)                      NOT NULL,
+				Label     VARCHAR(64)                       NOT NULL DEFAULT '',
+				IsPrimary BOOLEAN                           NOT NULL DEFAULT FALSE,
+				CONSTRAINT FkEmailAddressContactID FOREIGN KEY (ContactID) REFERENCES Contact (ID)
+			)`,
+			`CREATE INDEX EmailAddressContactIDIndex ON EmailAddress (ContactID)`,
+			`CREATE UNIQUE INDEX EmailAddressPrimaryIndex ON EmailAddress (ContactID) WHERE IsPrimary`,
+			`CREATE INDEX EmailAddressAddressLowerIndex ON EmailAddress (LOWER(Address))`,
+			`INSERT INTO EmailAddress (ContactID, Address, IsPrimary) SELECT ID, Email, TRUE FROM Contact WHERE Email <> '' ORDER BY ID`,
+			// SQLite can't drop a column that's indexed
+			`DROP INDEX ContactEmailLowerIndex`,
+			`ALTER TABLE Contact DROP COLUMN Email`,
+		},
+		// Going down, each contact keeps only its primary email, or its first email if none are primary.
+		Down: []string{
+			`ALTER TABLE Contact ADD COLUMN Email VARCHAR(255) NOT NULL DEFAULT ''`,
+			`UPDATE Contact SET Email = COALESCE((SELECT Address FROM EmailAddress WHERE EmailAddress.ContactID = Contact.ID ORDER BY IsPrimary DESC, ID LIMIT 1), '')`,
+			`CREATE INDEX ContactEmailLowerIndex ON Contact (LOWER(Email))`,
+			`DROP TABLE EmailAddress`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create_contact_merge_table",
+		// There's no foreign keys as the source contact is deleted by the merge and the audit
+		// should outlive the target contact too.
+		Up: []string{
+			`CREATE TABLE ContactMerge(
+				ID              INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+				TargetContactID INT                               NOT NULL,
+				SourceContactID INT                               NOT NULL,
+				Details         TEXT                              NOT NULL,
+				MergedAt        TIMESTAMP                         NOT NULL
+			)`,
+			`CREATE INDEX ContactMergeTargetContactIDIndex ON ContactMerge (TargetContactID)`,
+		},
+		Down: []string{
+			`DROP TABLE ContactMerge`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add_contact_uid_and_version",
+		// UID identifies a contact when syncing, ie. over CardDAV. Existing contacts are given
+		// one based on their ID, new contacts are given a random UUID. Version is incremented
+		// each time a contact changes.
+		Up: []string{
+			// SQLite can't add a NOT NULL column without a default, so it's given a blank one
+			`ALTER TABLE Contact ADD COLUMN UID VARCHAR(255) NOT NULL DEFAULT ''`,
+			`UPDATE Contact SET UID = 'contact-' || ID`,
+			`CREATE UNIQUE INDEX ContactUIDIndex ON Contact (UID)`,
+			`ALTER TABLE Contact ADD COLUMN Version INTEGER NOT NULL DEFAULT 1`,
+		},
+		Down: []string{
+			`ALTER TABLE Contact DROP COLUMN Version`,
+			`DROP INDEX ContactUIDIndex`,
+			`ALTER TABLE Contact DROP COLUMN UID`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "create_user_tables",
+		// Only a hash of each session token is stored, see user.Session. Sessions are deleted
+		// with their user by the store, the foreign key is only there to catch mistakes.
+		Up: []string{
+			`CREATE TABLE UserAccount(
+				ID           INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+				Username     VARCHAR(64)                       NOT NULL,
+				PasswordHash VARCHAR(255)                      NOT NULL,
+				CreatedAt    TIMESTAMP                         NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX UserAccountUsernameIndex ON UserAccount (Username)`,
+			`CREATE TABLE UserSession(
+				TokenHash VARCHAR(64) PRIMARY KEY NOT NULL,
+				UserID    INT                     NOT NULL,
+				CreatedAt TIMESTAMP               NOT NULL,
+				ExpiresAt TIMESTAMP               NOT NULL,
+				CONSTRAINT FkUserSessionUserID FOREIGN KEY (UserID) REFERENCES UserAccount (ID)
+			)`,
+			`CREATE INDEX UserSessionUserIDIndex ON UserSession (UserID)`,
+		},
+		Down: []string{
+			`DROP TABLE UserSession`,
+			`DROP TABLE UserAccount`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add_user_role",
+		// Users from before roles existed could do everything, so they're made admins.
+		// New users are always given a role, the default is only for existing rows.
+		Up: []string{
+			`ALTER TABLE UserAccount ADD COLUMN Role VARCHAR(16) NOT NULL DEFAULT 'viewer'`,
+			`UPDATE UserAccount SET Role = 'admin'`,
+		},
+		Down: []string{
+			`ALTER TABLE UserAccount DROP COLUMN Role`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "create_user_api_token_table",
+		// Like sessions, only a hash of each token is stored, see user.APIToken.
+		Up: []string{
+			`CREATE TABLE UserAPIToken(
+				ID         INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+				UserID     INT                               NOT NULL,
+				Name       VARCHAR(100)                      NOT NULL,
+				TokenHash  VARCHAR(64)                       NOT NULL,
+				Scope      VARCHAR(16)                       NOT NULL,
+				CreatedAt  TIMESTAMP                         NOT NULL,
+				ExpiresAt  TIMESTAMP                         NOT NULL,
+				LastUsedAt TIMESTAMP                             NULL,
+				CONSTRAINT FkUserAPITokenUserID FOREIGN KEY (UserID) REFERENCES UserAccount (ID)
+			)`,
+			`CREATE UNIQUE INDEX UserAPITokenTokenHashIndex ON UserAPIToken (TokenHash)`,
+			`CREATE INDEX UserAPITokenUserIDIndex ON UserAPIToken (UserID)`,
+		},
+		Down: []string{
+			`DROP TABLE UserAPIToken`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "create_contact_audit_table",
+		// Like ContactMerge, there's no foreign keys so that entries outlive the contact and user.
+		// Entries must never change, so the triggers refuse to update or delete them.
+		Up: []string{
+			`CREATE TABLE ContactAudit(
+				ID            INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+				ContactID     INT                               NOT NULL,
+				Action        VARCHAR(16)                       NOT NULL,
+				UserID        INT                                   NULL,
+				Username      VARCHAR(255)                      NOT NULL,
+				IP            VARCHAR(45)                       NOT NULL,
+				ContactBefore TEXT                                  NULL,
+				ContactAfter  TEXT                                  NULL,
+				ChangedAt     TIMESTAMP                         NOT NULL
+			)`,
+			`CREATE INDEX ContactAuditContactIDIndex ON ContactAudit (ContactID)`,
+			`CREATE INDEX ContactAuditUserIDIndex ON ContactAudit (UserID)`,
+			`CREATE TRIGGER ContactAuditNoUpdate BEFORE UPDATE ON ContactAudit
+			BEGIN
+				SELECT RAISE(ABORT, 'ContactAudit is append-only');
+			END`,
+			`CREATE TRIGGER ContactAuditNoDelete BEFORE DELETE ON ContactAudit
+			BEGIN
+				SELECT RAISE(ABORT, 'ContactAudit is append-only');
+			END`,
+		},
+		Down: []string{
+			`DROP TABLE ContactAudit`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "add_soft_delete",
+		// Deleted contacts and phone numbers are kept in the trash until they're purged. Deleted
+		// phone numbers keep their IsPrimary so that they're still primary if they're restored,
+		// which means the primary index has to ignore them.
+		//
+		// Going down purges the trash, as otherwise its records would come back.
+		Up: []string{
+			`ALTER TABLE Contact ADD COLUMN DeletedAt TIMESTAMP NULL`,
+			`ALTER TABLE PhoneNumber ADD COLUMN DeletedAt TIMESTAMP NULL`,
+			`CREATE INDEX ContactDeletedAtIndex ON Contact (DeletedAt)`,
+			`CREATE INDEX PhoneNumberDeletedAtIndex ON PhoneNumber (DeletedAt)`,
+			`DROP INDEX PhoneNumberPrimaryIndex`,
+			`CREATE UNIQUE INDEX PhoneNumberPrimaryIndex ON PhoneNumber (ContactID) WHERE IsPrimary AND DeletedAt IS NULL`,
+		},
+		Down: []string{
+			`DELETE FROM EmailAddress WHERE ContactID IN (SELECT ID FROM Contact WHERE DeletedAt IS NOT NULL)`,
+			`DELETE FROM PhoneNumber WHERE DeletedAt IS NOT NULL OR ContactID IN (SELECT ID FROM Contact WHERE DeletedAt IS NOT NULL)`,
+			`DELETE FROM Contact WHERE DeletedAt IS NOT NULL`,
+			`DROP INDEX PhoneNumberPrimaryIndex`,
+			`CREATE UNIQUE INDEX PhoneNumberPrimaryIndex ON PhoneNumber (ContactID) WHERE IsPrimary`,
+			`DROP INDEX PhoneNumberDeletedAtIndex`,
+			`DROP INDEX ContactDeletedAtIndex`,
+			`ALTER TABLE PhoneNumber DROP COLUMN DeletedAt`,
+			`ALTER TABLE Contact DROP COLUMN DeletedAt`,
+		},
+	},
+}
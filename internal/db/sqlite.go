@@ -0,0 +1,57 @@
+package db
+
+import (
+	"database/sql"
+	"net/url"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/silbinarywolf/contact-site/internal/trigram"
+)
+
+// sqliteDriverName is the name we register our SQLite driver under.
+//
+// We register our own rather than using the "sqlite3" driver as-is so that every connection
+// gets the Postgres functions that our queries rely on.
+const sqliteDriverName = "sqlite3_contactsite"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// From the "pg_trgm" extension, used for searching
+			if err := conn.RegisterFunc("word_similarity", trigram.WordSimilarity, true); err != nil {
+				return err
+			}
+			// SQLite's equivalent is the multi-argument form of "max()"
+			return conn.RegisterFunc("greatest", greatest, true)
+		},
+	})
+}
+
+func greatest(values ...float64) float64 {
+	result := 0.0
+	for i, value := range values {
+		if i == 0 || value > result {
+			result = value
+		}
+	}
+	return result
+}
+
+// openSQLite opens the SQLite database at the given path, creating it if it doesn't exist.
+//
+// SQLite requires cgo. If the binary was built with CGO_ENABLED=0, this will still
+// compile, but connecting will fail with an error explaining why.
+func openSQLite(path string) (*sql.DB, error) {
+	options := url.Values{}
+	// Foreign keys aren't enforced by SQLite unless we ask
+	options.Set("_foreign_keys", "1")
+	// Write-ahead logging lets readers and a writer work at the same time, and the busy timeout
+	// makes concurrent writers wait for each other rather than failing immediately.
+	options.Set("_journal_mode", "WAL")
+	options.Set("_busy_timeout", "5000")
+	// Take the write lock at the start of transactions. Otherwise a transaction that reads and then
+	// writes can fail with "database is locked" when another transaction is already writing.
+	options.Set("_txlock", "immediate")
+	return sql.Open(sqliteDriverName, "file:"+path+"?"+options.Encode())
+}
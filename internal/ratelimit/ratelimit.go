@@ -0,0 +1,117 @@
+// Package ratelimit limits how often something can be done with token buckets.
+//
+// Each key, ie. an IP address, has a bucket that holds up to Limit.Burst tokens. Every request
+// takes a token, and a token is put back every Limit.Every. Once the bucket is empty requests
+// are refused until another token is put back. This allows short bursts, like someone adding a
+// few contacts in a row, while stopping a bot from adding thousands.
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit is how many requests are allowed.
+type Limit struct {
+	// Burst is how many requests can be made at once, the size of the bucket
+	Burst int
+	// Every is how long it takes for another request to be allowed
+	Every time.Duration
+}
+
+// PerMinute returns a Limit that allows burst requests at once and then perMinute more
+// each minute.
+func PerMinute(burst int, perMinute float64) Limit {
+	if perMinute <= 0 {
+		return Limit{Burst: burst}
+	}
+	return Limit{
+		Burst: burst,
+		Every: time.Duration(float64(time.Minute) / perMinute),
+	}
+}
+
+// Bucket is how many tokens a key has left.
+type Bucket struct {
+	Tokens float64
+	// UpdatedAt is when Tokens was last worked out, tokens put back since then aren't
+	// included in it
+	UpdatedAt time.Time
+}
+
+// Limiter refuses requests for keys that have used up their Limit.
+type Limiter struct {
+	limit Limit
+	store Store
+	// now is replaced in tests so that they don't need to wait
+	now func() time.Time
+}
+
+// New returns a Limiter that keeps its buckets in store. A store can be shared by more than
+// one Limiter as long as they use different keys.
+func New(limit Limit, store Store) *Limiter {
+	return &Limiter{
+		limit: limit,
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key. If there are none left it returns false along
+// with how long until there will be.
+func (limiter *Limiter) Allow(key string) (bool, time.Duration) {
+	now := limiter.now()
+	burst := float64(limiter.limit.Burst)
+	// A bucket that hasn't been touched for this long is full again, so it doesn't need to be kept
+	expiry := time.Duration(burst) * limiter.limit.Every
+	var (
+		ok         bool
+		retryAfter time.Duration
+	)
+	limiter.store.Update(key, expiry, func(bucket *Bucket) Bucket {
+		tokens := burst
+		if bucket != nil {
+			tokens = bucket.Tokens
+			if limiter.limit.Every > 0 {
+				tokens += float64(now.Sub(bucket.UpdatedAt)) / float64(limiter.limit.Every)
+			}
+			tokens = math.Min(tokens, burst)
+		}
+		if tokens >= 1 {
+			ok = true
+			tokens--
+		} else if limiter.limit.Every > 0 {
+			retryAfter = time.Duration((1 - tokens) * float64(limiter.limit.Every))
+		} else {
+			// Nothing is ever put back
+			retryAfter = time.Duration(math.MaxInt64)
+		}
+		return Bucket{
+			Tokens:    tokens,
+			UpdatedAt: now,
+		}
+	})
+	return ok, retryAfter
+}
+
+// Refund puts back a token that Allow took from the bucket for key, ie. when a request that
+// was allowed is refused by another Limiter, so that it doesn't count against key.
+func (limiter *Limiter) Refund(key string) {
+	now := limiter.now()
+	burst := float64(limiter.limit.Burst)
+	expiry := time.Duration(burst) * limiter.limit.Every
+	limiter.store.Update(key, expiry, func(bucket *Bucket) Bucket {
+		tokens := burst
+		if bucket != nil {
+			tokens = bucket.Tokens + 1
+			if limiter.limit.Every > 0 {
+				tokens += float64(now.Sub(bucket.UpdatedAt)) / float64(limiter.limit.Every)
+			}
+			tokens = math.Min(tokens, burst)
+		}
+		return Bucket{
+			Tokens:    tokens,
+			UpdatedAt: now,
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2020, 7, 11, 12, 0, 0, 0, time.UTC)
+	limiter := New(Limit{Burst: 3, Every: 10 * time.Second}, NewMemoryStore())
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	// The whole burst is allowed at once
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d: expected to be allowed", i+1)
+		}
+	}
+	ok, retryAfter := limiter.Allow("a")
+	if ok || retryAfter != 10*time.Second {
+		t.Fatalf("expected to be refused for 10s after the burst, got %v %v", ok, retryAfter)
+	}
+
+	// Other keys have their own bucket
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Fatalf("expected another key to be allowed")
+	}
+
+	// Tokens are put back over time, but never more than the burst
+	now = now.Add(4 * time.Second)
+	if ok, retryAfter := limiter.Allow("a"); ok || retryAfter != 6*time.Second {
+		t.Fatalf("expected to be refused for 6s, got %v %v", ok, retryAfter)
+	}
+	now = now.Add(6 * time.Second)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Fatalf("expected to be allowed once a token was put back")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d: expected to be allowed after the bucket refilled", i+1)
+		}
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Fatalf("expected the refilled bucket to only hold the burst")
+	}
+}
+
+func TestLimiterRefund(t *testing.T) {
+	now := time.Date(2020, 7, 11, 12, 0, 0, 0, time.UTC)
+	limiter := New(Limit{Burst: 2, Every: time.Minute}, NewMemoryStore())
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d: expected to be allowed", i+1)
+		}
+	}
+	limiter.Refund("a")
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Fatalf("expected the refunded token to be allowed")
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Fatalf("expected only the refunded token to be put back")
+	}
+
+	// Refunding never holds more than the burst
+	limiter.Refund("b")
+	now = now.Add(time.Hour)
+	limiter.Refund("a")
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d: expected to be allowed after the bucket refilled", i+1)
+		}
+		if ok, _ := limiter.Allow("b"); !ok {
+			t.Fatalf("request %d: expected a refunded key without a bucket to be full", i+1)
+		}
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Fatalf("expected the refunded bucket to only hold the burst")
+	}
+}
+
+func TestPerMinute(t *testing.T) {
+	if limit := PerMinute(5, 2); limit.Burst != 5 || limit.Every != 30*time.Second {
+		t.Errorf("expected a token every 30s, got %+v", limit)
+	}
+	limit := PerMinute(1, 0)
+	if limit.Every != 0 {
+		t.Errorf("expected tokens never to be put back, got %+v", limit)
+	}
+	limiter := New(limit, NewMemoryStore())
+	limiter.Allow("a")
+	if ok, retryAfter := limiter.Allow("a"); ok || retryAfter <= 0 {
+		t.Errorf("expected to be refused forever, got %v %v", ok, retryAfter)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	store := NewMemoryStore().(*memoryStore)
+	store.Update("a", time.Nanosecond, func(bucket *Bucket) Bucket {
+		return Bucket{Tokens: 1}
+	})
+	store.Update("b", 0, func(bucket *Bucket) Bucket {
+		return Bucket{Tokens: 2}
+	})
+	time.Sleep(time.Millisecond)
+	store.Update("a", time.Hour, func(bucket *Bucket) Bucket {
+		if bucket != nil {
+			t.Errorf("expected an expired bucket to be forgotten, got %+v", bucket)
+		}
+		return Bucket{}
+	})
+
+	// Sweeping forgets expired buckets, but keeps ones without an expiry
+	store.Update("c", time.Nanosecond, func(bucket *Bucket) Bucket {
+		return Bucket{}
+	})
+	time.Sleep(time.Millisecond)
+	store.sweep(time.Now())
+	if _, ok := store.buckets["c"]; ok {
+		t.Errorf("expected expired bucket to be swept")
+	}
+	if _, ok := store.buckets["b"]; !ok {
+		t.Errorf("expected bucket without an expiry to be kept")
+	}
+}
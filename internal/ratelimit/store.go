@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Store is where the buckets for each key are kept. The memory store is enough when there's
+// one server, but the buckets would need to be shared, ie. in Redis, to limit across several.
+//
+// Implementations must:
+// - Make Update atomic for each key, so that two requests can't both take the last token
+// - Keep a bucket until it hasn't been updated for its expiry, which is 0 if it never expires
+// - Be safe for concurrent use
+type Store interface {
+	// Update calls update with the bucket for key, or nil if there isn't one, and keeps the
+	// bucket it returns
+	Update(key string, expiry time.Duration, update func(bucket *Bucket) Bucket)
+}
+
+// sweepInterval is how often the memory store forgets expired buckets, so that every IP address
+// that's ever made a request isn't kept forever.
+const sweepInterval = time.Minute
+
+// memoryStore keeps buckets in memory, so they're reset when the application restarts.
+type memoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]memoryBucket
+	lastSwept time.Time
+}
+
+type memoryBucket struct {
+	Bucket
+	expiresAt time.Time
+}
+
+// assert at compile-time that this type satisfies the Store interface
+var _ Store = new(memoryStore)
+
+// NewMemoryStore returns an empty Store that keeps buckets in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		buckets:   make(map[string]memoryBucket),
+		lastSwept: time.Now(),
+	}
+}
+
+func (store *memoryStore) Update(key string, expiry time.Duration, update func(bucket *Bucket) Bucket) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(store.lastSwept) >= sweepInterval {
+		store.sweep(now)
+	}
+	var current *Bucket
+	if record, ok := store.buckets[key]; ok && !record.hasExpired(now) {
+		current = &record.Bucket
+	}
+	record := memoryBucket{Bucket: update(current)}
+	if expiry > 0 {
+		record.expiresAt = now.Add(expiry)
+	}
+	store.buckets[key] = record
+}
+
+// sweep forgets every expired bucket.
+func (store *memoryStore) sweep(now time.Time) {
+	for key, record := range store.buckets {
+		if record.hasExpired(now) {
+			delete(store.buckets, key)
+		}
+	}
+	store.lastSwept = now
+}
+
+func (record memoryBucket) hasExpired(now time.Time) bool {
+	return !record.expiresAt.IsZero() && !now.Before(record.expiresAt)
+}
@@ -0,0 +1,90 @@
+// Package trigram implements the trigram similarity functions from Postgres's "pg_trgm"
+// extension in Go.
+//
+// This exists so that fuzzy searching behaves the same when the app isn't backed by Postgres.
+// ie. when using the in-memory or SQLite storage.
+package trigram
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Similarity returns how similar the two strings are, from 0 (nothing in common)
+// to 1 (identical trigrams). Equivalent to "similarity(a, b)" in pg_trgm.
+func Similarity(a, b string) float64 {
+	setA := make(map[string]bool)
+	for _, trigram := range trigrams(a) {
+		setA[trigram] = true
+	}
+	setB := make(map[string]bool)
+	for _, trigram := range trigrams(b) {
+		setB[trigram] = true
+	}
+	return ratio(setA, setB)
+}
+
+// WordSimilarity returns the greatest similarity between the trigrams in needle and any
+// continuous extent of the trigrams in haystack. Equivalent to "word_similarity(needle, haystack)"
+// in pg_trgm.
+//
+// In practice this means a short search like "perlmen" is very similar to "Radia Perlman",
+// whereas Similarity would be dragged down by "Radia".
+func WordSimilarity(needle, haystack string) float64 {
+	needleSet := make(map[string]bool)
+	for _, trigram := range trigrams(needle) {
+		needleSet[trigram] = true
+	}
+	if len(needleSet) == 0 {
+		return 0
+	}
+	haystackTrigrams := trigrams(haystack)
+	best := 0.0
+	for start := range haystackTrigrams {
+		// Only extents that start on a matching trigram can be the best match
+		if !needleSet[haystackTrigrams[start]] {
+			continue
+		}
+		extent := make(map[string]bool)
+		for end := start; end < len(haystackTrigrams); end++ {
+			extent[haystackTrigrams[end]] = true
+			if similarity := ratio(needleSet, extent); similarity > best {
+				best = similarity
+			}
+		}
+	}
+	return best
+}
+
+// ratio is the size of the intersection of the sets divided by the size of their union.
+func ratio(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for trigram := range a {
+		if b[trigram] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// trigrams splits the string into lower-case words made up of letters and digits, then
+// returns the trigrams of each word in order.
+//
+// Like pg_trgm, each word is padded with two spaces at the start and one at the end,
+// so "cat" has the trigrams "  c", " ca", "cat" and "at ".
+func trigrams(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var result []string
+	for _, word := range words {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			result = append(result, string(runes[i:i+3]))
+		}
+	}
+	return result
+}
@@ -0,0 +1,47 @@
+package trigram
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSimilarity(t *testing.T) {
+	type TestData struct {
+		A, B string
+		Out  float64
+	}
+	testDataList := []TestData{
+		{A: "word", B: "word", Out: 1},
+		{A: "Word", B: "wORD", Out: 1},
+		{A: "word", B: "", Out: 0},
+		// Values taken from running the same queries against pg_trgm
+		{A: "word", B: "two words", Out: 4.0 / 11.0},
+	}
+	for _, testData := range testDataList {
+		if got := Similarity(testData.A, testData.B); math.Abs(got-testData.Out) > 0.0001 {
+			t.Errorf("Similarity(%q, %q): expected %v but got %v", testData.A, testData.B, testData.Out, got)
+		}
+	}
+}
+
+func TestWordSimilarity(t *testing.T) {
+	type TestData struct {
+		Needle, Haystack string
+		Out              float64
+	}
+	testDataList := []TestData{
+		// Example from the pg_trgm documentation
+		{Needle: "word", Haystack: "two words", Out: 0.8},
+		{Needle: "perlman", Haystack: "Radia Perlman", Out: 1},
+		{Needle: "", Haystack: "Radia Perlman", Out: 0},
+	}
+	for _, testData := range testDataList {
+		if got := WordSimilarity(testData.Needle, testData.Haystack); math.Abs(got-testData.Out) > 0.0001 {
+			t.Errorf("WordSimilarity(%q, %q): expected %v but got %v", testData.Needle, testData.Haystack, testData.Out, got)
+		}
+	}
+	// Typos should still be fairly similar
+	if got := WordSimilarity("perlmen", "Radia Perlman"); got < 0.5 {
+		t.Errorf("expected typo to have a similarity of at least 0.5 but got %v", got)
+	}
+}
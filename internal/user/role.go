@@ -0,0 +1,92 @@
+package user
+
+import (
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+// Role decides what a User is allowed to do, see Permission.
+type Role string
+
+const (
+	// RoleViewer can only look at contacts
+	RoleViewer Role = "viewer"
+	// RoleEditor can add, change, delete, import and export contacts
+	RoleEditor Role = "editor"
+	// RoleAdmin can do everything an editor can, manage users and view the audit log
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists every Role, from the least to the most allowed.
+var Roles = []Role{RoleViewer, RoleEditor, RoleAdmin}
+
+// Permission is something a User is allowed to do.
+type Permission string
+
+const (
+	PermissionReadContacts   Permission = "read_contacts"
+	PermissionCreateContacts Permission = "create_contacts"
+	PermissionEditContacts   Permission = "edit_contacts"
+	PermissionDeleteContacts Permission = "delete_contacts"
+	// PermissionImportExportContacts covers importing contacts from and exporting them to files
+	PermissionImportExportContacts Permission = "import_export_contacts"
+	PermissionManageUsers          Permission = "manage_users"
+	// PermissionViewAuditLog covers seeing and exporting who changed each contact and when
+	PermissionViewAuditLog Permission = "view_audit_log"
+)
+
+// rolePermissions is every Permission each Role has. This is the only place permissions are
+// given out, so keep it in sync with the Role descriptions above.
+var rolePermissions = map[Role][]Permission{
+	RoleViewer: {
+		PermissionReadContacts,
+	},
+	RoleEditor: {
+		PermissionReadContacts,
+		PermissionCreateContacts,
+		PermissionEditContacts,
+		PermissionDeleteContacts,
+		PermissionImportExportContacts,
+	},
+	RoleAdmin: {
+		PermissionReadContacts,
+		PermissionCreateContacts,
+		PermissionEditContacts,
+		PermissionDeleteContacts,
+		PermissionImportExportContacts,
+		PermissionManageUsers,
+		PermissionViewAuditLog,
+	},
+}
+
+var (
+	ErrInvalidRole = validate.NewError("user.role.invalid", "Invalid Role provided. Must be \"viewer\", \"editor\" or \"admin\".")
+	// ErrLastAdmin is returned when changing the role of the only admin, as then no one could
+	// manage users.
+	ErrLastAdmin = validate.NewError("user.role.last_admin", "Invalid Role provided. There must always be at least one admin.")
+)
+
+// ParseRole returns the Role with the given name.
+//
+// Returns ErrInvalidRole if there's no such Role.
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := rolePermissions[role]; !ok {
+		return "", ErrInvalidRole
+	}
+	return role, nil
+}
+
+// Can returns true if the Role has the given Permission.
+func (role Role) Can(permission Permission) bool {
+	for _, rolePermission := range rolePermissions[role] {
+		if rolePermission == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Can returns true if the User has the given Permission.
+func (record User) Can(permission Permission) bool {
+	return record.Role.Can(permission)
+}
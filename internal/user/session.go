@@ -0,0 +1,92 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// SessionLifetime is how long a User stays signed in for.
+const SessionLifetime = 14 * 24 * time.Hour
+
+// ErrSessionNotFound is returned when a session token doesn't exist or has expired.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a signed in User, ie. a browser they've signed in with.
+type Session struct {
+	// TokenHash is the SHA-256 of the token given to the client, hex encoded. Only the hash is
+	// stored, so someone who can read the database still can't sign in as anyone.
+	TokenHash string
+	UserID    int64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// CreateSession signs in the User, returning the token that the client will sign in with.
+//
+// The token is as good as the users password until it expires, so it should only be given to
+// the client in a secure cookie.
+func CreateSession(userID int64) (string, Session, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", Session{}, err
+	}
+	now := time.Now().UTC()
+	session := Session{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(SessionLifetime),
+	}
+	// Clear out expired sessions here, as signing in happens far less often than
+	// checking a session but often enough to stop them from piling up.
+	if err := currentStore().DeleteExpiredSessions(now); err != nil {
+		return "", Session{}, err
+	}
+	if err := currentStore().InsertSession(&session); err != nil {
+		return "", Session{}, err
+	}
+	return token, session, nil
+}
+
+// GetSession returns the User signed in with the token.
+//
+// Returns ErrSessionNotFound if there's no such session or it has expired.
+func GetSession(token string) (User, error) {
+	session, err := currentStore().GetSession(hashToken(token))
+	if err != nil {
+		return User{}, err
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		return User{}, ErrSessionNotFound
+	}
+	record, err := currentStore().Get(session.UserID)
+	if err == ErrNotFound {
+		return User{}, ErrSessionNotFound
+	}
+	return record, err
+}
+
+// DeleteSession signs out the session with the token. It's not an error if the session
+// doesn't exist, as it's signed out either way.
+func DeleteSession(token string) error {
+	return currentStore().DeleteSession(hashToken(token))
+}
+
+// newToken returns 32 random bytes, base64 encoded so they can be sent in a cookie or header.
+func newToken() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// hashToken is how session and API tokens are stored, see Session.TokenHash.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,57 @@
+package user
+
+import "time"
+
+// UserStore is where users and their sessions are persisted.
+//
+// Implementations must:
+// - Set the ID of users they insert
+// - Return ErrNotFound / ErrSessionNotFound when a record doesn't exist
+// - Delete a users sessions and API tokens when the user is deleted
+// - Be safe for concurrent use
+type UserStore interface {
+	Insert(record *User) error
+	Get(id int64) (User, error)
+	// GetByUsername is given a normalized username, see normalizeUsername
+	GetByUsername(username string) (User, error)
+	// List returns every User ordered by username
+	List() ([]User, error)
+	UpdateRole(id int64, role Role) error
+	Delete(id int64) error
+	Count() (int, error)
+
+	InsertSession(session *Session) error
+	GetSession(tokenHash string) (Session, error)
+	DeleteSession(tokenHash string) error
+	// DeleteExpiredSessions deletes every session that expires at or before now
+	DeleteExpiredSessions(now time.Time) error
+
+	InsertAPIToken(token *APIToken) error
+	// GetAPIToken returns ErrAPITokenNotFound if there's no token with the hash
+	GetAPIToken(tokenHash string) (APIToken, error)
+	// ListAPITokens returns the users tokens, newest first
+	ListAPITokens(userID int64) ([]APIToken, error)
+	UpdateAPITokenLastUsed(id int64, lastUsedAt time.Time) error
+	// DeleteAPIToken returns ErrAPITokenNotFound if the user has no token with the ID
+	DeleteAPIToken(userID int64, id int64) error
+}
+
+var (
+	store UserStore
+)
+
+// SetStore will change where users are stored. This must be called before any other
+// functions in this package are used.
+//
+// The same as the "contact" package, there's only ever one store for the lifetime of the
+// application, so it's kept in a package variable.
+func SetStore(newStore UserStore) {
+	store = newStore
+}
+
+func currentStore() UserStore {
+	if store == nil {
+		panic("user.SetStore must be called before using the user package.")
+	}
+	return store
+}
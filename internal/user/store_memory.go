@@ -0,0 +1,237 @@
+package user
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps users and sessions in memory, so they're lost when the application stops.
+// Like the contact packages memoryStore, it exists to run the application without a database.
+type memoryStore struct {
+	mu         sync.RWMutex
+	users      map[int64]User
+	lastUserID int64
+	sessions   map[string]Session
+
+	apiTokens      map[int64]APIToken
+	lastAPITokenID int64
+}
+
+// assert at compile-time that this type satisfies the UserStore interface
+var _ UserStore = new(memoryStore)
+
+// NewMemoryStore returns an empty UserStore that keeps everything in memory.
+func NewMemoryStore() UserStore {
+	return &memoryStore{
+		users:     make(map[int64]User),
+		sessions:  make(map[string]Session),
+		apiTokens: make(map[int64]APIToken),
+	}
+}
+
+func (store *memoryStore) Insert(record *User) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.lastUserID++
+	record.ID = store.lastUserID
+	store.users[record.ID] = *record
+	return nil
+}
+
+func (store *memoryStore) Get(id int64) (User, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	record, ok := store.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return record, nil
+}
+
+func (store *memoryStore) GetByUsername(username string) (User, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, record := range store.users {
+		if record.Username == username {
+			return record, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (store *memoryStore) List() ([]User, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	records := make([]User, 0, len(store.users))
+	for _, record := range store.users {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Username < records[j].Username
+	})
+	return records, nil
+}
+
+func (store *memoryStore) UpdateRole(id int64, role Role) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record, ok := store.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	record.Role = role
+	store.users[id] = record
+	return nil
+}
+
+func (store *memoryStore) Delete(id int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.users[id]; !ok {
+		return ErrNotFound
+	}
+	delete(store.users, id)
+	for tokenHash, session := range store.sessions {
+		if session.UserID == id {
+			delete(store.sessions, tokenHash)
+		}
+	}
+	for tokenID, token := range store.apiTokens {
+		if token.UserID == id {
+			delete(store.apiTokens, tokenID)
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) Count() (int, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return len(store.users), nil
+}
+
+func (store *memoryStore) InsertSession(session *Session) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.users[session.UserID]; !ok {
+		return ErrNotFound
+	}
+	store.sessions[session.TokenHash] = *session
+	return nil
+}
+
+func (store *memoryStore) GetSession(tokenHash string) (Session, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	session, ok := store.sessions[tokenHash]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (store *memoryStore) DeleteSession(tokenHash string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.sessions, tokenHash)
+	return nil
+}
+
+func (store *memoryStore) DeleteExpiredSessions(now time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for tokenHash, session := range store.sessions {
+		if !session.ExpiresAt.After(now) {
+			delete(store.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) InsertAPIToken(token *APIToken) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.users[token.UserID]; !ok {
+		return ErrNotFound
+	}
+	store.lastAPITokenID++
+	token.ID = store.lastAPITokenID
+	store.apiTokens[token.ID] = copyAPIToken(*token)
+	return nil
+}
+
+func (store *memoryStore) GetAPIToken(tokenHash string) (APIToken, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, token := range store.apiTokens {
+		if token.TokenHash == tokenHash {
+			return copyAPIToken(token), nil
+		}
+	}
+	return APIToken{}, ErrAPITokenNotFound
+}
+
+func (store *memoryStore) ListAPITokens(userID int64) ([]APIToken, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var tokens []APIToken
+	for _, token := range store.apiTokens {
+		if token.UserID == userID {
+			tokens = append(tokens, copyAPIToken(token))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID > tokens[j].ID
+	})
+	return tokens, nil
+}
+
+func (store *memoryStore) UpdateAPITokenLastUsed(id int64, lastUsedAt time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	token, ok := store.apiTokens[id]
+	if !ok {
+		return ErrAPITokenNotFound
+	}
+	token.LastUsedAt = &lastUsedAt
+	store.apiTokens[id] = token
+	return nil
+}
+
+func (store *memoryStore) DeleteAPIToken(userID int64, id int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	token, ok := store.apiTokens[id]
+	if !ok || token.UserID != userID {
+		return ErrAPITokenNotFound
+	}
+	delete(store.apiTokens, id)
+	return nil
+}
+
+// copyAPIToken copies the token so that callers can't change what's stored through
+// LastUsedAt.
+func copyAPIToken(token APIToken) APIToken {
+	if token.LastUsedAt != nil {
+		lastUsedAt := *token.LastUsedAt
+		token.LastUsedAt = &lastUsedAt
+	}
+	return token
+}
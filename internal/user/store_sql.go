@@ -0,0 +1,261 @@
+package user
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/db"
+)
+
+// sqlStore stores users in the database connected to by the "db" package. Like the contact
+// packages sqlStore, queries are written for Postgres and passed through db.Rebind.
+//
+// The tables are named UserAccount, UserSession and UserAPIToken as "User" is a reserved word
+// in Postgres.
+type sqlStore struct{}
+
+// assert at compile-time that this type satisfies the UserStore interface
+var _ UserStore = new(sqlStore)
+
+// NewSQLStore returns a UserStore backed by the current database connection.
+// Supports both Postgres and SQLite, db.MustConnect must be called before it's used.
+func NewSQLStore() UserStore {
+	return &sqlStore{}
+}
+
+// The columns selected for each User and Session, in the order they're scanned.
+const (
+	userColumns     = `ID, Username, Role, PasswordHash, CreatedAt`
+	sessionColumns  = `TokenHash, UserID, CreatedAt, ExpiresAt`
+	apiTokenColumns = `ID, UserID, Name, TokenHash, Scope, CreatedAt, ExpiresAt, LastUsedAt`
+)
+
+func (store *sqlStore) Insert(record *User) error {
+	return db.Get().QueryRow(db.Rebind(`INSERT INTO UserAccount (Username, Role, PasswordHash, CreatedAt) VALUES ($1, $2, $3, $4) RETURNING ID`),
+		record.Username,
+		record.Role,
+		record.PasswordHash,
+		record.CreatedAt,
+	).Scan(&record.ID)
+}
+
+func (store *sqlStore) Get(id int64) (User, error) {
+	return getUser(db.Rebind(`SELECT `+userColumns+` FROM UserAccount WHERE ID = $1`), id)
+}
+
+func (store *sqlStore) GetByUsername(username string) (User, error) {
+	return getUser(db.Rebind(`SELECT `+userColumns+` FROM UserAccount WHERE Username = $1`), username)
+}
+
+func (store *sqlStore) List() ([]User, error) {
+	rows, err := db.Get().Query(`SELECT ` + userColumns + ` FROM UserAccount ORDER BY Username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []User
+	for rows.Next() {
+		record, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (store *sqlStore) UpdateRole(id int64, role Role) error {
+	res, err := db.Get().Exec(db.Rebind(`UPDATE UserAccount SET Role = $1 WHERE ID = $2`), role, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (store *sqlStore) Delete(id int64) error {
+	return db.RunInTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(db.Rebind(`DELETE FROM UserSession WHERE UserID = $1`), id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(db.Rebind(`DELETE FROM UserAPIToken WHERE UserID = $1`), id); err != nil {
+			return err
+		}
+		res, err := tx.Exec(db.Rebind(`DELETE FROM UserAccount WHERE ID = $1`), id)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (store *sqlStore) Count() (int, error) {
+	var count int
+	err := db.Get().QueryRow(`SELECT COUNT(*) FROM UserAccount`).Scan(&count)
+	return count, err
+}
+
+func (store *sqlStore) InsertSession(session *Session) error {
+	_, err := db.Get().Exec(db.Rebind(`INSERT INTO UserSession (`+sessionColumns+`) VALUES ($1, $2, $3, $4)`),
+		session.TokenHash,
+		session.UserID,
+		session.CreatedAt,
+		session.ExpiresAt,
+	)
+	return err
+}
+
+func (store *sqlStore) GetSession(tokenHash string) (Session, error) {
+	var session Session
+	err := db.Get().QueryRow(db.Rebind(`SELECT `+sessionColumns+` FROM UserSession WHERE TokenHash = $1`), tokenHash).Scan(
+		&session.TokenHash,
+		&session.UserID,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	session.CreatedAt = session.CreatedAt.UTC()
+	session.ExpiresAt = session.ExpiresAt.UTC()
+	return session, nil
+}
+
+func (store *sqlStore) DeleteSession(tokenHash string) error {
+	_, err := db.Get().Exec(db.Rebind(`DELETE FROM UserSession WHERE TokenHash = $1`), tokenHash)
+	return err
+}
+
+func (store *sqlStore) DeleteExpiredSessions(now time.Time) error {
+	_, err := db.Get().Exec(db.Rebind(`DELETE FROM UserSession WHERE ExpiresAt <= $1`), now.UTC())
+	return err
+}
+
+func (store *sqlStore) InsertAPIToken(token *APIToken) error {
+	return db.Get().QueryRow(db.Rebind(`INSERT INTO UserAPIToken (UserID, Name, TokenHash, Scope, CreatedAt, ExpiresAt) VALUES ($1, $2, $3, $4, $5, $6) RETURNING ID`),
+		token.UserID,
+		token.Name,
+		token.TokenHash,
+		token.Scope,
+		token.CreatedAt,
+		token.ExpiresAt,
+	).Scan(&token.ID)
+}
+
+func (store *sqlStore) GetAPIToken(tokenHash string) (APIToken, error) {
+	token, err := scanAPIToken(db.Get().QueryRow(db.Rebind(`SELECT `+apiTokenColumns+` FROM UserAPIToken WHERE TokenHash = $1`), tokenHash))
+	if err == sql.ErrNoRows {
+		return APIToken{}, ErrAPITokenNotFound
+	}
+	return token, err
+}
+
+func (store *sqlStore) ListAPITokens(userID int64) ([]APIToken, error) {
+	rows, err := db.Get().Query(db.Rebind(`SELECT `+apiTokenColumns+` FROM UserAPIToken WHERE UserID = $1 ORDER BY ID DESC`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (store *sqlStore) UpdateAPITokenLastUsed(id int64, lastUsedAt time.Time) error {
+	_, err := db.Get().Exec(db.Rebind(`UPDATE UserAPIToken SET LastUsedAt = $1 WHERE ID = $2`), lastUsedAt.UTC(), id)
+	return err
+}
+
+func (store *sqlStore) DeleteAPIToken(userID int64, id int64) error {
+	res, err := db.Get().Exec(db.Rebind(`DELETE FROM UserAPIToken WHERE ID = $1 AND UserID = $2`), id, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// scanAPIToken reads an APIToken from a row that selected apiTokenColumns.
+func scanAPIToken(row interface {
+	Scan(dest ...interface{}) error
+}) (APIToken, error) {
+	var token APIToken
+	var lastUsedAt sql.NullTime
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.TokenHash,
+		&token.Scope,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&lastUsedAt,
+	)
+	if err != nil {
+		return APIToken{}, err
+	}
+	token.CreatedAt = token.CreatedAt.UTC()
+	token.ExpiresAt = token.ExpiresAt.UTC()
+	if lastUsedAt.Valid {
+		t := lastUsedAt.Time.UTC()
+		token.LastUsedAt = &t
+	}
+	return token, nil
+}
+
+// getUser runs a query that selects userColumns for a single User. Returns ErrNotFound if
+// there's no such User.
+func getUser(query string, args ...interface{}) (User, error) {
+	record, err := scanUser(db.Get().QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return User{}, ErrNotFound
+	}
+	return record, err
+}
+
+// scanUser reads a User from a row that selected userColumns.
+func scanUser(row interface {
+	Scan(dest ...interface{}) error
+}) (User, error) {
+	var record User
+	err := row.Scan(
+		&record.ID,
+		&record.Username,
+		&record.Role,
+		&record.PasswordHash,
+		&record.CreatedAt,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	record.CreatedAt = record.CreatedAt.UTC()
+	return record, nil
+}
@@ -0,0 +1,171 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/db"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contact-site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db.MustConnect(db.Settings{
+		Dialect: db.DialectSQLite,
+		Path:    filepath.Join(dir, "test.db"),
+	})
+	defer db.MustClose()
+	if err := db.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, NewSQLStore())
+}
+
+// testStore checks the behaviour that every UserStore must share.
+func testStore(t *testing.T, store UserStore) {
+	now := time.Date(2020, 7, 11, 9, 30, 0, 0, time.UTC)
+	record := User{
+		Username:     "ada",
+		Role:         RoleEditor,
+		PasswordHash: "hash",
+		CreatedAt:    now,
+	}
+	if err := store.Insert(&record); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	if record.ID == 0 {
+		t.Fatalf("insert: expected the ID to be set but got %+v", record)
+	}
+	if got, err := store.Get(record.ID); err != nil || got != record {
+		t.Fatalf("get: expected %+v but got %+v (%v)", record, got, err)
+	}
+	if got, err := store.GetByUsername("ada"); err != nil || got != record {
+		t.Fatalf("get by username: expected %+v but got %+v (%v)", record, got, err)
+	}
+	if _, err := store.GetByUsername("grace"); err != ErrNotFound {
+		t.Fatalf("get by username: expected %v but got %v", ErrNotFound, err)
+	}
+	if count, err := store.Count(); err != nil || count != 1 {
+		t.Fatalf("count: expected 1 but got %d (%v)", count, err)
+	}
+
+	// Roles can be changed and users are listed by username
+	if err := store.UpdateRole(record.ID, RoleViewer); err != nil {
+		t.Fatalf("update role: %s", err)
+	}
+	record.Role = RoleViewer
+	if err := store.UpdateRole(record.ID+1, RoleViewer); err != ErrNotFound {
+		t.Fatalf("update role: expected %v but got %v", ErrNotFound, err)
+	}
+	other := User{
+		Username:     "aaron",
+		Role:         RoleAdmin,
+		PasswordHash: "hash",
+		CreatedAt:    now,
+	}
+	if err := store.Insert(&other); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	if records, err := store.List(); err != nil || len(records) != 2 || records[0] != other || records[1] != record {
+		t.Fatalf("list: expected %+v then %+v but got %+v (%v)", other, record, records, err)
+	}
+	if err := store.Delete(other.ID); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+
+	// Sessions
+	session := Session{TokenHash: "current", UserID: record.ID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	expired := Session{TokenHash: "expired", UserID: record.ID, CreatedAt: now.Add(-time.Hour), ExpiresAt: now}
+	for _, s := range []*Session{&session, &expired} {
+		if err := store.InsertSession(s); err != nil {
+			t.Fatalf("insert session: %s", err)
+		}
+	}
+	if got, err := store.GetSession("current"); err != nil || got != session {
+		t.Fatalf("get session: expected %+v but got %+v (%v)", session, got, err)
+	}
+	if err := store.DeleteExpiredSessions(now); err != nil {
+		t.Fatalf("delete expired sessions: %s", err)
+	}
+	if _, err := store.GetSession("expired"); err != ErrSessionNotFound {
+		t.Fatalf("delete expired sessions: expected %v but got %v", ErrSessionNotFound, err)
+	}
+	if _, err := store.GetSession("current"); err != nil {
+		t.Fatalf("delete expired sessions: expected the current session to be kept but got %v", err)
+	}
+	if err := store.DeleteSession("current"); err != nil {
+		t.Fatalf("delete session: %s", err)
+	}
+	if _, err := store.GetSession("current"); err != ErrSessionNotFound {
+		t.Fatalf("delete session: expected %v but got %v", ErrSessionNotFound, err)
+	}
+	if err := store.DeleteSession("current"); err != nil {
+		t.Fatalf("delete session: expected deleting twice to be fine but got %v", err)
+	}
+
+	// API tokens
+	older := APIToken{UserID: record.ID, Name: "Backup", TokenHash: "older", Scope: TokenScopeRead, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	newer := APIToken{UserID: record.ID, Name: "Import", TokenHash: "newer", Scope: TokenScopeWrite, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	for _, token := range []*APIToken{&older, &newer} {
+		if err := store.InsertAPIToken(token); err != nil {
+			t.Fatalf("insert api token: %s", err)
+		}
+	}
+	if older.ID == 0 || newer.ID == older.ID {
+		t.Fatalf("insert api token: expected the IDs to be set but got %d and %d", older.ID, newer.ID)
+	}
+	if got, err := store.GetAPIToken("older"); err != nil || !reflect.DeepEqual(got, older) {
+		t.Fatalf("get api token: expected %+v but got %+v (%v)", older, got, err)
+	}
+	if _, err := store.GetAPIToken("unknown"); err != ErrAPITokenNotFound {
+		t.Fatalf("get api token: expected %v but got %v", ErrAPITokenNotFound, err)
+	}
+	lastUsedAt := now.Add(time.Minute)
+	if err := store.UpdateAPITokenLastUsed(older.ID, lastUsedAt); err != nil {
+		t.Fatalf("update api token last used: %s", err)
+	}
+	older.LastUsedAt = &lastUsedAt
+	if tokens, err := store.ListAPITokens(record.ID); err != nil || !reflect.DeepEqual(tokens, []APIToken{newer, older}) {
+		t.Fatalf("list api tokens: expected %+v then %+v but got %+v (%v)", newer, older, tokens, err)
+	}
+	if err := store.DeleteAPIToken(record.ID+1, newer.ID); err != ErrAPITokenNotFound {
+		t.Fatalf("delete api token: expected %v for another users token but got %v", ErrAPITokenNotFound, err)
+	}
+	if err := store.DeleteAPIToken(record.ID, newer.ID); err != nil {
+		t.Fatalf("delete api token: %s", err)
+	}
+	if _, err := store.GetAPIToken("newer"); err != ErrAPITokenNotFound {
+		t.Fatalf("delete api token: expected %v but got %v", ErrAPITokenNotFound, err)
+	}
+
+	// Deleting a user deletes their sessions and API tokens
+	if err := store.InsertSession(&session); err != nil {
+		t.Fatalf("insert session: %s", err)
+	}
+	if err := store.Delete(record.ID); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, err := store.GetSession("current"); err != ErrSessionNotFound {
+		t.Fatalf("delete: expected the users sessions to be deleted but got %v", err)
+	}
+	if _, err := store.GetAPIToken("older"); err != ErrAPITokenNotFound {
+		t.Fatalf("delete: expected the users api tokens to be deleted but got %v", err)
+	}
+	if _, err := store.Get(record.ID); err != ErrNotFound {
+		t.Fatalf("delete: expected %v but got %v", ErrNotFound, err)
+	}
+	if err := store.Delete(record.ID); err != ErrNotFound {
+		t.Fatalf("delete: expected %v but got %v", ErrNotFound, err)
+	}
+}
@@ -0,0 +1,182 @@
+package user
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/silbinarywolf/contact-site/internal/validate"
+)
+
+// TokenScope limits what an APIToken can do, on top of what its users Role allows.
+type TokenScope string
+
+const (
+	// TokenScopeRead can only read and export contacts
+	TokenScopeRead TokenScope = "read"
+	// TokenScopeWrite can do anything the users role allows with contacts
+	TokenScopeWrite TokenScope = "write"
+)
+
+// TokenScopes lists every TokenScope, from the least to the most allowed.
+var TokenScopes = []TokenScope{TokenScopeRead, TokenScopeWrite}
+
+// tokenScopePermissions is every Permission each TokenScope allows. Neither allows managing
+// users or viewing the audit log, tokens are only for working with contacts.
+var tokenScopePermissions = map[TokenScope][]Permission{
+	TokenScopeRead: {
+		PermissionReadContacts,
+		// Exporting is reading. Importing also needs PermissionCreateContacts, which isn't here.
+		PermissionImportExportContacts,
+	},
+	TokenScopeWrite: {
+		PermissionReadContacts,
+		PermissionCreateContacts,
+		PermissionEditContacts,
+		PermissionDeleteContacts,
+		PermissionImportExportContacts,
+	},
+}
+
+const (
+	// apiTokenPrefix starts every API token so they can be recognised, ie. by secret scanners
+	apiTokenPrefix = "cst_"
+
+	maxAPITokenNameLength = 100
+	// MaxAPITokenLifetime is the longest an APIToken can last before it must be replaced
+	MaxAPITokenLifetime = 365 * 24 * time.Hour
+
+	// apiTokenLastUsedPrecision is how out of date APIToken.LastUsedAt can be. It's only
+	// updated once a minute so that a script making many requests isn't a write every time.
+	apiTokenLastUsedPrecision = time.Minute
+)
+
+var (
+	ErrInvalidAPITokenName     = validate.NewError("api_token.name.invalid", "Invalid Name provided. Must be between 1 and 100 characters.")
+	ErrInvalidAPITokenScope    = validate.NewError("api_token.scope.invalid", "Invalid Scope provided. Must be \"read\" or \"write\".")
+	ErrInvalidAPITokenLifetime = validate.NewError("api_token.expiry.invalid", "Invalid Expiry provided. Must be between 1 day and 1 year.")
+
+	// ErrAPITokenNotFound is returned when an API token doesn't exist, has expired or belongs
+	// to another User.
+	ErrAPITokenNotFound = errors.New("api token not found")
+)
+
+// APIToken lets a script or service act as a User without their password, by sending it as
+// "Authorization: Bearer {token}".
+type APIToken struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"userId"`
+	// Name is given by the User so they can tell their tokens apart, ie. "Nightly backup"
+	Name string `json:"name"`
+	// TokenHash is the SHA-256 of the token, hex encoded. Like a Session, the token itself is
+	// never stored.
+	TokenHash  string     `json:"-"`
+	Scope      TokenScope `json:"scope"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// ParseTokenScope returns the TokenScope with the given name.
+//
+// Returns ErrInvalidAPITokenScope if there's no such TokenScope.
+func ParseTokenScope(name string) (TokenScope, error) {
+	scope := TokenScope(name)
+	if _, ok := tokenScopePermissions[scope]; !ok {
+		return "", ErrInvalidAPITokenScope
+	}
+	return scope, nil
+}
+
+// Allows returns true if the TokenScope allows the given Permission.
+func (scope TokenScope) Allows(permission Permission) bool {
+	for _, scopePermission := range tokenScopePermissions[scope] {
+		if scopePermission == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired returns true if the APIToken can no longer be used.
+func (token APIToken) IsExpired() bool {
+	return !time.Now().Before(token.ExpiresAt)
+}
+
+// CreateAPIToken creates a token for the User that lasts for the given lifetime, returning
+// the token itself. It can't be retrieved again, so must be shown to the User straight away.
+func CreateAPIToken(userID int64, name string, scope TokenScope, lifetime time.Duration) (string, APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxAPITokenNameLength {
+		return "", APIToken{}, ErrInvalidAPITokenName
+	}
+	if _, err := ParseTokenScope(string(scope)); err != nil {
+		return "", APIToken{}, err
+	}
+	if lifetime < 24*time.Hour || lifetime > MaxAPITokenLifetime {
+		return "", APIToken{}, ErrInvalidAPITokenLifetime
+	}
+	secret, err := newToken()
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	token := apiTokenPrefix + secret
+	now := time.Now().UTC()
+	record := APIToken{
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashToken(token),
+		Scope:     scope,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+	}
+	if err := currentStore().InsertAPIToken(&record); err != nil {
+		return "", APIToken{}, err
+	}
+	return token, record, nil
+}
+
+// AuthenticateAPIToken returns the User the token belongs to and the token's details, and
+// records that it was used.
+//
+// Returns ErrAPITokenNotFound if there's no such token or it has expired.
+func AuthenticateAPIToken(token string) (User, APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return User{}, APIToken{}, ErrAPITokenNotFound
+	}
+	record, err := currentStore().GetAPIToken(hashToken(token))
+	if err != nil {
+		return User{}, APIToken{}, err
+	}
+	if record.IsExpired() {
+		return User{}, APIToken{}, ErrAPITokenNotFound
+	}
+	owner, err := currentStore().Get(record.UserID)
+	if err == ErrNotFound {
+		return User{}, APIToken{}, ErrAPITokenNotFound
+	}
+	if err != nil {
+		return User{}, APIToken{}, err
+	}
+	now := time.Now().UTC()
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) >= apiTokenLastUsedPrecision {
+		if err := currentStore().UpdateAPITokenLastUsed(record.ID, now); err != nil {
+			return User{}, APIToken{}, err
+		}
+		record.LastUsedAt = &now
+	}
+	return owner, record, nil
+}
+
+// ListAPITokens returns every token the User has, including expired ones, newest first.
+func ListAPITokens(userID int64) ([]APIToken, error) {
+	return currentStore().ListAPITokens(userID)
+}
+
+// RevokeAPIToken deletes one of the Users tokens, so it can't be used anymore.
+//
+// Returns ErrAPITokenNotFound if the User has no token with the given ID.
+func RevokeAPIToken(userID int64, id int64) error {
+	return currentStore().DeleteAPIToken(userID, id)
+}
@@ -0,0 +1,195 @@
+// Package user manages the accounts that can sign in to the contact site and their sessions.
+package user
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/silbinarywolf/contact-site/internal/validate"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	maxUsernameLength = 64
+	minPasswordLength = 8
+	// maxPasswordLength is the most bytes bcrypt will hash, anything after it is ignored
+	maxPasswordLength = 72
+)
+
+var (
+	ErrInvalidUsername       = validate.NewError("user.username.invalid", "Invalid Username provided. Must be between 1 and 64 letters, numbers, \".\", \"-\" or \"_\".")
+	ErrInvalidPassword       = validate.NewError("user.password.invalid", "Invalid Password provided. Must be between 8 and 72 characters.")
+	ErrUsernameAlreadyExists = validate.NewError("user.username.already_exists", "Invalid Username provided. Another user already has that username.")
+
+	// ErrNotFound is returned when trying to get or delete a User that doesn't exist.
+	ErrNotFound = errors.New("user not found")
+	// ErrInvalidCredentials is returned by Authenticate if either the username or password is
+	// wrong. Which one is deliberately not said, so usernames can't be discovered by guessing.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+// usernameRegex is the characters a username can have. It's kept simple so that usernames
+// can be typed into the "user name" field of any CardDAV client.
+var usernameRegex = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// User is an account that can sign in.
+type User struct {
+	ID int64 `json:"id"`
+	// Username is always lower-case, so signing in ignores case.
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+	// PasswordHash is the bcrypt hash of the users password. It's never sent to clients.
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// dummyPasswordHash is compared against when signing in as a user that doesn't exist, so that
+// it takes as long as signing in with the wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// normalizeUsername lower-cases the username and trims any surrounding whitespace.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Create will validate and then store a new User with the given password and role.
+//
+// Returns ErrUsernameAlreadyExists if another User has the same username, ignoring case.
+func Create(username string, password string, role Role) (User, error) {
+	username = normalizeUsername(username)
+	if len(username) > maxUsernameLength || !usernameRegex.MatchString(username) {
+		return User{}, ErrInvalidUsername
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return User{}, ErrInvalidPassword
+	}
+	if _, err := ParseRole(string(role)); err != nil {
+		return User{}, err
+	}
+	// Two people creating the same user at the same time could both get through this check,
+	// in which case the unique index on the username stops the second one.
+	if _, err := currentStore().GetByUsername(username); err != ErrNotFound {
+		if err == nil {
+			return User{}, ErrUsernameAlreadyExists
+		}
+		return User{}, err
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	record := User{
+		Username:     username,
+		Role:         role,
+		PasswordHash: string(passwordHash),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := currentStore().Insert(&record); err != nil {
+		return User{}, err
+	}
+	return record, nil
+}
+
+// Authenticate returns the User with the given username and password.
+//
+// Returns ErrInvalidCredentials if there's no such User or the password is wrong.
+func Authenticate(username string, password string) (User, error) {
+	record, err := currentStore().GetByUsername(normalizeUsername(username))
+	if err == ErrNotFound {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(record.PasswordHash), []byte(password)); err != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return record, nil
+}
+
+// Get will return the User with the given ID.
+//
+// Returns ErrNotFound if no User exists with the given ID.
+func Get(id int64) (User, error) {
+	return currentStore().Get(id)
+}
+
+// List returns every User, ordered by username.
+func List() ([]User, error) {
+	return currentStore().List()
+}
+
+// SetRole changes the Role of the User with the given ID. It takes effect on their next
+// request, they don't need to sign in again.
+//
+// Returns ErrLastAdmin if it would leave no admins and ErrNotFound if no User exists with
+// the given ID.
+func SetRole(id int64, role Role) error {
+	if _, err := ParseRole(string(role)); err != nil {
+		return err
+	}
+	record, err := currentStore().Get(id)
+	if err != nil {
+		return err
+	}
+	if record.Role == role {
+		return nil
+	}
+	if record.Role == RoleAdmin {
+		if err := checkIsNotLastAdmin(); err != nil {
+			return err
+		}
+	}
+	return currentStore().UpdateRole(id, role)
+}
+
+// Delete will remove the User and sign them out everywhere.
+//
+// Returns ErrNotFound if no User exists with the given ID.
+func Delete(id int64) error {
+	return currentStore().Delete(id)
+}
+
+// checkIsNotLastAdmin returns ErrLastAdmin if there's only one admin left.
+//
+// Like the username check in Create, two admins demoting each other at the same time could
+// both get through this. As admins are few and rarely changed that's not worth a lock for.
+func checkIsNotLastAdmin() error {
+	records, err := currentStore().List()
+	if err != nil {
+		return err
+	}
+	admins := 0
+	for _, record := range records {
+		if record.Role == RoleAdmin {
+			admins++
+		}
+	}
+	if admins <= 1 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// MustInsertMockData will add an admin named "admin" with the password "password" if there
+// are no users yet, so that the site can be signed in to straight away.
+//
+// This is only used by the "memory" database driver, which is for local development and
+// has no other way to add a user. This function will panic if an error occurs.
+func MustInsertMockData() {
+	count, err := currentStore().Count()
+	if err != nil {
+		panic(err)
+	}
+	if count > 0 {
+		return
+	}
+	if _, err := Create("admin", "password", RoleAdmin); err != nil {
+		panic(err)
+	}
+	log.Printf("Created user \"admin\" with the password \"password\".")
+}
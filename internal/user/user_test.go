@@ -0,0 +1,221 @@
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateAndAuthenticate(t *testing.T) {
+	SetStore(NewMemoryStore())
+	defer SetStore(nil)
+
+	record, err := Create(" Ada.Lovelace ", "correct horse", RoleAdmin)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if record.ID == 0 || record.Username != "ada.lovelace" || record.PasswordHash == "correct horse" {
+		t.Fatalf("create: expected a lower-case username and hashed password but got %+v", record)
+	}
+	type TestData struct {
+		Username string
+		Password string
+		Role     Role
+		Err      error
+	}
+	for _, testData := range []TestData{
+		{Username: "ADA.LOVELACE", Password: "correct horse", Role: RoleViewer, Err: ErrUsernameAlreadyExists},
+		{Username: "", Password: "correct horse", Role: RoleViewer, Err: ErrInvalidUsername},
+		{Username: "ada lovelace", Password: "correct horse", Role: RoleViewer, Err: ErrInvalidUsername},
+		{Username: "grace", Password: "short", Role: RoleViewer, Err: ErrInvalidPassword},
+		{Username: "grace", Password: "correct horse", Role: "owner", Err: ErrInvalidRole},
+	} {
+		if _, err := Create(testData.Username, testData.Password, testData.Role); err != testData.Err {
+			t.Errorf("create %q: expected %v but got %v", testData.Username, testData.Err, err)
+		}
+	}
+
+	if got, err := Authenticate("Ada.Lovelace", "correct horse"); err != nil || got.ID != record.ID {
+		t.Errorf("authenticate: expected user %d but got %+v (%v)", record.ID, got, err)
+	}
+	if _, err := Authenticate("ada.lovelace", "wrong horse"); err != ErrInvalidCredentials {
+		t.Errorf("authenticate: expected %v for the wrong password but got %v", ErrInvalidCredentials, err)
+	}
+	if _, err := Authenticate("grace", "correct horse"); err != ErrInvalidCredentials {
+		t.Errorf("authenticate: expected %v for an unknown user but got %v", ErrInvalidCredentials, err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	SetStore(NewMemoryStore())
+	defer SetStore(nil)
+
+	record, err := Create("ada", "correct horse", RoleViewer)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	token, session, err := CreateSession(record.ID)
+	if err != nil {
+		t.Fatalf("create session: %s", err)
+	}
+	if token == "" || session.TokenHash == token || !session.ExpiresAt.After(time.Now()) {
+		t.Fatalf("create session: expected a token that's stored hashed but got %q and %+v", token, session)
+	}
+	if got, err := GetSession(token); err != nil || got.ID != record.ID {
+		t.Fatalf("get session: expected user %d but got %+v (%v)", record.ID, got, err)
+	}
+	if _, err := GetSession(session.TokenHash); err != ErrSessionNotFound {
+		t.Errorf("get session: expected the hash to not work as a token but got %v", err)
+	}
+
+	// Expired sessions can't be used
+	expired := Session{
+		TokenHash: hashToken("expired"),
+		UserID:    record.ID,
+		CreatedAt: time.Now().Add(-SessionLifetime),
+		ExpiresAt: time.Now().Add(-time.Second),
+	}
+	if err := currentStore().InsertSession(&expired); err != nil {
+		t.Fatalf("insert session: %s", err)
+	}
+	if _, err := GetSession("expired"); err != ErrSessionNotFound {
+		t.Errorf("get session: expected %v for an expired session but got %v", ErrSessionNotFound, err)
+	}
+
+	if err := DeleteSession(token); err != nil {
+		t.Fatalf("delete session: %s", err)
+	}
+	if _, err := GetSession(token); err != ErrSessionNotFound {
+		t.Errorf("delete session: expected %v but got %v", ErrSessionNotFound, err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	SetStore(NewMemoryStore())
+	defer SetStore(nil)
+
+	type TestData struct {
+		Role       Role
+		Permission Permission
+		Can        bool
+	}
+	for _, testData := range []TestData{
+		{Role: RoleViewer, Permission: PermissionReadContacts, Can: true},
+		{Role: RoleViewer, Permission: PermissionCreateContacts, Can: false},
+		{Role: RoleViewer, Permission: PermissionImportExportContacts, Can: false},
+		{Role: RoleEditor, Permission: PermissionDeleteContacts, Can: true},
+		{Role: RoleEditor, Permission: PermissionManageUsers, Can: false},
+		{Role: RoleAdmin, Permission: PermissionManageUsers, Can: true},
+		{Role: RoleEditor, Permission: PermissionViewAuditLog, Can: false},
+		{Role: RoleAdmin, Permission: PermissionViewAuditLog, Can: true},
+		{Role: "owner", Permission: PermissionReadContacts, Can: false},
+	} {
+		if can := testData.Role.Can(testData.Permission); can != testData.Can {
+			t.Errorf("%s can %s: expected %v but got %v", testData.Role, testData.Permission, testData.Can, can)
+		}
+	}
+
+	admin, err := Create("ada", "correct horse", RoleAdmin)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	editor, err := Create("grace", "correct horse", RoleEditor)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if err := SetRole(admin.ID, RoleViewer); err != ErrLastAdmin {
+		t.Fatalf("set role: expected %v when demoting the only admin but got %v", ErrLastAdmin, err)
+	}
+	if err := SetRole(editor.ID, "owner"); err != ErrInvalidRole {
+		t.Fatalf("set role: expected %v but got %v", ErrInvalidRole, err)
+	}
+	if err := SetRole(editor.ID, RoleAdmin); err != nil {
+		t.Fatalf("set role: %s", err)
+	}
+	if err := SetRole(admin.ID, RoleViewer); err != nil {
+		t.Fatalf("set role: expected demoting an admin to work once there's another but got %v", err)
+	}
+	if got, err := Get(admin.ID); err != nil || got.Role != RoleViewer {
+		t.Fatalf("set role: expected %s but got %+v (%v)", RoleViewer, got, err)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	SetStore(NewMemoryStore())
+	defer SetStore(nil)
+
+	record, err := Create("ada", "correct horse", RoleEditor)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	type TestData struct {
+		Name     string
+		Scope    TokenScope
+		Lifetime time.Duration
+		Err      error
+	}
+	for _, testData := range []TestData{
+		{Name: " ", Scope: TokenScopeRead, Lifetime: 24 * time.Hour, Err: ErrInvalidAPITokenName},
+		{Name: "Backup", Scope: "admin", Lifetime: 24 * time.Hour, Err: ErrInvalidAPITokenScope},
+		{Name: "Backup", Scope: TokenScopeRead, Lifetime: time.Hour, Err: ErrInvalidAPITokenLifetime},
+		{Name: "Backup", Scope: TokenScopeRead, Lifetime: MaxAPITokenLifetime + time.Hour, Err: ErrInvalidAPITokenLifetime},
+	} {
+		if _, _, err := CreateAPIToken(record.ID, testData.Name, testData.Scope, testData.Lifetime); err != testData.Err {
+			t.Errorf("create api token %q: expected %v but got %v", testData.Name, testData.Err, err)
+		}
+	}
+
+	token, created, err := CreateAPIToken(record.ID, " Backup ", TokenScopeRead, 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("create api token: %s", err)
+	}
+	if !strings.HasPrefix(token, apiTokenPrefix) || created.TokenHash == token || created.Name != "Backup" || created.LastUsedAt != nil {
+		t.Fatalf("create api token: expected a prefixed token that's stored hashed but got %q and %+v", token, created)
+	}
+	owner, used, err := AuthenticateAPIToken(token)
+	if err != nil || owner.ID != record.ID || used.ID != created.ID || used.LastUsedAt == nil {
+		t.Fatalf("authenticate api token: expected user %d with the last use recorded but got %+v and %+v (%v)", record.ID, owner, used, err)
+	}
+	if tokens, err := ListAPITokens(record.ID); err != nil || len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+		t.Fatalf("list api tokens: expected the token to have been used but got %+v (%v)", tokens, err)
+	}
+	for _, badToken := range []string{"", created.TokenHash, apiTokenPrefix + "unknown", token[len(apiTokenPrefix):]} {
+		if _, _, err := AuthenticateAPIToken(badToken); err != ErrAPITokenNotFound {
+			t.Errorf("authenticate api token %q: expected %v but got %v", badToken, ErrAPITokenNotFound, err)
+		}
+	}
+
+	// Read tokens can't change anything, even for an editor
+	if !TokenScopeRead.Allows(PermissionReadContacts) || TokenScopeRead.Allows(PermissionCreateContacts) {
+		t.Errorf("expected read tokens to only read")
+	}
+	if !TokenScopeWrite.Allows(PermissionDeleteContacts) || TokenScopeWrite.Allows(PermissionManageUsers) {
+		t.Errorf("expected write tokens to change contacts but not manage users")
+	}
+
+	// Expired tokens can't be used
+	expired := APIToken{
+		UserID:    record.ID,
+		Name:      "Expired",
+		TokenHash: hashToken(apiTokenPrefix + "expired"),
+		Scope:     TokenScopeWrite,
+		CreatedAt: time.Now().Add(-48 * time.Hour),
+		ExpiresAt: time.Now().Add(-time.Second),
+	}
+	if err := currentStore().InsertAPIToken(&expired); err != nil {
+		t.Fatalf("insert api token: %s", err)
+	}
+	if _, _, err := AuthenticateAPIToken(apiTokenPrefix + "expired"); err != ErrAPITokenNotFound {
+		t.Errorf("authenticate api token: expected %v for an expired token but got %v", ErrAPITokenNotFound, err)
+	}
+
+	if err := RevokeAPIToken(record.ID+1, created.ID); err != ErrAPITokenNotFound {
+		t.Fatalf("revoke api token: expected %v for another users token but got %v", ErrAPITokenNotFound, err)
+	}
+	if err := RevokeAPIToken(record.ID, created.ID); err != nil {
+		t.Fatalf("revoke api token: %s", err)
+	}
+	if _, _, err := AuthenticateAPIToken(token); err != ErrAPITokenNotFound {
+		t.Errorf("revoke api token: expected %v but got %v", ErrAPITokenNotFound, err)
+	}
+}
@@ -2,12 +2,35 @@ package validate
 
 import (
 	"regexp"
+	"strings"
 )
 
 // ValidationError is a distinct error type that we use when we want to expose
 // error information to the frontend / end-user.
+//
+// It's either a single problem, made with NewError, or every problem found with something, made
+// with Errors.
 type ValidationError struct {
 	message string
+	code    string
+	// problems is set for errors made by Errors, with the field each problem is about
+	problems []problem
+}
+
+type problem struct {
+	field string
+	err   *ValidationError
+}
+
+// FieldError is a single problem, with the field it's about so that it can be shown next to it.
+type FieldError struct {
+	// Field is the path to the field, ie. "phoneNumbers[1].number", or blank if the problem
+	// isn't about a particular field.
+	Field string `json:"field,omitempty"`
+	// Code is a name for the problem that doesn't change, ie. "contact.phone.too_short", so
+	// that clients can tell problems apart without matching the message. See NewError.
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 // assert at compile-time that this type satisfies the error interface
@@ -17,9 +40,102 @@ func (err *ValidationError) Error() string {
 	return err.message
 }
 
-func NewError(message string) *ValidationError {
+// Code is a short name for the problem that doesn't change, see FieldError. If there's more
+// than one problem, it's the Code of the first.
+func (err *ValidationError) Code() string {
+	return err.code
+}
+
+// Fields returns each problem with the field it's about. An error made with NewError is
+// returned as a single problem without a field.
+func (err *ValidationError) Fields() []FieldError {
+	if err.problems == nil {
+		return []FieldError{{Code: err.code, Message: err.message}}
+	}
+	fields := make([]FieldError, len(err.problems))
+	for i, problem := range err.problems {
+		fields[i] = FieldError{
+			Field:   problem.field,
+			Code:    problem.err.code,
+			Message: problem.err.message,
+		}
+	}
+	return fields
+}
+
+// Is reports whether target is one of the problems in err, so that errors.Is can find an
+// error made with NewError in an error made with Errors.
+func (err *ValidationError) Is(target error) bool {
+	for _, problem := range err.problems {
+		if problem.err == target {
+			return true
+		}
+	}
+	return false
+}
+
+// NewError makes an error with a message for the end-user and a code for clients.
+//
+// The code is sent to clients along with the message, so once released it must never change.
+// It's the package or area the error is from, what it's about and what's wrong, separated by
+// ".", ie. "contact.email.invalid", and it must be listed in "docs/en/API.md#error-codes".
+func NewError(code string, message string) *ValidationError {
 	return &ValidationError{
 		message: message,
+		code:    code,
+	}
+}
+
+// Errors collects every problem found when validating something, so that they can all be
+// reported at once rather than only the first.
+type Errors struct {
+	problems []problem
+}
+
+// Add records a problem with the given field. If err is from Errors itself, each of its
+// problems is added, with their fields put under the given field, ie. "phoneNumbers[1]" and
+// "number" becomes "phoneNumbers[1].number".
+func (errs *Errors) Add(field string, err *ValidationError) {
+	if err.problems == nil {
+		errs.problems = append(errs.problems, problem{field: field, err: err})
+		return
+	}
+	for _, child := range err.problems {
+		childField := child.field
+		switch {
+		case field == "":
+		case childField == "":
+			childField = field
+		default:
+			childField = field + "." + childField
+		}
+		errs.problems = append(errs.problems, problem{field: childField, err: child.err})
+	}
+}
+
+// Len returns how many problems have been found.
+func (errs *Errors) Len() int {
+	return len(errs.problems)
+}
+
+// Err returns every problem found as a single *ValidationError, or nil if there weren't any.
+// Its message is each of their messages, in the order they were added.
+func (errs *Errors) Err() error {
+	if len(errs.problems) == 0 {
+		return nil
+	}
+	messages := make([]string, len(errs.problems))
+	for i, problem := range errs.problems {
+		messages[i] = strings.TrimSuffix(problem.err.message, ".")
+	}
+	message := errs.problems[0].err.message
+	if len(messages) > 1 {
+		message = strings.Join(messages, "; ") + "."
+	}
+	return &ValidationError{
+		message:  message,
+		code:     errs.problems[0].err.code,
+		problems: append([]problem(nil), errs.problems...),
 	}
 }
 
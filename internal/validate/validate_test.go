@@ -1,6 +1,9 @@
 package validate
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestIsValidEmail(t *testing.T) {
 	type TestData struct {
@@ -21,3 +24,51 @@ func TestIsValidEmail(t *testing.T) {
 		}
 	}
 }
+
+func TestErrors(t *testing.T) {
+	errTooShort := NewError("test.number.too_short", "Too short.")
+	errInvalidLabel := NewError("test.label.invalid", "Invalid label")
+	errMissing := NewError("test.name.missing", "Missing name")
+
+	var errs Errors
+	if errs.Err() != nil {
+		t.Fatalf("expected no error when there aren't any problems")
+	}
+	var child Errors
+	child.Add("number", errTooShort)
+	child.Add("", errInvalidLabel)
+	errs.Add("name", errMissing)
+	errs.Add("phoneNumbers[1]", child.Err().(*ValidationError))
+	err, ok := errs.Err().(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError but got %T", errs.Err())
+	}
+	if errs.Len() != 3 || err.Code() != "test.name.missing" {
+		t.Errorf("expected 3 problems with the code of the first but got %d with %q", errs.Len(), err.Code())
+	}
+	if got, want := err.Error(), "Missing name; Too short; Invalid label."; got != want {
+		t.Errorf("expected message %q but got %q", want, got)
+	}
+	want := []FieldError{
+		{Field: "name", Code: "test.name.missing", Message: "Missing name"},
+		{Field: "phoneNumbers[1].number", Code: "test.number.too_short", Message: "Too short."},
+		{Field: "phoneNumbers[1]", Code: "test.label.invalid", Message: "Invalid label"},
+	}
+	got := err.Fields()
+	if len(got) != len(want) {
+		t.Fatalf("expected fields %+v but got %+v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected field %d to be %+v but got %+v", i, want[i], got[i])
+		}
+	}
+	if !errors.Is(err, errTooShort) || !errors.Is(err, errMissing) || errors.Is(err, NewError("test.name.missing", "Missing name")) {
+		t.Errorf("expected errors.Is to find exactly the errors that were added")
+	}
+
+	// A single problem without a field
+	if got := errMissing.Fields(); len(got) != 1 || got[0] != (FieldError{Code: "test.name.missing", Message: "Missing name"}) {
+		t.Errorf("expected a single problem without a field but got %+v", got)
+	}
+}
@@ -1,23 +1,45 @@
 package test
 
 import (
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/silbinarywolf/contact-site/internal/app"
 	"github.com/silbinarywolf/contact-site/internal/config"
+	"github.com/silbinarywolf/contact-site/internal/user"
 )
 
 var (
 	HostName string
+	// TestUsername is the user the tests are signed in as
+	TestUsername string
+	TestUserID   int64
 )
 
+const testUserPassword = "correct horse battery staple"
+
+// testMinSubmitTime is how long the add contact form must be open before it's submitted,
+// it's short so that the tests don't take too long
+const testMinSubmitTime = 200 * time.Millisecond
+
 // TestMain will execute before all tests and allows us to do setup/teardown
 func TestMain(m *testing.M) {
 	// If we cannot find the config file in the current directory,
@@ -32,9 +54,24 @@ func TestMain(m *testing.M) {
 		if err := os.Chdir(filepath.Join(dir, "..")); err != nil {
 			panic(fmt.Sprintf("failed to change dir: %s", err))
 		}
-		// Fallthrough, if the config file still doesn't exist
-		// MustInitialize will fail with the appropriate error message.
 	}
+	var newConfig config.Config
+	if config.Exists() {
+		config.MustLoad()
+		newConfig = config.Get()
+	} else {
+		// If there's still no config file, run against an in-memory store so that the
+		// tests can be run without setting up a database server.
+		newConfig.Web.Port = 8080
+		newConfig.Database.Driver = config.DatabaseDriverMemory
+	}
+	// Every form submission pretends to be from a different address with X-Forwarded-For, so
+	// that the tests don't hit the per IP limit unless they're testing it. See postForm.
+	newConfig.Web.TrustForwardedFor = true
+	newConfig.Spam.PerIP = config.RateLimit{Burst: 3, PerMinute: 1}
+	newConfig.Spam.Global = config.RateLimit{Burst: -1}
+	newConfig.Spam.MinSubmitSeconds = testMinSubmitTime.Seconds()
+	config.Set(newConfig)
 
 	// Initialize the app
 	app.MustInitialize()
@@ -46,8 +83,132 @@ func TestMain(m *testing.M) {
 	// Start application without blocking (so we can run tests)
 	go app.MustStart()
 
+	// Wait for the server to start listening. This used to not be necessary as connecting to
+	// Postgres gave the server plenty of time to start, but the in-memory store is ready instantly.
+	mustWaitForServer()
+
+	// Everything but the login page requires a signed in user, so create one just for these
+	// tests and sign in with it. The cookie jar sends the session cookie with every request
+	// made with http.DefaultClient, which http.Get uses.
+	testUser, err := user.Create("test-"+strconv.FormatInt(time.Now().UnixNano(), 36), testUserPassword, user.RoleAdmin)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create test user: %s", err))
+	}
+	TestUsername = testUser.Username
+	TestUserID = testUser.ID
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	http.DefaultClient.Jar = jar
+	mustSignIn(http.DefaultClient, TestUsername, testUserPassword)
+
 	// Runs all the Test*** functions
-	os.Exit(m.Run())
+	code := m.Run()
+
+	if err := user.Delete(testUser.ID); err != nil {
+		panic(fmt.Sprintf("failed to delete test user: %s", err))
+	}
+	os.Exit(code)
+}
+
+// mustGetCSRFToken loads the login page to get a CSRF token for submitting forms. The cookie
+// it belongs to is returned as well if it was just set, for clients without a cookie jar.
+func mustGetCSRFToken(client *http.Client) (string, *http.Cookie) {
+	fields, cookie := mustGetHiddenFields(client, "/login")
+	return fields.Get("CSRFToken"), cookie
+}
+
+// mustGetHiddenFields loads the page at path and returns the hidden fields in its forms, ie.
+// the CSRF token. The CSRF cookie is returned as well if it was just set, for clients without
+// a cookie jar.
+func mustGetHiddenFields(client *http.Client, path string) (url.Values, *http.Cookie) {
+	resp, err := client.Get(HostName + path)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	fields := make(url.Values)
+	for _, match := range regexp.MustCompile(`<input type="hidden" name="([^"]+)" value="([^"]*)"`).FindAllSubmatch(body, -1) {
+		fields.Set(string(match[1]), html.UnescapeString(string(match[2])))
+	}
+	if fields.Get("CSRFToken") == "" {
+		panic(fmt.Sprintf("no CSRF token on %s:\n%s", path, body))
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "csrf" {
+			cookie = c
+		}
+	}
+	return fields, cookie
+}
+
+// lastForwardedFor is used by postForm to make each form submission look like it's from a
+// different address
+var lastForwardedFor uint32
+
+// postForm is the same as client.PostForm, but with the hidden fields a browser would send,
+// like the CSRF token.
+//
+// Adding contacts waits for testMinSubmitTime first, and every submission comes from a
+// different address so that the tests don't hit the per IP rate limit.
+func postForm(client *http.Client, rawURL string, data url.Values) (*http.Response, error) {
+	page := "/login"
+	if strings.HasSuffix(rawURL, "/postContact") {
+		page = "/"
+	}
+	form, cookie := mustGetHiddenFields(client, page)
+	for key, values := range data {
+		form[key] = values
+	}
+	if page == "/" {
+		time.Sleep(testMinSubmitTime)
+	}
+	req, err := http.NewRequest(http.MethodPost, rawURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	address := atomic.AddUint32(&lastForwardedFor, 1)
+	req.Header.Set("X-Forwarded-For", fmt.Sprintf("10.%d.%d.%d", byte(address>>16), byte(address>>8), byte(address)))
+	if client.Jar == nil && cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return client.Do(req)
+}
+
+// mustSignIn submits the login page with the given client, so that its cookie jar holds the
+// session cookie.
+func mustSignIn(client *http.Client, username, password string) {
+	resp, err := postForm(client, HostName+"/login", url.Values{
+		"Username": {username},
+		"Password": {password},
+	})
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		panic(fmt.Sprintf("failed to sign in as %q, got status %d for %s", username, resp.StatusCode, resp.Request.URL))
+	}
+}
+
+func mustWaitForServer() {
+	const maxAttempts = 50
+	for i := 0; i < maxAttempts; i++ {
+		conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(config.Get().Web.Port))
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	panic("server did not start listening in time")
 }
 
 func TestGetHomePage(t *testing.T) {
@@ -68,12 +229,15 @@ func TestPostFormSuccess(t *testing.T) {
 	// robust way to test whether the server is running correctly or not.
 	// Slow? Probably. But if it turns out to not be a good idea, we can always change it
 	// later.
-	resp, err := http.PostForm(
+	resp, err := postForm(
+		http.DefaultClient,
 		HostName+"/postContact",
 		url.Values{
 			"FullName":     {"Test"},
-			"Email":        {"test@test.com"},
-			"PhoneNumbers": {"043"},
+			"EmailAddress": {"test@test.com"},
+			"PhoneNumber":  {"0491 570 156"},
+			// The tests may be run more than once against the same database
+			"AllowDuplicates": {"true"},
 		},
 	)
 	if err != nil {
@@ -98,12 +262,13 @@ func TestPostFormSuccess(t *testing.T) {
 }
 
 func TestPostFormFailure(t *testing.T) {
-	resp, err := http.PostForm(
+	resp, err := postForm(
+		http.DefaultClient,
 		HostName+"/postContact",
 		url.Values{
 			"FullName":     {"Test"},
-			"Email":        {"BAD_EMAIL_TO_FAIL_VALIDATION"},
-			"PhoneNumbers": {"043"},
+			"EmailAddress": {"BAD_EMAIL_TO_FAIL_VALIDATION"},
+			"PhoneNumber":  {"043"},
 		},
 	)
 	if err != nil {
@@ -121,11 +286,2539 @@ func TestPostFormFailure(t *testing.T) {
 	case http.StatusOK:
 		t.Errorf("unexpected response: %s", dat)
 	case http.StatusBadRequest:
-		// expected result, success!
-		// If we add more failure cases, we might want to have an error code
-		// attached to the header or something so we can detect the type of
-		// error without needing to do string matches.
+		// expected result, check it failed for the reason we expect
+		if code := resp.Header.Get("X-Error-Code"); code != "contact.email.invalid" {
+			t.Errorf("expected error code %q but got %q", "contact.email.invalid", code)
+		}
 	default:
 		t.Fatalf("unhandled error: %s", err)
 	}
 }
+
+// apiContact mirrors the JSON structure returned by the "/api/v1/contacts" endpoints.
+type apiContact struct {
+	ID       int64  `json:"id"`
+	UID      string `json:"uid"`
+	Version  int64  `json:"version"`
+	FullName string `json:"fullName"`
+	Emails   []struct {
+		ID        int64  `json:"id"`
+		Address   string `json:"address"`
+		Label     string `json:"label"`
+		IsPrimary bool   `json:"isPrimary"`
+	} `json:"emails"`
+	PhoneNumbers []struct {
+		ID          int64  `json:"id"`
+		Number      string `json:"number"`
+		CountryCode string `json:"countryCode"`
+		Extension   string `json:"extension"`
+		Label       string `json:"label"`
+		IsPrimary   bool   `json:"isPrimary"`
+		LineType    string `json:"lineType"`
+	} `json:"phoneNumbers"`
+}
+
+// apiCreateContactPath is used to create contacts in tests that aren't testing duplicate
+// detection. Many of them reuse the phone numbers in the mock data and the tests may be run
+// more than once against the same database.
+const apiCreateContactPath = "/api/v1/contacts?allowDuplicates=true"
+
+// doJSONRequest will send the body as JSON to the given path and decode
+// the JSON response into out, if out is not nil.
+func doJSONRequest(t *testing.T, method, path string, body string, out interface{}) *http.Response {
+	t.Helper()
+	return doJSONRequestIfMatch(t, method, path, "", body, out)
+}
+
+// doJSONRequestIfMatch is doJSONRequest with an If-Match header, which changing or deleting a
+// contact needs. It's the ETag from getting the contact, or "*" to change it regardless.
+func doJSONRequestIfMatch(t *testing.T, method, path string, ifMatch string, body string, out interface{}) *http.Response {
+	t.Helper()
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, HostName+path, bodyReader)
+	if err != nil {
+		t.Fatalf("new request error: %s", err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s error: path \"%s\": %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	dat, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("readAll error: %s", err)
+	}
+	if out != nil && len(dat) > 0 {
+		if err := json.Unmarshal(dat, out); err != nil {
+			t.Fatalf("unable to decode JSON response: %s\n%s", err, dat)
+		}
+	}
+	return resp
+}
+
+func TestAPIContactLifecycle(t *testing.T) {
+	// Create
+	var created apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "API Test",
+		"emails": [{"address": "api@test.com"}],
+		"phoneNumbers": [{"number": "03 8578 6688"}]
+	}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if created.ID == 0 {
+		t.Fatalf("expected created contact to have an ID")
+	}
+	if len(created.PhoneNumbers) != 1 ||
+		created.PhoneNumbers[0].Number != "+61385786688" {
+		t.Errorf("expected phone number to be normalized to E.164 but got %+v", created.PhoneNumbers)
+	}
+	path := "/api/v1/contacts/" + strconv.FormatInt(created.ID, 10)
+
+	// Get
+	var got apiContact
+	resp = doJSONRequest(t, http.MethodGet, path, "", &got)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if got.FullName != "API Test" {
+		t.Errorf("expected FullName \"API Test\" but got \"%s\"", got.FullName)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag != `"`+strconv.FormatInt(created.ID, 10)+`-1"` {
+		t.Errorf("expected an ETag with the ID and version 1 but got %q", etag)
+	}
+
+	// Changes need the ETag, so they can't overwrite changes that haven't been seen
+	resp = doJSONRequest(t, http.MethodPatch, path, `{"fullName": "No ETag"}`, nil)
+	if resp.StatusCode != http.StatusPreconditionRequired {
+		t.Fatalf("expected status %d without If-Match but got %d", http.StatusPreconditionRequired, resp.StatusCode)
+	}
+
+	// Patch, only the emails should change
+	var patched apiContact
+	resp = doJSONRequestIfMatch(t, http.MethodPatch, path, etag, `{"emails": [{"address": "patched@test.com"}]}`, &patched)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	staleETag := etag
+	etag = resp.Header.Get("ETag")
+	if etag == staleETag || etag == "" {
+		t.Errorf("expected a new ETag after patching but got %q", etag)
+	}
+	if patched.FullName != "API Test" ||
+		len(patched.Emails) != 1 ||
+		patched.Emails[0].Address != "patched@test.com" ||
+		len(patched.PhoneNumbers) != 1 {
+		t.Errorf("unexpected patch result: %+v", patched)
+	}
+
+	// A change from before the patch is refused
+	var stale struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	resp = doJSONRequestIfMatch(t, http.MethodPut, path, staleETag, `{"fullName": "Stale", "phoneNumbers": [{"number": "0488445688"}]}`, &stale)
+	if resp.StatusCode != http.StatusPreconditionFailed || !strings.Contains(stale.Error.Message, "changed by someone else") {
+		t.Fatalf("expected status %d with a message for a stale ETag but got %d: %+v", http.StatusPreconditionFailed, resp.StatusCode, stale)
+	}
+	if resp := doJSONRequestIfMatch(t, http.MethodDelete, path, staleETag, "", nil); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d deleting with a stale ETag but got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+
+	// Put, replaces everything
+	var put apiContact
+	resp = doJSONRequestIfMatch(t, http.MethodPut, path, etag, `{
+		"fullName": "API Test Replaced",
+		"phoneNumbers": [{"number": "0488445688"}, {"number": "1800728069"}]
+	}`, &put)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if len(put.Emails) != 0 ||
+		len(put.PhoneNumbers) != 2 {
+		t.Errorf("unexpected put result: %+v", put)
+	}
+
+	// Delete
+	resp = doJSONRequestIfMatch(t, http.MethodDelete, path, resp.Header.Get("ETag"), "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	resp = doJSONRequest(t, http.MethodGet, path, "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d after delete but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestAPIContactEmails(t *testing.T) {
+	var created apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Email Test",
+		"emails": [
+			{"address": "  home@email.test ", "label": "Home"},
+			{"address": "work@email.test", "label": "work", "isPrimary": true}
+		],
+		"phoneNumbers": [{"number": "03 8578 6688"}]
+	}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if len(created.Emails) != 2 ||
+		created.Emails[0].ID == 0 ||
+		created.Emails[0].Address != "home@email.test" ||
+		created.Emails[0].Label != "home" ||
+		created.Emails[0].IsPrimary ||
+		created.Emails[1].Label != "work" ||
+		!created.Emails[1].IsPrimary {
+		t.Errorf("unexpected emails: %+v", created.Emails)
+	}
+	path := "/api/v1/contacts/" + strconv.FormatInt(created.ID, 10)
+
+	// Keep the first email, by ID, and replace the second
+	var patched apiContact
+	resp = doJSONRequestIfMatch(t, http.MethodPatch, path, "*", `{
+		"emails": [
+			{"id": `+strconv.FormatInt(created.Emails[0].ID, 10)+`, "address": "home@email.test", "isPrimary": true},
+			{"address": "other@email.test"}
+		]
+	}`, &patched)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if len(patched.Emails) != 2 ||
+		patched.Emails[0].ID != created.Emails[0].ID ||
+		!patched.Emails[0].IsPrimary ||
+		patched.Emails[1].Address != "other@email.test" {
+		t.Errorf("unexpected emails after patch: %+v", patched.Emails)
+	}
+
+	type FailureTestData struct {
+		Body       string
+		StatusCode int
+	}
+	failureTestDataList := []FailureTestData{
+		{Body: `{"emails": [{"address": "a@email.test", "isPrimary": true}, {"address": "b@email.test", "isPrimary": true}]}`, StatusCode: http.StatusBadRequest},
+		{Body: `{"emails": [{"address": "BAD_EMAIL_TO_FAIL_VALIDATION"}]}`, StatusCode: http.StatusBadRequest},
+		{Body: `{"emails": [{"id": 999999999, "address": "a@email.test"}]}`, StatusCode: http.StatusNotFound},
+	}
+	for _, testData := range failureTestDataList {
+		resp := doJSONRequestIfMatch(t, http.MethodPatch, path, "*", testData.Body, nil)
+		if resp.StatusCode != testData.StatusCode {
+			t.Errorf("%s: expected status %d but got %d", testData.Body, testData.StatusCode, resp.StatusCode)
+		}
+	}
+}
+
+func TestPostFormMultipleEmails(t *testing.T) {
+	resp, err := postForm(
+		http.DefaultClient,
+		HostName+"/postContact",
+		url.Values{
+			"FullName":        {"Multiple Emails Test"},
+			"EmailAddress":    {"first@multiple.test", "", "second@multiple.test"},
+			"PrimaryEmail":    {"0"},
+			"PhoneNumber":     {"0491 570 156"},
+			"AllowDuplicates": {"true"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("post error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	var body struct {
+		Contacts []apiContact `json:"contacts"`
+	}
+	// The most recently added, as the tests may be run more than once against the same database
+	doJSONRequest(t, http.MethodGet, "/api/v1/contacts?limit=1&sort=-id&email="+url.QueryEscape("@multiple.test"), "", &body)
+	if len(body.Contacts) != 1 {
+		t.Fatalf("expected 1 contact but got %+v", body.Contacts)
+	}
+	emails := body.Contacts[0].Emails
+	if len(emails) != 2 ||
+		emails[0].Address != "first@multiple.test" || !emails[0].IsPrimary ||
+		emails[1].Address != "second@multiple.test" || emails[1].IsPrimary {
+		t.Errorf("expected the first email to be primary but got %+v", emails)
+	}
+}
+
+func TestAPIUpdateStoredPhoneNumber(t *testing.T) {
+	// The mock data has a number from before we checked that numbers can exist, which
+	// shouldn't stop the contact from being changed
+	var body struct {
+		Contacts []apiContact `json:"contacts"`
+	}
+	doJSONRequest(t, http.MethodGet, "/api/v1/contacts?limit=1&phoneNumber="+url.QueryEscape("+6139888998"), "", &body)
+	if len(body.Contacts) != 1 {
+		t.Fatalf("expected the mock contact but got %+v", body.Contacts)
+	}
+	record := body.Contacts[0]
+	fullName, err := json.Marshal(record.FullName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := doJSONRequestIfMatch(t, http.MethodPatch, "/api/v1/contacts/"+strconv.FormatInt(record.ID, 10), "*", `{"fullName": `+string(fullName)+`}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestAPIPostContactFailure(t *testing.T) {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Code    string `json:"code"`
+			Fields  []struct {
+				Field   string `json:"field"`
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"fields"`
+		} `json:"error"`
+	}
+	resp := doJSONRequest(t, http.MethodPost, "/api/v1/contacts", `{
+		"fullName": "Test",
+		"emails": [{"address": "BAD_EMAIL_TO_FAIL_VALIDATION"}],
+		"phoneNumbers": [{"number": "(03) 9333 7119"}, {"number": "043"}, {"number": "0188 445 688", "extension": "reception"}]
+	}`, &body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if body.Error.Message == "" || body.Error.Code != "contact.email.invalid" || resp.Header.Get("X-Error-Code") != body.Error.Code {
+		t.Errorf("expected JSON error body and header to contain the code of the first problem but got %+v", body.Error)
+	}
+	// Every problem is reported, with the field it's about
+	want := []string{
+		"emails[0].address contact.email.invalid",
+		"phoneNumbers[1].number contact.phone.too_short",
+		"phoneNumbers[2].number contact.phone.invalid_for_country",
+		"phoneNumbers[2].extension contact.phone.invalid_extension",
+	}
+	var got []string
+	for _, field := range body.Error.Fields {
+		if field.Message == "" {
+			t.Errorf("expected a message for %s", field.Field)
+		}
+		got = append(got, field.Field+" "+field.Code)
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("expected fields %v but got %v", want, got)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	// API errors have the code in both the header and the body
+	apiTests := []struct {
+		Method string
+		Path   string
+		Body   string
+		Status int
+		Code   string
+	}{
+		{http.MethodGet, "/api/v1/contacts/999999999", "", http.StatusNotFound, "contact.not_found"},
+		{http.MethodGet, "/api/v1/contacts/999999999/phoneNumbers/abc", "", http.StatusNotFound, "contact.phone.not_found"},
+		{http.MethodDelete, "/api/v1/contacts", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.MethodPost, "/api/v1/contacts", "{", http.StatusBadRequest, "request.invalid_json"},
+		{http.MethodPost, "/api/v1/contacts", `{"fullName": "Test"}`, http.StatusBadRequest, "contact.phone.missing"},
+		{http.MethodGet, "/api/v1/contacts?limit=-1", "", http.StatusBadRequest, "request.limit.invalid"},
+	}
+	for _, test := range apiTests {
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		resp := doJSONRequest(t, test.Method, test.Path, test.Body, &body)
+		if resp.StatusCode != test.Status {
+			t.Errorf("%s %s: expected status %d but got %d", test.Method, test.Path, test.Status, resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Error-Code"); got != test.Code || body.Error.Code != test.Code {
+			t.Errorf("%s %s: expected code %q but got %q in the header and %q in the body", test.Method, test.Path, test.Code, got, body.Error.Code)
+		}
+	}
+
+	// Pages and requests that aren't signed in have it in the header
+	pageTests := []struct {
+		Client *http.Client
+		Path   string
+		Status int
+		Code   string
+	}{
+		{http.DefaultClient, "/postContact", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.DefaultClient, "/contacts/999999999", http.StatusNotFound, "contact.not_found"},
+		{http.DefaultClient, "/?limit=-1", http.StatusBadRequest, "request.limit.invalid"},
+		{&http.Client{}, "/api/v1/contacts", http.StatusUnauthorized, "auth.not_signed_in"},
+	}
+	for _, test := range pageTests {
+		resp, err := test.Client.Get(HostName + test.Path)
+		if err != nil {
+			t.Fatalf("get error: path \"%s\": %s", test.Path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.Status {
+			t.Errorf("%s: expected status %d but got %d", test.Path, test.Status, resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Error-Code"); got != test.Code {
+			t.Errorf("%s: expected code %q but got %q", test.Path, test.Code, got)
+		}
+	}
+
+	// Successful responses don't have one
+	resp := doJSONRequest(t, http.MethodGet, "/api/v1/contacts", "", nil)
+	if got := resp.Header.Get("X-Error-Code"); resp.StatusCode != http.StatusOK || got != "" {
+		t.Errorf("expected no error code for a successful request but got %q", got)
+	}
+}
+
+func TestAPIListContacts(t *testing.T) {
+	var body struct {
+		Contacts []apiContact `json:"contacts"`
+	}
+	resp := doJSONRequest(t, http.MethodGet, "/api/v1/contacts", "", &body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if body.Contacts == nil {
+		t.Errorf("expected contacts to be a JSON array")
+	}
+}
+
+func TestAPIPhoneNumberLifecycle(t *testing.T) {
+	var created apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "API Phone Test",
+		"phoneNumbers": [{"number": "03 8578 6688"}]
+	}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	contactPath := "/api/v1/contacts/" + strconv.FormatInt(created.ID, 10)
+	firstPhonePath := contactPath + "/phoneNumbers/" + strconv.FormatInt(created.PhoneNumbers[0].ID, 10)
+	etag := resp.Header.Get("ETag")
+
+	// Changing a phone number is changing the contact, so it needs the contacts ETag
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		resp = doJSONRequest(t, method, firstPhonePath, `{"number": "1800728069"}`, nil)
+		if resp.StatusCode != http.StatusPreconditionRequired {
+			t.Fatalf("%s: expected status %d without If-Match but got %d", method, http.StatusPreconditionRequired, resp.StatusCode)
+		}
+	}
+
+	// Cannot remove the last phone number
+	resp = doJSONRequestIfMatch(t, http.MethodDelete, firstPhonePath, etag, "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d when deleting last phone number but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Add
+	var added struct {
+		ID     int64  `json:"id"`
+		Number string `json:"number"`
+	}
+	resp = doJSONRequestIfMatch(t, http.MethodPost, contactPath+"/phoneNumbers", etag, `{"number": "0488 445 688"}`, &added)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if added.Number != "+61488445688" {
+		t.Errorf("expected phone number to be normalized to E.164 but got %s", added.Number)
+	}
+	staleETag := etag
+	if etag = resp.Header.Get("ETag"); etag == "" || etag == staleETag {
+		t.Fatalf("expected a new ETag but got %q", etag)
+	}
+	resp = doJSONRequestIfMatch(t, http.MethodPost, contactPath+"/phoneNumbers", staleETag, `{"number": "0488 445 689"}`, nil)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d for a stale ETag but got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+
+	// Replace
+	resp = doJSONRequestIfMatch(t, http.MethodPut, firstPhonePath, etag, `{"number": "1800728069"}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	etag = resp.Header.Get("ETag")
+	resp = doJSONRequestIfMatch(t, http.MethodPut, firstPhonePath, etag, `{"number": "not a number"}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for invalid number but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Remove, now that there is more than one
+	resp = doJSONRequestIfMatch(t, http.MethodDelete, firstPhonePath, staleETag, "", nil)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d for a stale ETag but got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+	resp = doJSONRequestIfMatch(t, http.MethodDelete, firstPhonePath, etag, "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	resp = doJSONRequestIfMatch(t, http.MethodDelete, firstPhonePath, resp.Header.Get("ETag"), "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d for already deleted phone number but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	var got apiContact
+	resp = doJSONRequest(t, http.MethodGet, contactPath, "", &got)
+	if len(got.PhoneNumbers) != 1 ||
+		got.PhoneNumbers[0].ID != added.ID {
+		t.Errorf("expected only the added phone number to remain but got %+v", got.PhoneNumbers)
+	}
+
+	// The new ETag is the one that's stored, even when changing regardless of the version
+	etag = resp.Header.Get("ETag")
+	resp = doJSONRequestIfMatch(t, http.MethodPost, contactPath+"/phoneNumbers", "*", `{"number": "0488 445 690"}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	changedETag := resp.Header.Get("ETag")
+	resp = doJSONRequest(t, http.MethodGet, contactPath, "", nil)
+	if changedETag == etag || changedETag != resp.Header.Get("ETag") {
+		t.Errorf("expected the ETag %q of the changed contact but got %q", resp.Header.Get("ETag"), changedETag)
+	}
+}
+
+func TestAPIContactCountryCode(t *testing.T) {
+	var created apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "API Country Test",
+		"countryCode": "NZ",
+		"phoneNumbers": [
+			{"number": "021 234 5678"},
+			{"number": "020 7946 0958", "countryCode": "GB"},
+			{"number": "+61 3 9333 7119"}
+		]
+	}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	type PhoneNumber struct {
+		Number      string
+		CountryCode string
+	}
+	expected := []PhoneNumber{
+		{Number: "+64212345678", CountryCode: "NZ"},
+		{Number: "+442079460958", CountryCode: "GB"},
+		{Number: "+61393337119", CountryCode: "AU"},
+	}
+	if len(created.PhoneNumbers) != len(expected) {
+		t.Fatalf("expected %d phone numbers but got %+v", len(expected), created.PhoneNumbers)
+	}
+	for i, phoneNumber := range created.PhoneNumbers {
+		if got := (PhoneNumber{Number: phoneNumber.Number, CountryCode: phoneNumber.CountryCode}); got != expected[i] {
+			t.Errorf("phone number %d: expected %+v but got %+v", i, expected[i], got)
+		}
+	}
+
+	resp = doJSONRequest(t, http.MethodPost, "/api/v1/contacts", `{
+		"fullName": "API Country Test",
+		"countryCode": "XX",
+		"phoneNumbers": [{"number": "021 234 5678"}]
+	}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for invalid country but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestAPIPhoneNumberMetadata(t *testing.T) {
+	var created apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "API Metadata Test",
+		"phoneNumbers": [
+			{"number": "(03) 9333 7119 ext. 123", "label": "Work"},
+			{"number": "0488 445 688", "label": "mobile", "isPrimary": true}
+		]
+	}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if len(created.PhoneNumbers) != 2 {
+		t.Fatalf("expected 2 phone numbers but got %+v", created.PhoneNumbers)
+	}
+	work, mobile := created.PhoneNumbers[0], created.PhoneNumbers[1]
+	if work.Number != "+61393337119" || work.Extension != "123" || work.Label != "work" || work.IsPrimary || work.LineType != "fixed_line" {
+		t.Errorf("unexpected work phone number: %+v", work)
+	}
+	if mobile.Number != "+61488445688" || mobile.Label != "mobile" || !mobile.IsPrimary || mobile.LineType != "mobile" {
+		t.Errorf("unexpected mobile phone number: %+v", mobile)
+	}
+
+	// Making another number primary takes the flag from the previous one
+	contactPath := "/api/v1/contacts/" + strconv.FormatInt(created.ID, 10)
+	resp = doJSONRequestIfMatch(t, http.MethodPut, contactPath+"/phoneNumbers/"+strconv.FormatInt(work.ID, 10), "*", `{"number": "+61393337119", "extension": "123", "isPrimary": true}`, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	var got apiContact
+	doJSONRequest(t, http.MethodGet, contactPath, "", &got)
+	if len(got.PhoneNumbers) != 2 || !got.PhoneNumbers[0].IsPrimary || got.PhoneNumbers[1].IsPrimary {
+		t.Errorf("expected only the first phone number to be primary but got %+v", got.PhoneNumbers)
+	}
+
+	resp = doJSONRequest(t, http.MethodPost, "/api/v1/contacts", `{
+		"fullName": "API Metadata Test",
+		"phoneNumbers": [
+			{"number": "(03) 9333 7119", "isPrimary": true},
+			{"number": "0488 445 688", "isPrimary": true}
+		]
+	}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for multiple primary phone numbers but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestPostFormCountryCode(t *testing.T) {
+	resp, err := postForm(
+		http.DefaultClient,
+		HostName+"/postContact",
+		url.Values{
+			"FullName":    {"Form Country Test"},
+			"PhoneNumber": {"021 234 5678"},
+			"CountryCode": {"NZ"},
+			// The API test uses the same number
+			"AllowDuplicates": {"true"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("post error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// NZ numbers are shown in international format, as the viewer is in Australia
+	resp, err = http.Get(HostName + "/?fullName=" + url.QueryEscape("Form Country Test"))
+	if err != nil {
+		t.Fatalf("get error: %s", err)
+	}
+	defer resp.Body.Close()
+	dat, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("readAll error: %s", err)
+	}
+	// Unescape the page as the browser would, html/template escapes "+" as "&#43;"
+	if !strings.Contains(html.UnescapeString(string(dat)), "+64 21 234 5678") {
+		t.Errorf("expected home page to contain NZ number in international format")
+	}
+}
+
+func TestAPIListContactsPagination(t *testing.T) {
+	// Ensure there's at least 2 contacts to page through
+	for i := 0; i < 2; i++ {
+		resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+			"fullName": "API Pagination Test",
+			"phoneNumbers": [{"number": "0488445688"}]
+		}`, nil)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+		}
+	}
+	type listBody struct {
+		Contacts []apiContact `json:"contacts"`
+		Next     string       `json:"next"`
+		Previous string       `json:"previous"`
+	}
+	var firstPage listBody
+	resp := doJSONRequest(t, http.MethodGet, "/api/v1/contacts?limit=1&sort=-id&fullName=pagination+test", "", &firstPage)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if len(firstPage.Contacts) != 1 {
+		t.Fatalf("expected 1 contact but got %d", len(firstPage.Contacts))
+	}
+	if firstPage.Next == "" || firstPage.Previous != "" {
+		t.Fatalf("expected only a next link on the first page but got next: %q, previous: %q", firstPage.Next, firstPage.Previous)
+	}
+	var secondPage listBody
+	doJSONRequest(t, http.MethodGet, firstPage.Next, "", &secondPage)
+	if len(secondPage.Contacts) != 1 {
+		t.Fatalf("expected 1 contact but got %d", len(secondPage.Contacts))
+	}
+	if secondPage.Contacts[0].ID >= firstPage.Contacts[0].ID {
+		t.Errorf("expected second page to have a lower ID when sorting by descending ID")
+	}
+	if secondPage.Previous == "" {
+		t.Errorf("expected second page to have a previous link")
+	}
+
+	resp = doJSONRequest(t, http.MethodGet, "/api/v1/contacts?sort=password", "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid sort but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestAPISearchContacts(t *testing.T) {
+	var created apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Searchable Hedy Lamarr",
+		"emails": [{"address": "hedy.lamarr@search.test"}],
+		"phoneNumbers": [{"number": "(03) 9555 1234"}]
+	}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	searches := []string{
+		// typo in the name
+		"lamar",
+		// case-insensitive email
+		"HEDY.LAMARR@SEARCH.TEST",
+		// end of the phone number
+		"1234",
+		// same phone number, different format
+		"+61 3 9555 1234",
+	}
+	for _, search := range searches {
+		var body struct {
+			Contacts []apiContact `json:"contacts"`
+		}
+		path := "/api/v1/contacts?limit=100&q=" + url.QueryEscape(search)
+		resp := doJSONRequest(t, http.MethodGet, path, "", &body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%q: expected status %d but got %d", search, http.StatusOK, resp.StatusCode)
+		}
+		found := false
+		for _, record := range body.Contacts {
+			if record.ID == created.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%q: expected search to find contact %d", search, created.ID)
+		}
+	}
+}
+
+func TestAPIDuplicateContactAndMerge(t *testing.T) {
+	const body = `{
+		"fullName": "Duplicate Ada Lovelace",
+		"emails": [{"address": "ada@duplicate.test"}],
+		"phoneNumbers": [{"number": "0491 570 156"}]
+	}`
+	var existing apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, body, &existing)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	existingPath := "/api/v1/contacts/" + strconv.FormatInt(existing.ID, 10)
+	existingETag := resp.Header.Get("ETag")
+	defer doJSONRequestIfMatch(t, http.MethodDelete, existingPath, "*", "", nil)
+
+	// Same person, different formatting
+	var conflict struct {
+		Error struct {
+			Message    string `json:"message"`
+			Duplicates []struct {
+				Contact apiContact `json:"contact"`
+				Reasons []string   `json:"reasons"`
+			} `json:"duplicates"`
+		} `json:"error"`
+	}
+	resp = doJSONRequest(t, http.MethodPost, "/api/v1/contacts", `{
+		"fullName": "duplicate ada lovelace",
+		"emails": [{"address": "ADA@duplicate.test"}],
+		"phoneNumbers": [{"number": "+61 491 570 156"}]
+	}`, &conflict)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected status %d but got %d", http.StatusConflict, resp.StatusCode)
+	}
+	found := false
+	for _, duplicate := range conflict.Error.Duplicates {
+		if duplicate.Contact.ID != existing.ID {
+			continue
+		}
+		found = true
+		if want := []string{"phoneNumber", "email", "fullName"}; !reflect.DeepEqual(duplicate.Reasons, want) {
+			t.Errorf("expected reasons %v but got %v", want, duplicate.Reasons)
+		}
+	}
+	if !found {
+		t.Fatalf("expected contact %d to be a duplicate but got %+v", existing.ID, conflict.Error.Duplicates)
+	}
+
+	// Insert it anyway, then merge it back into the existing contact
+	var duplicate apiContact
+	resp = doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Ada Lovelace",
+		"emails": [{"address": "ada@work.test", "isPrimary": true}],
+		"phoneNumbers": [{"number": "0491 570 156"}, {"number": "0491 570 157"}]
+	}`, &duplicate)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	var duplicates struct {
+		Duplicates []struct {
+			Contact apiContact `json:"contact"`
+		} `json:"duplicates"`
+	}
+	resp = doJSONRequest(t, http.MethodGet, existingPath+"/duplicates", "", &duplicates)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	found = false
+	for _, record := range duplicates.Duplicates {
+		found = found || record.Contact.ID == duplicate.ID
+	}
+	if !found {
+		t.Errorf("expected contact %d to be listed as a duplicate but got %+v", duplicate.ID, duplicates.Duplicates)
+	}
+
+	var merged struct {
+		Contact apiContact `json:"contact"`
+		Merge   struct {
+			ID                int64      `json:"id"`
+			SourceContactID   int64      `json:"sourceContactId"`
+			Source            apiContact `json:"source"`
+			AddedPhoneNumbers []struct {
+				Number string `json:"number"`
+			} `json:"addedPhoneNumbers"`
+		} `json:"merge"`
+	}
+	// Both contacts must be as the client last saw them, the target with If-Match and
+	// the source with sourceVersion
+	mergeBody := `{"sourceId": ` + strconv.FormatInt(duplicate.ID, 10) + `, "sourceVersion": ` + strconv.FormatInt(duplicate.Version, 10) + `}`
+	resp = doJSONRequest(t, http.MethodPost, existingPath+"/merges", mergeBody, nil)
+	if resp.StatusCode != http.StatusPreconditionRequired {
+		t.Fatalf("expected status %d without If-Match but got %d", http.StatusPreconditionRequired, resp.StatusCode)
+	}
+	staleSourceBody := `{"sourceId": ` + strconv.FormatInt(duplicate.ID, 10) + `, "sourceVersion": ` + strconv.FormatInt(duplicate.Version+1, 10) + `}`
+	resp = doJSONRequestIfMatch(t, http.MethodPost, existingPath+"/merges", existingETag, staleSourceBody, nil)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d for a stale sourceVersion but got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+	resp = doJSONRequestIfMatch(t, http.MethodPost, existingPath+"/merges", existingETag, `{"sourceId": `+strconv.FormatInt(duplicate.ID, 10)+`}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d without a sourceVersion but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	resp = doJSONRequestIfMatch(t, http.MethodPost, existingPath+"/merges", existingETag, mergeBody, &merged)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if merged.Contact.FullName != "Duplicate Ada Lovelace" ||
+		len(merged.Contact.Emails) != 2 ||
+		len(merged.Contact.PhoneNumbers) != 2 {
+		t.Errorf("unexpected merged contact: %+v", merged.Contact)
+	}
+	if merged.Merge.SourceContactID != duplicate.ID ||
+		merged.Merge.Source.FullName != "Ada Lovelace" ||
+		len(merged.Merge.AddedPhoneNumbers) != 1 ||
+		merged.Merge.AddedPhoneNumbers[0].Number != "+61491570157" {
+		t.Errorf("unexpected merge audit: %+v", merged.Merge)
+	}
+	resp = doJSONRequest(t, http.MethodGet, "/api/v1/contacts/"+strconv.FormatInt(duplicate.ID, 10), "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected merged contact to be deleted but got status %d", resp.StatusCode)
+	}
+	// It's in the trash, but restoring it would bring back the duplicate
+	resp, err := postForm(http.DefaultClient, HostName+"/trash", url.Values{
+		"Action":    {"restore"},
+		"ContactID": {strconv.FormatInt(duplicate.ID, 10)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get("X-Error-Code") != "contact.merge.cannot_restore" {
+		t.Errorf("expected status %d restoring the merged contact but got %d with %q", http.StatusConflict, resp.StatusCode, resp.Header.Get("X-Error-Code"))
+	}
+	var merges struct {
+		Merges []struct {
+			ID int64 `json:"id"`
+		} `json:"merges"`
+	}
+	doJSONRequest(t, http.MethodGet, existingPath+"/merges", "", &merges)
+	if len(merges.Merges) != 1 || merges.Merges[0].ID != merged.Merge.ID {
+		t.Errorf("expected the merge to be listed but got %+v", merges.Merges)
+	}
+
+	// Merging again fails, as the source no longer exists
+	resp = doJSONRequestIfMatch(t, http.MethodPost, existingPath+"/merges", "*", mergeBody, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	resp = doJSONRequestIfMatch(t, http.MethodPost, existingPath+"/merges", "*", `{"sourceId": `+strconv.FormatInt(existing.ID, 10)+`, "sourceVersion": 1}`, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d when merging into itself but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestPostFormDuplicate(t *testing.T) {
+	var existing apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Form Duplicate Grace Hopper",
+		"phoneNumbers": [{"number": "0491 570 158"}]
+	}`, &existing)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	defer doJSONRequestIfMatch(t, http.MethodDelete, "/api/v1/contacts/"+strconv.FormatInt(existing.ID, 10), "*", "", nil)
+
+	resp, err := postForm(
+		http.DefaultClient,
+		HostName+"/postContact",
+		url.Values{
+			"FullName":    {"Grace Hopper"},
+			"PhoneNumber": {"0491 570 158"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("post error: %s", err)
+	}
+	defer resp.Body.Close()
+	dat, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("readAll error: %s", err)
+	}
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected status %d but got %d", http.StatusConflict, resp.StatusCode)
+	}
+	if !strings.Contains(string(dat), "Form Duplicate Grace Hopper") ||
+		!strings.Contains(string(dat), `name="AllowDuplicates" value="true"`) {
+		t.Errorf("expected page to list the duplicate and allow saving anyway:\n%s", dat)
+	}
+}
+
+func TestAPIImportContacts(t *testing.T) {
+	const csvFile = "Full Name,Phone Numbers,Email\n" +
+		"Import Hedy Lamarr,0491 570 159,hedy@import.test\n" +
+		"Import Bad Email,0491 570 110,BAD_EMAIL\n" +
+		"Import H. Lamarr,+61 491 570 159,\n"
+	type importReport struct {
+		Inserted int `json:"inserted"`
+		Failed   int `json:"failed"`
+		Results  []struct {
+			Row       int    `json:"row"`
+			Status    string `json:"status"`
+			Error     string `json:"error"`
+			ContactID int64  `json:"contactId"`
+		} `json:"results"`
+	}
+	checkStatuses := func(report importReport, expected ...string) {
+		t.Helper()
+		if len(report.Results) != len(expected) {
+			t.Fatalf("expected %d results but got %+v", len(expected), report.Results)
+		}
+		for i, result := range report.Results {
+			if result.Row != i+2 || result.Status != expected[i] {
+				t.Errorf("row %d: expected %s but got %+v", i+2, expected[i], result)
+			}
+		}
+	}
+
+	// Dry run
+	var report importReport
+	resp := doJSONRequest(t, http.MethodPost, "/api/v1/contacts/import?dryRun=true", csvFile, &report)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("dry run: expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	checkStatuses(report, "valid", "invalid", "duplicate")
+	if report.Inserted != 0 || report.Failed != 2 {
+		t.Errorf("dry run: expected 0 inserted and 2 failed but got %+v", report)
+	}
+
+	// All or nothing, nothing is imported as some rows failed
+	report = importReport{}
+	resp = doJSONRequest(t, http.MethodPost, "/api/v1/contacts/import?allOrNothing=true", csvFile, &report)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("all or nothing: expected status %d but got %d", http.StatusUnprocessableEntity, resp.StatusCode)
+	}
+	checkStatuses(report, "valid", "invalid", "duplicate")
+	if report.Inserted != 0 {
+		t.Errorf("all or nothing: expected nothing to be inserted but got %+v", report)
+	}
+
+	// Uploaded as a file, the valid row is imported
+	var body strings.Builder
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "contacts.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, csvFile)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Post(HostName+"/api/v1/contacts/import", writer.FormDataContentType(), strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatalf("post error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	report = importReport{}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("unable to decode JSON response: %s", err)
+	}
+	checkStatuses(report, "inserted", "invalid", "duplicate")
+	if report.Inserted != 1 || report.Results[0].ContactID == 0 {
+		t.Fatalf("upload: expected 1 inserted contact but got %+v", report)
+	}
+	importedPath := "/api/v1/contacts/" + strconv.FormatInt(report.Results[0].ContactID, 10)
+	defer doJSONRequestIfMatch(t, http.MethodDelete, importedPath, "*", "", nil)
+	var imported apiContact
+	if resp := doJSONRequest(t, http.MethodGet, importedPath, "", &imported); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if imported.FullName != "Import Hedy Lamarr" ||
+		len(imported.Emails) != 1 || imported.Emails[0].Address != "hedy@import.test" {
+		t.Errorf("unexpected imported contact: %+v", imported)
+	}
+
+	// Malformed files are rejected outright
+	resp = doJSONRequest(t, http.MethodPost, "/api/v1/contacts/import", "Full Name,Password\nAlex Bell,hunter2\n", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestExportContacts(t *testing.T) {
+	var record apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Export Ada, Lovelace",
+		"emails": [{"address": "ada@export.test", "isPrimary": true}],
+		"phoneNumbers": [{"number": "0491 570 160", "label": "mobile"}]
+	}`, &record)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	defer doJSONRequestIfMatch(t, http.MethodDelete, "/api/v1/contacts/"+strconv.FormatInt(record.ID, 10), "*", "", nil)
+
+	getExport := func(path string, expectedStatusCode int) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(HostName + path)
+		if err != nil {
+			t.Fatalf("get error: path \"%s\": %s", path, err)
+		}
+		defer resp.Body.Close()
+		dat, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("readAll error: %s", err)
+		}
+		if resp.StatusCode != expectedStatusCode {
+			t.Fatalf("%s: expected status %d but got %d\n%s", path, expectedStatusCode, resp.StatusCode, dat)
+		}
+		return resp, string(dat)
+	}
+
+	resp, body := getExport("/export/contacts.csv?fullName=Export+Ada", http.StatusOK)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/csv; charset=utf-8" {
+		t.Errorf("csv: unexpected content type %q", contentType)
+	}
+	if expected := "FullName,PhoneNumbers,Emails\n\"Export Ada, Lovelace\",+61491570160,ada@export.test\n"; body != expected {
+		t.Errorf("csv: expected:\n%s\nbut got:\n%s", expected, body)
+	}
+
+	_, body = getExport("/export/contacts.jsonl?fullName=Export+Ada", http.StatusOK)
+	var exported apiContact
+	if err := json.Unmarshal([]byte(body), &exported); err != nil {
+		t.Fatalf("jsonl: %s\n%s", err, body)
+	}
+	if exported.ID != record.ID || strings.Count(body, "\n") != 1 {
+		t.Errorf("jsonl: expected a single line with contact %d but got:\n%s", record.ID, body)
+	}
+
+	resp, body = getExport("/export/contacts.vcf?version=3.0&fullName=Export+Ada", http.StatusOK)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/vcard; charset=utf-8" {
+		t.Errorf("vcf: unexpected content type %q", contentType)
+	}
+	for _, line := range []string{"VERSION:3.0\r\n", "FN:Export Ada\\, Lovelace\r\n", "TEL;TYPE=CELL:+61491570160\r\n"} {
+		if !strings.Contains(body, line) {
+			t.Errorf("vcf: expected %q in:\n%s", line, body)
+		}
+	}
+
+	getExport("/export/contacts.xml", http.StatusNotFound)
+	getExport("/export/contacts.vcf?version=2.1", http.StatusBadRequest)
+}
+
+func TestAPIImportVCards(t *testing.T) {
+	const vCardFile = "BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"FN:Import Katherine Johnson\r\n" +
+		"EMAIL;TYPE=INTERNET,WORK,PREF:katherine@import.test\r\n" +
+		"TEL;TYPE=CELL:0491 570 161\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"VERSION:2.1\r\n" +
+		"FN;ENCODING=QUOTED-PRINTABLE:Import Bad =\r\n" +
+		"Email\r\n" +
+		"EMAIL:BAD_EMAIL\r\n" +
+		"TEL;CELL:0491 570 162\r\n" +
+		"END:VCARD\r\n"
+	var body strings.Builder
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "contacts.vcf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, vCardFile)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(HostName+"/api/v1/contacts/import", writer.FormDataContentType(), strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatalf("post error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	var report struct {
+		Inserted int `json:"inserted"`
+		Results  []struct {
+			Row       int    `json:"row"`
+			FullName  string `json:"fullName"`
+			Status    string `json:"status"`
+			ContactID int64  `json:"contactId"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("unable to decode JSON response: %s", err)
+	}
+	if len(report.Results) != 2 {
+		t.Fatalf("expected 2 results but got %+v", report)
+	}
+	if report.Results[0].ContactID != 0 {
+		defer doJSONRequestIfMatch(t, http.MethodDelete, "/api/v1/contacts/"+strconv.FormatInt(report.Results[0].ContactID, 10), "*", "", nil)
+	}
+	if report.Inserted != 1 ||
+		report.Results[0].Row != 1 || report.Results[0].Status != "inserted" ||
+		report.Results[1].Row != 7 || report.Results[1].Status != "invalid" || report.Results[1].FullName != "Import Bad Email" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	var imported apiContact
+	doJSONRequest(t, http.MethodGet, "/api/v1/contacts/"+strconv.FormatInt(report.Results[0].ContactID, 10), "", &imported)
+	if imported.FullName != "Import Katherine Johnson" ||
+		len(imported.Emails) != 1 || !imported.Emails[0].IsPrimary || imported.Emails[0].Label != "work" ||
+		len(imported.PhoneNumbers) != 1 || imported.PhoneNumbers[0].Number != "+61491570161" || imported.PhoneNumbers[0].Label != "mobile" {
+		t.Errorf("unexpected imported contact: %+v", imported)
+	}
+
+	// The format can also be given by the content type, which is checked before importing
+	req, err := http.NewRequest(http.MethodPost, HostName+"/api/v1/contacts/import?dryRun=true", strings.NewReader("FN:Not a vCard\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/vcard")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// doDAVRequest sends a CardDAV request and returns the response with its body.
+func doDAVRequest(t *testing.T, method, path string, headers map[string]string, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, HostName+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request error: %s", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s error: path \"%s\": %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	dat, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("readAll error: %s", err)
+	}
+	return resp, string(dat)
+}
+
+func TestCardDAV(t *testing.T) {
+	expectStatus := func(name string, resp *http.Response, body string, expectedStatusCode int) {
+		t.Helper()
+		if resp.StatusCode != expectedStatusCode {
+			t.Fatalf("%s: expected status %d but got %d\n%s", name, expectedStatusCode, resp.StatusCode, body)
+		}
+	}
+	expectContains := func(name string, body string, values ...string) {
+		t.Helper()
+		for _, value := range values {
+			if !strings.Contains(body, value) {
+				t.Errorf("%s: expected %q in:\n%s", name, value, body)
+			}
+		}
+	}
+
+	// Clients that only know the host name are sent to the address book home
+	req, err := http.NewRequest("PROPFIND", HostName+"/.well-known/carddav", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("propfind error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/carddav/" {
+		t.Errorf("well-known: expected a redirect to /carddav/ but got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, body := doDAVRequest(t, "PROPFIND", "/carddav/", map[string]string{"Depth": "0"}, `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+	<prop><current-user-principal/><card:addressbook-home-set/><getlastmodified/></prop>
+</propfind>`)
+	expectStatus("propfind home", resp, body, http.StatusMultiStatus)
+	expectContains("propfind home", body,
+		"<D:current-user-principal><D:href>/carddav/</D:href></D:current-user-principal>",
+		"<C:addressbook-home-set><D:href>/carddav/</D:href></C:addressbook-home-set>",
+		"<D:getlastmodified/></D:prop><D:status>HTTP/1.1 404 Not Found</D:status>",
+	)
+	if !strings.Contains(resp.Header.Get("DAV"), "addressbook") {
+		t.Errorf("propfind home: expected the DAV header to include addressbook but got %q", resp.Header.Get("DAV"))
+	}
+
+	// Create a contact, named by its UID
+	uid := "carddav-test-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	path := "/carddav/contacts/" + uid + ".vcf"
+	card := "BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"UID:" + uid + "\r\n" +
+		"FN:CardDAV Grace Hopper\r\n" +
+		"EMAIL;TYPE=INTERNET,WORK:grace@carddav.test\r\n" +
+		"TEL;TYPE=CELL:0491 570 163\r\n" +
+		"END:VCARD\r\n"
+	vCardHeaders := map[string]string{"Content-Type": "text/vcard; charset=utf-8", "If-None-Match": "*"}
+	resp, body = doDAVRequest(t, http.MethodPut, path, vCardHeaders, card)
+	expectStatus("put new", resp, body, http.StatusCreated)
+	defer doDAVRequest(t, http.MethodDelete, path, nil, "")
+	resp, body = doDAVRequest(t, http.MethodPut, path, vCardHeaders, card)
+	expectStatus("put new again", resp, body, http.StatusPreconditionFailed)
+
+	resp, body = doDAVRequest(t, http.MethodGet, path, nil, "")
+	expectStatus("get", resp, body, http.StatusOK)
+	expectContains("get", body, "UID:"+uid+"\r\n", "FN:CardDAV Grace Hopper\r\n", "TEL;TYPE=CELL:+61491570163\r\n")
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("get: expected an ETag")
+	}
+
+	// Updating needs the current ETag, and changes it
+	updatedCard := strings.Replace(card, "FN:CardDAV Grace Hopper", "FN:CardDAV Grace Brewster Hopper", 1)
+	resp, body = doDAVRequest(t, http.MethodPut, path, map[string]string{"If-Match": `"0-0"`}, updatedCard)
+	expectStatus("put stale", resp, body, http.StatusPreconditionFailed)
+	resp, body = doDAVRequest(t, http.MethodPut, path, map[string]string{"If-Match": etag}, updatedCard)
+	expectStatus("put update", resp, body, http.StatusNoContent)
+	resp, body = doDAVRequest(t, http.MethodHead, path, nil, "")
+	expectStatus("head", resp, body, http.StatusOK)
+	if resp.Header.Get("ETag") == etag {
+		t.Errorf("put update: expected the ETag to change from %s", etag)
+	}
+	staleETag := etag
+	etag = resp.Header.Get("ETag")
+
+	// Contacts must still be valid
+	invalidCard := strings.Replace(card, "TEL;TYPE=CELL:0491 570 163\r\n", "", 1)
+	resp, body = doDAVRequest(t, http.MethodPut, path, nil, invalidCard)
+	expectStatus("put invalid", resp, body, http.StatusForbidden)
+	expectContains("put invalid", body, "<C:valid-address-data/>")
+
+	// The address book lists the contact
+	resp, body = doDAVRequest(t, "PROPFIND", "/carddav/contacts/", map[string]string{"Depth": "1"}, `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:" xmlns:cs="http://calendarserver.org/ns/"><prop><resourcetype/><getetag/><cs:getctag/></prop></propfind>`)
+	expectStatus("propfind address book", resp, body, http.StatusMultiStatus)
+	expectContains("propfind address book", body,
+		"<D:resourcetype><D:collection/><C:addressbook/></D:resourcetype>",
+		"<CS:getctag>",
+		"<D:href>"+path+"</D:href><D:propstat><D:prop><D:resourcetype/><D:getetag>"+strings.Replace(etag, `"`, "&#34;", -1)+"</D:getetag>",
+	)
+
+	// An empty body asks for every property
+	resp, body = doDAVRequest(t, "PROPFIND", "/carddav/contacts/", map[string]string{"Depth": "0"}, "")
+	expectStatus("propfind allprop", resp, body, http.StatusMultiStatus)
+	expectContains("propfind allprop", body, "<D:displayname>Contacts</D:displayname>", "<C:supported-address-data>")
+	if strings.Contains(body, path) {
+		t.Errorf("propfind allprop: expected only the address book with a depth of 0 but got:\n%s", body)
+	}
+
+	// Fetch it by href, along with one that doesn't exist
+	resp, body = doDAVRequest(t, "REPORT", "/carddav/contacts/", map[string]string{"Depth": "1"}, `<?xml version="1.0" encoding="utf-8"?>
+<C:addressbook-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+	<D:prop><D:getetag/><C:address-data version="4.0"/></D:prop>
+	<D:href>`+path+`</D:href>
+	<D:href>/carddav/contacts/missing-`+uid+`.vcf</D:href>
+</C:addressbook-multiget>`)
+	expectStatus("multiget", resp, body, http.StatusMultiStatus)
+	var multistatus struct {
+		Responses []struct {
+			Href        string `xml:"href"`
+			Status      string `xml:"status"`
+			AddressData string `xml:"propstat>prop>address-data"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal([]byte(body), &multistatus); err != nil {
+		t.Fatalf("multiget: unable to decode XML response: %s\n%s", err, body)
+	}
+	if len(multistatus.Responses) != 2 ||
+		multistatus.Responses[0].Href != path || multistatus.Responses[1].Status != "HTTP/1.1 404 Not Found" {
+		t.Fatalf("multiget: unexpected response:\n%s", body)
+	}
+	expectContains("multiget", multistatus.Responses[0].AddressData, "VERSION:4.0\r\n", "FN:CardDAV Grace Brewster Hopper\r\n")
+
+	// Search the address book
+	query := func(textMatch string) string {
+		t.Helper()
+		resp, body := doDAVRequest(t, "REPORT", "/carddav/contacts/", map[string]string{"Depth": "1"}, `<?xml version="1.0" encoding="utf-8"?>
+<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+	<D:prop><D:getetag/></D:prop>
+	<C:filter test="allof">
+		<C:prop-filter name="FN">`+textMatch+`</C:prop-filter>
+		<C:prop-filter name="EMAIL"><C:text-match match-type="ends-with">@CARDDAV.TEST</C:text-match></C:prop-filter>
+	</C:filter>
+</C:addressbook-query>`)
+		expectStatus("query", resp, body, http.StatusMultiStatus)
+		return body
+	}
+	if body := query(`<C:text-match>brewster</C:text-match>`); !strings.Contains(body, path) {
+		t.Errorf("query: expected %s in:\n%s", path, body)
+	}
+	if body := query(`<C:text-match negate-condition="yes">brewster</C:text-match>`); strings.Contains(body, path) {
+		t.Errorf("query: expected %s to not be in:\n%s", path, body)
+	}
+	resp, body = doDAVRequest(t, "REPORT", "/carddav/contacts/", nil, `<?xml version="1.0" encoding="utf-8"?>
+<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+	<D:prop><D:getetag/></D:prop>
+	<C:filter><C:prop-filter name="FN"><C:text-match collation="i;klingon">grace</C:text-match></C:prop-filter></C:filter>
+</C:addressbook-query>`)
+	expectStatus("query collation", resp, body, http.StatusForbidden)
+	expectContains("query collation", body, "<C:supported-collation/>")
+
+	// Deleting also needs the current ETag, if one is given
+	resp, body = doDAVRequest(t, http.MethodDelete, path, map[string]string{"If-Match": staleETag}, "")
+	expectStatus("delete stale", resp, body, http.StatusPreconditionFailed)
+	resp, body = doDAVRequest(t, http.MethodDelete, path, map[string]string{"If-Match": etag}, "")
+	expectStatus("delete", resp, body, http.StatusNoContent)
+	resp, body = doDAVRequest(t, http.MethodGet, path, nil, "")
+	expectStatus("get deleted", resp, body, http.StatusNotFound)
+}
+
+func TestAuthentication(t *testing.T) {
+	// A client with no cookie jar, so it isn't signed in
+	anonymous := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// Pages send you to the login page
+	resp, err := anonymous.Get(HostName + "/?q=alex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status %d for home page, not %d", http.StatusSeeOther, resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != "/login?next=%2F%3Fq%3Dalex" {
+		t.Fatalf("unexpected redirect to %q", location)
+	}
+
+	// The API, export and CardDAV ask for a username and password
+	for _, path := range []string{"/api/v1/contacts", "/export/contacts.csv", "/carddav/contacts/"} {
+		resp, err := anonymous.Get(HostName + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status %d for %s, not %d", http.StatusUnauthorized, path, resp.StatusCode)
+		}
+		if !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+			t.Fatalf("expected Basic authentication to be asked for by %s, not %q", path, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+
+	// HTTP Basic authentication works for the API, but only with the right password
+	for password, expectedStatus := range map[string]int{
+		testUserPassword: http.StatusOK,
+		"wrong password": http.StatusUnauthorized,
+	} {
+		req, err := http.NewRequest(http.MethodGet, HostName+"/api/v1/contacts", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(TestUsername, password)
+		resp, err := anonymous.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("expected status %d with password %q, not %d", expectedStatus, password, resp.StatusCode)
+		}
+	}
+
+	// But not for pages, as browsers would send it along with forms posted from other sites
+	req, err := http.NewRequest(http.MethodGet, HostName+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(TestUsername, testUserPassword)
+	resp, err = anonymous.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status %d for home page with Basic authentication, not %d", http.StatusSeeOther, resp.StatusCode)
+	}
+
+	// A wrong password shows the login page again
+	resp, err = postForm(anonymous, HostName+"/login", url.Values{
+		"Username": {TestUsername},
+		"Password": {"wrong password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %d for wrong password, not %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "Incorrect username or password.") {
+		t.Fatalf("expected login page to say the password was wrong, got:\n%s", body)
+	}
+
+	// Signing in sends you back to where you were, but never to another site
+	for next, expectedLocation := range map[string]string{
+		"/?q=alex":            "/?q=alex",
+		"//example.com":       "/",
+		"https://example.com": "/",
+	} {
+		resp, err = postForm(anonymous, HostName+"/login", url.Values{
+			"Username": {TestUsername},
+			"Password": {testUserPassword},
+			"Next":     {next},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("expected status %d for signing in, not %d", http.StatusSeeOther, resp.StatusCode)
+		}
+		if location := resp.Header.Get("Location"); location != expectedLocation {
+			t.Fatalf("expected signing in with next %q to redirect to %q, not %q", next, expectedLocation, location)
+		}
+	}
+	var sessionCookie *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session" {
+			sessionCookie = cookie
+		}
+	}
+	if sessionCookie == nil || sessionCookie.Value == "" {
+		t.Fatalf("expected a session cookie after signing in")
+	}
+	if !sessionCookie.HttpOnly || sessionCookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected the session cookie to be HttpOnly and SameSite=Lax: %s", sessionCookie)
+	}
+
+	// The session cookie signs you in
+	doWithSession := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, HostName+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(&http.Cookie{Name: sessionCookie.Name, Value: sessionCookie.Value})
+		// Send a CSRF token too, as a browser would when submitting the sign out form
+		token, csrfCookie := mustGetCSRFToken(anonymous)
+		req.AddCookie(csrfCookie)
+		req.Header.Set("X-CSRF-Token", token)
+		resp, err := anonymous.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := doWithSession(http.MethodGet, "/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d for home page with session, not %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// Signing out only works with POST, and ends the session
+	if resp := doWithSession(http.MethodGet, "/logout"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d for GET /logout, not %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+	if resp := doWithSession(http.MethodPost, "/logout"); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status %d for signing out, not %d", http.StatusSeeOther, resp.StatusCode)
+	}
+	if resp := doWithSession(http.MethodGet, "/api/v1/contacts"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %d after signing out, not %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	// Create a viewer and an editor for this test
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	viewer, err := user.Create("viewer-"+suffix, testUserPassword, user.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Delete(viewer.ID)
+	editor, err := user.Create("editor-"+suffix, testUserPassword, user.RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Delete(editor.ID)
+
+	doAs := func(record user.User, method, path, contentType, body string) *http.Response {
+		req, err := http.NewRequest(method, HostName+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if method == http.MethodDelete {
+			// This is testing roles rather than versions, so delete whatever version is stored
+			req.Header.Set("If-Match", "*")
+		}
+		req.SetBasicAuth(record.Username, testUserPassword)
+		client := &http.Client{}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	const newContact = `{"fullName": "Role Test", "phoneNumbers": [{"number": "+61 3 9333 7119"}]}`
+
+	// Viewers can only read
+	if resp := doAs(viewer, http.MethodGet, "/api/v1/contacts", "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected viewer to list contacts, got status %d", resp.StatusCode)
+	}
+	type TestData struct {
+		Method      string
+		Path        string
+		ContentType string
+		Body        string
+	}
+	for _, testData := range []TestData{
+		{Method: http.MethodPost, Path: "/api/v1/contacts", ContentType: "application/json", Body: newContact},
+		{Method: http.MethodPost, Path: "/api/v1/contacts/import", ContentType: "text/csv", Body: "Full Name,Phone Number\nRole Test,+61 3 9333 7119\n"},
+		{Method: http.MethodGet, Path: "/export/contacts.csv"},
+		{Method: http.MethodPut, Path: "/carddav/contacts/role-test.vcf", ContentType: "text/vcard", Body: "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Role Test\r\nTEL:+61 3 9333 7119\r\nEND:VCARD\r\n"},
+	} {
+		if resp := doAs(viewer, testData.Method, testData.Path, testData.ContentType, testData.Body); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected status %d for viewer doing %s %s, not %d", http.StatusForbidden, testData.Method, testData.Path, resp.StatusCode)
+		}
+	}
+
+	// Editors can change contacts, but not users
+	resp := doAs(editor, http.MethodPost, "/api/v1/contacts?allowDuplicates=true", "application/json", newContact)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected editor to create a contact, got status %d", resp.StatusCode)
+	}
+	contactPath := resp.Header.Get("Location")
+	if resp := doAs(viewer, http.MethodDelete, contactPath, "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d for viewer deleting a contact, not %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if resp := doAs(editor, http.MethodDelete, contactPath, "", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected editor to delete a contact, got status %d", resp.StatusCode)
+	}
+
+	// Only admins can manage users. The admin page only takes the session cookie, so sign in
+	// as the editor with a cookie jar.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editorClient := &http.Client{Jar: jar}
+	mustSignIn(editorClient, editor.Username, testUserPassword)
+	resp, err = editorClient.Get(HostName + "/admin/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d for editor viewing users, not %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// An admin can make the viewer an editor, and it applies straight away
+	resp, err = http.Get(HostName + "/admin/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), viewer.Username) {
+		t.Fatalf("expected admin to see the viewer in the list of users, got status %d:\n%s", resp.StatusCode, body)
+	}
+	resp, err = postForm(http.DefaultClient, HostName+"/admin/users", url.Values{
+		"UserID": {strconv.FormatInt(viewer.ID, 10)},
+		"Role":   {string(user.RoleEditor)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/admin/users" {
+		t.Fatalf("expected changing the role to go back to the list of users, got status %d for %s", resp.StatusCode, resp.Request.URL)
+	}
+	if resp := doAs(viewer, http.MethodGet, "/export/contacts.csv", "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the new editor to export contacts, got status %d", resp.StatusCode)
+	}
+
+	// Roles that don't exist are refused
+	resp, err = postForm(http.DefaultClient, HostName+"/admin/users", url.Values{
+		"UserID": {strconv.FormatInt(viewer.ID, 10)},
+		"Role":   {"owner"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an unknown role, not %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	// Create a token through the API tokens page, it's only shown once
+	createToken := func(name string, scope user.TokenScope) string {
+		resp, err := postForm(http.DefaultClient, HostName+"/account/tokens", url.Values{
+			"Action":        {"create"},
+			"Name":          {name},
+			"Scope":         {string(scope)},
+			"ExpiresInDays": {"30"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d creating a token, not %d:\n%s", http.StatusOK, resp.StatusCode, body)
+		}
+		token := regexp.MustCompile(`cst_[A-Za-z0-9_-]+`).FindString(string(body))
+		if token == "" {
+			t.Fatalf("expected the new token to be shown, got:\n%s", body)
+		}
+		return token
+	}
+	readToken := createToken("Read Test", user.TokenScopeRead)
+	writeToken := createToken("Write Test", user.TokenScopeWrite)
+
+	doWithToken := func(token, method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, HostName+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		if method == http.MethodDelete {
+			// This is testing tokens rather than versions, so delete whatever version is stored
+			req.Header.Set("If-Match", "*")
+		}
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	const newContact = `{"fullName": "Token Test", "phoneNumbers": [{"number": "+61 3 9333 7119"}]}`
+
+	// Read tokens can only read
+	if resp := doWithToken(readToken, http.MethodGet, "/api/v1/contacts", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected read token to list contacts, got status %d", resp.StatusCode)
+	}
+	if resp := doWithToken(readToken, http.MethodGet, "/export/contacts.csv", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected read token to export contacts, got status %d", resp.StatusCode)
+	}
+	if resp := doWithToken(readToken, http.MethodPost, "/api/v1/contacts", newContact); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d for read token creating a contact, not %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// Write tokens can change contacts
+	resp := doWithToken(writeToken, http.MethodPost, "/api/v1/contacts?allowDuplicates=true", newContact)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected write token to create a contact, got status %d", resp.StatusCode)
+	}
+	if resp := doWithToken(writeToken, http.MethodDelete, resp.Header.Get("Location"), ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected write token to delete a contact, got status %d", resp.StatusCode)
+	}
+
+	// But not pages, which need a browser session. This stops tokens from creating more tokens.
+	if resp := doWithToken(writeToken, http.MethodGet, "/account/tokens", ""); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status %d for a token viewing the tokens page, not %d", http.StatusSeeOther, resp.StatusCode)
+	}
+
+	// When each token was last used is recorded
+	tokens, err := user.ListAPITokens(TestUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readTokenID int64
+	for _, token := range tokens {
+		if token.Name == "Read Test" {
+			readTokenID = token.ID
+		}
+		if (token.Name == "Read Test" || token.Name == "Write Test") && token.LastUsedAt == nil {
+			t.Fatalf("expected %q to have been used", token.Name)
+		}
+	}
+
+	// Revoked and made up tokens are refused
+	resp, err = postForm(http.DefaultClient, HostName+"/account/tokens", url.Values{
+		"Action":  {"revoke"},
+		"TokenID": {strconv.FormatInt(readTokenID, 10)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/account/tokens" {
+		t.Fatalf("expected revoking to go back to the tokens page, got status %d for %s", resp.StatusCode, resp.Request.URL)
+	}
+	for _, token := range []string{readToken, "cst_madeup", "not a token"} {
+		resp := doWithToken(token, http.MethodGet, "/api/v1/contacts", "")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status %d for token %q, not %d", http.StatusUnauthorized, token, resp.StatusCode)
+		}
+		if !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Bearer ") {
+			t.Fatalf("expected a Bearer challenge for token %q, not %q", token, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestXSSEscaped(t *testing.T) {
+	const payload = `<script>alert("xss")</script>`
+	var existing apiContact
+	resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "XSS `+strings.Replace(payload, `"`, `\"`, -1)+`",
+		"phoneNumbers": [{"number": "0491 570 006"}]
+	}`, &existing)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	defer doJSONRequestIfMatch(t, http.MethodDelete, "/api/v1/contacts/"+strconv.FormatInt(existing.ID, 10), "*", "", nil)
+
+	assertEscaped := func(page string, body []byte) {
+		if strings.Contains(string(body), payload) {
+			t.Fatalf("expected FullName to be escaped on the %s, got:\n%s", page, body)
+		}
+		if !strings.Contains(string(body), "XSS &lt;script&gt;") {
+			t.Fatalf("expected escaped FullName on the %s, got:\n%s", page, body)
+		}
+	}
+
+	// Home page
+	resp, err := http.Get(HostName + "/?q=XSS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEscaped("home page", body)
+
+	// Duplicate contact page, which lists the existing contact
+	resp, err = postForm(http.DefaultClient, HostName+"/postContact", url.Values{
+		"FullName":    {"Not XSS"},
+		"PhoneNumber": {"0491 570 006"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected status %d but got %d", http.StatusConflict, resp.StatusCode)
+	}
+	assertEscaped("duplicate contact page", body)
+}
+
+func TestCSRF(t *testing.T) {
+	token, _ := mustGetCSRFToken(http.DefaultClient)
+	submit := func(form url.Values, origin string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, HostName+"/postContact", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	contact := url.Values{
+		"FullName":    {"CSRF Test"},
+		"PhoneNumber": {"0491 570 007"},
+	}
+
+	// Forms without the token, with the wrong one or from another site are refused
+	if resp := submit(contact, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d without a token, not %d", http.StatusForbidden, resp.StatusCode)
+	}
+	contact.Set("CSRFToken", strings.Repeat("a", len(token)))
+	if resp := submit(contact, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d with the wrong token, not %d", http.StatusForbidden, resp.StatusCode)
+	}
+	contact.Set("CSRFToken", token)
+	if resp := submit(contact, "https://evil.example"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d from another site, not %d", http.StatusForbidden, resp.StatusCode)
+	}
+	var body struct {
+		Contacts []apiContact `json:"contacts"`
+	}
+	doJSONRequest(t, http.MethodGet, "/api/v1/contacts?limit=100&q="+url.QueryEscape("CSRF Test"), "", &body)
+	for _, record := range body.Contacts {
+		if record.FullName == "CSRF Test" {
+			t.Fatalf("expected no contact to be created by refused forms, but found %d", record.ID)
+		}
+	}
+
+	// The API can't be used from another site with the browsers cookies either
+	req, err := http.NewRequest(http.MethodPost, HostName+apiCreateContactPath, strings.NewReader(`{"fullName": "CSRF Test", "phoneNumbers": [{"number": "0491 570 007"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Origin", "https://evil.example")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d for the API from another site, not %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, path := range []string{"/", "/login", "/api/v1/contacts", "/static/main.css"} {
+		resp, err := http.Get(HostName + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for name, want := range map[string]string{
+			"X-Frame-Options":        "DENY",
+			"X-Content-Type-Options": "nosniff",
+			"Referrer-Policy":        "same-origin",
+		} {
+			if got := resp.Header.Get(name); got != want {
+				t.Errorf("expected %s header of %q for %s, not %q", name, want, path, got)
+			}
+		}
+		if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'none'") ||
+			!strings.Contains(csp, "frame-ancestors 'none'") {
+			t.Errorf("expected a locked down Content-Security-Policy for %s, not %q", path, csp)
+		}
+	}
+}
+
+func TestPostFormSpam(t *testing.T) {
+	type rejections struct {
+		RateLimitedByIP uint64 `json:"rateLimitedByIP"`
+		Honeypot        uint64 `json:"honeypot"`
+		TooFast         uint64 `json:"tooFast"`
+		InvalidForm     uint64 `json:"invalidForm"`
+	}
+	getRejections := func() rejections {
+		var body struct {
+			PostContactRejections rejections `json:"postContactRejections"`
+		}
+		if resp := doJSONRequest(t, http.MethodGet, "/admin/metrics", "", &body); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d for metrics, not %d", http.StatusOK, resp.StatusCode)
+		}
+		return body.PostContactRejections
+	}
+	before := getRejections()
+
+	// submit sends the add contact form from the given address, with an invalid email so that
+	// nothing is added if it gets past the spam checks
+	submit := func(address string, wait bool, change func(form url.Values)) *http.Response {
+		form, _ := mustGetHiddenFields(http.DefaultClient, "/")
+		form.Set("FullName", "Spam Test")
+		form.Set("EmailAddress", "BAD_EMAIL_TO_FAIL_VALIDATION")
+		if change != nil {
+			change(form)
+		}
+		if wait {
+			time.Sleep(testMinSubmitTime)
+		}
+		req, err := http.NewRequest(http.MethodPost, HostName+"/postContact", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", address)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Bots that fill in the hidden field are refused
+	resp := submit("192.0.2.1", true, func(form url.Values) {
+		form.Set("Website", "http://spam.example")
+	})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d when the honeypot is filled in, not %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// As are forms without a real start time
+	resp = submit("192.0.2.1", true, func(form url.Values) {
+		form.Set("FormStartedAt", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)+".madeup")
+	})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a made up start time, not %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// And forms submitted faster than a person could
+	resp = submit("192.0.2.1", false, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("expected status %d with Retry-After for a form submitted too fast, got %d with %q", http.StatusTooManyRequests, resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Each address can submit a burst of 3, and then has to wait
+	for i := 0; i < 3; i++ {
+		if resp := submit("192.0.2.2", true, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("submission %d: expected the invalid email to be refused with status %d, not %d", i+1, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+	resp = submit("192.0.2.2", true, nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d after the burst, not %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 60 {
+		t.Fatalf("expected Retry-After to be at most a minute, not %q", resp.Header.Get("Retry-After"))
+	}
+	if resp := submit("192.0.2.3", true, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected other addresses to be unaffected, got status %d", resp.StatusCode)
+	}
+
+	after := getRejections()
+	if after.Honeypot-before.Honeypot != 1 ||
+		after.InvalidForm-before.InvalidForm != 1 ||
+		after.TooFast-before.TooFast != 1 ||
+		after.RateLimitedByIP-before.RateLimitedByIP != 1 {
+		t.Fatalf("expected one of each rejection to be counted, went from %+v to %+v", before, after)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	doAuditedRequest := func(method, path, body string, out interface{}) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, HostName+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if method == http.MethodPut || method == http.MethodDelete {
+			req.Header.Set("If-Match", "*")
+		}
+		req.Header.Set("X-Forwarded-For", "198.51.100.20")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatalf("unable to decode JSON response: %s", err)
+			}
+		}
+		return resp
+	}
+
+	// Create, change a phone number and delete a contact
+	var created apiContact
+	if resp := doAuditedRequest(http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Audit Test",
+		"phoneNumbers": [{"number": "+61 3 9333 7119"}]
+	}`, &created); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	path := "/api/v1/contacts/" + strconv.FormatInt(created.ID, 10)
+	phoneNumberPath := path + "/phoneNumbers/" + strconv.FormatInt(created.PhoneNumbers[0].ID, 10)
+	if resp := doAuditedRequest(http.MethodPut, phoneNumberPath, `{"number": "+61 3 9333 7120"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp := doAuditedRequest(http.MethodDelete, path, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	// Every change is exported, newest first, with who made it and from where
+	exportPath := "/admin/audit/export?contactId=" + strconv.FormatInt(created.ID, 10)
+	resp, err := http.Get(HostName + exportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	type AuditEntry struct {
+		ContactID int64  `json:"contactId"`
+		Action    string `json:"action"`
+		Actor     struct {
+			UserID   int64  `json:"userId"`
+			Username string `json:"username"`
+			IP       string `json:"ip"`
+		} `json:"actor"`
+		ChangedAt time.Time   `json:"changedAt"`
+		Before    *apiContact `json:"before"`
+		After     *apiContact `json:"after"`
+	}
+	var entries []AuditEntry
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var entry AuditEntry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 ||
+		entries[0].Action != "delete" ||
+		entries[1].Action != "update" ||
+		entries[2].Action != "create" {
+		t.Fatalf("expected a delete, update and create but got %+v", entries)
+	}
+	for _, entry := range entries {
+		if entry.ContactID != created.ID ||
+			entry.Actor.UserID != TestUserID ||
+			entry.Actor.Username != TestUsername ||
+			entry.Actor.IP != "198.51.100.20" ||
+			entry.ChangedAt.IsZero() {
+			t.Errorf("unexpected entry: %+v", entry)
+		}
+	}
+	if update := entries[1]; update.Before == nil ||
+		update.After == nil ||
+		update.Before.PhoneNumbers[0].Number != "+61393337119" ||
+		update.After.PhoneNumbers[0].Number != "+61393337120" {
+		t.Errorf("expected snapshots of the phone number before and after, got %+v", update)
+	}
+	if entries[0].After != nil || entries[2].Before != nil {
+		t.Errorf("expected no snapshot after a delete or before a create")
+	}
+
+	// The page can be browsed by contact and by user
+	getPage := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(HostName + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		dat, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(dat)
+	}
+	for _, path := range []string{
+		"/admin/audit?contactId=" + strconv.FormatInt(created.ID, 10),
+		"/admin/audit?userId=" + strconv.FormatInt(TestUserID, 10),
+	} {
+		resp, body := getPage(path)
+		// html/template escapes the "+" of phone numbers
+		body = html.UnescapeString(body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status %d but got %d", path, http.StatusOK, resp.StatusCode)
+		}
+		if !strings.Contains(body, "Phone Number +61393337119 changed to +61393337120") ||
+			!strings.Contains(body, "198.51.100.20") {
+			t.Errorf("%s: expected the phone number change in:\n%s", path, body)
+		}
+	}
+	if resp, _ := getPage("/admin/audit?userId=abc"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid filter but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Only admins can see the audit log
+	editor, err := user.Create("audit-editor-"+strconv.FormatInt(time.Now().UnixNano(), 36), testUserPassword, user.RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Delete(editor.ID)
+	req, err := http.NewRequest(http.MethodGet, HostName+exportPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(editor.Username, testUserPassword)
+	resp, err = (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d for an editor but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	getPage := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get(HostName + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		dat, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// html/template escapes the "+" of phone numbers
+		return resp, html.UnescapeString(string(dat))
+	}
+	postTrashForm := func(data url.Values) *http.Response {
+		t.Helper()
+		resp, err := postForm(http.DefaultClient, HostName+"/trash", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Deleting a contact or phone number moves it to the trash
+	var created apiContact
+	if resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Trash Test",
+		"phoneNumbers": [{"number": "+61 3 9333 7119"}, {"number": "+61 3 9333 7120"}]
+	}`, &created); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	contactID := strconv.FormatInt(created.ID, 10)
+	phoneNumberID := strconv.FormatInt(created.PhoneNumbers[1].ID, 10)
+	path := "/api/v1/contacts/" + contactID
+	if resp := doJSONRequestIfMatch(t, http.MethodDelete, path+"/phoneNumbers/"+phoneNumberID, "*", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	resp, body := getPage("/trash")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if !strings.Contains(body, "(03) 9333 7120") || !strings.Contains(body, `name="PhoneNumberID" value="`+phoneNumberID+`"`) {
+		t.Fatalf("expected the deleted phone number in the trash:\n%s", body)
+	}
+	if resp := postTrashForm(url.Values{
+		"Action":        {"restore"},
+		"ContactID":     {contactID},
+		"PhoneNumberID": {phoneNumberID},
+	}); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/trash" {
+		t.Fatalf("expected to restore the phone number, got status %d for %s", resp.StatusCode, resp.Request.URL)
+	}
+	var got apiContact
+	if resp := doJSONRequest(t, http.MethodGet, path, "", &got); resp.StatusCode != http.StatusOK || len(got.PhoneNumbers) != 2 {
+		t.Fatalf("expected the phone number to be restored, got status %d and %+v", resp.StatusCode, got)
+	}
+
+	// Deleted contacts are hidden everywhere until they're restored
+	if resp := doJSONRequestIfMatch(t, http.MethodDelete, path, "*", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if resp := doJSONRequest(t, http.MethodGet, path, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d for a deleted contact but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	var list struct {
+		Contacts []apiContact `json:"contacts"`
+	}
+	doJSONRequest(t, http.MethodGet, "/api/v1/contacts?q=Trash+Test", "", &list)
+	for _, record := range list.Contacts {
+		if record.ID == created.ID {
+			t.Fatalf("expected the deleted contact to not be listed")
+		}
+	}
+	if _, body := getPage("/trash"); !strings.Contains(body, "Trash Test") || !strings.Contains(body, "Whole contact") {
+		t.Fatalf("expected the deleted contact in the trash:\n%s", body)
+	}
+	postTrashForm(url.Values{"Action": {"restore"}, "ContactID": {contactID}})
+	if resp := doJSONRequest(t, http.MethodGet, path, "", &got); resp.StatusCode != http.StatusOK || len(got.PhoneNumbers) != 2 {
+		t.Fatalf("expected the contact to be restored, got status %d and %+v", resp.StatusCode, got)
+	}
+
+	// Purged contacts are gone for good
+	if resp := doJSONRequestIfMatch(t, http.MethodDelete, path, "*", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	postTrashForm(url.Values{"Action": {"purge"}, "ContactID": {contactID}})
+	if _, body := getPage("/trash"); strings.Contains(body, `name="ContactID" value="`+contactID+`"`) {
+		t.Fatalf("expected the purged contact to not be in the trash:\n%s", body)
+	}
+	if resp := postTrashForm(url.Values{"Action": {"restore"}, "ContactID": {contactID}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d restoring a purged contact but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if resp := postTrashForm(url.Values{"Action": {"empty"}, "ContactID": {contactID}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an invalid action but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// Viewers can't see the trash. The page only takes the session cookie, so sign in as the
+	// viewer with a cookie jar.
+	viewer, err := user.Create("trash-viewer-"+strconv.FormatInt(time.Now().UnixNano(), 36), testUserPassword, user.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Delete(viewer.ID)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerClient := &http.Client{Jar: jar}
+	mustSignIn(viewerClient, viewer.Username, testUserPassword)
+	resp, err = viewerClient.Get(HostName + "/trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d for a viewer but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestEditContactForm(t *testing.T) {
+	var created apiContact
+	if resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Edit Test",
+		"emails": [{"address": "edit@test.com", "label": "work"}],
+		"phoneNumbers": [{"number": "+61 3 9333 7119", "extension": "12", "isPrimary": true}]
+	}`, &created); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	id := strconv.FormatInt(created.ID, 10)
+	path := "/api/v1/contacts/" + id
+	defer doJSONRequestIfMatch(t, http.MethodDelete, path, "*", "", nil)
+	emailID := strconv.FormatInt(created.Emails[0].ID, 10)
+	phoneNumberID := strconv.FormatInt(created.PhoneNumbers[0].ID, 10)
+
+	// The form has the version it was loaded with, and a row for each email and phone number
+	fields, _ := mustGetHiddenFields(http.DefaultClient, "/contacts/"+id+"/edit")
+	if fields.Get("Version") != "1" || fields.Get("EmailID") != emailID || fields.Get("PhoneNumberID") != phoneNumberID {
+		t.Fatalf("expected version 1 and the row IDs in the form but got %v", fields)
+	}
+	form := url.Values{
+		"Version":              {"1"},
+		"FullName":             {"Edit Test Overwritten"},
+		"EmailID":              {emailID},
+		"EmailAddress":         {"edit@test.com"},
+		"EmailLabel":           {"work"},
+		"PhoneNumberID":        {phoneNumberID},
+		"PhoneNumber":          {"(03) 9333 7119"},
+		"PhoneNumberExtension": {"12"},
+		"PhoneNumberLabel":     {""},
+		"PrimaryPhoneNumber":   {"0"},
+	}
+
+	// Someone else changes the contact after the form was loaded
+	if resp := doJSONRequestIfMatch(t, http.MethodPatch, path, "*", `{"fullName": "Edit Test Elsewhere"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	for _, formPath := range []string{"/contacts/" + id + "/edit", "/contacts/" + id + "/delete"} {
+		resp, err := postForm(http.DefaultClient, HostName+formPath, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusConflict ||
+			!strings.Contains(html.UnescapeString(string(body)), "changed by someone else") ||
+			!strings.Contains(string(body), `name="Version" value="2"`) {
+			t.Fatalf("%s: expected status %d with the latest version but got %d:\n%s", formPath, http.StatusConflict, resp.StatusCode, body)
+		}
+	}
+	var got apiContact
+	if doJSONRequest(t, http.MethodGet, path, "", &got); got.FullName != "Edit Test Elsewhere" {
+		t.Fatalf("expected the other change to be kept but got %+v", got)
+	}
+
+	// Saving the latest version works, and takes you to the contact
+	form.Set("Version", "2")
+	form.Set("FullName", "Edit Test Saved")
+	form["EmailAddress"] = []string{"edit@test.com", "edit@home.test"}
+	form["EmailLabel"] = []string{"work", "home"}
+	form.Set("PrimaryEmail", "1")
+	resp, err := postForm(http.DefaultClient, HostName+"/contacts/"+id+"/edit", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/contacts/"+id {
+		t.Fatalf("expected to go to the contact after saving, got status %d for %s", resp.StatusCode, resp.Request.URL)
+	}
+	if doJSONRequest(t, http.MethodGet, path, "", &got); got.FullName != "Edit Test Saved" ||
+		len(got.Emails) != 2 ||
+		got.Emails[0].ID != created.Emails[0].ID || got.Emails[0].IsPrimary ||
+		got.Emails[1].Address != "edit@home.test" || got.Emails[1].Label != "home" || !got.Emails[1].IsPrimary ||
+		len(got.PhoneNumbers) != 1 ||
+		got.PhoneNumbers[0].ID != created.PhoneNumbers[0].ID || got.PhoneNumbers[0].Extension != "12" || !got.PhoneNumbers[0].IsPrimary {
+		t.Fatalf("expected the changes to be saved but got %+v", got)
+	}
+
+	// Mistakes are shown next to the field, with what was entered
+	form.Set("Version", "3")
+	form["EmailAddress"] = []string{"edit@test.com", "not an email"}
+	resp, err = postForm(http.DefaultClient, HostName+"/contacts/"+id+"/edit", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(string(body), `value="not an email"`) ||
+		!strings.Contains(string(body), `<p class="FieldError">Invalid Email provided</p>`) {
+		t.Fatalf("expected status %d with the error next to the email but got %d:\n%s", http.StatusBadRequest, resp.StatusCode, body)
+	}
+
+	resp, err = postForm(http.DefaultClient, HostName+"/contacts/"+id+"/edit", url.Values{"FullName": {"No Version"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d without a version but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	resp, err = postForm(http.DefaultClient, HostName+"/contacts/"+id+"/delete", url.Values{"Version": {"3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Fatalf("expected to go back home after deleting, got status %d for %s", resp.StatusCode, resp.Request.URL)
+	}
+	if resp := doJSONRequest(t, http.MethodGet, path, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the contact to be deleted, got status %d", resp.StatusCode)
+	}
+	resp, err = http.Get(HostName + "/contacts/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d for a deleted contact but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestContactPage(t *testing.T) {
+	var created apiContact
+	if resp := doJSONRequest(t, http.MethodPost, apiCreateContactPath, `{
+		"fullName": "Detail Test",
+		"emails": [{"address": "detail@test.com", "label": "work", "isPrimary": true}],
+		"phoneNumbers": [
+			{"number": "(03) 9333 7120", "extension": "45", "label": "office"},
+			{"number": "0488 445 688", "isPrimary": true}
+		]
+	}`, &created); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	id := strconv.FormatInt(created.ID, 10)
+	defer doJSONRequestIfMatch(t, http.MethodDelete, "/api/v1/contacts/"+id, "*", "", nil)
+
+	resp, err := http.Get(HostName + "/contacts/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+	}
+	body := html.UnescapeString(string(dat))
+	for _, want := range []string{
+		created.UID,
+		"detail@test.com",
+		"work",
+		"(03) 9333 7120 ext. 45",
+		"office",
+		"fixed line",
+		"0488 445 688",
+		"mobile",
+		"/contacts/" + id + "/edit",
+		"/admin/audit?contactId=" + id,
+		`action="/contacts/` + id + `/delete"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected contact page to contain %q:\n%s", want, body)
+		}
+	}
+
+	for _, path := range []string{"/contacts/0", "/contacts/abc", "/contacts/" + id + "/unknown"} {
+		resp, err := http.Get(HostName + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected status %d but got %d", path, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+
+	// Viewers can see contacts but not change them
+	viewer, err := user.Create("contact-viewer-"+strconv.FormatInt(time.Now().UnixNano(), 36), testUserPassword, user.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Delete(viewer.ID)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	mustSignIn(client, viewer.Username, testUserPassword)
+	for path, want := range map[string]int{
+		"/contacts/" + id:           http.StatusOK,
+		"/contacts/" + id + "/edit": http.StatusForbidden,
+		"/contacts/new":             http.StatusForbidden,
+	} {
+		resp, err := client.Get(HostName + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: expected status %d for a viewer but got %d", path, want, resp.StatusCode)
+		}
+	}
+}
+
+func TestPostFormRows(t *testing.T) {
+	// Adding and removing rows shows the form again, without saving anything
+	resp, err := postForm(http.DefaultClient, HostName+"/contacts/new", url.Values{
+		"FullName":           {"Rows Test"},
+		"PhoneNumber":        {"0491 570 001", "0491 570 002"},
+		"PrimaryPhoneNumber": {"1"},
+		"Action":             {"RemovePhoneNumber-0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(dat)
+	if resp.StatusCode != http.StatusOK ||
+		!strings.Contains(body, `value="Rows Test"`) ||
+		strings.Contains(body, `value="0491 570 001"`) ||
+		!strings.Contains(body, `name="PhoneNumber" value="0491 570 002"`) ||
+		!regexp.MustCompile(`name="PrimaryPhoneNumber" value="0"\s+checked`).MatchString(body) {
+		t.Fatalf("expected the first phone number to be removed, and the second to still be primary:\n%s", body)
+	}
+
+	resp, err = postForm(http.DefaultClient, HostName+"/contacts/new", url.Values{
+		"EmailAddress": {"rows@test.com"},
+		"Action":       {"AddEmail"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK ||
+		!strings.Contains(string(dat), `id="EmailAddress-1"`) ||
+		strings.Contains(string(dat), `id="EmailAddress-2"`) {
+		t.Fatalf("expected a second email row:\n%s", dat)
+	}
+
+	// Every problem is shown next to its field, rather than only the first
+	resp, err = postForm(http.DefaultClient, HostName+"/postContact", url.Values{
+		"FullName":     {strings.Repeat("a", 255)},
+		"EmailAddress": {"rows@test.com", "", "BAD_EMAIL_TO_FAIL_VALIDATION"},
+		"PhoneNumber":  {"0491 570 001", "not a number"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = html.UnescapeString(string(dat))
+	if resp.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(body, "Invalid Full Name provided") ||
+		!strings.Contains(body, "Invalid Email provided") ||
+		!strings.Contains(body, "Invalid Phone Number provided") ||
+		!strings.Contains(body, `value="BAD_EMAIL_TO_FAIL_VALIDATION"`) ||
+		!strings.Contains(body, `value="not a number"`) {
+		t.Fatalf("expected status %d with every error shown but got %d:\n%s", http.StatusBadRequest, resp.StatusCode, body)
+	}
+	// The blank email row is dropped, so the bad one is now the second row
+	if !strings.Contains(body, `id="EmailAddress-1" name="EmailAddress" value="BAD_EMAIL_TO_FAIL_VALIDATION"`) {
+		t.Errorf("expected the blank email row to be removed:\n%s", body)
+	}
+	resp, err = postForm(http.DefaultClient, HostName+"/postContact", url.Values{
+		"FullName": {"Rows Test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(string(dat), "No Phone Number(s) provided") {
+		t.Fatalf("expected status %d for no phone numbers but got %d:\n%s", http.StatusBadRequest, resp.StatusCode, dat)
+	}
+}